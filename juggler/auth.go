@@ -0,0 +1,93 @@
+package juggler
+
+import (
+	"errors"
+	"net/http"
+
+	"golang.org/x/net/context"
+
+	"github.com/PuerkitoBio/exp/juggler/msg"
+)
+
+var (
+	// ErrUnauthenticated can be returned by an Authorizer to deny a
+	// message because the connection is not authenticated. The client
+	// receives an ERR message with a 401 code.
+	ErrUnauthenticated = errors.New("juggler: not authenticated")
+
+	// ErrForbidden can be returned by an Authorizer to deny a message
+	// because the authenticated identity is not allowed to send it. The
+	// client receives an ERR message with a 403 code. Any error other
+	// than ErrUnauthenticated results in the same code.
+	ErrForbidden = errors.New("juggler: forbidden")
+)
+
+// Identity is the authenticated identity associated with a connection.
+type Identity struct {
+	// ID is the unique identifier of the authenticated principal,
+	// e.g. a user ID.
+	ID string
+
+	// Attrs holds optional attributes of the principal, such as
+	// roles or a tenant ID, that an Authorizer can use to take
+	// its decisions.
+	Attrs map[string]string
+}
+
+// Authenticator defines the method required to authenticate the HTTP
+// request that initiates a websocket connection.
+type Authenticator interface {
+	// Authenticate returns the identity of the peer that made the
+	// request r, typically using its headers, cookies or query string.
+	// If it returns an error, the websocket upgrade is refused with a
+	// 401 status code. It may return a nil identity and a nil error to
+	// accept an anonymous connection.
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+// AuthenticatorFunc is a function signature that implements the
+// Authenticator interface.
+type AuthenticatorFunc func(*http.Request) (*Identity, error)
+
+// Authenticate implements Authenticator for the AuthenticatorFunc by
+// calling the function itself.
+func (fn AuthenticatorFunc) Authenticate(r *http.Request) (*Identity, error) {
+	return fn(r)
+}
+
+// Authorizer defines the method required to authorize the messages
+// received from a client.
+type Authorizer interface {
+	// Authorize returns a non-nil error if the connection c is not
+	// allowed to send the message m. It is called by ProcessMsg for
+	// CALL, CNCL, PUB, SUB and UNSB messages, before they are forwarded
+	// to the broker. The identity of the connection, if any, is
+	// available in c.Identity.
+	Authorize(ctx context.Context, c *Conn, m msg.Msg) error
+}
+
+// AuthorizerFunc is a function signature that implements the
+// Authorizer interface.
+type AuthorizerFunc func(context.Context, *Conn, msg.Msg) error
+
+// Authorize implements Authorizer for the AuthorizerFunc by calling
+// the function itself.
+func (fn AuthorizerFunc) Authorize(ctx context.Context, c *Conn, m msg.Msg) error {
+	return fn(ctx, c, m)
+}
+
+// authorize calls the server's authorizer, if any, and returns the
+// ERR code to use if the message is denied.
+func authorize(ctx context.Context, c *Conn, m msg.Msg) (int, error) {
+	a := c.srv.Authorizer
+	if a == nil {
+		return 0, nil
+	}
+	if err := a.Authorize(ctx, c, m); err != nil {
+		if err == ErrUnauthenticated {
+			return 401, err
+		}
+		return 403, err
+	}
+	return 0, nil
+}
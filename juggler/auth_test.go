@@ -0,0 +1,141 @@
+package juggler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/PuerkitoBio/exp/juggler/broker/memorybroker"
+	"github.com/PuerkitoBio/exp/juggler/internal/jugglertest"
+	"github.com/PuerkitoBio/exp/juggler/internal/wstest"
+	"github.com/PuerkitoBio/exp/juggler/msg"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpgradeAuthenticate(t *testing.T) {
+	dbgl := &jugglertest.DebugLog{T: t}
+	brk := &memorybroker.Broker{LogFunc: dbgl.Printf}
+
+	ids := make(chan *Identity, 1)
+	server := &Server{
+		CallerBroker: brk,
+		PubSubBroker: brk,
+		LogFunc:      dbgl.Printf,
+		Authenticator: AuthenticatorFunc(func(r *http.Request) (*Identity, error) {
+			if tok := r.URL.Query().Get("token"); tok != "" {
+				return &Identity{ID: tok}, nil
+			}
+			return nil, errors.New("missing token")
+		}),
+		ConnState: func(c *Conn, cs ConnState) {
+			if cs == Connected {
+				ids <- c.Identity
+			}
+		},
+	}
+	upg := &websocket.Upgrader{Subprotocols: Subprotocols}
+	srv := httptest.NewServer(Upgrade(upg, server))
+	srv.URL = strings.Replace(srv.URL, "http:", "ws:", 1)
+	defer srv.Close()
+
+	d := &websocket.Dialer{Subprotocols: Subprotocols}
+
+	// no token, authentication fails
+	_, res, err := d.Dial(srv.URL, nil)
+	if assert.Error(t, err, "Dial without token") {
+		assert.Equal(t, http.StatusUnauthorized, res.StatusCode, "status code")
+	}
+
+	// valid token, identity is set on the connection
+	conn, _, err := d.Dial(srv.URL+"?token=abc", nil)
+	require.NoError(t, err, "Dial with token")
+	defer conn.Close()
+
+	select {
+	case id := <-ids:
+		if assert.NotNil(t, id, "identity") {
+			assert.Equal(t, "abc", id.ID, "identity ID")
+		}
+	case <-time.After(100 * time.Millisecond):
+		assert.Fail(t, "no connected state received")
+	}
+}
+
+func TestProcessMsgAuthorize(t *testing.T) {
+	var buf bytes.Buffer
+	done := make(chan bool, 1)
+	srv := wstest.StartRecordingServer(t, done, &buf)
+	defer srv.Close()
+
+	wsc := wstest.Dial(t, srv.URL)
+	defer wsc.Close()
+
+	dbgl := &jugglertest.DebugLog{T: t}
+	brk := &memorybroker.Broker{LogFunc: dbgl.Printf}
+	server := &Server{
+		CallerBroker: brk,
+		PubSubBroker: brk,
+		LogFunc:      dbgl.Printf,
+		Authorizer: AuthorizerFunc(func(ctx context.Context, c *Conn, m msg.Msg) error {
+			if c.Identity == nil {
+				return ErrUnauthenticated
+			}
+			if sub, ok := m.(*msg.Sub); ok && sub.Payload.Channel == "secret" {
+				return ErrForbidden
+			}
+			return nil
+		}),
+	}
+	jc := newConn(wsc, server)
+	jc.psc, jc.resc = fakePubSubConn{}, fakeResultsConn{}
+
+	// anonymous connection is denied
+	call, err := msg.NewCall("a", nil, 0)
+	require.NoError(t, err, "NewCall")
+	ProcessMsg(context.Background(), jc, call)
+
+	// authenticated connection is allowed on non-secret channels
+	jc.Identity = &Identity{ID: "x"}
+	sub := msg.NewSub("secret", false)
+	ProcessMsg(context.Background(), jc, sub)
+	ok := msg.NewSub("public", false)
+	ProcessMsg(context.Background(), jc, ok)
+
+	wsc.Close()
+	<-done
+
+	cases := []struct {
+		mt   msg.MessageType
+		from msg.Msg
+		code int
+	}{
+		{msg.ErrMsg, call, 401},
+		{msg.ErrMsg, sub, 403},
+		{msg.OKMsg, ok, 0},
+	}
+	var p json.RawMessage
+	dec := json.NewDecoder(bytes.NewReader(buf.Bytes()))
+	for i, c := range cases {
+		require.NoError(t, dec.Decode(&p), "Decode %d", i)
+		m, err := msg.UnmarshalResponse(bytes.NewReader(p))
+		require.NoError(t, err, "UnmarshalResponse %d", i)
+		require.Equal(t, c.mt, m.Type(), "%d: type", i)
+
+		switch m := m.(type) {
+		case *msg.Err:
+			assert.Equal(t, c.from.UUID(), m.Payload.For, "%d: for", i)
+			assert.Equal(t, c.code, m.Payload.Code, "%d: code", i)
+		case *msg.OK:
+			assert.Equal(t, c.from.UUID(), m.Payload.For, "%d: for", i)
+		}
+	}
+}
@@ -1,9 +1,11 @@
 // Package broker defines the generic interfaces that a broker must
 // implement in order to act as a juggler broker. The redisbroker
-// package implements those interfaces against a Redis backend.
+// package implements those interfaces against a Redis backend, and
+// the memorybroker package implements them in-process.
 package broker
 
 import (
+	"errors"
 	"time"
 
 	"github.com/PuerkitoBio/exp/juggler/msg"
@@ -17,6 +19,11 @@ import (
 // on the message.
 var DefaultCallTimeout = time.Minute
 
+// ErrCallNotOwned is returned by CallerBroker.Cancel when the call to
+// cancel was made by a different connection than the one requesting
+// the cancellation.
+var ErrCallNotOwned = errors.New("broker: call belongs to another connection")
+
 // CallerBroker defines the methods for a broker in the caller role.
 type CallerBroker interface {
 	// Results returns a ResultsConn that can be used to process results
@@ -25,6 +32,13 @@ type CallerBroker interface {
 
 	// Call registers a call request in the broker.
 	Call(cp *msg.CallPayload, timeout time.Duration) error
+
+	// Cancel cancels a call request. If the call is still waiting to
+	// be processed, it is dropped, otherwise the cancellation is sent
+	// to the callees listening on the call's URI via their CancelsConn.
+	// It returns ErrCallNotOwned if the call was made by a different
+	// connection.
+	Cancel(cp *msg.CnclPayload) error
 }
 
 // CalleeBroker defines the methods for a broker in the callee role.
@@ -33,6 +47,11 @@ type CalleeBroker interface {
 	// for the specified URIs.
 	Calls(uris ...string) (CallsConn, error)
 
+	// Cancels returns a CancelsConn that can be used to process the
+	// cancellation requests of calls being processed for the specified
+	// URIs.
+	Cancels(uris ...string) (CancelsConn, error)
+
 	// Result registers a call result in the broker.
 	Result(rp *msg.ResPayload, timeout time.Duration) error
 }
@@ -90,6 +109,27 @@ type CallsConn interface {
 	Close() error
 }
 
+// CancelsConn defines the methods to list the cancellation requests
+// of calls made on the URIs of the connection.
+type CancelsConn interface {
+	// Cancels returns a stream of cancellation requests for the URIs
+	// used to create the CancelsConn. The returned channel is closed
+	// when the connection is closed, or when an error occurs. Callers
+	// can call CancelsErr to check the error that caused the channel
+	// to be closed.
+	//
+	// Only the first call to Cancels starts the goroutine that listens
+	// to cancellations. Subsequent calls return the same channel.
+	Cancels() <-chan *msg.CnclPayload
+
+	// CancelsErr returns the error that caused the channel returned from
+	// Cancels to be closed. Is only non-nil once the channel is closed.
+	CancelsErr() error
+
+	// Close closes the connection.
+	Close() error
+}
+
 // PubSubConn defines the methods to manage subscriptions to events
 // for a connection.
 type PubSubConn interface {
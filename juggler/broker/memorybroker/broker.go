@@ -0,0 +1,321 @@
+// Package memorybroker implements an in-process juggler broker. It
+// supports the caller, callee and pub-sub roles, so that a juggler
+// server, its callees and its clients can run in the same process
+// without any external dependency, e.g. for tests and local
+// development.
+//
+// Call requests and results are stored in in-memory FIFO queues,
+// one per URI for calls and one per connection UUID for results.
+// Timeouts and queue capacities behave the same as with the
+// redisbroker package, and pattern-based subscriptions support
+// the same glob-style patterns as Redis. A call request that is
+// still queued is removed from its queue when it is canceled, and
+// the cancellation of a call that is being processed is sent to the
+// connections returned by Broker.Cancels for the call's URI.
+//
+// Payloads are marshaled to JSON when they are stored in the broker
+// and unmarshaled when they are read, so that the values received by
+// the consumers are independent from those sent by the producers,
+// as they would be with a networked broker.
+package memorybroker
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/exp/juggler/broker"
+	"github.com/PuerkitoBio/exp/juggler/logger"
+	"github.com/PuerkitoBio/exp/juggler/msg"
+	"github.com/pborman/uuid"
+)
+
+var (
+	// static check that *Broker implements all the broker interfaces
+	_ broker.CallerBroker = (*Broker)(nil)
+	_ broker.CalleeBroker = (*Broker)(nil)
+	_ broker.PubSubBroker = (*Broker)(nil)
+)
+
+// ErrClosed is the error returned when using a closed connection. It
+// is also the error returned by CallsErr, ResultsErr and EventsErr
+// once the connection is closed.
+var ErrClosed = errors.New("memorybroker: use of closed connection")
+
+// ErrCapacityExceeded is returned by Call or Result when the queue
+// capacity is exceeded.
+var ErrCapacityExceeded = errors.New("memorybroker: list capacity exceeded")
+
+// Broker is an in-memory broker that implements the caller, callee
+// and pub-sub broker interfaces. The zero value is ready to use.
+// The fields should not be updated once the broker is in use.
+type Broker struct {
+	// Logger is the structured logger to use. If nil, LogFunc is
+	// used.
+	Logger logger.Logger
+
+	// LogFunc is the logging function to use if Logger is nil. If nil,
+	// log.Printf is used. It can be set to juggler.DiscardLog to disable
+	// logging.
+	LogFunc func(string, ...interface{})
+
+	// CallCap is the capacity of the CALL queue per URI. If it is
+	// exceeded for a given URI, subsequent Broker.Call calls for that
+	// URI will fail with an error.
+	CallCap int
+
+	// ResultCap is the capacity of the RES queue per connection UUID.
+	// If it is exceeded for a given connection, Broker.Result calls
+	// for that connection will fail with an error.
+	ResultCap int
+
+	calls   queueSet // keyed by URI
+	results queueSet // keyed by connection UUID
+
+	// psmu protects access to subs.
+	psmu sync.Mutex
+	subs map[*pubSubConn]struct{}
+
+	// cnmu protects access to cancels.
+	cnmu    sync.Mutex
+	cancels map[*cancelsConn]struct{}
+}
+
+// Call registers a call request in the broker.
+func (b *Broker) Call(cp *msg.CallPayload, timeout time.Duration) error {
+	return b.calls.push(cp.URI, cp.ConnUUID.String(), cp.MsgUUID.String(), cp, timeout, b.CallCap)
+}
+
+// Cancel cancels a call request. If the call is still queued, it is
+// removed from the queue, otherwise the cancellation is sent to the
+// cancels connections listening on the call's URI.
+func (b *Broker) Cancel(cp *msg.CnclPayload) error {
+	removed, err := b.calls.remove(cp.URI, cp.ConnUUID.String(), cp.MsgUUID.String())
+	if err != nil || removed {
+		return err
+	}
+
+	b.cnmu.Lock()
+	defer b.cnmu.Unlock()
+	for c := range b.cancels {
+		c.cancel(cp)
+	}
+	return nil
+}
+
+// Result registers a call result in the broker.
+func (b *Broker) Result(rp *msg.ResPayload, timeout time.Duration) error {
+	return b.results.push(rp.ConnUUID.String(), rp.ConnUUID.String(), rp.MsgUUID.String(), rp, timeout, b.ResultCap)
+}
+
+// Publish publishes an event to a channel.
+func (b *Broker) Publish(channel string, pp *msg.PubPayload) error {
+	p, err := json.Marshal(pp)
+	if err != nil {
+		return err
+	}
+
+	b.psmu.Lock()
+	defer b.psmu.Unlock()
+	for c := range b.subs {
+		c.publish(channel, p)
+	}
+	return nil
+}
+
+// PubSub returns a pub-sub connection that can be used to subscribe and
+// unsubscribe to channels, and to process incoming events.
+func (b *Broker) PubSub() (broker.PubSubConn, error) {
+	c := newPubSubConn(b)
+
+	b.psmu.Lock()
+	if b.subs == nil {
+		b.subs = make(map[*pubSubConn]struct{})
+	}
+	b.subs[c] = struct{}{}
+	b.psmu.Unlock()
+
+	return c, nil
+}
+
+func (b *Broker) removePubSub(c *pubSubConn) {
+	b.psmu.Lock()
+	delete(b.subs, c)
+	b.psmu.Unlock()
+}
+
+// Calls returns a calls connection that can be used to process the call
+// requests for the specified URIs.
+func (b *Broker) Calls(uris ...string) (broker.CallsConn, error) {
+	return newCallsConn(b, uris), nil
+}
+
+// Cancels returns a cancels connection that can be used to process the
+// cancellation requests of calls for the specified URIs.
+func (b *Broker) Cancels(uris ...string) (broker.CancelsConn, error) {
+	c := newCancelsConn(b, uris)
+
+	b.cnmu.Lock()
+	if b.cancels == nil {
+		b.cancels = make(map[*cancelsConn]struct{})
+	}
+	b.cancels[c] = struct{}{}
+	b.cnmu.Unlock()
+
+	return c, nil
+}
+
+func (b *Broker) removeCancels(c *cancelsConn) {
+	b.cnmu.Lock()
+	delete(b.cancels, c)
+	b.cnmu.Unlock()
+}
+
+// Results returns a results connection that can be used to process the call
+// results for the specified connection UUID.
+func (b *Broker) Results(connUUID uuid.UUID) (broker.ResultsConn, error) {
+	return newResultsConn(b, connUUID), nil
+}
+
+// item is a payload stored in a queue, along with its expiration time
+// and the UUIDs of the connection and message that it belongs to.
+type item struct {
+	payload  []byte
+	deadline time.Time
+	connUUID string
+	msgUUID  string
+}
+
+// queueSet is a set of FIFO queues identified by a key. The zero value
+// is ready to use.
+type queueSet struct {
+	mu sync.Mutex
+	qs map[string][]*item
+
+	// notify is closed and replaced each time an item is pushed, so
+	// that blocked consumers can check for new items.
+	notify chan struct{}
+}
+
+func (s *queueSet) init() {
+	if s.qs == nil {
+		s.qs = make(map[string][]*item)
+		s.notify = make(chan struct{})
+	}
+}
+
+// push marshals v and stores it in the queue identified by key, for
+// the connection and message identified by connUUID and msgUUID. The
+// item expires after timeout, or broker.DefaultCallTimeout if timeout
+// is 0. If cap is > 0 and the queue already holds cap items,
+// ErrCapacityExceeded is returned.
+func (s *queueSet) push(key, connUUID, msgUUID string, v interface{}, timeout time.Duration, cap int) error {
+	p, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	if timeout == 0 {
+		timeout = broker.DefaultCallTimeout
+	}
+	now := time.Now()
+	it := &item{payload: p, deadline: now.Add(timeout), connUUID: connUUID, msgUUID: msgUUID}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.init()
+
+	// drop the expired items, they will never be processed
+	q := s.qs[key]
+	live := q[:0]
+	for _, it := range q {
+		if it.deadline.After(now) {
+			live = append(live, it)
+		}
+	}
+	for i := len(live); i < len(q); i++ {
+		q[i] = nil
+	}
+	q = live
+
+	if cap > 0 && len(q) >= cap {
+		s.qs[key] = q
+		return ErrCapacityExceeded
+	}
+	s.qs[key] = append(q, it)
+
+	// wake up the consumers
+	close(s.notify)
+	s.notify = make(chan struct{})
+	return nil
+}
+
+// pop removes and returns the oldest item from the first non-empty
+// queue identified by keys, in order. It blocks until an item is
+// available or done is closed, in which case it returns ErrClosed.
+func (s *queueSet) pop(keys []string, done <-chan struct{}) (*item, error) {
+	for {
+		s.mu.Lock()
+		s.init()
+		for _, k := range keys {
+			if q := s.qs[k]; len(q) > 0 {
+				it := q[0]
+				q[0] = nil
+				if len(q) == 1 {
+					delete(s.qs, k)
+				} else {
+					s.qs[k] = q[1:]
+				}
+				s.mu.Unlock()
+				return it, nil
+			}
+		}
+		notify := s.notify
+		s.mu.Unlock()
+
+		select {
+		case <-done:
+			return nil, ErrClosed
+		case <-notify:
+		}
+	}
+}
+
+// remove removes the item for msgUUID from the queue identified by
+// key. It returns true if the item was found and removed, and
+// broker.ErrCallNotOwned if it belongs to another connection.
+func (s *queueSet) remove(key, connUUID, msgUUID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	q := s.qs[key]
+	for i, it := range q {
+		if it.msgUUID != msgUUID {
+			continue
+		}
+		if it.connUUID != connUUID {
+			return false, broker.ErrCallNotOwned
+		}
+
+		copy(q[i:], q[i+1:])
+		q[len(q)-1] = nil
+		if len(q) == 1 {
+			delete(s.qs, key)
+		} else {
+			s.qs[key] = q[:len(q)-1]
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// logger returns the Logger of the broker, which adapts LogFunc if
+// Logger is nil.
+func (b *Broker) logger() logger.Logger {
+	if b.Logger != nil {
+		return b.Logger
+	}
+	return logger.Func(b.LogFunc)
+}
@@ -0,0 +1,166 @@
+package memorybroker
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/exp/juggler/broker"
+	"github.com/PuerkitoBio/exp/juggler/msg"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const cap = 2
+
+func testBrokerCallOrRes(t *testing.T, qs func(*Broker) *queueSet, run func(*Broker, uuid.UUID) (uuid.UUID, error)) {
+	brk := &Broker{
+		LogFunc:   logIfVerbose,
+		CallCap:   cap,
+		ResultCap: cap,
+	}
+
+	var uuids []uuid.UUID
+	// run all on same key
+	keyUUID := uuid.NewRandom()
+	for i := 0; i <= cap; i++ {
+		uid, err := run(brk, keyUUID)
+		uuids = append(uuids, uid)
+		if i < cap {
+			assert.NoError(t, err, "Call %d", i)
+		} else {
+			assert.Equal(t, ErrCapacityExceeded, err, "Call %d", i)
+		}
+	}
+
+	// the first 2 msg uuids should be present, in FIFO order
+	expectUUIDs(t, qs(brk), keyUUID.String(), uuids[0], uuids[1])
+
+	// call on a different key works fine
+	diffKeyUUID := uuid.NewRandom()
+	_, err := run(brk, diffKeyUUID)
+	assert.NoError(t, err, "Call on different key")
+
+	// popping a value should pop uuids[0]
+	_, err = qs(brk).pop([]string{keyUUID.String()}, nil)
+	require.NoError(t, err, "pop")
+	expectUUIDs(t, qs(brk), keyUUID.String(), uuids[1])
+
+	// call should now work on original key
+	uid, err := run(brk, keyUUID)
+	uuids = append(uuids, uid)
+	assert.NoError(t, err, "Call after pop")
+
+	expectUUIDs(t, qs(brk), keyUUID.String(), uuids[1], uuids[3])
+}
+
+func TestBrokerCall(t *testing.T) {
+	connUUID := uuid.NewRandom()
+	testBrokerCallOrRes(t, func(b *Broker) *queueSet { return &b.calls }, func(b *Broker, keyParm uuid.UUID) (uuid.UUID, error) {
+		cp := &msg.CallPayload{
+			ConnUUID: connUUID,
+			MsgUUID:  uuid.NewRandom(),
+			URI:      keyParm.String(),
+		}
+		err := b.Call(cp, time.Second)
+		return cp.MsgUUID, err
+	})
+}
+
+func TestBrokerResult(t *testing.T) {
+	testBrokerCallOrRes(t, func(b *Broker) *queueSet { return &b.results }, func(b *Broker, keyParm uuid.UUID) (uuid.UUID, error) {
+		rp := &msg.ResPayload{
+			ConnUUID: keyParm,
+			MsgUUID:  uuid.NewRandom(),
+			URI:      "z",
+		}
+		err := b.Result(rp, time.Second)
+		return rp.MsgUUID, err
+	})
+}
+
+func TestBrokerCapIgnoresExpired(t *testing.T) {
+	brk := &Broker{LogFunc: logIfVerbose, CallCap: 1}
+
+	cp := &msg.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a"}
+	require.NoError(t, brk.Call(cp, time.Millisecond), "Call 1")
+	time.Sleep(2 * time.Millisecond)
+
+	// the first call is expired, so it does not count towards the capacity
+	cp = &msg.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a"}
+	require.NoError(t, brk.Call(cp, time.Second), "Call 2")
+	expectUUIDs(t, &brk.calls, "a", cp.MsgUUID)
+}
+
+func TestPublish(t *testing.T) {
+	brk := broker.PubSubBroker(&Broker{LogFunc: logIfVerbose})
+
+	psc, err := brk.PubSub()
+	require.NoError(t, err, "get PubSubConn")
+
+	// subscribe to channel "a"
+	require.NoError(t, psc.Subscribe("a", false), "Subscribe")
+
+	// listen to events on "a"
+	var cnt int
+	expPlds := []string{`"abc"`, `{"v":3}`}
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for ev := range psc.Events() {
+			var want string
+
+			if cnt < len(expPlds) {
+				want = expPlds[cnt]
+			}
+			assert.Equal(t, "a", ev.Channel, "event is from the subscribed channel")
+			assert.Equal(t, want, string(ev.Args), "event payload")
+			cnt++
+		}
+	}()
+
+	cases := []struct {
+		v  interface{}
+		ch string
+	}{
+		{"abc", "a"},
+		{"def", "b"},
+		{map[string]interface{}{"v": 3}, "a"},
+		{5, "c"},
+	}
+	for i, c := range cases {
+		b, err := json.Marshal(c.v)
+		require.NoError(t, err, "marshal case %d", i)
+		pp := &msg.PubPayload{MsgUUID: uuid.NewRandom(), Args: b}
+		require.NoError(t, brk.Publish(c.ch, pp), "Publish event %d", i)
+	}
+
+	time.Sleep(10 * time.Millisecond) // ensure time to deliver the last event
+	require.NoError(t, psc.Close(), "close subscribed connection")
+	wg.Wait()
+	assert.Equal(t, 2, cnt, "number of events received")
+}
+
+func expectUUIDs(t *testing.T, qs *queueSet, key string, uuids ...uuid.UUID) {
+	qs.mu.Lock()
+	items := qs.qs[key]
+	qs.mu.Unlock()
+
+	if assert.Equal(t, len(uuids), len(items), "number of items") {
+		for i, it := range items {
+			var cp msg.CallPayload
+			require.NoError(t, json.Unmarshal(it.payload, &cp), "unmarshal into CallPayload")
+			assert.Equal(t, uuids[i], cp.MsgUUID, "expected MsgUUID at %d", i)
+		}
+	}
+}
+
+func logIfVerbose(s string, args ...interface{}) {
+	if testing.Verbose() {
+		log.Printf(s, args...)
+	}
+}
@@ -0,0 +1,100 @@
+package memorybroker
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/exp/juggler/broker"
+	"github.com/PuerkitoBio/exp/juggler/logger"
+	"github.com/PuerkitoBio/exp/juggler/msg"
+)
+
+var _ broker.CallsConn = (*callsConn)(nil)
+
+type callsConn struct {
+	b    *Broker
+	uris []string
+
+	// closeOnce makes sure the kill channel is closed only once.
+	closeOnce sync.Once
+	kill      chan struct{}
+
+	// once makes sure only the first call to Calls starts the goroutine.
+	once sync.Once
+	ch   chan *msg.CallPayload
+
+	// errmu protects access to err.
+	errmu sync.Mutex
+	err   error
+}
+
+func newCallsConn(b *Broker, uris []string) *callsConn {
+	return &callsConn{b: b, uris: uris, kill: make(chan struct{})}
+}
+
+// Close closes the connection.
+func (c *callsConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.kill)
+	})
+	return nil
+}
+
+// CallsErr returns the error that caused the Calls channel to close.
+func (c *callsConn) CallsErr() error {
+	c.errmu.Lock()
+	err := c.err
+	c.errmu.Unlock()
+	return err
+}
+
+// Calls returns a stream of call requests for the URIs specified when
+// creating the callsConn.
+func (c *callsConn) Calls() <-chan *msg.CallPayload {
+	c.once.Do(func() {
+		c.ch = make(chan *msg.CallPayload)
+
+		go func() {
+			defer close(c.ch)
+
+			for {
+				it, err := c.b.calls.pop(c.uris, c.kill)
+				if err != nil {
+					c.errmu.Lock()
+					c.err = err
+					c.errmu.Unlock()
+					return
+				}
+
+				var cp msg.CallPayload
+				if err := json.Unmarshal(it.payload, &cp); err != nil {
+					c.b.logger().Log(logger.Error, "Calls: failed to unmarshal call payload", logger.Err(err))
+					continue
+				}
+
+				// check if call is expired
+				now := time.Now()
+				ttl := it.deadline.Sub(now)
+				if ttl <= 0 {
+					c.b.logger().Log(logger.Warn, "Calls: message expired, dropping call", logger.Conn(cp.ConnUUID), logger.Msg(cp.MsgUUID), logger.URI(cp.URI))
+					continue
+				}
+
+				cp.ReadTimestamp = now.UTC()
+				cp.TTLAfterRead = ttl
+
+				select {
+				case c.ch <- &cp:
+				case <-c.kill:
+					c.errmu.Lock()
+					c.err = ErrClosed
+					c.errmu.Unlock()
+					return
+				}
+			}
+		}()
+	})
+
+	return c.ch
+}
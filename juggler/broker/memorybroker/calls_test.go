@@ -0,0 +1,77 @@
+package memorybroker
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/exp/juggler/msg"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCalls(t *testing.T) {
+	brk := &Broker{LogFunc: logIfVerbose}
+
+	// list calls on URI "a"
+	cc, err := brk.Calls("a")
+	require.NoError(t, err, "get Calls connection")
+
+	// keep track of received calls
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	var uuids []uuid.UUID
+	go func() {
+		defer wg.Done()
+		for cp := range cc.Calls() {
+			assert.True(t, cp.TTLAfterRead > 0, "TTLAfterRead is set")
+			assert.False(t, cp.ReadTimestamp.IsZero(), "ReadTimestamp is set")
+			uuids = append(uuids, cp.MsgUUID)
+		}
+	}()
+
+	cases := []struct {
+		cp      *msg.CallPayload
+		timeout time.Duration
+		exp     bool
+	}{
+		{&msg.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a"}, time.Second, true},
+		{&msg.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "b"}, time.Second, false},
+		{&msg.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a"}, time.Minute, true},
+	}
+	var expected []uuid.UUID
+	for i, c := range cases {
+		if c.exp {
+			expected = append(expected, c.cp.MsgUUID)
+		}
+		require.NoError(t, brk.Call(c.cp, c.timeout), "Call %d", i)
+	}
+
+	time.Sleep(10 * time.Millisecond) // ensure time to pop the last message
+	require.NoError(t, cc.Close(), "close calls connection")
+	wg.Wait()
+	assert.Equal(t, ErrClosed, cc.CallsErr(), "CallsErr is the expected error")
+	assert.Equal(t, expected, uuids, "got expected UUIDs")
+}
+
+func TestCallsExpired(t *testing.T) {
+	brk := &Broker{LogFunc: logIfVerbose}
+
+	cp1 := &msg.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a"}
+	require.NoError(t, brk.Call(cp1, time.Millisecond), "Call 1")
+	cp2 := &msg.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a"}
+	require.NoError(t, brk.Call(cp2, time.Second), "Call 2")
+	time.Sleep(2 * time.Millisecond)
+
+	cc, err := brk.Calls("a")
+	require.NoError(t, err, "get Calls connection")
+	defer cc.Close()
+
+	select {
+	case cp := <-cc.Calls():
+		assert.Equal(t, cp2.MsgUUID, cp.MsgUUID, "expired call is dropped")
+	case <-time.After(100 * time.Millisecond):
+		assert.Fail(t, "no call received")
+	}
+}
@@ -0,0 +1,125 @@
+package memorybroker
+
+import (
+	"sync"
+
+	"github.com/PuerkitoBio/exp/juggler/broker"
+	"github.com/PuerkitoBio/exp/juggler/msg"
+)
+
+var _ broker.CancelsConn = (*cancelsConn)(nil)
+
+type cancelsConn struct {
+	b    *Broker
+	uris map[string]struct{}
+
+	// closeOnce makes sure the kill channel is closed only once.
+	closeOnce sync.Once
+	kill      chan struct{}
+
+	// mu protects the pending cancellations.
+	mu      sync.Mutex
+	pending []*msg.CnclPayload
+
+	// signal receives a value when cancellations are added to pending.
+	signal chan struct{}
+
+	// once makes sure only the first call to Cancels starts the goroutine.
+	once sync.Once
+	ch   chan *msg.CnclPayload
+
+	// errmu protects access to err.
+	errmu sync.Mutex
+	err   error
+}
+
+func newCancelsConn(b *Broker, uris []string) *cancelsConn {
+	m := make(map[string]struct{}, len(uris))
+	for _, uri := range uris {
+		m[uri] = struct{}{}
+	}
+	return &cancelsConn{
+		b:      b,
+		uris:   m,
+		kill:   make(chan struct{}),
+		signal: make(chan struct{}, 1),
+	}
+}
+
+// Close closes the connection.
+func (c *cancelsConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.b.removeCancels(c)
+		close(c.kill)
+	})
+	return nil
+}
+
+// cancel queues the cancellation for delivery if the connection
+// listens on the URI of the call.
+func (c *cancelsConn) cancel(cp *msg.CnclPayload) {
+	if _, ok := c.uris[cp.URI]; !ok {
+		return
+	}
+
+	// store a copy, as it would be with a networked broker
+	cpy := *cp
+	c.mu.Lock()
+	c.pending = append(c.pending, &cpy)
+	c.mu.Unlock()
+
+	select {
+	case c.signal <- struct{}{}:
+	default:
+	}
+}
+
+// CancelsErr returns the error that caused the Cancels channel to close.
+func (c *cancelsConn) CancelsErr() error {
+	c.errmu.Lock()
+	err := c.err
+	c.errmu.Unlock()
+	return err
+}
+
+// Cancels returns a stream of cancellation requests for the URIs
+// specified when creating the cancelsConn.
+func (c *cancelsConn) Cancels() <-chan *msg.CnclPayload {
+	c.once.Do(func() {
+		c.ch = make(chan *msg.CnclPayload)
+
+		go func() {
+			defer close(c.ch)
+
+			for {
+				select {
+				case <-c.kill:
+					c.errmu.Lock()
+					c.err = ErrClosed
+					c.errmu.Unlock()
+					return
+
+				case <-c.signal:
+				}
+
+				c.mu.Lock()
+				cps := c.pending
+				c.pending = nil
+				c.mu.Unlock()
+
+				for _, cp := range cps {
+					select {
+					case c.ch <- cp:
+					case <-c.kill:
+						c.errmu.Lock()
+						c.err = ErrClosed
+						c.errmu.Unlock()
+						return
+					}
+				}
+			}
+		}()
+	})
+
+	return c.ch
+}
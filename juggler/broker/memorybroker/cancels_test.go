@@ -0,0 +1,69 @@
+package memorybroker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/exp/juggler/broker"
+	"github.com/PuerkitoBio/exp/juggler/msg"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCancelQueued(t *testing.T) {
+	brk := &Broker{LogFunc: logIfVerbose}
+
+	cp1 := &msg.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a"}
+	require.NoError(t, brk.Call(cp1, time.Second), "Call 1")
+	cp2 := &msg.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a"}
+	require.NoError(t, brk.Call(cp2, time.Second), "Call 2")
+
+	// cancel from a different connection fails
+	err := brk.Cancel(&msg.CnclPayload{ConnUUID: cp2.ConnUUID, MsgUUID: cp1.MsgUUID, URI: "a"})
+	assert.Equal(t, broker.ErrCallNotOwned, err, "Cancel not owned")
+
+	// cancel from the calling connection removes the call
+	err = brk.Cancel(&msg.CnclPayload{ConnUUID: cp1.ConnUUID, MsgUUID: cp1.MsgUUID, URI: "a"})
+	assert.NoError(t, err, "Cancel")
+	expectUUIDs(t, &brk.calls, "a", cp2.MsgUUID)
+}
+
+func TestCancels(t *testing.T) {
+	brk := &Broker{LogFunc: logIfVerbose}
+
+	cc, err := brk.Cancels("a", "b")
+	require.NoError(t, err, "get Cancels connection")
+
+	cases := []struct {
+		cp  *msg.CnclPayload
+		exp bool
+	}{
+		{&msg.CnclPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a"}, true},
+		{&msg.CnclPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "c"}, false},
+		{&msg.CnclPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "b"}, true},
+	}
+	var expected []uuid.UUID
+	for i, c := range cases {
+		if c.exp {
+			expected = append(expected, c.cp.MsgUUID)
+		}
+		require.NoError(t, brk.Cancel(c.cp), "Cancel %d", i)
+	}
+
+	var uuids []uuid.UUID
+	for range expected {
+		select {
+		case cp := <-cc.Cancels():
+			uuids = append(uuids, cp.MsgUUID)
+		case <-time.After(100 * time.Millisecond):
+			assert.Fail(t, "no cancellation received")
+		}
+	}
+	assert.Equal(t, expected, uuids, "got expected UUIDs")
+
+	require.NoError(t, cc.Close(), "close cancels connection")
+	_, ok := <-cc.Cancels()
+	assert.False(t, ok, "Cancels channel is closed")
+	assert.Equal(t, ErrClosed, cc.CancelsErr(), "CancelsErr is the expected error")
+}
@@ -0,0 +1,96 @@
+package memorybroker
+
+// match reports whether s matches the glob-style pattern, using the
+// same rules as the Redis PSUBSCRIBE command:
+//
+//   - ? matches any single byte
+//   - * matches any sequence of bytes, including the empty one
+//   - [abc] matches any of the listed bytes, [a-c] any byte in the
+//     range, and [^abc] any byte not listed
+//   - \ escapes the next byte so that it is matched literally
+//
+// Like Redis, matching is done byte by byte.
+func match(pattern, s string) bool {
+	p, i := 0, 0
+	for p < len(pattern) {
+		switch pattern[p] {
+		case '*':
+			for p+1 < len(pattern) && pattern[p+1] == '*' {
+				p++
+			}
+			if p+1 == len(pattern) {
+				return true
+			}
+			for j := i; j <= len(s); j++ {
+				if match(pattern[p+1:], s[j:]) {
+					return true
+				}
+			}
+			return false
+
+		case '?':
+			if i >= len(s) {
+				return false
+			}
+			i++
+
+		case '[':
+			if i >= len(s) {
+				return false
+			}
+			p++
+			not := p < len(pattern) && pattern[p] == '^'
+			if not {
+				p++
+			}
+
+			var matched bool
+			for p < len(pattern) && pattern[p] != ']' {
+				switch {
+				case pattern[p] == '\\' && p+1 < len(pattern):
+					p++
+					if pattern[p] == s[i] {
+						matched = true
+					}
+				case p+2 < len(pattern) && pattern[p+1] == '-':
+					lo, hi := pattern[p], pattern[p+2]
+					if lo > hi {
+						lo, hi = hi, lo
+					}
+					if lo <= s[i] && s[i] <= hi {
+						matched = true
+					}
+					p += 2
+				default:
+					if pattern[p] == s[i] {
+						matched = true
+					}
+				}
+				p++
+			}
+			if not {
+				matched = !matched
+			}
+			if !matched {
+				return false
+			}
+			i++
+			// p is now on the closing bracket, or past the end of the
+			// pattern if the class is not terminated.
+
+		case '\\':
+			if p+1 < len(pattern) {
+				p++
+			}
+			fallthrough
+
+		default:
+			if i >= len(s) || pattern[p] != s[i] {
+				return false
+			}
+			i++
+		}
+		p++
+	}
+	return i == len(s)
+}
@@ -0,0 +1,50 @@
+package memorybroker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatch(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		pat, s string
+		want   bool
+	}{
+		{"", "", true},
+		{"", "a", false},
+		{"a", "a", true},
+		{"a", "b", false},
+		{"abc", "ab", false},
+		{"*", "", true},
+		{"*", "a/b.c", true},
+		{"a*", "a", true},
+		{"a*", "abc", true},
+		{"a*", "ba", false},
+		{"*c", "abc", true},
+		{"a**c", "abbc", true},
+		{"a*b*c", "axxbyyc", true},
+		{"a*b*c", "axxbyy", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h[c-a]llo", "hbllo", true},
+		{"h[a-c]llo", "hdllo", false},
+		{`h[\]]llo`, "h]llo", true},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{`a\`, `a\`, true},
+		{`a\`, "a", false},
+		{"a[b", "ab", true},
+		{"[a", "", false},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.want, match(c.pat, c.s), "%q ~ %q", c.pat, c.s)
+	}
+}
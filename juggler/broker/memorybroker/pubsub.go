@@ -0,0 +1,192 @@
+package memorybroker
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/PuerkitoBio/exp/juggler/broker"
+	"github.com/PuerkitoBio/exp/juggler/logger"
+	"github.com/PuerkitoBio/exp/juggler/msg"
+)
+
+var _ broker.PubSubConn = (*pubSubConn)(nil)
+
+type pubSubConn struct {
+	b *Broker
+
+	// closeOnce makes sure the kill channel is closed only once.
+	closeOnce sync.Once
+	kill      chan struct{}
+
+	// mu protects the subscriptions and the pending events.
+	mu       sync.Mutex
+	channels map[string]struct{}
+	patterns map[string]struct{}
+	pending  []*msg.EvntPayload
+
+	// signal receives a value when events are added to pending.
+	signal chan struct{}
+
+	// once makes sure only the first call to Events starts the goroutine.
+	once sync.Once
+	evch chan *msg.EvntPayload
+
+	// errmu protects access to err.
+	errmu sync.Mutex
+	err   error
+}
+
+func newPubSubConn(b *Broker) *pubSubConn {
+	return &pubSubConn{
+		b:        b,
+		kill:     make(chan struct{}),
+		channels: make(map[string]struct{}),
+		patterns: make(map[string]struct{}),
+		signal:   make(chan struct{}, 1),
+	}
+}
+
+// Close closes the connection.
+func (c *pubSubConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.b.removePubSub(c)
+		close(c.kill)
+	})
+	return nil
+}
+
+// Subscribe subscribes the connection to the channel, which may
+// be a pattern.
+func (c *pubSubConn) Subscribe(channel string, pattern bool) error {
+	return c.subUnsub(channel, pattern, true)
+}
+
+// Unsubscribe unsubscribes the connection from the channel, which
+// may be a pattern.
+func (c *pubSubConn) Unsubscribe(channel string, pattern bool) error {
+	return c.subUnsub(channel, pattern, false)
+}
+
+func (c *pubSubConn) subUnsub(ch string, pat bool, sub bool) error {
+	select {
+	case <-c.kill:
+		return ErrClosed
+	default:
+	}
+
+	m := c.channels
+	if pat {
+		m = c.patterns
+	}
+
+	c.mu.Lock()
+	if sub {
+		m[ch] = struct{}{}
+	} else {
+		delete(m, ch)
+	}
+	c.mu.Unlock()
+	return nil
+}
+
+// publish queues the event for delivery if the connection is subscribed
+// to the channel. As with Redis, an event is received once for the
+// channel subscription, and once for each matching pattern subscription.
+func (c *pubSubConn) publish(channel string, pld []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var n int
+	if _, ok := c.channels[channel]; ok {
+		c.queue(channel, "", pld)
+		n++
+	}
+	for p := range c.patterns {
+		if match(p, channel) {
+			c.queue(channel, p, pld)
+			n++
+		}
+	}
+
+	if n > 0 {
+		select {
+		case c.signal <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// queue adds an event to the pending list. The caller must hold the
+// lock.
+func (c *pubSubConn) queue(channel, pattern string, pld []byte) {
+	ep, err := newEvntPayload(channel, pattern, pld)
+	if err != nil {
+		c.b.logger().Log(logger.Error, "Events: failed to unmarshal event payload", logger.Channel(channel), logger.Err(err))
+		return
+	}
+	c.pending = append(c.pending, ep)
+}
+
+// Events returns the stream of events from channels that the connection
+// is subscribed to.
+func (c *pubSubConn) Events() <-chan *msg.EvntPayload {
+	c.once.Do(func() {
+		c.evch = make(chan *msg.EvntPayload)
+
+		go func() {
+			defer close(c.evch)
+
+			for {
+				select {
+				case <-c.kill:
+					c.errmu.Lock()
+					c.err = ErrClosed
+					c.errmu.Unlock()
+					return
+
+				case <-c.signal:
+				}
+
+				c.mu.Lock()
+				evs := c.pending
+				c.pending = nil
+				c.mu.Unlock()
+
+				for _, ev := range evs {
+					select {
+					case c.evch <- ev:
+					case <-c.kill:
+						c.errmu.Lock()
+						c.err = ErrClosed
+						c.errmu.Unlock()
+						return
+					}
+				}
+			}
+		}()
+	})
+
+	return c.evch
+}
+
+func newEvntPayload(channel, pattern string, pld []byte) (*msg.EvntPayload, error) {
+	var pp msg.PubPayload
+	if err := json.Unmarshal(pld, &pp); err != nil {
+		return nil, err
+	}
+	ep := &msg.EvntPayload{
+		MsgUUID: pp.MsgUUID,
+		Channel: channel,
+		Pattern: pattern,
+		Args:    pp.Args,
+	}
+	return ep, nil
+}
+
+// EventsErr returns the error that caused the events channel to close.
+func (c *pubSubConn) EventsErr() error {
+	c.errmu.Lock()
+	err := c.err
+	c.errmu.Unlock()
+	return err
+}
@@ -0,0 +1,72 @@
+package memorybroker
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/exp/juggler/msg"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPubSub(t *testing.T) {
+	brk := &Broker{LogFunc: logIfVerbose}
+
+	psc, err := brk.PubSub()
+	require.NoError(t, err, "get PubSub connection")
+
+	// keep track of received events
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	var uuids []uuid.UUID
+	var patterns []string
+	go func() {
+		defer wg.Done()
+		for ep := range psc.Events() {
+			uuids = append(uuids, ep.MsgUUID)
+			patterns = append(patterns, ep.Pattern)
+		}
+	}()
+
+	// subscribe to some channels
+	require.NoError(t, psc.Subscribe("a", false), "Subscribe a")
+	require.NoError(t, psc.Subscribe("b", false), "Subscribe b")
+	require.NoError(t, psc.Subscribe("d.*", true), "Subscribe d.*")
+
+	cases := []struct {
+		ch   string
+		pp   *msg.PubPayload
+		exp  string // "-" if not expected, otherwise the pattern
+		unsb string
+	}{
+		{"a", &msg.PubPayload{MsgUUID: uuid.NewRandom()}, "", ""},
+		{"b", &msg.PubPayload{MsgUUID: uuid.NewRandom()}, "", ""},
+		{"c", &msg.PubPayload{MsgUUID: uuid.NewRandom()}, "-", "a"},
+		{"a", &msg.PubPayload{MsgUUID: uuid.NewRandom()}, "-", ""},
+		{"d.x", &msg.PubPayload{MsgUUID: uuid.NewRandom()}, "d.*", ""},
+		{"b", &msg.PubPayload{MsgUUID: uuid.NewRandom()}, "", "b"},
+		{"b", &msg.PubPayload{MsgUUID: uuid.NewRandom()}, "-", ""},
+	}
+	var expected []uuid.UUID
+	var expectedPats []string
+	for i, c := range cases {
+		if c.exp != "-" {
+			expected = append(expected, c.pp.MsgUUID)
+			expectedPats = append(expectedPats, c.exp)
+		}
+		require.NoError(t, brk.Publish(c.ch, c.pp), "Publish %d", i)
+		if c.unsb != "" {
+			require.NoError(t, psc.Unsubscribe(c.unsb, false), "Unsubscribe %d", i)
+		}
+	}
+
+	time.Sleep(10 * time.Millisecond) // ensure time to deliver the last event
+	require.NoError(t, psc.Close(), "close pubsub connection")
+	wg.Wait()
+	assert.Equal(t, ErrClosed, psc.EventsErr(), "EventsErr is the expected error")
+	assert.Equal(t, expected, uuids, "got expected UUIDs")
+	assert.Equal(t, expectedPats, patterns, "got expected patterns")
+	assert.Equal(t, ErrClosed, psc.Subscribe("a", false), "Subscribe after Close")
+}
@@ -0,0 +1,97 @@
+package memorybroker
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/exp/juggler/broker"
+	"github.com/PuerkitoBio/exp/juggler/logger"
+	"github.com/PuerkitoBio/exp/juggler/msg"
+	"github.com/pborman/uuid"
+)
+
+var _ broker.ResultsConn = (*resultsConn)(nil)
+
+type resultsConn struct {
+	b        *Broker
+	connUUID uuid.UUID
+
+	// closeOnce makes sure the kill channel is closed only once.
+	closeOnce sync.Once
+	kill      chan struct{}
+
+	// once makes sure only the first call to Results starts the goroutine.
+	once sync.Once
+	ch   chan *msg.ResPayload
+
+	// errmu protects access to err.
+	errmu sync.Mutex
+	err   error
+}
+
+func newResultsConn(b *Broker, connUUID uuid.UUID) *resultsConn {
+	return &resultsConn{b: b, connUUID: connUUID, kill: make(chan struct{})}
+}
+
+// Close closes the connection.
+func (c *resultsConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.kill)
+	})
+	return nil
+}
+
+// ResultsErr returns the error that caused the Results channel to close.
+func (c *resultsConn) ResultsErr() error {
+	c.errmu.Lock()
+	err := c.err
+	c.errmu.Unlock()
+	return err
+}
+
+// Results returns a stream of call results for the connUUID specified when
+// creating the resultsConn.
+func (c *resultsConn) Results() <-chan *msg.ResPayload {
+	c.once.Do(func() {
+		c.ch = make(chan *msg.ResPayload)
+
+		go func() {
+			defer close(c.ch)
+
+			keys := []string{c.connUUID.String()}
+			for {
+				it, err := c.b.results.pop(keys, c.kill)
+				if err != nil {
+					c.errmu.Lock()
+					c.err = err
+					c.errmu.Unlock()
+					return
+				}
+
+				var rp msg.ResPayload
+				if err := json.Unmarshal(it.payload, &rp); err != nil {
+					c.b.logger().Log(logger.Error, "Results: failed to unmarshal result payload", logger.Err(err))
+					continue
+				}
+
+				// check if result is expired
+				if !it.deadline.After(time.Now()) {
+					c.b.logger().Log(logger.Warn, "Results: message expired, dropping call", logger.Conn(rp.ConnUUID), logger.Msg(rp.MsgUUID), logger.URI(rp.URI))
+					continue
+				}
+
+				select {
+				case c.ch <- &rp:
+				case <-c.kill:
+					c.errmu.Lock()
+					c.err = ErrClosed
+					c.errmu.Unlock()
+					return
+				}
+			}
+		}()
+	})
+
+	return c.ch
+}
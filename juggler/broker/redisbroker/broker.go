@@ -10,17 +10,46 @@
 // and the same is true for results and their expiring key,
 // so that using a redis cluster is supported. The call
 // requests are hashed on the call URI, and the results
-// are hashed on the calling connection's UUID.
+// are hashed on the calling connection's UUID. To connect
+// to a redis cluster, use a Cluster as the Pool and its
+// Dial method as the Dial function of the Broker.
+//
+// To connect to a master monitored by redis sentinels, use a
+// Sentinel as the Pool and its Dial method as the Dial function
+// of the Broker. The long-lived connections then reconnect to the
+// new master after a failover, instead of failing. For other
+// deployments, set the Broker's Redial field to reconnect the
+// long-lived connections when they fail.
+//
+// By default, the Broker dials a redis connection for each pub-sub
+// and results connection, so that a server has two redis connections
+// for each juggler connection. Set the Broker's Mux field to multiplex
+// them over a fixed number of redis connections instead.
+//
+// The expiring key of a call request holds the UUID of the calling
+// connection, so that only that connection can cancel the call. A
+// call that is still in the list is canceled by deleting its key,
+// and a call that is being processed is canceled by publishing the
+// cancellation on a pub-sub channel specific to the call URI, that
+// the callees listen to via Broker.Cancels.
+//
+// A call request popped from its list is lost if the callee dies
+// before storing its result. The StreamBroker stores the call requests
+// in Redis Streams read by a consumer group instead, so that the calls
+// that are not acknowledged are reclaimed by another callee. Both
+// brokers use the same keys for the results and the same pub-sub
+// channels, but the callers and callees of a URI must all use the
+// same kind of broker.
 //
 package redisbroker
 
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"time"
 
 	"github.com/PuerkitoBio/exp/juggler/broker"
+	"github.com/PuerkitoBio/exp/juggler/logger"
 	"github.com/PuerkitoBio/exp/juggler/msg"
 	"github.com/garyburd/redigo/redis"
 	"github.com/pborman/uuid"
@@ -53,12 +82,31 @@ type Broker struct {
 	// redis connection. Typically, it can be set to redis.Pool.Dial.
 	Dial func() (redis.Conn, error)
 
+	// Redial enables the reconnection of the long-lived connections
+	// when they fail, e.g. on a network error or a redis restart. If
+	// not nil, a new connection is dialed with Dial, waiting between
+	// attempts as configured by the Backoff, the failed command is
+	// retried and the pub-sub subscriptions are replayed, so that the
+	// juggler connections using them are not closed. The connections
+	// returned by Sentinel.Dial always redial.
+	Redial *Backoff
+
+	// Mux, if not nil, multiplexes the connections returned by PubSub
+	// and Results over its shared redis connections, instead of dialing
+	// a redis connection for each of them.
+	Mux *Mux
+
 	// BlockingTimeout is the time to wait for a value on calls to
 	// BRPOP before trying again. The default of 0 means no timeout.
 	BlockingTimeout time.Duration
 
-	// LogFunc is the logging function to use. If nil, log.Printf
-	// is used. It can be set to juggler.DiscardLog to disable logging.
+	// Logger is the structured logger to use. If nil, LogFunc is
+	// used.
+	Logger logger.Logger
+
+	// LogFunc is the logging function to use if Logger is nil. If nil,
+	// log.Printf is used. It can be set to juggler.DiscardLog to disable
+	// logging.
 	LogFunc func(string, ...interface{})
 
 	// CallCap is the capacity of the CALL queue per URI. If it is
@@ -74,7 +122,7 @@ type Broker struct {
 
 const (
 	callOrResScript = `
-		redis.call("SET", KEYS[1], ARGV[1], "PX", tonumber(ARGV[1]))
+		redis.call("SET", KEYS[1], ARGV[4], "PX", tonumber(ARGV[1]))
 		local res = redis.call("LPUSH", KEYS[2], ARGV[2])
 		local limit = tonumber(ARGV[3])
 		if res > limit and limit > 0 then
@@ -89,26 +137,84 @@ const (
 	callKey        = "juggler:calls:{%s}"            // 1: URI
 	callTimeoutKey = "juggler:calls:timeout:{%s}:%s" // 1: URI, 2: mUUID
 
+	cancelScript = `
+		local owner = redis.call("GET", KEYS[1])
+		if owner == ARGV[1] then
+			redis.call("DEL", KEYS[1])
+			return 1
+		elseif owner then
+			return -1
+		end
+		redis.call("PUBLISH", ARGV[2], ARGV[3])
+		return 0
+	`
+
+	// pub-sub channel of call cancellations
+	cancelChannel = "juggler:calls:cancel:{%s}" // 1: URI
+
 	// redis cluster-compliant keys, so that both keys are in the same slot
 	resKey        = "juggler:results:{%s}"            // 1: cUUID
 	resTimeoutKey = "juggler:results:timeout:{%s}:%s" // 1: cUUID, 2: mUUID
+
+	// expiring key of a streamed result, in the same slot as resKey
+	resSeqTimeoutKey = "juggler:results:timeout:{%s}:%s:%d" // 1: cUUID, 2: mUUID, 3: seq
 )
 
 // Call registers a call request in the broker.
 func (b *Broker) Call(cp *msg.CallPayload, timeout time.Duration) error {
 	k1 := fmt.Sprintf(callTimeoutKey, cp.URI, cp.MsgUUID)
 	k2 := fmt.Sprintf(callKey, cp.URI)
-	return registerCallOrRes(b.Pool, cp, timeout, b.CallCap, k1, k2)
+	return registerCallOrRes(b.Pool, cp, timeout, b.CallCap, cp.ConnUUID.String(), k1, k2)
+}
+
+// Cancel cancels a call request. If the call is still in the calls list,
+// its expiring key is deleted so that it gets dropped when it is read,
+// otherwise the cancellation is published to the callees.
+func (b *Broker) Cancel(cp *msg.CnclPayload) error {
+	p, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+
+	rc := b.Pool.Get()
+	defer rc.Close()
+
+	k := fmt.Sprintf(callTimeoutKey, cp.URI, cp.MsgUUID)
+	ch := fmt.Sprintf(cancelChannel, cp.URI)
+	res, err := redis.Int(rc.Do("EVAL",
+		cancelScript,
+		1,                    // the number of keys
+		k,                    // key[1] : the SET key with expiration
+		cp.ConnUUID.String(), // argv[1] : the UUID of the calling connection
+		ch,                   // argv[2] : the cancellation channel
+		p,                    // argv[3] : the cancel payload
+	))
+	if err != nil {
+		return err
+	}
+	if res < 0 {
+		return broker.ErrCallNotOwned
+	}
+	return nil
 }
 
 // Result registers a call result in the broker.
 func (b *Broker) Result(rp *msg.ResPayload, timeout time.Duration) error {
-	k1 := fmt.Sprintf(resTimeoutKey, rp.ConnUUID, rp.MsgUUID)
+	k1 := resultTimeoutKey(rp)
 	k2 := fmt.Sprintf(resKey, rp.ConnUUID)
-	return registerCallOrRes(b.Pool, rp, timeout, b.ResultCap, k1, k2)
+	return registerCallOrRes(b.Pool, rp, timeout, b.ResultCap, rp.ConnUUID.String(), k1, k2)
+}
+
+// resultTimeoutKey returns the expiring key associated with the result
+// rp. Each result of a call that streams its results has its own key.
+func resultTimeoutKey(rp *msg.ResPayload) string {
+	if rp.Seq > 0 {
+		return fmt.Sprintf(resSeqTimeoutKey, rp.ConnUUID, rp.MsgUUID, rp.Seq)
+	}
+	return fmt.Sprintf(resTimeoutKey, rp.ConnUUID, rp.MsgUUID)
 }
 
-func registerCallOrRes(pool Pool, pld interface{}, timeout time.Duration, cap int, k1, k2 string) error {
+func registerCallOrRes(pool Pool, pld interface{}, timeout time.Duration, cap int, owner, k1, k2 string) error {
 	p, err := json.Marshal(pld)
 	if err != nil {
 		return err
@@ -124,12 +230,13 @@ func registerCallOrRes(pool Pool, pld interface{}, timeout time.Duration, cap in
 
 	_, err = rc.Do("EVAL",
 		callOrResScript,
-		2,   // the number of keys
-		k1,  // key[1] : the SET key with expiration
-		k2,  // key[2] : the LIST key
-		to,  // argv[1] : the timeout in milliseconds
-		p,   // argv[2] : the call payload
-		cap, // argv[3] : the LIST capacity
+		2,     // the number of keys
+		k1,    // key[1] : the SET key with expiration
+		k2,    // key[2] : the LIST key
+		to,    // argv[1] : the timeout in milliseconds
+		p,     // argv[2] : the call payload
+		cap,   // argv[3] : the LIST capacity
+		owner, // argv[4] : the value of the SET key, the connection UUID
 	)
 	return err
 }
@@ -151,37 +258,67 @@ func (b *Broker) Publish(channel string, pp *msg.PubPayload) error {
 // PubSub returns a pub-sub connection that can be used to subscribe and
 // unsubscribe to channels, and to process incoming events.
 func (b *Broker) PubSub() (broker.PubSubConn, error) {
-	rc, err := b.Dial()
+	if b.Mux != nil {
+		return b.Mux.pubSubConn(b), nil
+	}
+	rc, err := b.dial()
 	if err != nil {
 		return nil, err
 	}
-	return newPubSubConn(rc, b.LogFunc), nil
+	return newPubSubConn(rc, b.logger()), nil
 }
 
 // Calls returns a calls connection that can be used to process the call
 // requests for the specified URIs.
 func (b *Broker) Calls(uris ...string) (broker.CallsConn, error) {
-	rc, err := b.Dial()
+	rc, err := b.dial()
 	if err != nil {
 		return nil, err
 	}
-	return newCallsConn(rc, uris, b.BlockingTimeout, b.LogFunc), nil
+	return newCallsConn(rc, uris, b.BlockingTimeout, b.logger()), nil
+}
+
+// Cancels returns a cancels connection that can be used to process the
+// cancellation requests of calls for the specified URIs.
+func (b *Broker) Cancels(uris ...string) (broker.CancelsConn, error) {
+	rc, err := b.dial()
+	if err != nil {
+		return nil, err
+	}
+	return newCancelsConn(rc, uris, b.logger()), nil
 }
 
 // Results returns a results connection that can be used to process the call
 // results for the specified connection UUID.
 func (b *Broker) Results(connUUID uuid.UUID) (broker.ResultsConn, error) {
+	if b.Mux != nil {
+		return b.Mux.resultsConn(b, connUUID)
+	}
+	rc, err := b.dial()
+	if err != nil {
+		return nil, err
+	}
+	return newResultsConn(rc, connUUID, b.BlockingTimeout, b.logger()), nil
+}
+
+// dial returns a new long-lived connection, that redials when it
+// fails if b.Redial is set.
+func (b *Broker) dial() (redis.Conn, error) {
 	rc, err := b.Dial()
 	if err != nil {
 		return nil, err
 	}
-	return newResultsConn(rc, connUUID, b.BlockingTimeout, b.LogFunc), nil
+	if _, ok := rc.(*redialConn); ok || b.Redial == nil {
+		return rc, nil
+	}
+	return newRedialConn(rc, b.Dial, b.Redial, b.logger()), nil
 }
 
-func logf(fn func(string, ...interface{}), f string, args ...interface{}) {
-	if fn != nil {
-		fn(f, args...)
-	} else {
-		log.Printf(f, args...)
+// logger returns the Logger of the broker, which adapts LogFunc if
+// Logger is nil.
+func (b *Broker) logger() logger.Logger {
+	if b.Logger != nil {
+		return b.Logger
 	}
+	return logger.Func(b.LogFunc)
 }
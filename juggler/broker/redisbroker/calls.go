@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/PuerkitoBio/exp/juggler/broker"
+	"github.com/PuerkitoBio/exp/juggler/logger"
 	"github.com/PuerkitoBio/exp/juggler/msg"
 	"github.com/garyburd/redigo/redis"
 )
@@ -25,7 +26,7 @@ type callsConn struct {
 	c       redis.Conn
 	uris    []string
 	timeout time.Duration
-	logFn   func(string, ...interface{})
+	logger  logger.Logger
 
 	// once makes sure only the first call to Calls starts the goroutine.
 	once sync.Once
@@ -36,8 +37,8 @@ type callsConn struct {
 	err   error
 }
 
-func newCallsConn(rc redis.Conn, uris []string, to time.Duration, logFn func(string, ...interface{})) *callsConn {
-	return &callsConn{c: rc, uris: uris, timeout: to, logFn: logFn}
+func newCallsConn(rc redis.Conn, uris []string, to time.Duration, lg logger.Logger) *callsConn {
+	return &callsConn{c: rc, uris: uris, timeout: to, logger: lg}
 }
 
 // Close closes the connection.
@@ -90,7 +91,7 @@ func (c *callsConn) Calls() <-chan *msg.CallPayload {
 				// unmarshal the payload
 				var cp msg.CallPayload
 				if err := unmarshalBRPOPValue(&cp, v); err != nil {
-					logf(c.logFn, "Calls: BRPOP failed to unmarshal call payload: %v", err)
+					c.logger.Log(logger.Error, "Calls: BRPOP failed to unmarshal call payload", logger.Err(err))
 					continue
 				}
 
@@ -98,11 +99,11 @@ func (c *callsConn) Calls() <-chan *msg.CallPayload {
 				k := fmt.Sprintf(callTimeoutKey, cp.URI, cp.MsgUUID)
 				pttl, err := redis.Int(c.c.Do("EVAL", delAndPTTLScript, 1, k))
 				if err != nil {
-					logf(c.logFn, "Calls: DEL/PTTL failed: %v", err)
+					c.logger.Log(logger.Error, "Calls: DEL/PTTL failed", logger.Msg(cp.MsgUUID), logger.URI(cp.URI), logger.Err(err))
 					continue
 				}
 				if pttl <= 0 {
-					logf(c.logFn, "Calls: message %v expired, dropping call", cp.MsgUUID)
+					c.logger.Log(logger.Warn, "Calls: message expired, dropping call", logger.Conn(cp.ConnUUID), logger.Msg(cp.MsgUUID), logger.URI(cp.URI))
 					continue
 				}
 
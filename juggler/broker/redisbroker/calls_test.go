@@ -32,10 +32,12 @@ func TestCalls(t *testing.T) {
 	wg := sync.WaitGroup{}
 	wg.Add(1)
 	var uuids []uuid.UUID
+	var mds []map[string]string
 	go func() {
 		defer wg.Done()
 		for cp := range cc.Calls() {
 			uuids = append(uuids, cp.MsgUUID)
+			mds = append(mds, cp.Metadata)
 		}
 	}()
 
@@ -49,12 +51,14 @@ func TestCalls(t *testing.T) {
 	}{
 		{&msg.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a"}, time.Second, true},
 		{&msg.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "b"}, time.Second, false},
-		{&msg.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a"}, time.Minute, true},
+		{&msg.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a", Metadata: map[string]string{"k": "v"}}, time.Minute, true},
 	}
 	var expected []uuid.UUID
+	var expectedMds []map[string]string
 	for i, c := range cases {
 		if c.exp {
 			expected = append(expected, c.cp.MsgUUID)
+			expectedMds = append(expectedMds, c.cp.Metadata)
 		}
 		require.NoError(t, brk.Call(c.cp, c.timeout), "Call %d", i)
 	}
@@ -66,4 +70,5 @@ func TestCalls(t *testing.T) {
 		assert.Contains(t, cc.CallsErr().Error(), "use of closed network connection", "CallsErr is the expected error")
 	}
 	assert.Equal(t, expected, uuids, "got expected UUIDs")
+	assert.Equal(t, expectedMds, mds, "got expected metadata")
 }
@@ -0,0 +1,91 @@
+package redisbroker
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/PuerkitoBio/exp/juggler/broker"
+	"github.com/PuerkitoBio/exp/juggler/logger"
+	"github.com/PuerkitoBio/exp/juggler/msg"
+	"github.com/garyburd/redigo/redis"
+)
+
+var _ broker.CancelsConn = (*cancelsConn)(nil)
+
+type cancelsConn struct {
+	psc    redis.PubSubConn
+	uris   []string
+	logger logger.Logger
+
+	// once makes sure only the first call to Cancels starts the goroutine.
+	once sync.Once
+	ch   chan *msg.CnclPayload
+
+	// errmu protects access to err.
+	errmu sync.Mutex
+	err   error
+}
+
+func newCancelsConn(rc redis.Conn, uris []string, lg logger.Logger) *cancelsConn {
+	return &cancelsConn{psc: redis.PubSubConn{Conn: rc}, uris: uris, logger: lg}
+}
+
+// Close closes the connection.
+func (c *cancelsConn) Close() error {
+	return c.psc.Close()
+}
+
+// CancelsErr returns the error that caused the Cancels channel to close.
+func (c *cancelsConn) CancelsErr() error {
+	c.errmu.Lock()
+	err := c.err
+	c.errmu.Unlock()
+	return err
+}
+
+// Cancels returns a stream of cancellation requests for the URIs
+// specified when creating the cancelsConn.
+func (c *cancelsConn) Cancels() <-chan *msg.CnclPayload {
+	c.once.Do(func() {
+		c.ch = make(chan *msg.CnclPayload)
+
+		go func() {
+			defer close(c.ch)
+
+			chans := make([]interface{}, len(c.uris))
+			for i, uri := range c.uris {
+				chans[i] = fmt.Sprintf(cancelChannel, uri)
+			}
+			if err := c.psc.Subscribe(chans...); err != nil {
+				c.errmu.Lock()
+				c.err = err
+				c.errmu.Unlock()
+				return
+			}
+
+			for {
+				switch v := c.psc.Receive().(type) {
+				case redis.Message:
+					var cp msg.CnclPayload
+					if err := json.Unmarshal(v.Data, &cp); err != nil {
+						c.logger.Log(logger.Error, "Cancels: failed to unmarshal cancel payload", logger.Channel(v.Channel), logger.Err(err))
+						continue
+					}
+					c.ch <- &cp
+
+				case error:
+					// possibly because the pub-sub connection was closed, but
+					// in any case, the pub-sub is now broken, terminate the
+					// loop.
+					c.errmu.Lock()
+					c.err = v
+					c.errmu.Unlock()
+					return
+				}
+			}
+		}()
+	})
+
+	return c.ch
+}
@@ -0,0 +1,93 @@
+package redisbroker
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/exp/juggler/broker"
+	"github.com/PuerkitoBio/exp/juggler/internal/redistest"
+	"github.com/PuerkitoBio/exp/juggler/msg"
+	"github.com/garyburd/redigo/redis"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCancelQueued(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil)
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	brk := &Broker{
+		Pool:    pool,
+		Dial:    pool.Dial,
+		LogFunc: logIfVerbose,
+	}
+
+	cp := &msg.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a"}
+	require.NoError(t, brk.Call(cp, time.Second), "Call")
+
+	// cancel from a different connection fails
+	err := brk.Cancel(&msg.CnclPayload{ConnUUID: uuid.NewRandom(), MsgUUID: cp.MsgUUID, URI: "a"})
+	assert.Equal(t, broker.ErrCallNotOwned, err, "Cancel not owned")
+
+	// cancel from the calling connection deletes the expiring key
+	err = brk.Cancel(&msg.CnclPayload{ConnUUID: cp.ConnUUID, MsgUUID: cp.MsgUUID, URI: "a"})
+	assert.NoError(t, err, "Cancel")
+
+	rc := pool.Get()
+	defer rc.Close()
+	n, err := redis.Int(rc.Do("EXISTS", fmt.Sprintf(callTimeoutKey, cp.URI, cp.MsgUUID)))
+	require.NoError(t, err, "EXISTS")
+	assert.Equal(t, 0, n, "expiring key is deleted")
+}
+
+func TestCancels(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil)
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	brk := &Broker{
+		Pool:    pool,
+		Dial:    pool.Dial,
+		LogFunc: logIfVerbose,
+	}
+
+	cc, err := brk.Cancels("a", "b")
+	require.NoError(t, err, "get Cancels connection")
+	ch := cc.Cancels()
+	time.Sleep(10 * time.Millisecond) // ensure time to subscribe
+
+	cases := []struct {
+		cp  *msg.CnclPayload
+		exp bool
+	}{
+		{&msg.CnclPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a"}, true},
+		{&msg.CnclPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "c"}, false},
+		{&msg.CnclPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "b"}, true},
+	}
+	var expected []uuid.UUID
+	for i, c := range cases {
+		if c.exp {
+			expected = append(expected, c.cp.MsgUUID)
+		}
+		require.NoError(t, brk.Cancel(c.cp), "Cancel %d", i)
+	}
+
+	var uuids []uuid.UUID
+	for range expected {
+		select {
+		case cp := <-ch:
+			uuids = append(uuids, cp.MsgUUID)
+		case <-time.After(100 * time.Millisecond):
+			assert.Fail(t, "no cancellation received")
+		}
+	}
+	assert.Equal(t, expected, uuids, "got expected UUIDs")
+
+	require.NoError(t, cc.Close(), "close cancels connection")
+	_, ok := <-ch
+	assert.False(t, ok, "Cancels channel is closed")
+	assert.Error(t, cc.CancelsErr(), "CancelsErr returns the error")
+}
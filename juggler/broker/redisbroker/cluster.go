@@ -0,0 +1,538 @@
+package redisbroker
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/exp/juggler/internal/hashslot"
+	"github.com/garyburd/redigo/redis"
+)
+
+var _ Pool = (*Cluster)(nil)
+
+// ErrClusterClosed is returned by the connections of a Cluster once
+// it is closed.
+var ErrClusterClosed = errors.New("redisbroker: cluster closed")
+
+// DefaultNodeTimeout is the default connect, read and write timeout of
+// the connections to the redis nodes dialed by a Cluster or a Sentinel.
+const DefaultNodeTimeout = 10 * time.Second
+
+// maxRedirects is the maximum number of MOVED or ASK redirections
+// followed for a command.
+const maxRedirects = 16
+
+// Cluster is a Pool that routes the commands to the nodes of a redis
+// cluster. Each connection returned by Get or Dial is bound to the
+// node that serves the hash slot of the key of its first command, and
+// follows the MOVED and ASK redirections. Because the connections are
+// bound to a single node, all keys used with a connection must be in
+// the same hash slot, which is the case for the keys of a call request
+// or of a call result, and for the keys of a Calls connection if its
+// URIs are grouped with callee.SplitByHashSlot.
+//
+// To use it with a Broker, set the Broker's Pool to the Cluster and
+// its Dial function to the Cluster's Dial method.
+type Cluster struct {
+	// StartupNodes is the list of addresses of the nodes used to
+	// discover the mapping of hash slots to nodes.
+	StartupNodes []string
+
+	// DialNode is the function called to connect to the node at addr.
+	// If nil, redis.Dial is used on the TCP network.
+	DialNode func(addr string) (redis.Conn, error)
+
+	// ConnectTimeout, ReadTimeout and WriteTimeout are the timeouts of
+	// the connections dialed when DialNode is nil. The default of 0
+	// uses DefaultNodeTimeout. ReadTimeout does not apply to the
+	// connections returned by Dial, as they run blocking commands.
+	ConnectTimeout time.Duration
+	ReadTimeout    time.Duration
+	WriteTimeout   time.Duration
+
+	// MaxIdle, MaxActive and IdleTimeout configure the pool of
+	// connections of each node, see redis.Pool.
+	MaxIdle     int
+	MaxActive   int
+	IdleTimeout time.Duration
+
+	// mu protects the following fields.
+	mu         sync.Mutex
+	slots      [hashslot.NumSlots]string // node address by hash slot
+	mapped     bool                      // slots were loaded at least once
+	refreshing bool
+	pools      map[string]*redis.Pool // by node address
+	closed     bool
+}
+
+// Refresh loads the mapping of hash slots to nodes, using the first
+// node that answers among the startup nodes and the known nodes.
+func (c *Cluster) Refresh() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrClusterClosed
+	}
+	addrs := append([]string(nil), c.StartupNodes...)
+	for addr := range c.pools {
+		addrs = append(addrs, addr)
+	}
+	c.mu.Unlock()
+
+	if len(addrs) == 0 {
+		return errors.New("redisbroker: no cluster node to load the slots from")
+	}
+
+	var err error
+	for _, addr := range addrs {
+		var slots []slotRange
+		if slots, err = c.loadSlots(addr); err != nil {
+			continue
+		}
+
+		c.mu.Lock()
+		for i := range c.slots {
+			c.slots[i] = ""
+		}
+		for _, sr := range slots {
+			for i := sr.start; i <= sr.end && i < hashslot.NumSlots; i++ {
+				c.slots[i] = sr.addr
+			}
+		}
+		c.mapped = true
+		c.mu.Unlock()
+		return nil
+	}
+	return err
+}
+
+// slotRange is a range of hash slots served by the node at addr.
+type slotRange struct {
+	start, end int
+	addr       string
+}
+
+// loadSlots returns the slot ranges returned by CLUSTER SLOTS on the
+// node at addr.
+func (c *Cluster) loadSlots(addr string) ([]slotRange, error) {
+	rc, err := c.dialNode(addr, true)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	// CLUSTER SLOTS returns an array of [0]: start slot, [1]: end slot,
+	// [2]: master node as [0]: IP, [1]: port, followed by the replicas.
+	vals, err := redis.Values(rc.Do("CLUSTER", "SLOTS"))
+	if err != nil {
+		return nil, err
+	}
+	slots := make([]slotRange, 0, len(vals))
+	for _, v := range vals {
+		rng, err := redis.Values(v, nil)
+		if err != nil || len(rng) < 3 {
+			return nil, fmt.Errorf("redisbroker: invalid CLUSTER SLOTS reply: %v", v)
+		}
+		node, err := redis.Values(rng[2], nil)
+		if err != nil || len(node) < 2 {
+			return nil, fmt.Errorf("redisbroker: invalid CLUSTER SLOTS node: %v", rng[2])
+		}
+
+		var sr slotRange
+		var ip string
+		var port int
+		if _, err := redis.Scan(rng[:2], &sr.start, &sr.end); err != nil {
+			return nil, err
+		}
+		if _, err := redis.Scan(node[:2], &ip, &port); err != nil {
+			return nil, err
+		}
+		sr.addr = ip + ":" + strconv.Itoa(port)
+		slots = append(slots, sr)
+	}
+	return slots, nil
+}
+
+// Get returns a connection to the cluster. It is bound to a node on
+// its first command. Close must be called to release it.
+func (c *Cluster) Get() redis.Conn {
+	return &clusterConn{cluster: c, pooled: true}
+}
+
+// Dial returns a non-pooled connection to the cluster, suitable for
+// long-lived connections. It is bound to a node on its first command.
+func (c *Cluster) Dial() (redis.Conn, error) {
+	if err := c.ensureMapped(); err != nil {
+		return nil, err
+	}
+	return &clusterConn{cluster: c}, nil
+}
+
+// Close releases the resources used by the cluster.
+func (c *Cluster) Close() error {
+	c.mu.Lock()
+	pools := c.pools
+	c.pools = nil
+	c.closed = true
+	c.mu.Unlock()
+
+	var err error
+	for _, p := range pools {
+		if e := p.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// ensureMapped loads the mapping of hash slots if it was never loaded.
+func (c *Cluster) ensureMapped() error {
+	c.mu.Lock()
+	mapped := c.mapped
+	c.mu.Unlock()
+	if mapped {
+		return nil
+	}
+	return c.Refresh()
+}
+
+// addrForSlot returns the address of the node that serves slot, or
+// the address of any known node if slot is < 0 or is not mapped.
+func (c *Cluster) addrForSlot(slot int) (string, error) {
+	if err := c.ensureMapped(); err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if slot >= 0 && c.slots[slot] != "" {
+		return c.slots[slot], nil
+	}
+	if len(c.StartupNodes) == 0 {
+		return "", errors.New("redisbroker: no cluster node available")
+	}
+	return c.StartupNodes[rand.Intn(len(c.StartupNodes))], nil
+}
+
+// moved records that slot is now served by the node at addr, and
+// starts a refresh of the mapping of hash slots in the background.
+func (c *Cluster) moved(slot int, addr string) {
+	c.mu.Lock()
+	c.slots[slot] = addr
+	refresh := !c.refreshing
+	c.refreshing = true
+	c.mu.Unlock()
+
+	if refresh {
+		go func() {
+			c.Refresh()
+			c.mu.Lock()
+			c.refreshing = false
+			c.mu.Unlock()
+		}()
+	}
+}
+
+// getConn returns a connection to the node at addr, from the node's
+// pool if pooled is true.
+func (c *Cluster) getConn(addr string, pooled bool) (redis.Conn, error) {
+	if !pooled {
+		return c.dialNode(addr, false)
+	}
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, ErrClusterClosed
+	}
+	p := c.pools[addr]
+	if p == nil {
+		p = &redis.Pool{
+			MaxIdle:     c.MaxIdle,
+			MaxActive:   c.MaxActive,
+			IdleTimeout: c.IdleTimeout,
+			Dial: func() (redis.Conn, error) {
+				return c.dialNode(addr, true)
+			},
+		}
+		if c.pools == nil {
+			c.pools = make(map[string]*redis.Pool)
+		}
+		c.pools[addr] = p
+	}
+	c.mu.Unlock()
+
+	rc := p.Get()
+	if err := rc.Err(); err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return rc, nil
+}
+
+// dialNode connects to the node at addr. The read timeout is set only
+// if readTimeout is true.
+func (c *Cluster) dialNode(addr string, readTimeout bool) (redis.Conn, error) {
+	if c.DialNode != nil {
+		return c.DialNode(addr)
+	}
+	read := time.Duration(0)
+	if readTimeout {
+		read = nodeTimeout(c.ReadTimeout)
+	}
+	return dialTCP(addr, nodeTimeout(c.ConnectTimeout), read, nodeTimeout(c.WriteTimeout))
+}
+
+// dialTCP connects to the redis server at addr with the specified
+// timeouts, a timeout of 0 meaning no timeout.
+func dialTCP(addr string, connect, read, write time.Duration) (redis.Conn, error) {
+	return redis.Dial("tcp", addr,
+		redis.DialConnectTimeout(connect),
+		redis.DialReadTimeout(read),
+		redis.DialWriteTimeout(write))
+}
+
+// nodeTimeout returns d, or DefaultNodeTimeout if d is 0.
+func nodeTimeout(d time.Duration) time.Duration {
+	if d > 0 {
+		return d
+	}
+	return DefaultNodeTimeout
+}
+
+// clusterConn is a connection to a redis cluster, bound to a node on
+// its first command.
+type clusterConn struct {
+	cluster *Cluster
+	pooled  bool
+
+	// mu protects the following fields.
+	mu     sync.Mutex
+	rc     redis.Conn
+	err    error
+	closed bool
+}
+
+// bind returns the connection to the node that serves slot, binding
+// the connection to that node if it is not bound yet.
+func (c *clusterConn) bind(slot int) (redis.Conn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil, ErrClusterClosed
+	}
+	if c.rc != nil {
+		return c.rc, nil
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	addr, err := c.cluster.addrForSlot(slot)
+	if err == nil {
+		c.rc, err = c.cluster.getConn(addr, c.pooled)
+	}
+	c.err = err
+	return c.rc, err
+}
+
+// rebind binds the connection to the node at addr, closing the
+// connection to the previous node.
+func (c *clusterConn) rebind(addr string) (redis.Conn, error) {
+	rc, err := c.cluster.getConn(addr, c.pooled)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		if rc != nil {
+			rc.Close()
+		}
+		return nil, ErrClusterClosed
+	}
+	if c.rc != nil {
+		c.rc.Close()
+	}
+	c.rc, c.err = rc, err
+	return rc, err
+}
+
+// Close closes the connection.
+func (c *clusterConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	if c.rc != nil {
+		return c.rc.Close()
+	}
+	return nil
+}
+
+// Err returns a non-nil value if the connection is not usable.
+func (c *clusterConn) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return ErrClusterClosed
+	}
+	if c.rc != nil {
+		return c.rc.Err()
+	}
+	return c.err
+}
+
+// Do sends the command to the node that serves the hash slot of its
+// key, following the MOVED and ASK redirections.
+func (c *clusterConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	slot := cmdSlot(cmd, args)
+	rc, err := c.bind(slot)
+	if err != nil {
+		return nil, err
+	}
+	if cmd == "" {
+		return rc.Do(cmd, args...)
+	}
+
+	for i := 0; ; i++ {
+		v, err := rc.Do(cmd, args...)
+		re := parseRedirect(err)
+		if re == nil || i >= maxRedirects {
+			return v, err
+		}
+
+		if re.ask {
+			// the slot is being migrated, send this command only to the
+			// target node.
+			return c.ask(re.addr, cmd, args)
+		}
+		c.cluster.moved(re.slot, re.addr)
+		if rc, err = c.rebind(re.addr); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// ask sends the command to the node at addr, preceded by ASKING.
+func (c *clusterConn) ask(addr, cmd string, args []interface{}) (interface{}, error) {
+	rc, err := c.cluster.getConn(addr, true)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	if _, err := rc.Do("ASKING"); err != nil {
+		return nil, err
+	}
+	return rc.Do(cmd, args...)
+}
+
+// Send writes the command to the output buffer of the connection to
+// the node that serves the hash slot of its key. Redirections are not
+// followed.
+func (c *clusterConn) Send(cmd string, args ...interface{}) error {
+	rc, err := c.bind(cmdSlot(cmd, args))
+	if err != nil {
+		return err
+	}
+	return rc.Send(cmd, args...)
+}
+
+// Flush flushes the output buffer.
+func (c *clusterConn) Flush() error {
+	rc, err := c.bind(-1)
+	if err != nil {
+		return err
+	}
+	return rc.Flush()
+}
+
+// Receive receives a single reply.
+func (c *clusterConn) Receive() (interface{}, error) {
+	rc, err := c.bind(-1)
+	if err != nil {
+		return nil, err
+	}
+	return rc.Receive()
+}
+
+// redirect is a MOVED or ASK redirection.
+type redirect struct {
+	ask  bool
+	slot int
+	addr string
+}
+
+// parseRedirect returns the redirection of the error reply err, or
+// nil if err is not a redirection.
+func parseRedirect(err error) *redirect {
+	re, ok := err.(redis.Error)
+	if !ok {
+		return nil
+	}
+
+	// "MOVED <slot> <addr>" or "ASK <slot> <addr>"
+	parts := strings.Fields(string(re))
+	if len(parts) != 3 || (parts[0] != "MOVED" && parts[0] != "ASK") {
+		return nil
+	}
+	slot, err := strconv.Atoi(parts[1])
+	if err != nil || slot < 0 || slot >= hashslot.NumSlots {
+		return nil
+	}
+	return &redirect{ask: parts[0] == "ASK", slot: slot, addr: parts[2]}
+}
+
+// cmdSlot returns the hash slot of the key of the command, or -1 if
+// the command has no key.
+func cmdSlot(cmd string, args []interface{}) int {
+	i := 0
+	switch strings.ToUpper(cmd) {
+	case "":
+		return -1
+	case "EVAL", "EVALSHA":
+		// script, number of keys, keys...
+		if len(args) < 3 {
+			return -1
+		}
+		if n, err := strconv.Atoi(fmt.Sprint(args[1])); err != nil || n <= 0 {
+			return -1
+		}
+		i = 2
+	case "XREAD", "XREADGROUP":
+		// options, STREAMS, keys..., IDs...
+		i = -1
+		for j, arg := range args {
+			if s, ok := arg.(string); ok && strings.EqualFold(s, "STREAMS") {
+				i = j + 1
+				break
+			}
+		}
+	case "XGROUP", "XINFO":
+		// subcommand, key
+		i = 1
+	}
+	if i < 0 || i >= len(args) {
+		return -1
+	}
+
+	switch key := args[i].(type) {
+	case string:
+		return hashslot.Slot(key)
+	case []byte:
+		return hashslot.Slot(string(key))
+	default:
+		return hashslot.Slot(fmt.Sprint(key))
+	}
+}
@@ -0,0 +1,195 @@
+package redisbroker
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/exp/juggler/internal/hashslot"
+	"github.com/garyburd/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeNode is a fake redis cluster node. All nodes report that the
+// slots from 0 to 8191 are on port 1, and the others on port 2.
+type fakeNode struct {
+	do func(cmd string, args []interface{}, asking bool) (interface{}, error)
+}
+
+type fakeNodeConn struct {
+	node   *fakeNode
+	asking bool
+}
+
+func (c *fakeNodeConn) Close() error                      { return nil }
+func (c *fakeNodeConn) Err() error                        { return nil }
+func (c *fakeNodeConn) Send(string, ...interface{}) error { return errors.New("not supported") }
+func (c *fakeNodeConn) Flush() error                      { return errors.New("not supported") }
+func (c *fakeNodeConn) Receive() (interface{}, error)     { return nil, errors.New("not supported") }
+func (c *fakeNodeConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	switch cmd {
+	case "":
+		return nil, nil
+	case "CLUSTER":
+		return []interface{}{
+			[]interface{}{int64(0), int64(8191), []interface{}{[]byte("127.0.0.1"), int64(1)}},
+			[]interface{}{int64(8192), int64(16383), []interface{}{[]byte("127.0.0.1"), int64(2)}},
+		}, nil
+	case "ASKING":
+		c.asking = true
+		return "OK", nil
+	}
+	asking := c.asking
+	c.asking = false
+	return c.node.do(cmd, args, asking)
+}
+
+func TestCluster(t *testing.T) {
+	// "foo" is in slot 12182 on node 2, but it moved to node 3
+	// "bar" is in slot 5061 on node 1, and it is being migrated to node 3
+	movedErr := redis.Error(fmt.Sprintf("MOVED %d 127.0.0.1:3", hashslot.Slot("foo")))
+	askErr := redis.Error(fmt.Sprintf("ASK %d 127.0.0.1:3", hashslot.Slot("bar")))
+	nodes := map[string]*fakeNode{
+		"127.0.0.1:1": {do: func(cmd string, args []interface{}, asking bool) (interface{}, error) {
+			if args[0] == "bar" {
+				return nil, askErr
+			}
+			return []byte("1"), nil
+		}},
+		"127.0.0.1:2": {do: func(cmd string, args []interface{}, asking bool) (interface{}, error) {
+			if args[0] == "foo" {
+				return nil, movedErr
+			}
+			return []byte("2"), nil
+		}},
+		"127.0.0.1:3": {do: func(cmd string, args []interface{}, asking bool) (interface{}, error) {
+			if args[0] == "bar" && !asking {
+				return nil, redis.Error(fmt.Sprintf("MOVED %d 127.0.0.1:1", hashslot.Slot("bar")))
+			}
+			return []byte("3"), nil
+		}},
+	}
+
+	c := &Cluster{
+		StartupNodes: []string{"127.0.0.1:1"},
+		DialNode: func(addr string) (redis.Conn, error) {
+			n := nodes[addr]
+			if n == nil {
+				return nil, fmt.Errorf("unknown node %s", addr)
+			}
+			return &fakeNodeConn{node: n}, nil
+		},
+	}
+	defer c.Close()
+	require.NoError(t, c.Refresh(), "Refresh")
+
+	cases := []struct {
+		key  string
+		want string
+	}{
+		{"a", "2"}, // slot 15495
+		{"b", "1"}, // slot 3300
+		{"foo", "3"},
+		{"bar", "3"},
+		{"{a}x", "2"},
+	}
+	for i, cs := range cases {
+		rc := c.Get()
+		v, err := redis.String(rc.Do("GET", cs.key))
+		require.NoError(t, err, "%d: GET %s", i, cs.key)
+		assert.Equal(t, cs.want, v, "%d: GET %s", i, cs.key)
+		require.NoError(t, rc.Close(), "%d: Close", i)
+	}
+
+	// EVAL routes on the first key
+	rc, err := c.Dial()
+	require.NoError(t, err, "Dial")
+	v, err := redis.String(rc.Do("EVAL", "script", 2, "b", "a"))
+	require.NoError(t, err, "EVAL")
+	assert.Equal(t, "1", v, "EVAL")
+	require.NoError(t, rc.Close(), "Close")
+	assert.Equal(t, ErrClusterClosed, rc.Err(), "Err after Close")
+
+	require.NoError(t, c.Close(), "Close cluster")
+	_, err = c.Get().Do("GET", "a")
+	assert.Equal(t, ErrClusterClosed, err, "GET after Close")
+}
+
+// silentServer returns a listener that accepts connections but never
+// replies.
+func silentServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "Listen")
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	return l
+}
+
+func TestClusterNodeTimeout(t *testing.T) {
+	l := silentServer(t)
+	defer l.Close()
+
+	c := &Cluster{StartupNodes: []string{l.Addr().String()}, ReadTimeout: 100 * time.Millisecond}
+	done := make(chan error, 1)
+	go func() { done <- c.Refresh() }()
+	select {
+	case err := <-done:
+		assert.Error(t, err, "Refresh")
+	case <-time.After(2 * time.Second):
+		assert.Fail(t, "Refresh did not time out")
+	}
+}
+
+func TestCmdSlot(t *testing.T) {
+	cases := []struct {
+		cmd  string
+		args []interface{}
+		key  string
+	}{
+		{"", nil, ""},
+		{"PING", nil, ""},
+		{"GET", []interface{}{"a"}, "a"},
+		{"BRPOP", []interface{}{"a", "b", 0}, "a"},
+		{"PUBLISH", []interface{}{[]byte("ch"), "x"}, "ch"},
+		{"EVAL", []interface{}{"script", 0}, ""},
+		{"EVAL", []interface{}{"script", 2, "k1", "k2", "arg"}, "k1"},
+		{"eval", []interface{}{"script", "1", "k1", "arg"}, "k1"},
+		{"XREADGROUP", []interface{}{"GROUP", "g", "c", "COUNT", 1, "STREAMS", "s1", "s2", ">", ">"}, "s1"},
+		{"XGROUP", []interface{}{"CREATE", "s", "g", "0"}, "s"},
+	}
+	for i, c := range cases {
+		want := -1
+		if c.key != "" {
+			want = hashslot.Slot(c.key)
+		}
+		assert.Equal(t, want, cmdSlot(c.cmd, c.args), "%d: %s", i, c.cmd)
+	}
+}
+
+func TestParseRedirect(t *testing.T) {
+	cases := []struct {
+		err  error
+		want *redirect
+	}{
+		{nil, nil},
+		{errors.New("MOVED 1 a:1"), nil},
+		{redis.Error("ERR x"), nil},
+		{redis.Error("MOVED x a:1"), nil},
+		{redis.Error("MOVED 16384 a:1"), nil},
+		{redis.Error("MOVED 1 a:1"), &redirect{slot: 1, addr: "a:1"}},
+		{redis.Error("ASK 123 a:2"), &redirect{ask: true, slot: 123, addr: "a:2"}},
+	}
+	for i, c := range cases {
+		assert.Equal(t, c.want, parseRedirect(c.err), "%d", i)
+	}
+}
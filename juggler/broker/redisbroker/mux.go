@@ -0,0 +1,685 @@
+package redisbroker
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/exp/juggler/broker"
+	"github.com/PuerkitoBio/exp/juggler/logger"
+	"github.com/PuerkitoBio/exp/juggler/msg"
+	"github.com/garyburd/redigo/redis"
+	"github.com/pborman/uuid"
+)
+
+var (
+	_ broker.PubSubConn  = (*muxPubSubConn)(nil)
+	_ broker.ResultsConn = (*muxResultsConn)(nil)
+)
+
+// ErrBufferFull is the error that causes the channel of a multiplexed
+// pub-sub connection to be closed when it is full, because its
+// consumer does not keep up.
+var ErrBufferFull = errors.New("redisbroker: multiplexed connection buffer full")
+
+// DefaultMuxBuffer is the default size of the buffer of the channel
+// of a multiplexed connection.
+const DefaultMuxBuffer = 64
+
+// wakeup list of a results multiplexing connection, pushed to when
+// the list of polled keys changes.
+const resWakeupKey = "juggler:results:wakeup:%s" // 1: mux connection UUID
+
+// Mux multiplexes the pub-sub and results connections of a Broker over
+// a fixed number of long-lived redis connections, instead of dialing
+// two redis connections for each juggler connection. Set it as the Mux
+// field of the Broker to use it. A Mux must be used by a single Broker.
+//
+// The subscriptions of the pub-sub connections are reference-counted,
+// so that the shared redis connection subscribes to a channel or
+// pattern once, and the events are dispatched in-process to the
+// subscribed connections. The results of the connections are polled
+// with a single BRPOP on the results lists of all connections, so it
+// cannot be used with a Cluster.
+//
+// The events or results received for a connection are buffered in
+// its channel. If the buffer of a pub-sub connection is full when an
+// event is received for it, its channel is closed with ErrBufferFull,
+// so that a slow consumer never blocks the dispatch of the events to
+// the others, and Buffer should be large enough to absorb the bursts
+// of events. The results of a
+// connection whose buffer is full are not polled until its consumer
+// catches up, so they stay in redis until they expire.
+type Mux struct {
+	// Conns is the number of redis connections to use for pub-sub,
+	// and the same number is used for results. The channels and
+	// patterns are distributed over the connections based on their
+	// name, and the results based on the connection UUID. If <= 0,
+	// a single connection is used.
+	Conns int
+
+	// Buffer is the size of the buffer of the channel of each
+	// multiplexed connection. If <= 0, DefaultMuxBuffer is used.
+	Buffer int
+
+	// mu protects the following fields.
+	mu      sync.Mutex
+	pubsubs []*muxPubSub
+	results []*muxResults
+	closed  bool
+}
+
+// Close closes the shared redis connections. The multiplexed
+// connections fail with the resulting error.
+func (m *Mux) Close() error {
+	m.mu.Lock()
+	pubsubs, results := m.pubsubs, m.results
+	m.pubsubs, m.results = nil, nil
+	m.closed = true
+	m.mu.Unlock()
+
+	var err error
+	for _, ps := range pubsubs {
+		if ps == nil {
+			continue
+		}
+		if e := ps.psc.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	for _, rs := range results {
+		if rs == nil {
+			continue
+		}
+		if e := rs.c.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (m *Mux) conns() int {
+	if m.Conns > 0 {
+		return m.Conns
+	}
+	return 1
+}
+
+func (m *Mux) buffer() int {
+	if m.Buffer > 0 {
+		return m.Buffer
+	}
+	return DefaultMuxBuffer
+}
+
+// shard returns the index of the shared connection for key.
+func (m *Mux) shard(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(m.conns()))
+}
+
+// pubSub returns the shared pub-sub connection for the subscription
+// s, dialing it with b if it doesn't exist or if it failed.
+func (m *Mux) pubSub(b *Broker, s muxSub) (*muxPubSub, error) {
+	i := m.shard(s.name)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return nil, errConnClosed
+	}
+	if m.pubsubs == nil {
+		m.pubsubs = make([]*muxPubSub, m.conns())
+	}
+	if ps := m.pubsubs[i]; ps != nil && ps.Err() == nil {
+		return ps, nil
+	}
+
+	rc, err := b.dial()
+	if err != nil {
+		return nil, err
+	}
+	ps := &muxPubSub{
+		psc:    redis.PubSubConn{Conn: rc},
+		logger: b.logger(),
+		subs:   make(map[muxSub]map[*muxPubSubConn]bool),
+	}
+	go ps.receive()
+	m.pubsubs[i] = ps
+	return ps, nil
+}
+
+// resultsFor returns the shared results connection for connUUID,
+// dialing it with b if it doesn't exist or if it failed.
+func (m *Mux) resultsFor(b *Broker, connUUID uuid.UUID) (*muxResults, error) {
+	i := m.shard(connUUID.String())
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return nil, errConnClosed
+	}
+	if m.results == nil {
+		m.results = make([]*muxResults, m.conns())
+	}
+	if rs := m.results[i]; rs != nil && rs.Err() == nil {
+		return rs, nil
+	}
+
+	rc, err := b.dial()
+	if err != nil {
+		return nil, err
+	}
+	rs := &muxResults{
+		c:       rc,
+		pool:    b.Pool,
+		wakeKey: fmt.Sprintf(resWakeupKey, uuid.NewRandom()),
+		timeout: b.BlockingTimeout,
+		logger:  b.logger(),
+		conns:   make(map[string]*muxResultsConn),
+	}
+	go rs.poll()
+	m.results[i] = rs
+	return rs, nil
+}
+
+// pubSubConn returns a new multiplexed pub-sub connection.
+func (m *Mux) pubSubConn(b *Broker) *muxPubSubConn {
+	return &muxPubSubConn{
+		mux:  m,
+		b:    b,
+		ch:   make(chan *msg.EvntPayload, m.buffer()),
+		subs: make(map[muxSub]*muxPubSub),
+	}
+}
+
+// resultsConn returns a new multiplexed results connection for
+// connUUID.
+func (m *Mux) resultsConn(b *Broker, connUUID uuid.UUID) (*muxResultsConn, error) {
+	rs, err := m.resultsFor(b, connUUID)
+	if err != nil {
+		return nil, err
+	}
+	c := &muxResultsConn{
+		rs:   rs,
+		key:  fmt.Sprintf(resKey, connUUID),
+		ch:   make(chan *msg.ResPayload, m.buffer()),
+		size: m.buffer(),
+	}
+	if err := rs.register(c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// muxSub is a channel or pattern subscription.
+type muxSub struct {
+	name    string
+	pattern bool
+}
+
+// muxPubSub is a shared pub-sub connection.
+type muxPubSub struct {
+	psc    redis.PubSubConn
+	logger logger.Logger
+
+	// mu protects the following fields and the writes to psc.
+	mu   sync.Mutex
+	subs map[muxSub]map[*muxPubSubConn]bool
+	err  error
+}
+
+// Err returns the error that caused the connection to fail.
+func (ps *muxPubSub) Err() error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.err
+}
+
+// subscribe adds c to the subscribers of s, subscribing the redis
+// connection if c is the first one.
+func (ps *muxPubSub) subscribe(s muxSub, c *muxPubSubConn) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if ps.err != nil {
+		return ps.err
+	}
+	conns := ps.subs[s]
+	if len(conns) == 0 {
+		var err error
+		if s.pattern {
+			err = ps.psc.PSubscribe(s.name)
+		} else {
+			err = ps.psc.Subscribe(s.name)
+		}
+		if err != nil {
+			return err
+		}
+		conns = make(map[*muxPubSubConn]bool)
+		ps.subs[s] = conns
+	}
+	conns[c] = true
+	return nil
+}
+
+// unsubscribe removes c from the subscribers of s, unsubscribing the
+// redis connection if c was the last one.
+func (ps *muxPubSub) unsubscribe(s muxSub, c *muxPubSubConn) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if ps.err != nil {
+		return nil
+	}
+	conns := ps.subs[s]
+	if !conns[c] {
+		return nil
+	}
+	delete(conns, c)
+	if len(conns) > 0 {
+		return nil
+	}
+	delete(ps.subs, s)
+	if s.pattern {
+		return ps.psc.PUnsubscribe(s.name)
+	}
+	return ps.psc.Unsubscribe(s.name)
+}
+
+// receive dispatches the events received on the connection to the
+// subscribed connections, until the connection fails.
+func (ps *muxPubSub) receive() {
+	for {
+		switch v := ps.psc.Receive().(type) {
+		case redis.Message:
+			ps.dispatch(muxSub{name: v.Channel}, v.Channel, "", v.Data)
+
+		case redis.PMessage:
+			ps.dispatch(muxSub{name: v.Pattern, pattern: true}, v.Channel, v.Pattern, v.Data)
+
+		case error:
+			ps.fail(v)
+			return
+		}
+	}
+}
+
+// dispatch sends the event to the subscribers of s. The same payload
+// is sent to all subscribers.
+func (ps *muxPubSub) dispatch(s muxSub, channel, pattern string, data []byte) {
+	ps.mu.Lock()
+	conns := make([]*muxPubSubConn, 0, len(ps.subs[s]))
+	for c := range ps.subs[s] {
+		conns = append(conns, c)
+	}
+	ps.mu.Unlock()
+
+	if len(conns) == 0 {
+		return
+	}
+	ep, err := newEvntPayload(channel, pattern, data)
+	if err != nil {
+		ps.logger.Log(logger.Error, "Events: failed to unmarshal event payload", logger.Channel(channel), logger.F("pattern", pattern), logger.Err(err))
+		return
+	}
+	for _, c := range conns {
+		c.deliver(ep)
+	}
+}
+
+// fail marks the connection as failed and closes all subscribed
+// connections with err.
+func (ps *muxPubSub) fail(err error) {
+	ps.mu.Lock()
+	ps.err = err
+	conns := make(map[*muxPubSubConn]bool)
+	for _, cs := range ps.subs {
+		for c := range cs {
+			conns[c] = true
+		}
+	}
+	ps.subs = nil
+	ps.mu.Unlock()
+	ps.psc.Close()
+
+	for c := range conns {
+		c.fail(err)
+	}
+}
+
+// muxPubSubConn is a pub-sub connection multiplexed over the shared
+// connections of a Mux.
+type muxPubSubConn struct {
+	mux *Mux
+	b   *Broker
+	ch  chan *msg.EvntPayload
+
+	// mu protects the following fields and the sends on ch.
+	mu     sync.Mutex
+	subs   map[muxSub]*muxPubSub
+	closed bool
+	err    error
+}
+
+// Subscribe subscribes the connection to the channel, which may be a
+// pattern.
+func (c *muxPubSubConn) Subscribe(channel string, pattern bool) error {
+	s := muxSub{name: channel, pattern: pattern}
+	ps, err := c.mux.pubSub(c.b, s)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return errConnClosed
+	}
+	if c.subs[s] != nil {
+		return nil
+	}
+	if err := ps.subscribe(s, c); err != nil {
+		return err
+	}
+	c.subs[s] = ps
+	return nil
+}
+
+// Unsubscribe unsubscribes the connection from the channel, which may
+// be a pattern.
+func (c *muxPubSubConn) Unsubscribe(channel string, pattern bool) error {
+	s := muxSub{name: channel, pattern: pattern}
+
+	c.mu.Lock()
+	ps := c.subs[s]
+	delete(c.subs, s)
+	c.mu.Unlock()
+
+	if ps == nil {
+		return nil
+	}
+	return ps.unsubscribe(s, c)
+}
+
+// Events returns the stream of events from channels that the
+// connection is subscribed to.
+func (c *muxPubSubConn) Events() <-chan *msg.EvntPayload {
+	return c.ch
+}
+
+// EventsErr returns the error that caused the events channel to close.
+func (c *muxPubSubConn) EventsErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Close closes the connection and removes its subscriptions.
+func (c *muxPubSubConn) Close() error {
+	c.fail(errConnClosed)
+	return nil
+}
+
+// deliver sends ep on the channel of the connection, failing it if
+// the channel is full. It never blocks, so that a slow consumer does
+// not delay the events of the other connections.
+func (c *muxPubSubConn) deliver(ep *msg.EvntPayload) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	select {
+	case c.ch <- ep:
+		c.mu.Unlock()
+	default:
+		c.mu.Unlock()
+		c.fail(ErrBufferFull)
+	}
+}
+
+// fail closes the channel of the connection with err, and removes its
+// subscriptions.
+func (c *muxPubSubConn) fail(err error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.closed = true
+	c.err = err
+	close(c.ch)
+	subs := c.subs
+	c.subs = nil
+	c.mu.Unlock()
+
+	for s, ps := range subs {
+		ps.unsubscribe(s, c)
+	}
+}
+
+// muxResults is a shared results connection.
+type muxResults struct {
+	c       redis.Conn
+	pool    Pool
+	wakeKey string
+	timeout time.Duration
+	logger  logger.Logger
+
+	// mu protects the following fields.
+	mu    sync.Mutex
+	conns map[string]*muxResultsConn // by results key
+	err   error
+}
+
+// Err returns the error that caused the connection to fail.
+func (rs *muxResults) Err() error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return rs.err
+}
+
+// register adds c to the polled connections, and wakes up the polling
+// BRPOP so that it polls the results of c.
+func (rs *muxResults) register(c *muxResultsConn) error {
+	rs.mu.Lock()
+	if rs.err != nil {
+		rs.mu.Unlock()
+		return rs.err
+	}
+	rs.conns[c.key] = c
+	rs.mu.Unlock()
+
+	rc := rs.pool.Get()
+	defer rc.Close()
+
+	if err := rc.Send("LPUSH", rs.wakeKey, 1); err != nil {
+		rs.unregister(c)
+		return err
+	}
+	if _, err := rc.Do("PEXPIRE", rs.wakeKey, wakeupTTL(rs.timeout)); err != nil {
+		rs.unregister(c)
+		return err
+	}
+	return nil
+}
+
+// fullPollTimeout is the BRPOP timeout in seconds of a shared results
+// connection when a connection is not polled because its channel is
+// full.
+const fullPollTimeout = 1
+
+// wakeupTTL returns the TTL in milliseconds of the wakeup list, so
+// that it is deleted if it is not consumed.
+func wakeupTTL(timeout time.Duration) int {
+	return int((timeout + time.Minute) / time.Millisecond)
+}
+
+// unregister removes c from the polled connections.
+func (rs *muxResults) unregister(c *muxResultsConn) {
+	rs.mu.Lock()
+	if rs.conns[c.key] == c {
+		delete(rs.conns, c.key)
+	}
+	rs.mu.Unlock()
+}
+
+// poll pops the results of the registered connections and sends them
+// to the connection, until the connection fails. The connections whose
+// channel is full are not polled, so that their results stay in redis
+// until their consumer catches up.
+func (rs *muxResults) poll() {
+	for {
+		// the order of the keys is random, so that a connection that
+		// receives many results doesn't starve the others.
+		var full bool
+		rs.mu.Lock()
+		args := make(redis.Args, 0, len(rs.conns)+2)
+		for k, c := range rs.conns {
+			if c.full() {
+				full = true
+				continue
+			}
+			args = append(args, k)
+		}
+		rs.mu.Unlock()
+
+		// poll again soon if a connection is full, to check if it has
+		// room for its results.
+		to := int(rs.timeout / time.Second)
+		if full && (to <= 0 || to > fullPollTimeout) {
+			to = fullPollTimeout
+		}
+		args = args.Add(rs.wakeKey, to)
+
+		// BRPOP returns array with [0]: key name, [1]: payload.
+		v, err := redis.Values(rs.c.Do("BRPOP", args...))
+		if err != nil {
+			if err == redis.ErrNil {
+				// no available value
+				continue
+			}
+			rs.fail(err)
+			return
+		}
+
+		key, _ := redis.String(v[0], nil)
+		if key == rs.wakeKey {
+			continue
+		}
+
+		// unmarshal the payload
+		var rp msg.ResPayload
+		if err := unmarshalBRPOPValue(&rp, v); err != nil {
+			rs.logger.Log(logger.Error, "Results: BRPOP failed to unmarshal result payload", logger.F("key", key), logger.Err(err))
+			continue
+		}
+
+		// check if call is expired
+		k := resultTimeoutKey(&rp)
+		pttl, err := redis.Int(rs.c.Do("EVAL", delAndPTTLScript, 1, k))
+		if err != nil {
+			rs.logger.Log(logger.Error, "Results: DEL/PTTL failed", logger.Conn(rp.ConnUUID), logger.Msg(rp.MsgUUID), logger.URI(rp.URI), logger.Err(err))
+			continue
+		}
+		if pttl <= 0 {
+			rs.logger.Log(logger.Warn, "Results: message expired, dropping call", logger.Conn(rp.ConnUUID), logger.Msg(rp.MsgUUID), logger.URI(rp.URI))
+			continue
+		}
+
+		rs.mu.Lock()
+		c := rs.conns[key]
+		rs.mu.Unlock()
+		if c == nil {
+			rs.logger.Log(logger.Warn, "Results: connection closed, dropping result", logger.Conn(rp.ConnUUID), logger.Msg(rp.MsgUUID), logger.URI(rp.URI))
+			continue
+		}
+		c.deliver(&rp)
+	}
+}
+
+// fail marks the connection as failed and closes all registered
+// connections with err.
+func (rs *muxResults) fail(err error) {
+	rs.mu.Lock()
+	rs.err = err
+	conns := rs.conns
+	rs.conns = nil
+	rs.mu.Unlock()
+	rs.c.Close()
+
+	for _, c := range conns {
+		c.fail(err)
+	}
+}
+
+// muxResultsConn is a results connection multiplexed over the shared
+// connections of a Mux.
+type muxResultsConn struct {
+	rs   *muxResults
+	key  string
+	ch   chan *msg.ResPayload
+	size int // the size of the buffer of ch
+
+	// mu protects the following fields and the sends on ch.
+	mu     sync.Mutex
+	closed bool
+	err    error
+}
+
+// Results returns the stream of call results for the connection.
+func (c *muxResultsConn) Results() <-chan *msg.ResPayload {
+	return c.ch
+}
+
+// ResultsErr returns the error that caused the Results channel to close.
+func (c *muxResultsConn) ResultsErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Close closes the connection.
+func (c *muxResultsConn) Close() error {
+	c.fail(errConnClosed)
+	return nil
+}
+
+// full returns true if the channel of the connection is full.
+func (c *muxResultsConn) full() bool {
+	return len(c.ch) >= c.size
+}
+
+// deliver sends rp on the channel of the connection. The results of
+// a connection are only polled when its channel is not full, and the
+// polling goroutine is the only sender, so it does not block.
+func (c *muxResultsConn) deliver(rp *msg.ResPayload) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	c.ch <- rp
+}
+
+// fail closes the channel of the connection with err, and stops
+// polling its results.
+func (c *muxResultsConn) fail(err error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.closed = true
+	c.err = err
+	close(c.ch)
+	c.mu.Unlock()
+
+	c.rs.unregister(c)
+}
@@ -0,0 +1,372 @@
+package redisbroker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/exp/juggler/internal/redistest"
+	"github.com/PuerkitoBio/exp/juggler/logger"
+	"github.com/PuerkitoBio/exp/juggler/msg"
+	"github.com/garyburd/redigo/redis"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recvEvent returns the next event of ch, or nil if the channel is
+// closed, and fails if there is no event.
+func recvEvent(t *testing.T, ch <-chan *msg.EvntPayload) *msg.EvntPayload {
+	select {
+	case ep := <-ch:
+		return ep
+	case <-time.After(time.Second):
+		require.FailNow(t, "no event received")
+	}
+	return nil
+}
+
+func TestMuxPubSub(t *testing.T) {
+	f := &fakeSentinel{master: "127.0.0.1:1"}
+	brk := &Broker{
+		Dial:   func() (redis.Conn, error) { return f.dial("127.0.0.1:1") },
+		Mux:    &Mux{Buffer: 2},
+		Logger: logger.Discard,
+	}
+	defer brk.Mux.Close()
+
+	c1, err := brk.PubSub()
+	require.NoError(t, err, "PubSub 1")
+	c2, err := brk.PubSub()
+	require.NoError(t, err, "PubSub 2")
+
+	require.NoError(t, c1.Subscribe("a", false), "c1 Subscribe a")
+	require.NoError(t, c2.Subscribe("a", false), "c2 Subscribe a")
+	require.NoError(t, c2.Subscribe("b*", true), "c2 PSubscribe b*")
+
+	f.mu.Lock()
+	n := len(f.conns["127.0.0.1:1"])
+	f.mu.Unlock()
+	require.Equal(t, 1, n, "single redis connection")
+	rc := f.lastConn("127.0.0.1:1")
+	assert.Equal(t, []string{"SUBSCRIBE a", "PSUBSCRIBE b*"}, rc.sentCmds(), "subscribed once")
+
+	pld, err := json.Marshal(&msg.PubPayload{MsgUUID: uuid.NewRandom(), Args: json.RawMessage("1")})
+	require.NoError(t, err, "Marshal")
+
+	rc.recv <- []interface{}{[]byte("message"), []byte("a"), pld}
+	assert.Equal(t, "a", recvEvent(t, c1.Events()).Channel, "c1 event a")
+	assert.Equal(t, "a", recvEvent(t, c2.Events()).Channel, "c2 event a")
+
+	rc.recv <- []interface{}{[]byte("pmessage"), []byte("b*"), []byte("bc"), pld}
+	assert.Equal(t, "bc", recvEvent(t, c2.Events()).Channel, "c2 event bc")
+
+	// the redis connection unsubscribes when the last subscriber does
+	require.NoError(t, c1.Unsubscribe("a", false), "c1 Unsubscribe a")
+	assert.Equal(t, 2, len(rc.sentCmds()), "still subscribed to a")
+	require.NoError(t, c2.Close(), "c2 Close")
+	if cmds := rc.sentCmds(); assert.Equal(t, 4, len(cmds), "unsubscribed") {
+		assert.ElementsMatch(t, []string{"UNSUBSCRIBE a", "PUNSUBSCRIBE b*"}, cmds[2:], "unsubscribed")
+	}
+	_, ok := <-c2.Events()
+	assert.False(t, ok, "c2 events closed")
+
+	// a consumer that does not overflow its buffer is not failed
+	require.NoError(t, c1.Subscribe("z", false), "c1 Subscribe z")
+	for i := 0; i < 2; i++ {
+		rc.recv <- []interface{}{[]byte("message"), []byte("z"), pld}
+	}
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, "z", recvEvent(t, c1.Events()).Channel, "c1 event z %d", i)
+	}
+	assert.Nil(t, c1.EventsErr(), "c1 not failed")
+
+	// a slow consumer fails without blocking the others
+	require.NoError(t, c1.Subscribe("x", false), "c1 Subscribe x")
+	c3, err := brk.PubSub()
+	require.NoError(t, err, "PubSub 3")
+	require.NoError(t, c3.Subscribe("x", false), "c3 Subscribe x")
+	for i := 0; i < 3; i++ {
+		rc.recv <- []interface{}{[]byte("message"), []byte("x"), pld}
+		assert.Equal(t, "x", recvEvent(t, c1.Events()).Channel, "c1 event x %d", i)
+	}
+	// the events are dispatched in order, so once c1 receives y, c3
+	// received all x events.
+	require.NoError(t, c1.Subscribe("y", false), "c1 Subscribe y")
+	rc.recv <- []interface{}{[]byte("message"), []byte("y"), pld}
+	assert.Equal(t, "y", recvEvent(t, c1.Events()).Channel, "c1 event y")
+	for i := 0; i < 3; i++ {
+		if ep := recvEvent(t, c3.Events()); ep == nil {
+			assert.Equal(t, 2, i, "c3 received the buffered events")
+			break
+		}
+	}
+	assert.Equal(t, ErrBufferFull, c3.EventsErr(), "c3 buffer full")
+
+	// the failure of the redis connection closes the connections
+	close(rc.recv)
+	_, ok = <-c1.Events()
+	assert.False(t, ok, "c1 events closed")
+	assert.Error(t, c1.EventsErr(), "c1 events error")
+}
+
+func TestMuxPubSubSlowConsumer(t *testing.T) {
+	f := &fakeSentinel{master: "127.0.0.1:1"}
+	brk := &Broker{
+		Dial:   func() (redis.Conn, error) { return f.dial("127.0.0.1:1") },
+		Mux:    &Mux{Buffer: 1},
+		Logger: logger.Discard,
+	}
+	defer brk.Mux.Close()
+
+	// both connections share the single redis connection
+	fast, err := brk.PubSub()
+	require.NoError(t, err, "PubSub fast")
+	slow, err := brk.PubSub()
+	require.NoError(t, err, "PubSub slow")
+	require.NoError(t, fast.Subscribe("a", false), "fast Subscribe a")
+	require.NoError(t, slow.Subscribe("a", false), "slow Subscribe a")
+	rc := f.lastConn("127.0.0.1:1")
+
+	pld, err := json.Marshal(&msg.PubPayload{MsgUUID: uuid.NewRandom(), Args: json.RawMessage("1")})
+	require.NoError(t, err, "Marshal")
+
+	// slow never reads its events, fast gets each event right away
+	for i := 0; i < 10; i++ {
+		rc.recv <- []interface{}{[]byte("message"), []byte("a"), pld}
+		select {
+		case ep := <-fast.Events():
+			require.NotNil(t, ep, "fast event %d", i)
+		case <-time.After(50 * time.Millisecond):
+			require.FailNow(t, "fast event delayed", "event %d", i)
+		}
+	}
+
+	// slow received the buffered event and failed
+	assert.NotNil(t, recvEvent(t, slow.Events()), "slow buffered event")
+	assert.Nil(t, recvEvent(t, slow.Events()), "slow events closed")
+	assert.Equal(t, ErrBufferFull, slow.EventsErr(), "slow buffer full")
+	assert.Nil(t, fast.EventsErr(), "fast not failed")
+}
+
+func TestMuxResults(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil)
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	brk := &Broker{
+		Pool:            pool,
+		Dial:            pool.Dial,
+		BlockingTimeout: time.Second,
+		LogFunc:         logIfVerbose,
+		Mux:             &Mux{Conns: 2},
+	}
+	defer brk.Mux.Close()
+
+	conns := make([]uuid.UUID, 5)
+	rcs := make([]interface {
+		Results() <-chan *msg.ResPayload
+	}, len(conns))
+	for i := range conns {
+		conns[i] = uuid.NewRandom()
+		rc, err := brk.Results(conns[i])
+		require.NoError(t, err, "Results %d", i)
+		defer rc.Close()
+		rcs[i] = rc
+	}
+
+	for i, connUUID := range conns {
+		rp := &msg.ResPayload{ConnUUID: connUUID, MsgUUID: uuid.NewRandom(), URI: "a"}
+		require.NoError(t, brk.Result(rp, time.Minute), "Result %d", i)
+
+		select {
+		case got := <-rcs[i].Results():
+			assert.Equal(t, rp.MsgUUID, got.MsgUUID, "%d: result", i)
+		case <-time.After(time.Second):
+			require.FailNow(t, "no result received", "%d", i)
+		}
+	}
+
+	// a connection created after the BRPOP started is polled
+	connUUID := uuid.NewRandom()
+	rc, err := brk.Results(connUUID)
+	require.NoError(t, err, "Results")
+	rp := &msg.ResPayload{ConnUUID: connUUID, MsgUUID: uuid.NewRandom(), URI: "a"}
+	require.NoError(t, brk.Result(rp, time.Minute), "Result")
+	select {
+	case got := <-rc.Results():
+		assert.Equal(t, rp.MsgUUID, got.MsgUUID, "result of new connection")
+	case <-time.After(500 * time.Millisecond):
+		require.FailNow(t, "no result received for new connection")
+	}
+	require.NoError(t, rc.Close(), "Close")
+	assert.Equal(t, errConnClosed, rc.ResultsErr(), "ResultsErr")
+}
+
+// fakeLists is a fake redis server that supports the list commands
+// used by the multiplexed results connections.
+type fakeLists struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	lists  map[string][][]byte
+	closed bool
+}
+
+func newFakeLists() *fakeLists {
+	f := &fakeLists{lists: make(map[string][][]byte)}
+	f.cond = sync.NewCond(&f.mu)
+	return f
+}
+
+func (f *fakeLists) Get() redis.Conn { return &fakeListsConn{f} }
+
+func (f *fakeLists) Dial() (redis.Conn, error) { return &fakeListsConn{f}, nil }
+
+func (f *fakeLists) Close() error {
+	f.mu.Lock()
+	f.closed = true
+	f.cond.Broadcast()
+	f.mu.Unlock()
+	return nil
+}
+
+func (f *fakeLists) len(key string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.lists[key])
+}
+
+func (f *fakeLists) push(key string, v []byte) {
+	f.mu.Lock()
+	f.lists[key] = append(f.lists[key], v)
+	f.cond.Broadcast()
+	f.mu.Unlock()
+}
+
+type fakeListsConn struct {
+	f *fakeLists
+}
+
+func (c *fakeListsConn) Close() error                  { return nil }
+func (c *fakeListsConn) Err() error                    { return nil }
+func (c *fakeListsConn) Flush() error                  { return nil }
+func (c *fakeListsConn) Receive() (interface{}, error) { return nil, errors.New("not supported") }
+
+func (c *fakeListsConn) Send(cmd string, args ...interface{}) error {
+	_, err := c.Do(cmd, args...)
+	return err
+}
+
+func (c *fakeListsConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	switch cmd {
+	case "", "PEXPIRE":
+		return nil, nil
+	case "EVAL":
+		return int64(1000), nil
+	case "LPUSH":
+		c.f.push(args[0].(string), []byte("1"))
+		return int64(1), nil
+	case "BRPOP":
+		f := c.f
+		var deadline time.Time
+		if to := args[len(args)-1].(int); to > 0 {
+			d := time.Duration(to) * time.Second
+			deadline = time.Now().Add(d)
+			t := time.AfterFunc(d, func() {
+				f.mu.Lock()
+				f.cond.Broadcast()
+				f.mu.Unlock()
+			})
+			defer t.Stop()
+		}
+
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		for !f.closed {
+			for _, arg := range args[:len(args)-1] {
+				k := arg.(string)
+				if l := f.lists[k]; len(l) > 0 {
+					f.lists[k] = l[1:]
+					return []interface{}{[]byte(k), l[0]}, nil
+				}
+			}
+			if !deadline.IsZero() && !time.Now().Before(deadline) {
+				return nil, redis.ErrNil
+			}
+			f.cond.Wait()
+		}
+		return nil, errConnClosed
+	}
+	return nil, errors.New("not supported")
+}
+
+func TestMuxResultsFake(t *testing.T) {
+	f := newFakeLists()
+	brk := &Broker{Pool: f, Dial: f.Dial, Mux: &Mux{Conns: 2, Buffer: 2}, Logger: logger.Discard}
+	defer brk.Mux.Close()
+
+	conns := make([]uuid.UUID, 5)
+	var rcs []<-chan *msg.ResPayload
+	for i := range conns {
+		conns[i] = uuid.NewRandom()
+		rc, err := brk.Results(conns[i])
+		require.NoError(t, err, "Results %d", i)
+		defer rc.Close()
+		rcs = append(rcs, rc.Results())
+	}
+
+	for i, connUUID := range conns {
+		rp := &msg.ResPayload{ConnUUID: connUUID, MsgUUID: uuid.NewRandom(), URI: "a"}
+		b, err := json.Marshal(rp)
+		require.NoError(t, err, "Marshal")
+		f.push(fmt.Sprintf(resKey, connUUID), b)
+
+		select {
+		case got := <-rcs[i]:
+			assert.Equal(t, rp.MsgUUID, got.MsgUUID, "%d: result", i)
+		case <-time.After(time.Second):
+			require.FailNow(t, "no result received", "%d", i)
+		}
+	}
+
+	// the results of a connection with a full buffer stay in redis
+	// until it catches up
+	connUUID := uuid.NewRandom()
+	rc, err := brk.Results(connUUID)
+	require.NoError(t, err, "Results")
+	defer rc.Close()
+	key := fmt.Sprintf(resKey, connUUID)
+	var want []uuid.UUID
+	for i := 0; i < 3; i++ {
+		rp := &msg.ResPayload{ConnUUID: connUUID, MsgUUID: uuid.NewRandom(), URI: "a"}
+		b, err := json.Marshal(rp)
+		require.NoError(t, err, "Marshal")
+		f.push(key, b)
+		want = append(want, rp.MsgUUID)
+	}
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 1, f.len(key), "result left in redis")
+	for i := 0; i < 3; i++ {
+		select {
+		case got := <-rc.Results():
+			assert.Equal(t, want[i], got.MsgUUID, "%d: result", i)
+		case <-time.After(2 * time.Second):
+			require.FailNow(t, "no result received", "%d", i)
+		}
+	}
+	assert.Nil(t, rc.ResultsErr(), "results not failed")
+
+	// closing the shared connections fails the multiplexed ones
+	require.NoError(t, f.Close(), "Close lists")
+	for i, ch := range rcs {
+		select {
+		case _, ok := <-ch:
+			assert.False(t, ok, "%d: results closed", i)
+		case <-time.After(time.Second):
+			require.FailNow(t, "results not closed", "%d", i)
+		}
+	}
+}
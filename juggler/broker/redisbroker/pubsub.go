@@ -5,6 +5,7 @@ import (
 	"sync"
 
 	"github.com/PuerkitoBio/exp/juggler/broker"
+	"github.com/PuerkitoBio/exp/juggler/logger"
 	"github.com/PuerkitoBio/exp/juggler/msg"
 	"github.com/garyburd/redigo/redis"
 )
@@ -12,8 +13,8 @@ import (
 var _ broker.PubSubConn = (*pubSubConn)(nil)
 
 type pubSubConn struct {
-	psc   redis.PubSubConn
-	logFn func(string, ...interface{})
+	psc    redis.PubSubConn
+	logger logger.Logger
 
 	// wmu controls writes (sub/unsub calls) to the connection.
 	wmu sync.Mutex
@@ -27,8 +28,8 @@ type pubSubConn struct {
 	err   error
 }
 
-func newPubSubConn(rc redis.Conn, logFn func(string, ...interface{})) *pubSubConn {
-	return &pubSubConn{psc: redis.PubSubConn{Conn: rc}, logFn: logFn}
+func newPubSubConn(rc redis.Conn, lg logger.Logger) *pubSubConn {
+	return &pubSubConn{psc: redis.PubSubConn{Conn: rc}, logger: lg}
 }
 
 // Close closes the connection.
@@ -81,7 +82,7 @@ func (c *pubSubConn) Events() <-chan *msg.EvntPayload {
 				case redis.Message:
 					ep, err := newEvntPayload(v.Channel, "", v.Data)
 					if err != nil {
-						logf(c.logFn, "Events: failed to unmarshal event payload: %v", err)
+						c.logger.Log(logger.Error, "Events: failed to unmarshal event payload", logger.Channel(v.Channel), logger.Err(err))
 						continue
 					}
 					c.evch <- ep
@@ -89,7 +90,7 @@ func (c *pubSubConn) Events() <-chan *msg.EvntPayload {
 				case redis.PMessage:
 					ep, err := newEvntPayload(v.Channel, v.Pattern, v.Data)
 					if err != nil {
-						logf(c.logFn, "Events: failed to unmarshal event payload: %v", err)
+						c.logger.Log(logger.Error, "Events: failed to unmarshal event payload", logger.Channel(v.Channel), logger.F("pattern", v.Pattern), logger.Err(err))
 						continue
 					}
 					c.evch <- ep
@@ -0,0 +1,435 @@
+package redisbroker
+
+import (
+	"errors"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/exp/juggler/logger"
+	"github.com/garyburd/redigo/redis"
+)
+
+var _ redis.Conn = (*redialConn)(nil)
+
+var errConnClosed = errors.New("redisbroker: connection closed")
+
+// Default values of the Backoff fields.
+const (
+	DefaultRedialMinDelay = 100 * time.Millisecond
+	DefaultRedialMaxDelay = 5 * time.Second
+)
+
+// Backoff configures the delay between the attempts to redial a
+// long-lived connection that failed. The first attempt is immediate,
+// then the delay starts at MinDelay and doubles on each attempt, up
+// to MaxDelay. A nil *Backoff uses the default values.
+type Backoff struct {
+	// MinDelay is the delay before the second attempt. If <= 0,
+	// DefaultRedialMinDelay is used.
+	MinDelay time.Duration
+
+	// MaxDelay is the maximum delay between attempts. If <= 0,
+	// DefaultRedialMaxDelay is used.
+	MaxDelay time.Duration
+
+	// MaxAttempts is the number of attempts after which the connection
+	// gives up and fails with the error that caused the redial. The
+	// default of 0 means no limit.
+	MaxAttempts int
+
+	// Jitter randomly shortens each delay by up to half of its value,
+	// so that the connections that failed together don't redial in
+	// lockstep.
+	Jitter bool
+}
+
+// Delay returns the delay before the redial attempt, starting at 0.
+func (b *Backoff) Delay(attempt int) time.Duration {
+	if attempt <= 0 {
+		return 0
+	}
+
+	min, max := DefaultRedialMinDelay, DefaultRedialMaxDelay
+	var jitter bool
+	if b != nil {
+		if b.MinDelay > 0 {
+			min = b.MinDelay
+		}
+		if b.MaxDelay > 0 {
+			max = b.MaxDelay
+		}
+		jitter = b.Jitter
+	}
+
+	d := max
+	if attempt-1 < 32 {
+		if v := min << uint(attempt-1); v > 0 && v < max {
+			d = v
+		}
+	}
+	if jitter && d > 1 {
+		d -= time.Duration(rand.Int63n(int64(d / 2)))
+	}
+	return d
+}
+
+func (b *Backoff) maxAttempts() int {
+	if b == nil {
+		return 0
+	}
+	return b.MaxAttempts
+}
+
+// redialConn is a long-lived redis connection that dials a new
+// connection when the current one fails, e.g. after a failover or a
+// network error. The commands that fail because of a connection error
+// are retried on the new connection, and the channel and pattern
+// subscriptions are replayed, so that the failure is transparent to
+// the caller. The scripts are not retried, as they may have run before
+// the connection failed: their error is returned once the connection
+// is redialed.
+type redialConn struct {
+	dial    func() (redis.Conn, error)
+	backoff *Backoff
+	logger  logger.Logger
+
+	// redialmu ensures only one goroutine redials at a time.
+	redialmu sync.Mutex
+
+	// done is closed when the connection is closed.
+	done chan struct{}
+
+	// mu protects the following fields.
+	mu        sync.Mutex
+	rc        redis.Conn
+	gen       int  // incremented on each redial
+	redialing bool // a redial is in progress
+	closed    bool
+	failed    error // set when the redial gives up
+	subsent   bool  // a subscription command was sent since the last flush
+	channels  map[string]bool
+	patterns  map[string]bool
+}
+
+func newRedialConn(rc redis.Conn, dial func() (redis.Conn, error), backoff *Backoff, lg logger.Logger) *redialConn {
+	return &redialConn{
+		rc:       rc,
+		dial:     dial,
+		backoff:  backoff,
+		logger:   lg,
+		done:     make(chan struct{}),
+		channels: make(map[string]bool),
+		patterns: make(map[string]bool),
+	}
+}
+
+// current returns the current connection and its generation.
+func (c *redialConn) current() (redis.Conn, int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.errLocked(); err != nil {
+		return nil, 0, err
+	}
+	return c.rc, c.gen, nil
+}
+
+func (c *redialConn) errLocked() error {
+	if c.closed {
+		return errConnClosed
+	}
+	return c.failed
+}
+
+// redial replaces the connection of generation gen by a new one, and
+// replays the subscriptions. If the connection was already replaced,
+// it returns immediately. It returns an error if c is closed or if
+// the maximum number of attempts is reached.
+func (c *redialConn) redial(gen int, cause error) error {
+	c.redialmu.Lock()
+	defer c.redialmu.Unlock()
+
+	c.mu.Lock()
+	if err := c.errLocked(); err != nil {
+		c.mu.Unlock()
+		return err
+	}
+	if c.gen != gen {
+		// already redialed by another goroutine
+		c.mu.Unlock()
+		return nil
+	}
+	c.redialing = true
+	c.rc.Close()
+	c.mu.Unlock()
+
+	c.logger.Log(logger.Warn, "redial: connection failed, redialing", logger.Err(cause))
+	max := c.backoff.maxAttempts()
+	for attempt := 0; max <= 0 || attempt < max; attempt++ {
+		if d := c.backoff.Delay(attempt); d > 0 {
+			select {
+			case <-time.After(d):
+			case <-c.done:
+				return errConnClosed
+			}
+		}
+
+		rc, err := c.dial()
+		if err == nil {
+			if err = c.replay(rc); err != nil {
+				rc.Close()
+			}
+		}
+		if err == errConnClosed {
+			return err
+		}
+		if err != nil {
+			c.logger.Log(logger.Warn, "redial: failed", logger.F("attempt", attempt+1), logger.Err(err))
+			continue
+		}
+
+		c.logger.Log(logger.Info, "redial: connection restored", logger.F("attempts", attempt+1))
+		return nil
+	}
+
+	c.logger.Log(logger.Error, "redial: giving up", logger.F("attempts", max), logger.Err(cause))
+	c.mu.Lock()
+	c.failed = cause
+	c.redialing = false
+	c.mu.Unlock()
+	return cause
+}
+
+// replay subscribes rc to the channels and patterns of c, and makes
+// it the current connection. It holds the lock for the whole replay
+// so that no subscription change is missed.
+func (c *redialConn) replay(rc redis.Conn) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return errConnClosed
+	}
+
+	if len(c.channels) > 0 {
+		if err := rc.Send("SUBSCRIBE", redis.Args{}.AddFlat(keys(c.channels))...); err != nil {
+			return err
+		}
+	}
+	if len(c.patterns) > 0 {
+		if err := rc.Send("PSUBSCRIBE", redis.Args{}.AddFlat(keys(c.patterns))...); err != nil {
+			return err
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		return err
+	}
+
+	c.rc = rc
+	c.gen++
+	c.redialing = false
+	return nil
+}
+
+func keys(m map[string]bool) []string {
+	ks := make([]string, 0, len(m))
+	for k := range m {
+		ks = append(ks, k)
+	}
+	return ks
+}
+
+// track records the subscriptions changes of a command. It returns
+// true if cmd is a subscription command. The lock must be held.
+func (c *redialConn) track(cmd string, args []interface{}) bool {
+	var m map[string]bool
+	var sub bool
+	switch strings.ToUpper(cmd) {
+	case "SUBSCRIBE":
+		m, sub = c.channels, true
+	case "UNSUBSCRIBE":
+		m = c.channels
+	case "PSUBSCRIBE":
+		m, sub = c.patterns, true
+	case "PUNSUBSCRIBE":
+		m = c.patterns
+	default:
+		return false
+	}
+
+	if !sub && len(args) == 0 {
+		// unsubscribe from all
+		for k := range m {
+			delete(m, k)
+		}
+		return true
+	}
+	for _, arg := range args {
+		k, err := redis.String(arg, nil)
+		if err != nil {
+			continue
+		}
+		if sub {
+			m[k] = true
+		} else {
+			delete(m, k)
+		}
+	}
+	return true
+}
+
+// Close closes the connection. It stops any redial in progress.
+func (c *redialConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	return c.rc.Close()
+}
+
+// Err returns a non-nil value if the connection is closed or if the
+// redial gave up. A connection being redialed is not reported as
+// failed.
+func (c *redialConn) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.errLocked()
+}
+
+// Do sends the command and returns its reply. If it fails because
+// of a connection error, the connection is redialed and the command
+// is sent again, unless it is a script that may have run, in which
+// case the error is returned.
+func (c *redialConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	for {
+		rc, gen, err := c.current()
+		if err != nil {
+			return nil, err
+		}
+		if err := rc.Err(); err != nil {
+			// the connection failed before the command was sent
+			if err := c.redial(gen, err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		v, err := rc.Do(cmd, args...)
+		if !isConnErr(err) {
+			if err == nil {
+				c.mu.Lock()
+				c.track(cmd, args)
+				c.mu.Unlock()
+			}
+			return v, err
+		}
+		if err := c.redial(gen, err); err != nil {
+			return nil, err
+		}
+		if !canRetry(cmd, err) {
+			return nil, err
+		}
+	}
+}
+
+// canRetry returns true if the command cmd that failed with the
+// connection error err can be sent again. A READONLY error reply means
+// the command was not executed, otherwise the scripts are not retried
+// as they are not idempotent.
+func canRetry(cmd string, err error) bool {
+	if _, ok := err.(redis.Error); ok {
+		return true
+	}
+	switch strings.ToUpper(cmd) {
+	case "EVAL", "EVALSHA":
+		return false
+	}
+	return true
+}
+
+// Send writes the command to the output buffer. The subscription
+// commands are recorded so that they are replayed on a new connection,
+// and they succeed while the connection is being redialed.
+func (c *redialConn) Send(cmd string, args ...interface{}) error {
+	c.mu.Lock()
+	if err := c.errLocked(); err != nil {
+		c.mu.Unlock()
+		return err
+	}
+	isSub := c.track(cmd, args)
+	if isSub && c.redialing {
+		// it will be replayed on the new connection
+		c.mu.Unlock()
+		return nil
+	}
+	c.subsent = c.subsent || isSub
+	rc := c.rc
+	c.mu.Unlock()
+
+	err := rc.Send(cmd, args...)
+	if isSub && isConnErr(err) {
+		// the connection is broken, it will be redialed and the
+		// subscription replayed once Receive detects it.
+		return nil
+	}
+	return err
+}
+
+// Flush flushes the output buffer. It succeeds while the connection is
+// being redialed, as the subscriptions are replayed on the new one.
+func (c *redialConn) Flush() error {
+	c.mu.Lock()
+	if err := c.errLocked(); err != nil {
+		c.mu.Unlock()
+		return err
+	}
+	if c.redialing {
+		c.mu.Unlock()
+		return nil
+	}
+	rc, subsent := c.rc, c.subsent
+	c.subsent = false
+	c.mu.Unlock()
+
+	err := rc.Flush()
+	if subsent && isConnErr(err) {
+		// same as for Send, the subscriptions will be replayed
+		return nil
+	}
+	return err
+}
+
+// Receive receives a single reply. If it fails because of a connection
+// error, the connection is redialed and it receives from the new one.
+func (c *redialConn) Receive() (interface{}, error) {
+	for {
+		rc, gen, err := c.current()
+		if err != nil {
+			return nil, err
+		}
+		v, err := rc.Receive()
+		if !isConnErr(err) {
+			return v, err
+		}
+		if err := c.redial(gen, err); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// isConnErr returns true if err is a connection error, as opposed to
+// an error reply from redis. A READONLY error reply is a connection
+// error, as it means the server was turned into a replica.
+func isConnErr(err error) bool {
+	if err == nil {
+		return false
+	}
+	if rerr, ok := err.(redis.Error); ok {
+		return strings.HasPrefix(string(rerr), "READONLY ")
+	}
+	return true
+}
@@ -0,0 +1,171 @@
+package redisbroker
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/exp/juggler/logger"
+	"github.com/PuerkitoBio/exp/juggler/msg"
+	"github.com/garyburd/redigo/redis"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	var nilb *Backoff
+	b := &Backoff{MinDelay: time.Second, MaxDelay: 10 * time.Second}
+	cases := []struct {
+		b       *Backoff
+		attempt int
+		want    time.Duration
+	}{
+		{nilb, 0, 0},
+		{nilb, 1, DefaultRedialMinDelay},
+		{nilb, 2, 2 * DefaultRedialMinDelay},
+		{nilb, 100, DefaultRedialMaxDelay},
+		{b, 0, 0},
+		{b, 1, time.Second},
+		{b, 4, 8 * time.Second},
+		{b, 5, 10 * time.Second},
+		{b, 64, 10 * time.Second},
+	}
+	for i, c := range cases {
+		assert.Equal(t, c.want, c.b.Delay(c.attempt), "%d: attempt %d", i, c.attempt)
+	}
+
+	jb := &Backoff{MinDelay: time.Second, Jitter: true}
+	for i := 0; i < 100; i++ {
+		d := jb.Delay(1)
+		assert.True(t, d > 500*time.Millisecond && d <= time.Second, "jitter delay %s", d)
+	}
+}
+
+// redialFake returns a Broker with Redial set that dials the fake
+// server at "127.0.0.1:1". If fail is not nil and returns true, the
+// dial fails.
+func redialFake(f *fakeSentinel, fail func() bool) *Broker {
+	return &Broker{
+		Dial: func() (redis.Conn, error) {
+			if fail != nil && fail() {
+				return nil, errors.New("dial failed")
+			}
+			return f.dial("127.0.0.1:1")
+		},
+		Redial: &Backoff{MinDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond},
+		Logger: logger.Discard,
+	}
+}
+
+// waitConn waits for the n-th connection to addr.
+func waitConn(t *testing.T, f *fakeSentinel, addr string, n int) *fakeServerConn {
+	for i := 0; i < 100; i++ {
+		f.mu.Lock()
+		conns := f.conns[addr]
+		f.mu.Unlock()
+		if len(conns) >= n {
+			return conns[n-1]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.FailNow(t, "connection not dialed", "connection %d to %s", n, addr)
+	return nil
+}
+
+func TestRedialDo(t *testing.T) {
+	f := &fakeSentinel{master: "127.0.0.1:1"}
+	brk := redialFake(f, nil)
+	rc, err := brk.dial()
+	require.NoError(t, err, "dial")
+	defer rc.Close()
+
+	// a failed command is retried on the new connection
+	waitConn(t, f, "127.0.0.1:1", 1).Close()
+	_, err = rc.Do("PING")
+	require.NoError(t, err, "PING")
+	assert.Equal(t, []string{"PING"}, waitConn(t, f, "127.0.0.1:1", 2).sentCmds(), "PING retried")
+
+	// a failed script is not retried, but the connection is redialed
+	waitConn(t, f, "127.0.0.1:1", 2).Close()
+	_, err = rc.Do("EVAL", "return 1", 0)
+	assert.Equal(t, io.EOF, err, "EVAL error")
+	assert.Empty(t, waitConn(t, f, "127.0.0.1:1", 3).sentCmds(), "EVAL not retried")
+	_, err = rc.Do("EVAL", "return 1", 0)
+	assert.NoError(t, err, "EVAL on new connection")
+}
+
+func TestRedialPubSub(t *testing.T) {
+	f := &fakeSentinel{master: "127.0.0.1:1"}
+
+	var mu sync.Mutex
+	failing := false
+	brk := redialFake(f, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return failing
+	})
+
+	psc, err := brk.PubSub()
+	require.NoError(t, err, "PubSub")
+	defer psc.Close()
+	require.NoError(t, psc.Subscribe("a", false), "Subscribe a")
+	evc := psc.Events()
+
+	// break the connection, the redial fails until failing is reset
+	mu.Lock()
+	failing = true
+	mu.Unlock()
+	close(waitConn(t, f, "127.0.0.1:1", 1).recv)
+	time.Sleep(10 * time.Millisecond)
+
+	// subscriptions changes during the redial are not lost
+	require.NoError(t, psc.Subscribe("b*", true), "PSubscribe b* while redialing")
+	require.NoError(t, psc.Unsubscribe("a", false), "Unsubscribe a while redialing")
+	mu.Lock()
+	failing = false
+	mu.Unlock()
+
+	nc := waitConn(t, f, "127.0.0.1:1", 2)
+	pld, err := json.Marshal(&msg.PubPayload{MsgUUID: uuid.NewRandom(), Args: json.RawMessage("1")})
+	require.NoError(t, err, "Marshal")
+	nc.recv <- []interface{}{[]byte("pmessage"), []byte("b*"), []byte("bc"), pld}
+
+	select {
+	case ep := <-evc:
+		assert.Equal(t, "bc", ep.Channel, "event channel")
+		assert.Equal(t, "b*", ep.Pattern, "event pattern")
+	case <-time.After(time.Second):
+		require.FailNow(t, "no event received")
+	}
+	assert.Nil(t, psc.EventsErr(), "no events error")
+	assert.Equal(t, []string{"PSUBSCRIBE b*"}, nc.sentCmds(), "subscriptions replayed")
+}
+
+func TestRedialGiveUp(t *testing.T) {
+	f := &fakeSentinel{master: "127.0.0.1:1"}
+	dials := 0
+	brk := redialFake(f, func() bool {
+		dials++
+		return dials > 1
+	})
+	brk.Redial.MaxAttempts = 5
+
+	psc, err := brk.PubSub()
+	require.NoError(t, err, "PubSub")
+	defer psc.Close()
+	evc := psc.Events()
+
+	close(waitConn(t, f, "127.0.0.1:1", 1).recv)
+	select {
+	case _, ok := <-evc:
+		assert.False(t, ok, "events channel closed")
+	case <-time.After(time.Second):
+		require.FailNow(t, "events channel not closed")
+	}
+	assert.Error(t, psc.EventsErr(), "events error")
+	assert.Equal(t, 6, dials, "first dial and redial attempts")
+}
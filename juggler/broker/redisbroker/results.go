@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/PuerkitoBio/exp/juggler/broker"
+	"github.com/PuerkitoBio/exp/juggler/logger"
 	"github.com/PuerkitoBio/exp/juggler/msg"
 	"github.com/garyburd/redigo/redis"
 	"github.com/pborman/uuid"
@@ -17,7 +18,7 @@ type resultsConn struct {
 	c        redis.Conn
 	connUUID uuid.UUID
 	timeout  time.Duration
-	logFn    func(string, ...interface{})
+	logger   logger.Logger
 
 	// once makes sure only the first call to Results starts the goroutine.
 	once sync.Once
@@ -28,8 +29,8 @@ type resultsConn struct {
 	err   error
 }
 
-func newResultsConn(rc redis.Conn, connUUID uuid.UUID, to time.Duration, logFn func(string, ...interface{})) *resultsConn {
-	return &resultsConn{c: rc, connUUID: connUUID, timeout: to, logFn: logFn}
+func newResultsConn(rc redis.Conn, connUUID uuid.UUID, to time.Duration, lg logger.Logger) *resultsConn {
+	return &resultsConn{c: rc, connUUID: connUUID, timeout: to, logger: lg}
 }
 
 // Close closes the connection.
@@ -77,19 +78,19 @@ func (c *resultsConn) Results() <-chan *msg.ResPayload {
 				// unmarshal the payload
 				var rp msg.ResPayload
 				if err := unmarshalBRPOPValue(&rp, v); err != nil {
-					logf(c.logFn, "Results: BRPOP failed to unmarshal result payload: %v", err)
+					c.logger.Log(logger.Error, "Results: BRPOP failed to unmarshal result payload", logger.Conn(c.connUUID), logger.Err(err))
 					continue
 				}
 
 				// check if call is expired
-				k := fmt.Sprintf(resTimeoutKey, rp.ConnUUID, rp.MsgUUID)
+				k := resultTimeoutKey(&rp)
 				pttl, err := redis.Int(c.c.Do("EVAL", delAndPTTLScript, 1, k))
 				if err != nil {
-					logf(c.logFn, "Results: DEL/PTTL failed: %v", err)
+					c.logger.Log(logger.Error, "Results: DEL/PTTL failed", logger.Conn(c.connUUID), logger.Msg(rp.MsgUUID), logger.URI(rp.URI), logger.Err(err))
 					continue
 				}
 				if pttl <= 0 {
-					logf(c.logFn, "Results: message %v expired, dropping call", rp.MsgUUID)
+					c.logger.Log(logger.Warn, "Results: message expired, dropping call", logger.Conn(c.connUUID), logger.Msg(rp.MsgUUID), logger.URI(rp.URI))
 					continue
 				}
 
@@ -0,0 +1,257 @@
+package redisbroker
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/exp/juggler/logger"
+	"github.com/garyburd/redigo/redis"
+)
+
+var _ Pool = (*Sentinel)(nil)
+
+// checkMasterIdle is the time after which the role of an idle pooled
+// connection is checked when it is borrowed.
+const checkMasterIdle = time.Second
+
+// Sentinel is a Pool that connects to the master of a redis
+// deployment monitored by redis sentinels. The address of the master
+// is asked to the sentinels each time a connection is dialed. The role
+// of the pooled connections that were idle for some time is checked
+// when they are borrowed, and the pooled connections that receive a
+// READONLY error are discarded, so that new connections go to the new
+// master after a failover.
+//
+// The connections returned by Dial redial the current master when
+// they fail, retrying the failed command and replaying the pub-sub
+// subscriptions, so that the long-lived connections of the Broker
+// survive a failover.
+//
+// To use it with a Broker, set the Broker's Pool to the Sentinel and
+// its Dial function to the Sentinel's Dial method.
+type Sentinel struct {
+	// Addrs is the list of addresses of the sentinels.
+	Addrs []string
+
+	// MasterName is the name of the master monitored by the sentinels.
+	MasterName string
+
+	// DialNode is the function called to connect to the sentinel or
+	// redis server at addr. If nil, redis.Dial is used on the TCP
+	// network.
+	DialNode func(addr string) (redis.Conn, error)
+
+	// ConnectTimeout, ReadTimeout and WriteTimeout are the timeouts of
+	// the connections dialed when DialNode is nil. The default of 0
+	// uses DefaultNodeTimeout. ReadTimeout does not apply to the
+	// connections returned by Dial, as they run blocking commands.
+	ConnectTimeout time.Duration
+	ReadTimeout    time.Duration
+	WriteTimeout   time.Duration
+
+	// MaxIdle, MaxActive and IdleTimeout configure the pool of
+	// connections to the master, see redis.Pool.
+	MaxIdle     int
+	MaxActive   int
+	IdleTimeout time.Duration
+
+	// Redial configures the delay between the attempts to redial the
+	// master for the connections returned by Dial. If nil, the default
+	// values of Backoff are used.
+	Redial *Backoff
+
+	// Logger is the structured logger used by the connections returned
+	// by Dial. If nil, log.Printf is used.
+	Logger logger.Logger
+
+	once sync.Once
+	pool *redis.Pool
+}
+
+// MasterAddr returns the address of the master, as reported by the
+// first sentinel that knows it.
+func (s *Sentinel) MasterAddr() (string, error) {
+	if len(s.Addrs) == 0 {
+		return "", errors.New("redisbroker: no sentinel address")
+	}
+
+	var err error
+	for _, addr := range s.Addrs {
+		var master string
+		if master, err = s.askMaster(addr); err == nil {
+			return master, nil
+		}
+	}
+	return "", err
+}
+
+// askMaster returns the address of the master, as reported by the
+// sentinel at addr.
+func (s *Sentinel) askMaster(addr string) (string, error) {
+	rc, err := s.dialNode(addr, true)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	vals, err := redis.Strings(rc.Do("SENTINEL", "get-master-addr-by-name", s.MasterName))
+	if err == redis.ErrNil {
+		return "", fmt.Errorf("redisbroker: unknown master %s on sentinel %s", s.MasterName, addr)
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(vals) != 2 {
+		return "", fmt.Errorf("redisbroker: invalid SENTINEL get-master-addr-by-name reply: %v", vals)
+	}
+	return net.JoinHostPort(vals[0], vals[1]), nil
+}
+
+// DialMaster returns a new connection to the current master. It fails
+// if the server reported by the sentinels is not a master, e.g. during
+// a failover.
+func (s *Sentinel) DialMaster() (redis.Conn, error) {
+	return s.dialMaster(true)
+}
+
+// dialMaster is like DialMaster, the read timeout of the connection is
+// set only if readTimeout is true.
+func (s *Sentinel) dialMaster(readTimeout bool) (redis.Conn, error) {
+	addr, err := s.MasterAddr()
+	if err != nil {
+		return nil, err
+	}
+	rc, err := s.dialNode(addr, readTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkMaster(rc); err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return rc, nil
+}
+
+// checkMaster returns an error if the server of rc is not a master.
+func checkMaster(rc redis.Conn) error {
+	vals, err := redis.Values(rc.Do("ROLE"))
+	if err != nil {
+		return err
+	}
+	if len(vals) == 0 {
+		return errors.New("redisbroker: invalid ROLE reply")
+	}
+	role, err := redis.String(vals[0], nil)
+	if err != nil {
+		return err
+	}
+	if role != "master" {
+		return fmt.Errorf("redisbroker: server role is %s, not master", role)
+	}
+	return nil
+}
+
+// Get returns a pooled connection to the master. Close must be called
+// to release it.
+func (s *Sentinel) Get() redis.Conn {
+	return s.getPool().Get()
+}
+
+func (s *Sentinel) getPool() *redis.Pool {
+	s.once.Do(func() {
+		s.pool = &redis.Pool{
+			MaxIdle:     s.MaxIdle,
+			MaxActive:   s.MaxActive,
+			IdleTimeout: s.IdleTimeout,
+			Dial: func() (redis.Conn, error) {
+				rc, err := s.DialMaster()
+				if err != nil {
+					return nil, err
+				}
+				return &masterConn{Conn: rc}, nil
+			},
+			TestOnBorrow: func(rc redis.Conn, t time.Time) error {
+				if time.Since(t) < checkMasterIdle {
+					return nil
+				}
+				return checkMaster(rc)
+			},
+		}
+	})
+	return s.pool
+}
+
+// masterConn is a pooled connection to the master. Once it receives
+// a READONLY error, meaning that the server was turned into a replica,
+// its Err method returns that error so that the pool discards it.
+type masterConn struct {
+	redis.Conn
+	err error
+}
+
+func (c *masterConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	v, err := c.Conn.Do(cmd, args...)
+	c.check(err)
+	return v, err
+}
+
+func (c *masterConn) Receive() (interface{}, error) {
+	v, err := c.Conn.Receive()
+	c.check(err)
+	return v, err
+}
+
+func (c *masterConn) Err() error {
+	if c.err != nil {
+		return c.err
+	}
+	return c.Conn.Err()
+}
+
+func (c *masterConn) check(err error) {
+	if _, ok := err.(redis.Error); ok && isConnErr(err) {
+		c.err = err
+	}
+}
+
+// Dial returns a non-pooled connection to the master, suitable for
+// long-lived connections. It redials the current master if it fails.
+func (s *Sentinel) Dial() (redis.Conn, error) {
+	dial := func() (redis.Conn, error) {
+		return s.dialMaster(false)
+	}
+	rc, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	return newRedialConn(rc, dial, s.Redial, s.logger()), nil
+}
+
+// Close releases the resources used by the pool. The connections
+// returned by Dial must be closed separately.
+func (s *Sentinel) Close() error {
+	return s.getPool().Close()
+}
+
+// dialNode connects to the sentinel or redis server at addr. The read
+// timeout is set only if readTimeout is true.
+func (s *Sentinel) dialNode(addr string, readTimeout bool) (redis.Conn, error) {
+	if s.DialNode != nil {
+		return s.DialNode(addr)
+	}
+	read := time.Duration(0)
+	if readTimeout {
+		read = nodeTimeout(s.ReadTimeout)
+	}
+	return dialTCP(addr, nodeTimeout(s.ConnectTimeout), read, nodeTimeout(s.WriteTimeout))
+}
+
+func (s *Sentinel) logger() logger.Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return logger.Func(nil)
+}
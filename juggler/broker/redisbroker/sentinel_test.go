@@ -0,0 +1,275 @@
+package redisbroker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/exp/juggler/logger"
+	"github.com/PuerkitoBio/exp/juggler/msg"
+	"github.com/garyburd/redigo/redis"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSentinel is a fake redis deployment with a sentinel at
+// "sentinel:1" and servers at "127.0.0.1:1" and "127.0.0.1:2".
+type fakeSentinel struct {
+	mu     sync.Mutex
+	master string
+	conns  map[string][]*fakeServerConn // by address
+}
+
+func (f *fakeSentinel) setMaster(addr string) {
+	f.mu.Lock()
+	f.master = addr
+	f.mu.Unlock()
+}
+
+func (f *fakeSentinel) getMaster() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.master
+}
+
+// lastConn returns the last connection dialed to addr.
+func (f *fakeSentinel) lastConn(addr string) *fakeServerConn {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	conns := f.conns[addr]
+	if len(conns) == 0 {
+		return nil
+	}
+	return conns[len(conns)-1]
+}
+
+func (f *fakeSentinel) dial(addr string) (redis.Conn, error) {
+	if addr != "sentinel:1" && addr != "127.0.0.1:1" && addr != "127.0.0.1:2" {
+		return nil, fmt.Errorf("unknown node %s", addr)
+	}
+	c := &fakeServerConn{fake: f, addr: addr, recv: make(chan interface{}, 10), done: make(chan struct{})}
+	f.mu.Lock()
+	if f.conns == nil {
+		f.conns = make(map[string][]*fakeServerConn)
+	}
+	f.conns[addr] = append(f.conns[addr], c)
+	f.mu.Unlock()
+	return c, nil
+}
+
+// fakeServerConn is a connection to the fake deployment. The replies
+// received by Receive are sent on recv, and closing recv makes it
+// fail like a broken connection.
+type fakeServerConn struct {
+	fake *fakeSentinel
+	addr string
+	recv chan interface{}
+	done chan struct{}
+	once sync.Once
+
+	mu   sync.Mutex
+	sent []string
+}
+
+func (c *fakeServerConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return nil
+}
+
+func (c *fakeServerConn) Err() error   { return nil }
+func (c *fakeServerConn) Flush() error { return nil }
+
+func (c *fakeServerConn) Send(cmd string, args ...interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sent = append(c.sent, strings.TrimSpace(fmt.Sprint(cmd, " ", fmt.Sprint(args...))))
+	return nil
+}
+
+func (c *fakeServerConn) sentCmds() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.sent...)
+}
+
+func (c *fakeServerConn) Receive() (interface{}, error) {
+	select {
+	case v, ok := <-c.recv:
+		if !ok {
+			return nil, io.EOF
+		}
+		return v, nil
+	case <-c.done:
+		return nil, io.EOF
+	}
+}
+
+func (c *fakeServerConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	master := c.fake.getMaster()
+	switch cmd {
+	case "":
+		return nil, nil
+	case "SENTINEL":
+		if c.addr != "sentinel:1" || args[1] != "mymaster" {
+			return nil, nil
+		}
+		host, port := master[:strings.Index(master, ":")], master[strings.Index(master, ":")+1:]
+		return []interface{}{[]byte(host), []byte(port)}, nil
+	case "ROLE":
+		if c.addr == master {
+			return []interface{}{[]byte("master"), int64(0), []interface{}{}}, nil
+		}
+		return []interface{}{[]byte("slave"), []byte("127.0.0.1"), int64(1), []byte("connected"), int64(0)}, nil
+	case "PING", "EVAL":
+		c.mu.Lock()
+		c.sent = append(c.sent, cmd)
+		c.mu.Unlock()
+		select {
+		case <-c.done:
+			// the command is executed, but the connection fails
+			return nil, io.EOF
+		default:
+		}
+		return []byte("OK"), nil
+	case "GET":
+		if c.addr != master {
+			return nil, redis.Error("READONLY You can't write against a read only replica.")
+		}
+		return []byte(c.addr), nil
+	}
+	return nil, errors.New("not supported")
+}
+
+func TestSentinelMasterAddr(t *testing.T) {
+	f := &fakeSentinel{master: "127.0.0.1:1"}
+	s := &Sentinel{Addrs: []string{"unknown:1", "sentinel:1"}, MasterName: "mymaster", DialNode: f.dial}
+	defer s.Close()
+
+	addr, err := s.MasterAddr()
+	require.NoError(t, err, "MasterAddr")
+	assert.Equal(t, "127.0.0.1:1", addr, "master address")
+
+	s.MasterName = "unknown"
+	_, err = s.MasterAddr()
+	if assert.Error(t, err, "unknown master") {
+		assert.Contains(t, err.Error(), "unknown master", "error message")
+	}
+}
+
+func TestSentinelNodeTimeout(t *testing.T) {
+	l := silentServer(t)
+	defer l.Close()
+
+	s := &Sentinel{Addrs: []string{l.Addr().String()}, MasterName: "m", ReadTimeout: 100 * time.Millisecond}
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.MasterAddr()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		assert.Error(t, err, "MasterAddr")
+	case <-time.After(2 * time.Second):
+		assert.Fail(t, "MasterAddr did not time out")
+	}
+}
+
+func TestSentinelPool(t *testing.T) {
+	f := &fakeSentinel{master: "127.0.0.1:1"}
+	s := &Sentinel{Addrs: []string{"sentinel:1"}, MasterName: "mymaster", DialNode: f.dial, MaxIdle: 1}
+	defer s.Close()
+
+	rc := s.Get()
+	v, err := redis.String(rc.Do("GET", "k"))
+	require.NoError(t, err, "GET")
+	assert.Equal(t, "127.0.0.1:1", v, "first master")
+	require.NoError(t, rc.Close(), "Close")
+
+	// the idle connection is to the old master, it fails with READONLY
+	// and is discarded
+	f.setMaster("127.0.0.1:2")
+	rc = s.Get()
+	_, err = rc.Do("GET", "k")
+	assert.Error(t, err, "GET on old master")
+	require.NoError(t, rc.Close(), "Close")
+
+	rc = s.Get()
+	v, err = redis.String(rc.Do("GET", "k"))
+	require.NoError(t, err, "GET")
+	assert.Equal(t, "127.0.0.1:2", v, "new master")
+	require.NoError(t, rc.Close(), "Close")
+
+	// the role of a connection idle for some time is checked
+	test := s.getPool().TestOnBorrow
+	f.setMaster("127.0.0.1:1")
+	rc = s.Get()
+	assert.NoError(t, test(rc, time.Now()), "recently used connection")
+	assert.Error(t, test(rc, time.Now().Add(-2*checkMasterIdle)), "idle connection to old master")
+	require.NoError(t, rc.Close(), "Close")
+}
+
+func TestSentinelDial(t *testing.T) {
+	f := &fakeSentinel{master: "127.0.0.1:1"}
+	s := &Sentinel{Addrs: []string{"sentinel:1"}, MasterName: "mymaster", DialNode: f.dial, Logger: logger.Discard}
+	defer s.Close()
+
+	rc, err := s.Dial()
+	require.NoError(t, err, "Dial")
+
+	// a failed command is retried on the new master
+	f.setMaster("127.0.0.1:2")
+	v, err := redis.String(rc.Do("GET", "k"))
+	require.NoError(t, err, "GET")
+	assert.Equal(t, "127.0.0.1:2", v, "GET on new master")
+	require.NoError(t, rc.Close(), "Close")
+	_, err = rc.Do("GET", "k")
+	assert.Equal(t, errConnClosed, err, "GET after Close")
+}
+
+func TestSentinelPubSub(t *testing.T) {
+	f := &fakeSentinel{master: "127.0.0.1:1"}
+	s := &Sentinel{Addrs: []string{"sentinel:1"}, MasterName: "mymaster", DialNode: f.dial, Logger: logger.Discard}
+	defer s.Close()
+
+	rc, err := s.Dial()
+	require.NoError(t, err, "Dial")
+	psc := newPubSubConn(rc, logger.Discard)
+	defer psc.Close()
+
+	require.NoError(t, psc.Subscribe("a", false), "Subscribe a")
+	require.NoError(t, psc.Subscribe("b", false), "Subscribe b")
+	require.NoError(t, psc.Subscribe("c*", true), "PSubscribe c*")
+	require.NoError(t, psc.Unsubscribe("b", false), "Unsubscribe b")
+	evc := psc.Events()
+
+	pld, err := json.Marshal(&msg.PubPayload{MsgUUID: uuid.NewRandom(), Args: json.RawMessage("1")})
+	require.NoError(t, err, "Marshal")
+
+	// fail over to the second server and break the connection
+	old := f.lastConn("127.0.0.1:1")
+	f.setMaster("127.0.0.1:2")
+	close(old.recv)
+
+	var nc *fakeServerConn
+	for i := 0; i < 100 && nc == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+		nc = f.lastConn("127.0.0.1:2")
+	}
+	require.NotNil(t, nc, "redialed the new master")
+	nc.recv <- []interface{}{[]byte("message"), []byte("a"), pld}
+
+	select {
+	case ep := <-evc:
+		assert.Equal(t, "a", ep.Channel, "event channel")
+	case <-time.After(time.Second):
+		require.FailNow(t, "no event received")
+	}
+	assert.Nil(t, psc.EventsErr(), "no events error")
+	assert.Equal(t, []string{"SUBSCRIBE a", "PSUBSCRIBE c*"}, nc.sentCmds(), "subscriptions replayed")
+}
@@ -0,0 +1,592 @@
+package redisbroker
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/exp/juggler/broker"
+	"github.com/PuerkitoBio/exp/juggler/logger"
+	"github.com/PuerkitoBio/exp/juggler/msg"
+	"github.com/garyburd/redigo/redis"
+	"github.com/pborman/uuid"
+)
+
+var (
+	// static check that *StreamBroker implements all the broker interfaces
+	_ broker.CallerBroker = (*StreamBroker)(nil)
+	_ broker.CalleeBroker = (*StreamBroker)(nil)
+	_ broker.PubSubBroker = (*StreamBroker)(nil)
+
+	_ broker.CallsConn = (*streamCallsConn)(nil)
+)
+
+// DefaultGroup is the default name of the consumer group of the
+// call streams.
+const DefaultGroup = "juggler"
+
+// DefaultClaimIdle is the default time after which a call request
+// that was read but not acknowledged is reclaimed by another callee.
+// It is the same as broker.DefaultCallTimeout, so that a call with
+// the default timeout that is being processed by a live callee expires
+// before it can be reclaimed.
+const DefaultClaimIdle = time.Minute
+
+// StreamBroker is a broker that stores the call requests in Redis
+// Streams instead of lists, so that a call request is delivered at
+// least once. It embeds a Broker for the results, the cancellations
+// and the pub-sub support, which are the same, and its configuration
+// fields apply to the StreamBroker too, BlockingTimeout being the
+// BLOCK time of XREADGROUP.
+//
+// The call requests of a URI are added to a stream with XADD, and
+// the callees read them with XREADGROUP in the same consumer group.
+// A call request stays in the group's pending entries until its final
+// result is stored via StreamBroker.Result, which acknowledges it
+// with XACK. If a callee dies while processing a call, the call is
+// reclaimed with XCLAIM by another callee listening on the same URI
+// once it has been pending for ClaimIdle, and is processed again if
+// it has not expired. The call timeouts are still honored using the
+// same expiring key as for Broker, which is only deleted once the
+// call is acknowledged or canceled. The call requests that a callee
+// read but dropped without a result, e.g. because they were canceled
+// or expired, are acknowledged when it checks for calls to reclaim.
+//
+// Each calls connection reads the call requests as a distinct consumer
+// of the group, which is deleted when the connection is closed if it
+// has no pending call requests left. Otherwise it is kept so that its
+// pending call requests can still be acknowledged or reclaimed.
+//
+// Because the reclaimed calls are processed again, the processing of
+// a call should be idempotent, and ClaimIdle should be longer than
+// the longest expected call processing time.
+type StreamBroker struct {
+	Broker
+
+	// Group is the name of the consumer group of the callees. The
+	// default of "" uses DefaultGroup.
+	Group string
+
+	// ClaimIdle is the time after which an unacknowledged call
+	// request is reclaimed by another callee. The default of 0 uses
+	// DefaultClaimIdle, or broker.DefaultCallTimeout if it is longer.
+	ClaimIdle time.Duration
+
+	// mu protects entries, the stream entries of the call requests
+	// read by the calls connections that are not acknowledged yet,
+	// by call message UUID.
+	mu      sync.Mutex
+	entries map[string]streamEntry
+}
+
+// streamEntry identifies a call request read from a stream.
+type streamEntry struct {
+	key     string // the stream key
+	id      string // the entry ID
+	expires time.Time
+}
+
+const (
+	streamCallScript = `
+		local limit = tonumber(ARGV[3])
+		if limit > 0 and redis.call("XLEN", KEYS[2]) >= limit then
+			return redis.error_reply("stream capacity exceeded")
+		end
+		redis.call("SET", KEYS[1], ARGV[4], "PX", tonumber(ARGV[1]))
+		return redis.call("XADD", KEYS[2], "*", "payload", ARGV[2])
+	`
+
+	streamCancelScript = `
+		local owner = redis.call("GET", KEYS[1])
+		if owner == ARGV[1] then
+			redis.call("DEL", KEYS[1])
+			redis.call("PUBLISH", ARGV[2], ARGV[3])
+			return 1
+		elseif owner then
+			return -1
+		end
+		return 0
+	`
+
+	streamAckScript = `
+		redis.call("XACK", KEYS[1], ARGV[1], ARGV[2])
+		redis.call("XDEL", KEYS[1], ARGV[2])
+		redis.call("DEL", KEYS[2])
+		return 1
+	`
+
+	streamDelConsumerScript = `
+		local pending = redis.pcall("XPENDING", KEYS[1], ARGV[1], "-", "+", 1, ARGV[2])
+		if pending.err then
+			return -1
+		elseif #pending > 0 then
+			return 0
+		end
+		redis.call("XGROUP", "DELCONSUMER", KEYS[1], ARGV[1], ARGV[2])
+		return 1
+	`
+
+	// redis cluster-compliant key, in the same slot as callTimeoutKey
+	callStreamKey = "juggler:calls:stream:{%s}" // 1: URI
+
+	// maximum number of pending entries to check per stream when
+	// reclaiming calls.
+	claimCount = 100
+)
+
+// Call registers a call request in the broker.
+func (b *StreamBroker) Call(cp *msg.CallPayload, timeout time.Duration) error {
+	p, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+
+	rc := b.Pool.Get()
+	defer rc.Close()
+
+	to := int(timeout / time.Millisecond)
+	if to == 0 {
+		to = int(broker.DefaultCallTimeout / time.Millisecond)
+	}
+
+	k1 := fmt.Sprintf(callTimeoutKey, cp.URI, cp.MsgUUID)
+	k2 := fmt.Sprintf(callStreamKey, cp.URI)
+	_, err = rc.Do("EVAL",
+		streamCallScript,
+		2,                    // the number of keys
+		k1,                   // key[1] : the SET key with expiration
+		k2,                   // key[2] : the STREAM key
+		to,                   // argv[1] : the timeout in milliseconds
+		p,                    // argv[2] : the call payload
+		b.CallCap,            // argv[3] : the STREAM capacity
+		cp.ConnUUID.String(), // argv[4] : the value of the SET key, the connection UUID
+	)
+	return err
+}
+
+// Cancel cancels a call request. The expiring key of the call is
+// deleted so that it gets dropped if it is read or reclaimed, and the
+// cancellation is published to the callees in case it is being
+// processed.
+func (b *StreamBroker) Cancel(cp *msg.CnclPayload) error {
+	p, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+
+	rc := b.Pool.Get()
+	defer rc.Close()
+
+	k := fmt.Sprintf(callTimeoutKey, cp.URI, cp.MsgUUID)
+	ch := fmt.Sprintf(cancelChannel, cp.URI)
+	res, err := redis.Int(rc.Do("EVAL",
+		streamCancelScript,
+		1,                    // the number of keys
+		k,                    // key[1] : the SET key with expiration
+		cp.ConnUUID.String(), // argv[1] : the UUID of the calling connection
+		ch,                   // argv[2] : the cancellation channel
+		p,                    // argv[3] : the cancel payload
+	))
+	if err != nil {
+		return err
+	}
+	if res < 0 {
+		return broker.ErrCallNotOwned
+	}
+	return nil
+}
+
+// Result registers a call result in the broker. Once the final result
+// of a call is registered, the call request is acknowledged so that
+// it is not reclaimed.
+func (b *StreamBroker) Result(rp *msg.ResPayload, timeout time.Duration) error {
+	if err := b.Broker.Result(rp, timeout); err != nil {
+		return err
+	}
+	if rp.Partial {
+		return nil
+	}
+
+	key := rp.MsgUUID.String()
+	b.mu.Lock()
+	e, ok := b.entries[key]
+	delete(b.entries, key)
+	b.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	rc := b.Pool.Get()
+	defer rc.Close()
+	return b.ack(rc, e, rp.URI, rp.MsgUUID)
+}
+
+// Calls returns a calls connection that can be used to process the call
+// requests for the specified URIs.
+func (b *StreamBroker) Calls(uris ...string) (broker.CallsConn, error) {
+	rc, err := b.dial()
+	if err != nil {
+		return nil, err
+	}
+	return newStreamCallsConn(rc, b, uris), nil
+}
+
+// ack acknowledges and deletes the stream entry e of the call request
+// identified by uri and msgUUID, and deletes its expiring key.
+func (b *StreamBroker) ack(rc redis.Conn, e streamEntry, uri string, msgUUID uuid.UUID) error {
+	k := fmt.Sprintf(callTimeoutKey, uri, msgUUID)
+	_, err := rc.Do("EVAL",
+		streamAckScript,
+		2,         // the number of keys
+		e.key,     // key[1] : the STREAM key
+		k,         // key[2] : the SET key with expiration
+		b.group(), // argv[1] : the consumer group
+		e.id,      // argv[2] : the entry ID
+	)
+	return err
+}
+
+// track registers the stream entry e of the call request cp so that
+// it is acknowledged once its result is stored. It also removes the
+// expired entries, that are reclaimed and dropped by the callees.
+func (b *StreamBroker) track(cp *msg.CallPayload, e streamEntry) {
+	now := time.Now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.entries == nil {
+		b.entries = make(map[string]streamEntry)
+	}
+	for k, e := range b.entries {
+		if now.After(e.expires) {
+			delete(b.entries, k)
+		}
+	}
+	b.entries[cp.MsgUUID.String()] = e
+}
+
+// liveEntries returns the set of the tracked stream entries, by stream
+// key and entry ID, that are not expired yet, i.e. the call requests
+// that may still be processed.
+func (b *StreamBroker) liveEntries() map[[2]string]bool {
+	now := time.Now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	live := make(map[[2]string]bool, len(b.entries))
+	for _, e := range b.entries {
+		if now.Before(e.expires) {
+			live[[2]string{e.key, e.id}] = true
+		}
+	}
+	return live
+}
+
+func (b *StreamBroker) group() string {
+	if b.Group != "" {
+		return b.Group
+	}
+	return DefaultGroup
+}
+
+func (b *StreamBroker) claimIdle() time.Duration {
+	if b.ClaimIdle > 0 {
+		return b.ClaimIdle
+	}
+	if broker.DefaultCallTimeout > DefaultClaimIdle {
+		return broker.DefaultCallTimeout
+	}
+	return DefaultClaimIdle
+}
+
+type streamCallsConn struct {
+	c        redis.Conn
+	b        *StreamBroker
+	uris     []string
+	consumer string
+	logger   logger.Logger
+
+	// once makes sure only the first call to Calls starts the goroutine.
+	once sync.Once
+	ch   chan *msg.CallPayload
+
+	// errmu protects access to err.
+	errmu sync.Mutex
+	err   error
+}
+
+func newStreamCallsConn(rc redis.Conn, b *StreamBroker, uris []string) *streamCallsConn {
+	return &streamCallsConn{
+		c:        rc,
+		b:        b,
+		uris:     uris,
+		consumer: uuid.NewRandom().String(),
+		logger:   b.logger(),
+	}
+}
+
+// Close closes the connection and deletes its consumer from the
+// consumer group of each stream if it has no pending call requests.
+func (c *streamCallsConn) Close() error {
+	err := c.c.Close()
+	if derr := c.deleteConsumer(); err == nil {
+		err = derr
+	}
+	return err
+}
+
+// deleteConsumer deletes the consumer of c from the consumer group of
+// the streams, unless it has pending call requests that must still be
+// acknowledged or reclaimed. It uses a connection from the pool as the
+// calls connection is closed, so that no call request can be read by
+// the consumer afterwards.
+func (c *streamCallsConn) deleteConsumer() error {
+	rc := c.b.Pool.Get()
+	defer rc.Close()
+
+	group := c.b.group()
+	for _, uri := range c.uris {
+		key := fmt.Sprintf(callStreamKey, uri)
+		n, err := redis.Int(rc.Do("EVAL",
+			streamDelConsumerScript,
+			1,          // the number of keys
+			key,        // key[1] : the STREAM key
+			group,      // argv[1] : the consumer group
+			c.consumer, // argv[2] : the consumer
+		))
+		if err != nil {
+			return err
+		}
+		// n < 0 if the consumer group does not exist
+		if n == 0 {
+			c.logger.Log(logger.Info, "Close: consumer has pending calls, keeping it", logger.F("key", key), logger.F("consumer", c.consumer))
+		}
+	}
+	return nil
+}
+
+// CallsErr returns the error that caused the Calls channel to close.
+func (c *streamCallsConn) CallsErr() error {
+	c.errmu.Lock()
+	err := c.err
+	c.errmu.Unlock()
+	return err
+}
+
+func (c *streamCallsConn) setErr(err error) {
+	c.errmu.Lock()
+	c.err = err
+	c.errmu.Unlock()
+}
+
+// Calls returns a stream of call requests for the URIs specified when
+// creating the streamCallsConn.
+func (c *streamCallsConn) Calls() <-chan *msg.CallPayload {
+	c.once.Do(func() {
+		c.ch = make(chan *msg.CallPayload)
+
+		go func() {
+			defer close(c.ch)
+
+			group := c.b.group()
+			idle := c.b.claimIdle()
+
+			// compute all keys, create the consumer groups
+			keys := make([]string, len(c.uris))
+			for i, uri := range c.uris {
+				keys[i] = fmt.Sprintf(callStreamKey, uri)
+			}
+			if err := c.createGroups(keys, group); err != nil {
+				c.setErr(err)
+				return
+			}
+
+			// block for at most the claim idle time, so that calls
+			// are reclaimed regularly.
+			block := c.b.BlockingTimeout
+			if block <= 0 || block > idle {
+				block = idle
+			}
+			args := redis.Args{}.Add("GROUP", group, c.consumer, "COUNT", 1, "BLOCK", int(block/time.Millisecond), "STREAMS").AddFlat(keys)
+			for range keys {
+				args = args.Add(">")
+			}
+
+			var lastClaim time.Time
+			for {
+				if time.Since(lastClaim) >= idle {
+					err := c.reclaim(keys, group, idle)
+					if isNoGroupErr(err) {
+						// the connection was redialed to a server that
+						// lost the consumer groups.
+						err = c.createGroups(keys, group)
+					}
+					if err != nil {
+						c.setErr(err)
+						return
+					}
+					lastClaim = time.Now()
+				}
+
+				// XREADGROUP returns an array of [0]: key name, [1]: array of entries.
+				v, err := redis.Values(c.c.Do("XREADGROUP", args...))
+				if err != nil {
+					if err == redis.ErrNil {
+						// no available value
+						continue
+					}
+					if isNoGroupErr(err) {
+						if err = c.createGroups(keys, group); err == nil {
+							continue
+						}
+					}
+
+					// possibly a closed connection, in any case stop
+					// the loop.
+					c.setErr(err)
+					return
+				}
+
+				for _, kv := range v {
+					kes, err := redis.Values(kv, nil)
+					if err != nil || len(kes) != 2 {
+						c.logger.Log(logger.Error, "Calls: XREADGROUP returned an invalid reply", logger.Err(err))
+						continue
+					}
+					key, _ := redis.String(kes[0], nil)
+					entries, _ := redis.Values(kes[1], nil)
+					c.process(key, entries)
+				}
+			}
+		}()
+	})
+
+	return c.ch
+}
+
+// createGroups creates the consumer group of the streams identified by
+// keys, creating the streams if needed.
+func (c *streamCallsConn) createGroups(keys []string, group string) error {
+	for _, key := range keys {
+		_, err := c.c.Do("XGROUP", "CREATE", key, group, "0", "MKSTREAM")
+		if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			return err
+		}
+	}
+	return nil
+}
+
+// isNoGroupErr returns true if err is the error reply of a command on
+// a consumer group that does not exist.
+func isNoGroupErr(err error) bool {
+	rerr, ok := err.(redis.Error)
+	return ok && strings.HasPrefix(string(rerr), "NOGROUP")
+}
+
+// reclaim claims the call requests of the other consumers that are
+// pending for at least idle in the streams identified by keys, and
+// processes them. It also acknowledges the call requests of this
+// consumer that are no longer processed, because they were dropped
+// without a result, so that they don't stay in the streams.
+func (c *streamCallsConn) reclaim(keys []string, group string, idle time.Duration) error {
+	ms := int(idle / time.Millisecond)
+	live := c.b.liveEntries()
+	for _, key := range keys {
+		// XPENDING returns an array of [0]: ID, [1]: consumer, [2]: idle time, [3]: deliveries.
+		pending, err := redis.Values(c.c.Do("XPENDING", key, group, "-", "+", claimCount))
+		if err != nil {
+			return err
+		}
+
+		var claim, drop []string
+		for _, p := range pending {
+			vals, err := redis.Values(p, nil)
+			if err != nil || len(vals) < 3 {
+				continue
+			}
+			id, _ := redis.String(vals[0], nil)
+			owner, _ := redis.String(vals[1], nil)
+			pidle, _ := redis.Int(vals[2], nil)
+			switch {
+			case owner == c.consumer:
+				if !live[[2]string{key, id}] {
+					drop = append(drop, id)
+				}
+			case pidle >= ms:
+				claim = append(claim, id)
+			}
+		}
+
+		if len(drop) > 0 {
+			if _, err := c.c.Do("XACK", redis.Args{}.Add(key, group).AddFlat(drop)...); err != nil {
+				return err
+			}
+			if _, err := c.c.Do("XDEL", redis.Args{}.Add(key).AddFlat(drop)...); err != nil {
+				return err
+			}
+			c.logger.Log(logger.Info, "Calls: acknowledged dropped calls", logger.F("key", key), logger.F("count", len(drop)))
+		}
+		if len(claim) == 0 {
+			continue
+		}
+
+		entries, err := redis.Values(c.c.Do("XCLAIM", redis.Args{}.Add(key, group, c.consumer, ms).AddFlat(claim)...))
+		if err != nil {
+			return err
+		}
+		c.logger.Log(logger.Info, "Calls: reclaimed pending calls", logger.F("key", key), logger.F("count", len(entries)))
+		c.process(key, entries)
+	}
+	return nil
+}
+
+// process sends the call requests in the stream entries read from key
+// on the calls channel. The expired or canceled calls are acknowledged
+// and dropped.
+func (c *streamCallsConn) process(key string, entries []interface{}) {
+	for _, ent := range entries {
+		// each entry is an array of [0]: ID, [1]: array of field-value pairs.
+		vals, err := redis.Values(ent, nil)
+		if err != nil || len(vals) != 2 {
+			// deleted entries are returned as nil
+			continue
+		}
+		e := streamEntry{key: key}
+		e.id, _ = redis.String(vals[0], nil)
+		fields, _ := redis.StringMap(vals[1], nil)
+
+		// unmarshal the payload
+		var cp msg.CallPayload
+		if err := json.Unmarshal([]byte(fields["payload"]), &cp); err != nil {
+			c.logger.Log(logger.Error, "Calls: XREADGROUP failed to unmarshal call payload", logger.F("id", e.id), logger.Err(err))
+			c.c.Do("XACK", key, c.b.group(), e.id)
+			continue
+		}
+
+		// check if call is expired, the expiring key is deleted only
+		// once the call is acknowledged.
+		k := fmt.Sprintf(callTimeoutKey, cp.URI, cp.MsgUUID)
+		pttl, err := redis.Int(c.c.Do("PTTL", k))
+		if err != nil {
+			c.logger.Log(logger.Error, "Calls: PTTL failed", logger.Msg(cp.MsgUUID), logger.URI(cp.URI), logger.Err(err))
+			continue
+		}
+		if pttl <= 0 {
+			c.logger.Log(logger.Warn, "Calls: message expired, dropping call", logger.Conn(cp.ConnUUID), logger.Msg(cp.MsgUUID), logger.URI(cp.URI))
+			if err := c.b.ack(c.c, e, cp.URI, cp.MsgUUID); err != nil {
+				c.logger.Log(logger.Error, "Calls: XACK failed", logger.Msg(cp.MsgUUID), logger.URI(cp.URI), logger.Err(err))
+			}
+			continue
+		}
+
+		cp.ReadTimestamp = time.Now().UTC()
+		cp.TTLAfterRead = time.Duration(pttl) * time.Millisecond
+		e.expires = time.Now().Add(cp.TTLAfterRead)
+		c.b.track(&cp, e)
+		c.ch <- &cp
+	}
+}
@@ -0,0 +1,186 @@
+package redisbroker
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/exp/juggler/broker"
+	"github.com/PuerkitoBio/exp/juggler/internal/redistest"
+	"github.com/PuerkitoBio/exp/juggler/msg"
+	"github.com/garyburd/redigo/redis"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamCalls(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil)
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	brk := &StreamBroker{
+		Broker: Broker{
+			Pool:            pool,
+			Dial:            pool.Dial,
+			BlockingTimeout: 100 * time.Millisecond,
+			LogFunc:         logIfVerbose,
+		},
+		ClaimIdle: 200 * time.Millisecond,
+	}
+
+	cps := []*msg.CallPayload{
+		{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a"},
+		{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a"},
+		{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a"},
+	}
+	for i, cp := range cps[:2] {
+		require.NoError(t, brk.Call(cp, time.Minute), "Call %d", i)
+	}
+
+	// the first callee reads a call and dies without storing its result
+	cc1, err := brk.Calls("a")
+	require.NoError(t, err, "get Calls connection 1")
+	select {
+	case cp := <-cc1.Calls():
+		assert.Equal(t, cps[0].MsgUUID, cp.MsgUUID, "first call")
+	case <-time.After(time.Second):
+		require.FailNow(t, "no call received")
+	}
+	require.NoError(t, cc1.Close(), "close calls connection 1")
+
+	// a canceled call is dropped
+	require.NoError(t, brk.Call(cps[2], time.Minute), "Call 2")
+	require.NoError(t, brk.Cancel(&msg.CnclPayload{ConnUUID: cps[2].ConnUUID, MsgUUID: cps[2].MsgUUID, URI: "a"}), "Cancel")
+
+	// the second callee gets the pending call once it is reclaimed
+	cc2, err := brk.Calls("a")
+	require.NoError(t, err, "get Calls connection 2")
+	defer cc2.Close()
+
+	var got []uuid.UUID
+	for len(got) < 2 {
+		select {
+		case cp := <-cc2.Calls():
+			got = append(got, cp.MsgUUID)
+			rp := &msg.ResPayload{ConnUUID: cp.ConnUUID, MsgUUID: cp.MsgUUID, URI: cp.URI}
+			require.NoError(t, brk.Result(rp, time.Minute), "Result")
+		case <-time.After(2 * time.Second):
+			require.FailNow(t, "no call received", "got %v", got)
+		}
+	}
+	assert.ElementsMatch(t, []uuid.UUID{cps[0].MsgUUID, cps[1].MsgUUID}, got, "got expected calls")
+
+	// wait for the canceled call to be read and acknowledged
+	time.Sleep(100 * time.Millisecond)
+
+	rc := pool.Get()
+	defer rc.Close()
+	n, err := redis.Int(rc.Do("XLEN", fmt.Sprintf(callStreamKey, "a")))
+	require.NoError(t, err, "XLEN")
+	assert.Equal(t, 0, n, "all calls acknowledged")
+	for _, cp := range cps {
+		n, err := redis.Int(rc.Do("EXISTS", fmt.Sprintf(callTimeoutKey, cp.URI, cp.MsgUUID)))
+		require.NoError(t, err, "EXISTS")
+		assert.Equal(t, 0, n, "timeout key deleted")
+	}
+}
+
+func TestStreamClaimIdle(t *testing.T) {
+	// a call running on a live callee is not reclaimed before it expires
+	assert.True(t, (&StreamBroker{}).claimIdle() >= broker.DefaultCallTimeout, "default claim idle")
+	assert.Equal(t, time.Second, (&StreamBroker{ClaimIdle: time.Second}).claimIdle(), "claim idle")
+}
+
+func TestStreamConsumers(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil)
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	brk := &StreamBroker{
+		Broker: Broker{
+			Pool:            pool,
+			Dial:            pool.Dial,
+			BlockingTimeout: 50 * time.Millisecond,
+			LogFunc:         logIfVerbose,
+		},
+		ClaimIdle: 200 * time.Millisecond,
+	}
+
+	// two callees listen on the same URI
+	cc1, err := brk.Calls("a")
+	require.NoError(t, err, "get Calls connection 1")
+	defer cc1.Close()
+	cc2, err := brk.Calls("a")
+	require.NoError(t, err, "get Calls connection 2")
+	defer cc2.Close()
+
+	recv := func() *msg.CallPayload {
+		select {
+		case cp := <-cc1.Calls():
+			return cp
+		case cp := <-cc2.Calls():
+			return cp
+		case <-time.After(time.Second):
+			return nil
+		}
+	}
+
+	const n = 10
+	for i := 0; i < n; i++ {
+		cp := &msg.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a"}
+		require.NoError(t, brk.Call(cp, time.Minute), "Call %d", i)
+	}
+
+	// each call is delivered once
+	got := make(map[string]int)
+	for len(got) < n {
+		cp := recv()
+		require.NotNil(t, cp, "no call received, got %d", len(got))
+		got[cp.MsgUUID.String()]++
+		rp := &msg.ResPayload{ConnUUID: cp.ConnUUID, MsgUUID: cp.MsgUUID, URI: cp.URI}
+		require.NoError(t, brk.Result(rp, time.Minute), "Result")
+	}
+	for k, v := range got {
+		assert.Equal(t, 1, v, "%s: deliveries", k)
+	}
+
+	// a call dropped by its callee without a result is acknowledged
+	// once it is expired
+	cp := &msg.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a"}
+	require.NoError(t, brk.Call(cp, 100*time.Millisecond), "Call dropped")
+	got1 := recv()
+	require.NotNil(t, got1, "no call received")
+	assert.Equal(t, cp.MsgUUID, got1.MsgUUID, "dropped call")
+	assert.Nil(t, recv(), "dropped call is not delivered again")
+
+	rc := pool.Get()
+	defer rc.Close()
+	cnt, err := redis.Int(rc.Do("XLEN", fmt.Sprintf(callStreamKey, "a")))
+	require.NoError(t, err, "XLEN")
+	assert.Equal(t, 0, cnt, "all calls acknowledged")
+
+	// the consumers without pending calls are deleted on close
+	require.NoError(t, cc1.Close(), "close calls connection 1")
+	require.NoError(t, cc2.Close(), "close calls connection 2")
+	consumers, err := redis.Values(rc.Do("XINFO", "CONSUMERS", fmt.Sprintf(callStreamKey, "a"), DefaultGroup))
+	require.NoError(t, err, "XINFO CONSUMERS")
+	assert.Equal(t, 0, len(consumers), "consumers deleted")
+}
+
+func TestStreamCallCap(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil)
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	brk := &StreamBroker{Broker: Broker{Pool: pool, LogFunc: logIfVerbose, CallCap: cap}}
+
+	for i := 0; i <= cap; i++ {
+		err := brk.Call(&msg.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a"}, time.Second)
+		if i < cap {
+			assert.NoError(t, err, "Call %d", i)
+		} else if assert.Error(t, err, "Call %d", i) {
+			assert.Contains(t, err.Error(), "stream capacity exceeded", "error has expected message")
+		}
+	}
+}
@@ -2,16 +2,26 @@
 // and process call requests. A callee listens to some URIs using
 // a broker.CalleeBroker, and stores the result of the calls so that
 // the broker can send it back to the calling client.
+//
+// The functions that handle the calls can be written as Thunk or
+// ContextThunk functions that deal with the raw JSON arguments, or
+// as strongly-typed functions registered in a Registry, that
+// generates the thunks.
 package callee
 
 import (
 	"encoding/json"
 	"errors"
-	"log"
+	"sync"
 	"time"
 
+	"golang.org/x/net/context"
+
 	"github.com/PuerkitoBio/exp/juggler/broker"
+	"github.com/PuerkitoBio/exp/juggler/internal/hashslot"
+	"github.com/PuerkitoBio/exp/juggler/logger"
 	"github.com/PuerkitoBio/exp/juggler/msg"
+	"github.com/PuerkitoBio/exp/juggler/trace"
 )
 
 // ErrCallExpired is returned when a call is processed but the
@@ -20,22 +30,73 @@ import (
 // returned from InvokeAndStoreResult.
 var ErrCallExpired = errors.New("juggler/callee: call expired")
 
+// ErrCallCanceled is returned when a call is canceled by the caller
+// while it is being processed. The result is dropped and this error is
+// returned from InvokeAndStoreResultContext.
+var ErrCallCanceled = errors.New("juggler/callee: call canceled")
+
+// ErrCalleeClosed is returned by Listen and ListenContext after a call
+// to Callee.Shutdown.
+var ErrCalleeClosed = errors.New("juggler/callee: callee closed")
+
 // Thunk is the function signature for functions that handle calls
 // to a URI. Generally, it should be used to decode the arguments
 // to the type expected by the actual underlying function, call that
 // strongly-typed function, and transfer the results back in the
-// generic empty interface.
+// generic empty interface. The caller's identity and any other
+// metadata associated with the call are available in the payload's
+// Metadata field.
 type Thunk func(*msg.CallPayload) (interface{}, error)
 
+// ContextThunk is like Thunk, but it receives a context that is
+// canceled when the caller cancels the call or when the callee stops
+// listening, and that has a deadline set to the call's expiration,
+// so that the function can stop early when its result can no longer
+// be delivered. Use AdaptThunk to convert a Thunk to a ContextThunk.
+type ContextThunk func(context.Context, *msg.CallPayload) (interface{}, error)
+
 // Callee is a peer that handles call requests for some URIs.
 type Callee struct {
 	// Broker is the callee broker to use to listen for call requests
 	// and to store results.
 	Broker broker.CalleeBroker
 
-	// LogFunc is the logging function to use. If nil, log.Printf
-	// is used. It can be set to juggler.DiscardLog to disable logging.
+	// Logger is the structured logger to use. If nil, LogFunc is
+	// used.
+	Logger logger.Logger
+
+	// LogFunc is the logging function to use if Logger is nil. If nil,
+	// log.Printf is used. It can be set to juggler.DiscardLog to disable
+	// logging.
 	LogFunc func(string, ...interface{})
+
+	// Tracer can be set to record the spans of the calls processed
+	// by InvokeAndStoreResultContext. If nil, no span is recorded, but
+	// the trace context is still propagated to the results.
+	Tracer trace.Tracer
+
+	// mu protects seqs, the sequence number of the last partial result
+	// stored for each call, and running, the calls being processed by
+	// InvokeAndStoreResultContext. Both are keyed by call message UUID,
+	// and running holds each delivery of a call, as the same call may
+	// be delivered more than once. It also protects the listening state,
+	// closed and stops, the stop channels of the active calls to
+	// ListenContext.
+	mu      sync.Mutex
+	seqs    map[string]int
+	running map[string]map[*runningCall]struct{}
+	closed  bool
+	stops   map[chan struct{}]struct{}
+
+	// wg tracks the active calls to ListenContext.
+	wg sync.WaitGroup
+}
+
+// runningCall is a call being processed by InvokeAndStoreResultContext.
+type runningCall struct {
+	connUUID string
+	cancel   context.CancelFunc
+	canceled bool
 }
 
 // SplitByHashSlot takes a list of URIs and splits them into groups
@@ -43,75 +104,488 @@ type Callee struct {
 // the same hash slot can be listened to using the same broker.CallsConn,
 // optimizing the number of redis connections.
 //
+// The URIs are hashed as the hash tag of the redis keys that hold
+// their call requests. The groups are returned in the order of the
+// first URI of each group, and the URIs of a group are in the same
+// order as in uris.
+//
 // See the redis cluster documentation for details:
 // http://redis.io/topics/cluster-tutorial
 func SplitByHashSlot(uris []string) [][]string {
-	// TODO : implement when redis-cluster package is ready
-	return nil
+	var groups [][]string
+	bySlot := make(map[int]int) // index of the group of each slot
+	for _, uri := range uris {
+		slot := hashslot.Slot("{" + uri + "}")
+		i, ok := bySlot[slot]
+		if !ok {
+			i = len(groups)
+			bySlot[slot] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], uri)
+	}
+	return groups
 }
 
 // InvokeAndStoreResult processes the provided call payload by calling
 // fn and storing the result so that it can be sent back to the caller.
 // If the call timeout is exceeded, the result is dropped and
 // ErrCallExpired is returned.
+//
+// It is the same as calling InvokeAndStoreResultContext with a
+// background context and fn wrapped with AdaptThunk.
 func (c *Callee) InvokeAndStoreResult(cp *msg.CallPayload, fn Thunk) error {
-	ttl := cp.TTLAfterRead
-	start := time.Now()
+	return c.InvokeAndStoreResultContext(context.Background(), cp, AdaptThunk(fn))
+}
 
-	v, err := fn(cp)
-	if remain := ttl - time.Now().Sub(start); remain > 0 {
+// InvokeAndStoreResultContext is like InvokeAndStoreResult, but it
+// calls a ContextThunk. The context passed to fn is derived from ctx,
+// and its deadline is set to the time when the call expires, based
+// on the ReadTimestamp and TTLAfterRead fields of cp. It is canceled
+// if the call is canceled via Callee.Cancel while fn is running, in
+// which case the result is dropped and ErrCallCanceled is returned.
+//
+// The call is recorded in a span that is a child of the trace context
+// in cp's metadata. fn receives a copy of cp with the trace context
+// set to that span, and the results carry it in their metadata.
+func (c *Callee) InvokeAndStoreResultContext(ctx context.Context, cp *msg.CallPayload, fn ContextThunk) error {
+	deadline := callDeadline(cp)
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+
+	span := c.tracer().Start("callee.call", trace.FromMetadata(cp.Metadata))
+	span.SetAttr(logger.ConnKey, cp.ConnUUID.String())
+	span.SetAttr(logger.MsgKey, cp.MsgUUID.String())
+	span.SetAttr(logger.URIKey, cp.URI)
+	cp = withTraceContext(cp, span.Context())
+
+	key := cp.MsgUUID.String()
+	rc := &runningCall{connUUID: cp.ConnUUID.String(), cancel: cancel}
+	c.mu.Lock()
+	if c.running == nil {
+		c.running = make(map[string]map[*runningCall]struct{})
+	}
+	if c.running[key] == nil {
+		c.running[key] = make(map[*runningCall]struct{})
+	}
+	c.running[key][rc] = struct{}{}
+	c.mu.Unlock()
+
+	v, err := fn(ctx, cp)
+
+	c.mu.Lock()
+	canceled := rc.canceled
+	delete(c.running[key], rc)
+	if len(c.running[key]) == 0 {
+		delete(c.running, key)
+	}
+	c.mu.Unlock()
+
+	seq := c.finalSeq(cp)
+	if canceled {
+		span.End(ErrCallCanceled)
+		return ErrCallCanceled
+	}
+	if remain := deadline.Sub(time.Now()); remain > 0 {
 		// register the result
-		return c.storeResult(cp, v, err, remain)
+		serr := c.storeResult(cp, v, err, remain, seq, false)
+		if serr != nil {
+			err = serr
+		}
+		span.End(err)
+		return serr
 	}
+	span.End(ErrCallExpired)
 	return ErrCallExpired
 }
 
+// Cancel cancels the context of the call identified by cp, if it is
+// being processed by InvokeAndStoreResultContext. The call is only
+// canceled if it was made by the connection that requested the
+// cancellation. If the call is being processed more than once, all
+// of them are canceled. It returns true if the call was canceled.
+func (c *Callee) Cancel(cp *msg.CnclPayload) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var ok bool
+	connUUID := cp.ConnUUID.String()
+	for rc := range c.running[cp.MsgUUID.String()] {
+		if rc.connUUID != connUUID {
+			continue
+		}
+		rc.canceled = true
+		rc.cancel()
+		ok = true
+	}
+	return ok
+}
+
+// StorePartialResult stores v as an intermediate result for the call
+// request cp, so that it is sent to the caller before the final result.
+// It is meant to be called by a Thunk that streams its results, any
+// number of times before it returns the final result. The remaining
+// time-to-live of the call is computed from the ReadTimestamp and
+// TTLAfterRead fields of cp. If the call timeout is exceeded, the
+// result is dropped and ErrCallExpired is returned.
+func (c *Callee) StorePartialResult(cp *msg.CallPayload, v interface{}) error {
+	remain := callDeadline(cp).Sub(time.Now())
+	if remain <= 0 {
+		return ErrCallExpired
+	}
+
+	c.mu.Lock()
+	if c.seqs == nil {
+		c.seqs = make(map[string]int)
+	}
+	key := cp.MsgUUID.String()
+	c.seqs[key]++
+	seq := c.seqs[key]
+	c.mu.Unlock()
+
+	return c.storeResult(cp, v, nil, remain, seq, true)
+}
+
+// callDeadline returns the time when the call request cp expires,
+// based on its ReadTimestamp and TTLAfterRead fields. If cp has no
+// ReadTimestamp, e.g. because it was not read from a broker, the
+// current time is used.
+func callDeadline(cp *msg.CallPayload) time.Time {
+	read := cp.ReadTimestamp
+	if read.IsZero() {
+		read = time.Now()
+	}
+	return read.Add(cp.TTLAfterRead)
+}
+
+// finalSeq returns the sequence number of the final result of the
+// call request cp, which is 0 if no partial result was stored.
+func (c *Callee) finalSeq(cp *msg.CallPayload) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := cp.MsgUUID.String()
+	seq, ok := c.seqs[key]
+	if !ok {
+		return 0
+	}
+	delete(c.seqs, key)
+	return seq + 1
+}
+
 // Listen is a helper method that listens for call requests for the
 // requested URIs and calls the corresponding Thunk to execute the
 // request. The m map has URIs as keys, and the associated Thunk
 // function as value. If a redis cluster is used, all URIs in m
 // must belong to the same hash slot (see SplitByHashSlot).
 //
-// The method implements a single-producer, single-consumer helper,
-// where a single redis connection is used to listen for call requests
-// on the URIs, and for each request, a single goroutine executes
-// the calls and stores the results. More advanced concurrency
-// patterns can be implemented using Callee.Broker.Calls directly,
-// and starting multiple consumer goroutines reading from the same calls
-// channel and calling InvokeAndStoreResult to process each call request.
+// By default, a single redis connection is used to listen for call
+// requests on the URIs, and for each request, a single goroutine
+// executes the calls and stores the results. The Workers option sets
+// the number of goroutines that execute calls concurrently, and the
+// URILimit option limits the concurrency for a specific URI, whose call
+// requests are then read on a separate connection. More
+// advanced concurrency patterns can be implemented using
+// Callee.Broker.Calls directly, and starting multiple consumer
+// goroutines reading from the same calls channel and calling
+// InvokeAndStoreResult to process each call request.
 //
 // The function blocks until the call request loop exits. It returns
 // the error that caused the loop to stop, or the error to initiate
-// the connection to the broker.
-func (c *Callee) Listen(m map[string]Thunk) error {
+// the connection to the broker. After a call to Shutdown, it returns
+// ErrCalleeClosed once all running calls are done.
+//
+// It is the same as calling ListenContext with a background context
+// and each Thunk wrapped with AdaptThunk.
+func (c *Callee) Listen(m map[string]Thunk, opts ...ListenOption) error {
+	cm := make(map[string]ContextThunk, len(m))
+	for k, fn := range m {
+		cm[k] = AdaptThunk(fn)
+	}
+	return c.ListenContext(context.Background(), cm, opts...)
+}
+
+// ListenContext is like Listen, but it calls ContextThunk functions.
+// With the HandleCancels option, it also listens for the cancellation
+// requests of calls on the same URIs, and cancels the context of the
+// corresponding running calls.
+//
+// The context of each call is derived from ctx. When ctx is done, the
+// callee stops listening for call requests, the context of the running
+// calls is canceled, and ListenContext returns ctx.Err().
+func (c *Callee) ListenContext(ctx context.Context, m map[string]ContextThunk, opts ...ListenOption) error {
 	if len(m) == 0 {
 		return nil
 	}
 
+	conf := listenConfig{workers: 1}
+	for _, opt := range opts {
+		opt(&conf)
+	}
+	if conf.workers <= 0 {
+		conf.workers = 1
+	}
+
+	// the URIs with a concurrency limit are listened to on their own
+	// connection by their own workers, so that their pending calls
+	// wait in the broker instead of holding the workers of other URIs.
+	var groups []listenGroup
 	uris := make([]string, 0, len(m))
+	var rest []string
 	for k := range m {
 		uris = append(uris, k)
+		if n := conf.limits[k]; n > 0 && n < conf.workers {
+			groups = append(groups, listenGroup{uris: []string{k}, workers: n})
+			continue
+		}
+		rest = append(rest, k)
 	}
-	conn, err := c.Broker.Calls(uris...)
-	if err != nil {
+	if len(rest) > 0 {
+		groups = append(groups, listenGroup{uris: rest, workers: conf.workers})
+	}
+
+	for i := range groups {
+		conn, err := c.Broker.Calls(groups[i].uris...)
+		if err != nil {
+			closeGroups(groups[:i])
+			return err
+		}
+		groups[i].conn = conn
+	}
+
+	if conf.cancels {
+		cncl, err := c.Broker.Cancels(uris...)
+		if err != nil {
+			closeGroups(groups)
+			return err
+		}
+		defer cncl.Close()
+
+		go func() {
+			for cp := range cncl.Cancels() {
+				c.Cancel(cp)
+			}
+		}()
+	}
+
+	stop := make(chan struct{})
+	if err := c.addListener(stop); err != nil {
+		closeGroups(groups)
 		return err
 	}
-	defer conn.Close()
+	defer c.removeListener(stop)
+
+	var (
+		wg       sync.WaitGroup
+		quit     = make(chan struct{})
+		quitOnce sync.Once
+		failed   broker.CallsConn
+	)
+	for i := range groups {
+		g := &groups[i]
+		g.calls = g.conn.Calls()
 
-	for cp := range conn.Calls() {
-		if err := c.InvokeAndStoreResult(cp, m[cp.URI]); err != nil {
-			if err == ErrCallExpired {
-				logf(c.LogFunc, "dropping expired message %v", cp.MsgUUID)
-				continue
+		wg.Add(g.workers)
+		for j := 0; j < g.workers; j++ {
+			go func() {
+				defer wg.Done()
+
+				for {
+					select {
+					case <-ctx.Done():
+						return
+					case <-stop:
+						return
+					case <-quit:
+						return
+					case cp, ok := <-g.calls:
+						if !ok {
+							// the connection failed, stop the other ones
+							quitOnce.Do(func() {
+								failed = g.conn
+								close(quit)
+							})
+							return
+						}
+						c.invoke(ctx, cp, m[cp.URI])
+					}
+				}
+			}()
+		}
+	}
+	wg.Wait()
+
+	// the call requests already read from the broker when the
+	// connections are closed are still processed, unless ctx is done.
+	closeGroups(groups)
+	for _, g := range groups {
+		for cp := range g.calls {
+			if ctx.Err() == nil {
+				c.invoke(ctx, cp, m[cp.URI])
 			}
-			logf(c.LogFunc, "storeResult failed for message %v: %v", cp.MsgUUID, err)
-			continue
 		}
 	}
-	return conn.CallsErr()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	closed := c.closed
+	c.mu.Unlock()
+	if closed {
+		return ErrCalleeClosed
+	}
+	if failed != nil {
+		return failed.CallsErr()
+	}
+	return nil
+}
+
+// listenGroup is a group of URIs listened to on the same calls
+// connection by the same workers.
+type listenGroup struct {
+	uris    []string
+	workers int
+	conn    broker.CallsConn
+	calls   <-chan *msg.CallPayload
 }
 
-func (c *Callee) storeResult(cp *msg.CallPayload, v interface{}, e error, timeout time.Duration) error {
+func closeGroups(groups []listenGroup) {
+	for _, g := range groups {
+		g.conn.Close()
+	}
+}
+
+// invoke calls InvokeAndStoreResultContext and logs the failures.
+func (c *Callee) invoke(ctx context.Context, cp *msg.CallPayload, fn ContextThunk) {
+	if err := c.InvokeAndStoreResultContext(ctx, cp, fn); err != nil {
+		switch err {
+		case ErrCallExpired:
+			c.logger().Log(logger.Warn, "dropping expired message", logger.Conn(cp.ConnUUID), logger.Msg(cp.MsgUUID), logger.URI(cp.URI))
+		case ErrCallCanceled:
+			c.logger().Log(logger.Info, "dropping canceled message", logger.Conn(cp.ConnUUID), logger.Msg(cp.MsgUUID), logger.URI(cp.URI))
+		default:
+			c.logger().Log(logger.Error, "storeResult failed", logger.Conn(cp.ConnUUID), logger.Msg(cp.MsgUUID), logger.URI(cp.URI), logger.Err(err))
+		}
+	}
+}
+
+// addListener registers the stop channel of an active call to
+// ListenContext, so that it gets closed on Shutdown.
+func (c *Callee) addListener(stop chan struct{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return ErrCalleeClosed
+	}
+	if c.stops == nil {
+		c.stops = make(map[chan struct{}]struct{})
+	}
+	c.stops[stop] = struct{}{}
+	c.wg.Add(1)
+	return nil
+}
+
+func (c *Callee) removeListener(stop chan struct{}) {
+	c.mu.Lock()
+	delete(c.stops, stop)
+	c.mu.Unlock()
+	c.wg.Done()
+}
+
+// Shutdown gracefully stops the calls to Listen and ListenContext. It
+// stops reading new call requests, waits for the running calls to
+// complete and store their result, and then closes the calls
+// connections. The cancellation requests are still processed until
+// then. Once Shutdown is called, Listen and ListenContext return
+// ErrCalleeClosed.
+//
+// If ctx is done before the running calls complete, their context is
+// canceled and Shutdown returns ctx.Err().
+func (c *Callee) Shutdown(ctx context.Context) error {
+	c.mu.Lock()
+	if !c.closed {
+		c.closed = true
+		for stop := range c.stops {
+			close(stop)
+		}
+	}
+	c.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		c.mu.Lock()
+		for _, rcs := range c.running {
+			for rc := range rcs {
+				rc.cancel()
+			}
+		}
+		c.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// ListenOption sets an option on a call to Listen or ListenContext.
+type ListenOption func(*listenConfig)
+
+type listenConfig struct {
+	workers int
+	limits  map[string]int
+	cancels bool
+}
+
+// Workers sets the number of goroutines that process call requests
+// concurrently, in addition to the dedicated workers of the URIs
+// limited by URILimit. The default is 1.
+func Workers(n int) ListenOption {
+	return func(conf *listenConfig) {
+		conf.workers = n
+	}
+}
+
+// URILimit limits to n the number of call requests for uri that are
+// processed concurrently. It only has an effect if n is lower than
+// the number of workers. The call requests for uri are then read on
+// a separate broker connection and processed by n dedicated workers,
+// so that they wait in the broker when the limit is reached, without
+// delaying the calls to the other URIs.
+func URILimit(uri string, n int) ListenOption {
+	return func(conf *listenConfig) {
+		if conf.limits == nil {
+			conf.limits = make(map[string]int)
+		}
+		conf.limits[uri] = n
+	}
+}
+
+// HandleCancels listens for the cancellation requests of the calls,
+// on a separate broker connection, so that Callee.Cancel is called
+// for each of them. By default, the cancellation requests are ignored.
+func HandleCancels() ListenOption {
+	return func(conf *listenConfig) {
+		conf.cancels = true
+	}
+}
+
+// AdaptThunk returns a ContextThunk that calls fn. The context is
+// ignored, so fn cannot stop early when the call is canceled or
+// expired, but its result is still dropped in that case.
+func AdaptThunk(fn Thunk) ContextThunk {
+	return func(ctx context.Context, cp *msg.CallPayload) (interface{}, error) {
+		return fn(cp)
+	}
+}
+
+func (c *Callee) storeResult(cp *msg.CallPayload, v interface{}, e error, timeout time.Duration, seq int, partial bool) error {
 	// if there's an error, that's what gets stored
 	if e != nil {
 		if ms, ok := e.(json.Marshaler); ok {
@@ -133,14 +607,42 @@ func (c *Callee) storeResult(cp *msg.CallPayload, v interface{}, e error, timeou
 		MsgUUID:  cp.MsgUUID,
 		URI:      cp.URI,
 		Args:     b,
+		Partial:  partial,
+		Seq:      seq,
+		Metadata: trace.Inject(nil, trace.FromMetadata(cp.Metadata)),
 	}
 	return c.Broker.Result(rp, timeout)
 }
 
-func logf(fn func(string, ...interface{}), s string, args ...interface{}) {
-	if fn != nil {
-		fn(s, args...)
-	} else {
-		log.Printf(s, args...)
+// withTraceContext returns a copy of cp with the trace context sc set
+// in a copy of its metadata. If sc is not valid, cp is returned.
+func withTraceContext(cp *msg.CallPayload, sc trace.SpanContext) *msg.CallPayload {
+	if !sc.IsValid() {
+		return cp
+	}
+	md := make(map[string]string, len(cp.Metadata)+1)
+	for k, v := range cp.Metadata {
+		md[k] = v
+	}
+	cp2 := *cp
+	cp2.Metadata = trace.Inject(md, sc)
+	return &cp2
+}
+
+// tracer returns the Tracer of the callee, which is trace.Nop if
+// Tracer is nil.
+func (c *Callee) tracer() trace.Tracer {
+	if c.Tracer != nil {
+		return c.Tracer
+	}
+	return trace.Nop
+}
+
+// logger returns the Logger of the callee, which adapts LogFunc if
+// Logger is nil.
+func (c *Callee) logger() logger.Logger {
+	if c.Logger != nil {
+		return c.Logger
 	}
+	return logger.Func(c.LogFunc)
 }
@@ -3,11 +3,15 @@ package callee
 import (
 	"encoding/json"
 	"io"
+	"sync"
 	"testing"
 	"time"
 
+	"golang.org/x/net/context"
+
 	"github.com/PuerkitoBio/exp/juggler"
 	"github.com/PuerkitoBio/exp/juggler/broker"
+	"github.com/PuerkitoBio/exp/juggler/broker/memorybroker"
 	"github.com/PuerkitoBio/exp/juggler/msg"
 	"github.com/pborman/uuid"
 	"github.com/stretchr/testify/assert"
@@ -15,9 +19,10 @@ import (
 )
 
 type mockCalleeBroker struct {
-	cps []*msg.CallPayload
-	err error
-	rps []*msg.ResPayload
+	cps     []*msg.CallPayload
+	err     error
+	rps     []*msg.ResPayload
+	cancels chan *msg.CnclPayload
 }
 
 func (b *mockCalleeBroker) Result(rp *msg.ResPayload, timeout time.Duration) error {
@@ -29,6 +34,25 @@ func (b *mockCalleeBroker) Calls(uris ...string) (broker.CallsConn, error) {
 	return &mockCallsConn{cps: b.cps, err: b.err}, nil
 }
 
+func (b *mockCalleeBroker) Cancels(uris ...string) (broker.CancelsConn, error) {
+	if b.cancels == nil {
+		b.cancels = make(chan *msg.CnclPayload)
+	}
+	return &mockCancelsConn{ch: b.cancels}, nil
+}
+
+type mockCancelsConn struct {
+	once sync.Once
+	ch   chan *msg.CnclPayload
+}
+
+func (c *mockCancelsConn) Cancels() <-chan *msg.CnclPayload { return c.ch }
+func (c *mockCancelsConn) CancelsErr() error                { return nil }
+func (c *mockCancelsConn) Close() error {
+	c.once.Do(func() { close(c.ch) })
+	return nil
+}
+
 type mockCallsConn struct {
 	cps []*msg.CallPayload
 	err error
@@ -90,3 +114,373 @@ func TestCallee(t *testing.T) {
 	assert.Equal(t, io.EOF, err, "Listen returns expected error")
 	assert.Equal(t, exp, brk.rps, "got expected results")
 }
+
+func TestStorePartialResult(t *testing.T) {
+	cuid := uuid.NewRandom()
+	brk := &mockCalleeBroker{
+		cps: []*msg.CallPayload{
+			{ConnUUID: cuid, MsgUUID: uuid.NewRandom(), URI: "stream", TTLAfterRead: time.Second, ReadTimestamp: time.Now().UTC()},
+			{ConnUUID: cuid, MsgUUID: uuid.NewRandom(), URI: "ok", TTLAfterRead: time.Second, ReadTimestamp: time.Now().UTC()},
+		},
+		err: io.EOF,
+	}
+
+	cle := &Callee{Broker: brk, LogFunc: juggler.DiscardLog}
+	streamThunk := func(cp *msg.CallPayload) (interface{}, error) {
+		for i := 1; i <= 2; i++ {
+			if err := cle.StorePartialResult(cp, i); err != nil {
+				return nil, err
+			}
+		}
+		return "done", nil
+	}
+
+	exp := []*msg.ResPayload{
+		{ConnUUID: cuid, MsgUUID: brk.cps[0].MsgUUID, URI: "stream", Args: json.RawMessage(`1`), Partial: true, Seq: 1},
+		{ConnUUID: cuid, MsgUUID: brk.cps[0].MsgUUID, URI: "stream", Args: json.RawMessage(`2`), Partial: true, Seq: 2},
+		{ConnUUID: cuid, MsgUUID: brk.cps[0].MsgUUID, URI: "stream", Args: json.RawMessage(`"done"`), Seq: 3},
+		{ConnUUID: cuid, MsgUUID: brk.cps[1].MsgUUID, URI: "ok", Args: json.RawMessage(`"ok"`)},
+	}
+
+	err := cle.Listen(map[string]Thunk{
+		"stream": streamThunk,
+		"ok":     okThunk,
+	})
+	assert.Equal(t, io.EOF, err, "Listen returns expected error")
+	assert.Equal(t, exp, brk.rps, "got expected results")
+	assert.Empty(t, cle.seqs, "sequence numbers are cleared")
+
+	// expired call
+	cp := &msg.CallPayload{ConnUUID: cuid, MsgUUID: uuid.NewRandom(), URI: "stream", TTLAfterRead: time.Millisecond, ReadTimestamp: time.Now().Add(-time.Second)}
+	assert.Equal(t, ErrCallExpired, cle.StorePartialResult(cp, 1), "partial result of expired call")
+
+	// call without a read timestamp
+	brk.rps = nil
+	cp = &msg.CallPayload{ConnUUID: cuid, MsgUUID: uuid.NewRandom(), URI: "stream", TTLAfterRead: time.Second}
+	require.NoError(t, cle.StorePartialResult(cp, 1), "partial result of hand-built call")
+	assert.Equal(t, 1, len(brk.rps), "partial result stored")
+}
+
+func TestListenContextCancel(t *testing.T) {
+	cuid := uuid.NewRandom()
+	brk := &mockCalleeBroker{
+		cps: []*msg.CallPayload{
+			{ConnUUID: cuid, MsgUUID: uuid.NewRandom(), URI: "wait", TTLAfterRead: time.Second},
+			{ConnUUID: cuid, MsgUUID: uuid.NewRandom(), URI: "ok", TTLAfterRead: time.Second},
+		},
+		cancels: make(chan *msg.CnclPayload),
+		err:     io.EOF,
+	}
+
+	started := make(chan bool)
+	waitThunk := func(ctx context.Context, cp *msg.CallPayload) (interface{}, error) {
+		started <- true
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Second):
+			return "timeout", nil
+		}
+	}
+	okCtxThunk := func(ctx context.Context, cp *msg.CallPayload) (interface{}, error) {
+		return okThunk(cp)
+	}
+
+	go func() {
+		<-started
+		// wrong connection, not canceled
+		brk.cancels <- &msg.CnclPayload{ConnUUID: uuid.NewRandom(), MsgUUID: brk.cps[0].MsgUUID, URI: "wait"}
+		brk.cancels <- &msg.CnclPayload{ConnUUID: cuid, MsgUUID: brk.cps[0].MsgUUID, URI: "wait"}
+	}()
+
+	cle := &Callee{Broker: brk, LogFunc: juggler.DiscardLog}
+	err := cle.ListenContext(context.Background(), map[string]ContextThunk{
+		"wait": waitThunk,
+		"ok":   okCtxThunk,
+	}, HandleCancels())
+
+	exp := []*msg.ResPayload{
+		{ConnUUID: cuid, MsgUUID: brk.cps[1].MsgUUID, URI: "ok", Args: json.RawMessage(`"ok"`)},
+	}
+	assert.Equal(t, io.EOF, err, "ListenContext returns expected error")
+	assert.Equal(t, exp, brk.rps, "got expected results")
+	assert.Empty(t, cle.running, "running calls are cleared")
+}
+
+func TestInvokeSameCallTwice(t *testing.T) {
+	brk := &mockCalleeBroker{}
+	cle := &Callee{Broker: brk, LogFunc: juggler.DiscardLog}
+
+	cp := &msg.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "wait", TTLAfterRead: time.Second}
+	started := make(chan bool)
+	release := make(chan bool)
+	waitThunk := func(ctx context.Context, cp *msg.CallPayload) (interface{}, error) {
+		started <- true
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-release:
+			return "ok", nil
+		}
+	}
+
+	// the same call is delivered twice, the first one completes while
+	// the second one is still running.
+	errc := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			errc <- cle.InvokeAndStoreResultContext(context.Background(), cp, waitThunk)
+		}()
+		<-started
+	}
+	release <- true
+	assert.NoError(t, <-errc, "first delivery")
+
+	cle.mu.Lock()
+	assert.Equal(t, 1, len(cle.running[cp.MsgUUID.String()]), "second delivery still running")
+	cle.mu.Unlock()
+
+	assert.True(t, cle.Cancel(&msg.CnclPayload{ConnUUID: cp.ConnUUID, MsgUUID: cp.MsgUUID, URI: cp.URI}), "Cancel")
+	assert.Equal(t, ErrCallCanceled, <-errc, "second delivery")
+	assert.Empty(t, cle.running, "running calls are cleared")
+	assert.Equal(t, 1, len(brk.rps), "result of first delivery")
+}
+
+func TestInvokeAndStoreResultContextDeadline(t *testing.T) {
+	brk := &mockCalleeBroker{}
+	cle := &Callee{Broker: brk, LogFunc: juggler.DiscardLog}
+
+	cp := &msg.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "wait", TTLAfterRead: 10 * time.Millisecond}
+	var thunkErr error
+	err := cle.InvokeAndStoreResultContext(context.Background(), cp, func(ctx context.Context, cp *msg.CallPayload) (interface{}, error) {
+		_, ok := ctx.Deadline()
+		assert.True(t, ok, "context has a deadline")
+		select {
+		case <-ctx.Done():
+			thunkErr = ctx.Err()
+			return nil, thunkErr
+		case <-time.After(time.Second):
+			return "timeout", nil
+		}
+	})
+	assert.Equal(t, ErrCallExpired, err, "InvokeAndStoreResultContext returns expected error")
+	assert.Equal(t, context.DeadlineExceeded, thunkErr, "thunk context deadline exceeded")
+	assert.Empty(t, brk.rps, "no result stored")
+
+	// the deadline is relative to the time the call was read
+	read := time.Now().Add(-time.Second)
+	cp = &msg.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "wait", TTLAfterRead: 2 * time.Second, ReadTimestamp: read}
+	err = cle.InvokeAndStoreResultContext(context.Background(), cp, func(ctx context.Context, cp *msg.CallPayload) (interface{}, error) {
+		dl, _ := ctx.Deadline()
+		assert.Equal(t, read.Add(2*time.Second), dl, "deadline")
+		return "ok", nil
+	})
+	assert.NoError(t, err, "InvokeAndStoreResultContext")
+}
+
+func TestListenContextDone(t *testing.T) {
+	brk := &memorybroker.Broker{LogFunc: juggler.DiscardLog}
+	cle := &Callee{Broker: brk, LogFunc: juggler.DiscardLog}
+
+	started := make(chan bool)
+	var thunkErr error
+	waitThunk := func(ctx context.Context, cp *msg.CallPayload) (interface{}, error) {
+		started <- true
+		<-ctx.Done()
+		thunkErr = ctx.Err()
+		return nil, thunkErr
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- cle.ListenContext(ctx, map[string]ContextThunk{"wait": waitThunk})
+	}()
+
+	cp := &msg.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "wait"}
+	require.NoError(t, brk.Call(cp, time.Second), "Call")
+	<-started
+	cancel()
+
+	select {
+	case err := <-done:
+		assert.Equal(t, context.Canceled, err, "ListenContext returns expected error")
+		assert.Equal(t, context.Canceled, thunkErr, "thunk context canceled")
+	case <-time.After(100 * time.Millisecond):
+		assert.Fail(t, "ListenContext did not return")
+	}
+}
+
+func TestListenWorkers(t *testing.T) {
+	cases := []struct {
+		opts []ListenOption
+		max  int
+	}{
+		{nil, 1},
+		{[]ListenOption{Workers(3)}, 3},
+		{[]ListenOption{Workers(3), URILimit("a", 2)}, 2},
+		{[]ListenOption{Workers(3), URILimit("b", 2)}, 3},
+	}
+	for i, c := range cases {
+		brk := &memorybroker.Broker{LogFunc: juggler.DiscardLog}
+		cle := &Callee{Broker: brk, LogFunc: juggler.DiscardLog}
+
+		var mu sync.Mutex
+		var cur, max int
+		thunk := func(cp *msg.CallPayload) (interface{}, error) {
+			mu.Lock()
+			cur++
+			if cur > max {
+				max = cur
+			}
+			mu.Unlock()
+
+			time.Sleep(10 * time.Millisecond)
+
+			mu.Lock()
+			cur--
+			mu.Unlock()
+			return nil, nil
+		}
+
+		for j := 0; j < 4; j++ {
+			cp := &msg.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a"}
+			require.NoError(t, brk.Call(cp, time.Second), "%d: Call %d", i, j)
+		}
+
+		done := make(chan error)
+		go func() {
+			done <- cle.Listen(map[string]Thunk{"a": thunk, "b": thunk}, c.opts...)
+		}()
+		time.Sleep(50 * time.Millisecond)
+
+		require.NoError(t, cle.Shutdown(context.Background()), "%d: Shutdown", i)
+		assert.Equal(t, ErrCalleeClosed, <-done, "%d: Listen returns expected error", i)
+
+		mu.Lock()
+		assert.Equal(t, c.max, max, "%d: max concurrent calls", i)
+		mu.Unlock()
+	}
+}
+
+func TestListenURILimitIsolated(t *testing.T) {
+	brk := &memorybroker.Broker{LogFunc: juggler.DiscardLog}
+	cle := &Callee{Broker: brk, LogFunc: juggler.DiscardLog}
+
+	release := make(chan bool)
+	waitThunk := func(cp *msg.CallPayload) (interface{}, error) {
+		<-release
+		return nil, nil
+	}
+	done := make(chan bool, 1)
+	okThunk := func(cp *msg.CallPayload) (interface{}, error) {
+		done <- true
+		return nil, nil
+	}
+
+	// the limited URI is saturated, the call to b is still processed
+	for i := 0; i < 3; i++ {
+		cp := &msg.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a"}
+		require.NoError(t, brk.Call(cp, time.Second), "Call a %d", i)
+	}
+	cp := &msg.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "b"}
+	require.NoError(t, brk.Call(cp, time.Second), "Call b")
+
+	errc := make(chan error)
+	go func() {
+		errc <- cle.Listen(map[string]Thunk{"a": waitThunk, "b": okThunk}, Workers(2), URILimit("a", 1))
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		assert.Fail(t, "call to b not processed")
+	}
+	close(release)
+
+	require.NoError(t, cle.Shutdown(context.Background()), "Shutdown")
+	assert.Equal(t, ErrCalleeClosed, <-errc, "Listen returns expected error")
+}
+
+func TestShutdown(t *testing.T) {
+	brk := &memorybroker.Broker{LogFunc: juggler.DiscardLog}
+	cle := &Callee{Broker: brk, LogFunc: juggler.DiscardLog}
+
+	started := make(chan bool)
+	waitThunk := func(cp *msg.CallPayload) (interface{}, error) {
+		started <- true
+		time.Sleep(20 * time.Millisecond)
+		return "done", nil
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- cle.Listen(map[string]Thunk{"wait": waitThunk})
+	}()
+
+	cp := &msg.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "wait"}
+	require.NoError(t, brk.Call(cp, time.Second), "Call")
+	<-started
+
+	// the running call completes and stores its result
+	require.NoError(t, cle.Shutdown(context.Background()), "Shutdown")
+	assert.Equal(t, ErrCalleeClosed, <-done, "Listen returns expected error")
+
+	rc, err := brk.Results(cp.ConnUUID)
+	require.NoError(t, err, "get Results connection")
+	defer rc.Close()
+	select {
+	case rp := <-rc.Results():
+		assert.Equal(t, cp.MsgUUID, rp.MsgUUID, "result UUID")
+	case <-time.After(100 * time.Millisecond):
+		assert.Fail(t, "no result received")
+	}
+
+	// Listen after Shutdown fails
+	assert.Equal(t, ErrCalleeClosed, cle.Listen(map[string]Thunk{"wait": waitThunk}), "Listen after Shutdown")
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	brk := &memorybroker.Broker{LogFunc: juggler.DiscardLog}
+	cle := &Callee{Broker: brk, LogFunc: juggler.DiscardLog}
+
+	started := make(chan bool)
+	var thunkErr error
+	waitThunk := func(ctx context.Context, cp *msg.CallPayload) (interface{}, error) {
+		started <- true
+		<-ctx.Done()
+		thunkErr = ctx.Err()
+		return nil, thunkErr
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- cle.ListenContext(context.Background(), map[string]ContextThunk{"wait": waitThunk})
+	}()
+
+	cp := &msg.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "wait"}
+	require.NoError(t, brk.Call(cp, time.Second), "Call")
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, cle.Shutdown(ctx), "Shutdown")
+	assert.Equal(t, ErrCalleeClosed, <-done, "ListenContext returns expected error")
+	assert.Equal(t, context.Canceled, thunkErr, "thunk context canceled")
+}
+
+func TestSplitByHashSlot(t *testing.T) {
+	cases := []struct {
+		in  []string
+		out [][]string
+	}{
+		{nil, nil},
+		{[]string{"a"}, [][]string{{"a"}}},
+		{[]string{"foo", "bar", "baz"}, [][]string{{"foo"}, {"bar"}, {"baz"}}},
+		// the keys of "foo}x" and "foo}y" have the same "foo" hash tag
+		{[]string{"foo}x", "bar", "foo}y", "foo"}, [][]string{{"foo}x", "foo}y", "foo"}, {"bar"}}},
+	}
+	for i, c := range cases {
+		assert.Equal(t, c.out, SplitByHashSlot(c.in), "%d", i)
+	}
+}
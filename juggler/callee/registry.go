@@ -0,0 +1,158 @@
+package callee
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"golang.org/x/net/context"
+
+	"github.com/PuerkitoBio/exp/juggler/msg"
+)
+
+var (
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// Registry holds strongly-typed functions registered for URIs, and
+// generates the ContextThunk functions that call them. The thunks
+// unmarshal the JSON arguments of the call request into the type
+// expected by the function, and return its result so that it gets
+// marshaled to JSON. The zero value is ready to use.
+//
+// A Registry is not safe for concurrent use, the functions should
+// be registered before calling Thunks.
+type Registry struct {
+	thunks map[string]ContextThunk
+}
+
+// Register registers fn as the function that handles the call requests
+// for uri. The fn value must be a function with an optional first
+// parameter of type context.Context, followed by at most one parameter
+// of any type that is used to decode the arguments of the call. It
+// must return either a value of any type and an error, a single error,
+// or a single value of any type. For example, all of these signatures
+// are valid:
+//
+//	func(context.Context, ArgsT) (ResT, error)
+//	func(ArgsT) (ResT, error)
+//	func(context.Context) error
+//	func(ArgsT) ResT
+//
+// It returns an error if fn is not a valid function or if uri is
+// already registered.
+func (r *Registry) Register(uri string, fn interface{}) error {
+	if _, ok := r.thunks[uri]; ok {
+		return fmt.Errorf("juggler/callee: URI %s is already registered", uri)
+	}
+	th, err := newTypedThunk(fn)
+	if err != nil {
+		return fmt.Errorf("juggler/callee: invalid function for URI %s: %v", uri, err)
+	}
+
+	if r.thunks == nil {
+		r.thunks = make(map[string]ContextThunk)
+	}
+	r.thunks[uri] = th
+	return nil
+}
+
+// MustRegister is like Register, but it panics if fn cannot be
+// registered.
+func (r *Registry) MustRegister(uri string, fn interface{}) {
+	if err := r.Register(uri, fn); err != nil {
+		panic(err)
+	}
+}
+
+// Thunks returns the map of URIs to the generated ContextThunk
+// functions, that can be used in a call to Callee.ListenContext.
+func (r *Registry) Thunks() map[string]ContextThunk {
+	m := make(map[string]ContextThunk, len(r.thunks))
+	for k, v := range r.thunks {
+		m[k] = v
+	}
+	return m
+}
+
+// newTypedThunk validates the signature of fn and returns the
+// ContextThunk that calls it.
+func newTypedThunk(fn interface{}) (ContextThunk, error) {
+	fv := reflect.ValueOf(fn)
+	if !fv.IsValid() {
+		return nil, errors.New("nil is not a function")
+	}
+	ft := fv.Type()
+	if ft.Kind() != reflect.Func {
+		return nil, fmt.Errorf("%s is not a function", ft)
+	}
+	if fv.IsNil() {
+		return nil, fmt.Errorf("%s is nil", ft)
+	}
+	if ft.IsVariadic() {
+		return nil, fmt.Errorf("%s is variadic", ft)
+	}
+
+	// validate the parameters
+	var withCtx bool
+	var argType reflect.Type
+	nin := ft.NumIn()
+	if nin > 0 && ft.In(0) == contextType {
+		withCtx = true
+		nin--
+	}
+	switch nin {
+	case 0:
+	case 1:
+		argType = ft.In(ft.NumIn() - 1)
+	default:
+		return nil, fmt.Errorf("%s has too many parameters", ft)
+	}
+
+	// validate the results
+	var withRes, withErr bool
+	switch ft.NumOut() {
+	case 1:
+		withErr = ft.Out(0) == errorType
+		withRes = !withErr
+	case 2:
+		if ft.Out(1) != errorType {
+			return nil, fmt.Errorf("%s does not return an error as second value", ft)
+		}
+		withRes, withErr = true, true
+	default:
+		return nil, fmt.Errorf("%s must return one or two values", ft)
+	}
+
+	return func(ctx context.Context, cp *msg.CallPayload) (interface{}, error) {
+		in := make([]reflect.Value, 0, 2)
+		if withCtx {
+			in = append(in, reflect.ValueOf(&ctx).Elem())
+		}
+		if argType != nil {
+			arg := reflect.New(argType)
+			if len(cp.Args) > 0 {
+				if err := json.Unmarshal(cp.Args, arg.Interface()); err != nil {
+					return nil, err
+				}
+			}
+			in = append(in, arg.Elem())
+		}
+
+		out := fv.Call(in)
+
+		var v interface{}
+		var err error
+		if withRes {
+			v = out[0].Interface()
+		}
+		if withErr {
+			if e := out[len(out)-1].Interface(); e != nil {
+				err = e.(error)
+			}
+		}
+		return v, err
+	}, nil
+}
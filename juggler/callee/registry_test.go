@@ -0,0 +1,126 @@
+package callee
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/PuerkitoBio/exp/juggler"
+	"github.com/PuerkitoBio/exp/juggler/msg"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type addArgs struct {
+	A, B int
+}
+
+func TestRegistryRegister(t *testing.T) {
+	cases := []struct {
+		fn interface{}
+		ok bool
+	}{
+		{func(ctx context.Context, s string) (string, error) { return s, nil }, true},
+		{func(s string) (string, error) { return s, nil }, true},
+		{func(ctx context.Context) error { return nil }, true},
+		{func() error { return nil }, true},
+		{func(a addArgs) int { return a.A + a.B }, true},
+		{func(a *addArgs) (int, error) { return a.A + a.B, nil }, true},
+		{"not a func", false},
+		{nil, false},
+		{(func() error)(nil), false},
+		{func(a, b int) (int, error) { return a + b, nil }, false},
+		{func(ctx context.Context, a, b int) error { return nil }, false},
+		{func(a ...int) error { return nil }, false},
+		{func(a int) {}, false},
+		{func(a int) (int, int) { return a, a }, false},
+		{func(a int) (int, int, error) { return a, a, nil }, false},
+	}
+	for i, c := range cases {
+		var r Registry
+		err := r.Register("a", c.fn)
+		assert.Equal(t, c.ok, err == nil, "%d: %v", i, err)
+	}
+
+	var r Registry
+	require.NoError(t, r.Register("a", func() error { return nil }), "Register")
+	assert.Error(t, r.Register("a", func() error { return nil }), "Register twice")
+	assert.Panics(t, func() { r.MustRegister("a", func() error { return nil }) }, "MustRegister twice")
+}
+
+func TestRegistryThunks(t *testing.T) {
+	var r Registry
+	r.MustRegister("add", func(ctx context.Context, a addArgs) (int, error) {
+		require.NotNil(t, ctx, "context")
+		return a.A + a.B, nil
+	})
+	r.MustRegister("addp", func(a *addArgs) int { return a.A + a.B })
+	r.MustRegister("upper", func(s string) (string, error) { return strings.ToUpper(s), nil })
+	r.MustRegister("fail", func() error { return io.ErrUnexpectedEOF })
+	r.MustRegister("ok", func(ctx context.Context) error { return nil })
+
+	cases := []struct {
+		uri  string
+		args string
+		res  interface{}
+		err  error
+	}{
+		{"add", `{"A": 1, "B": 2}`, 3, nil},
+		{"addp", `{"A": 3, "B": 4}`, 7, nil},
+		{"upper", `"abc"`, "ABC", nil},
+		{"upper", ``, "", nil},
+		{"fail", `null`, nil, io.ErrUnexpectedEOF},
+		{"ok", ``, nil, nil},
+	}
+
+	m := r.Thunks()
+	assert.Equal(t, 5, len(m), "number of thunks")
+	for i, c := range cases {
+		th := m[c.uri]
+		require.NotNil(t, th, "%d: thunk for %s", i, c.uri)
+
+		cp := &msg.CallPayload{URI: c.uri, Args: json.RawMessage(c.args)}
+		v, err := th(context.Background(), cp)
+		assert.Equal(t, c.err, err, "%d: error", i)
+		assert.Equal(t, c.res, v, "%d: result", i)
+	}
+
+	// invalid arguments
+	_, err := m["add"](context.Background(), &msg.CallPayload{URI: "add", Args: json.RawMessage(`"abc"`)})
+	assert.Error(t, err, "invalid arguments")
+}
+
+func TestRegistryListen(t *testing.T) {
+	var r Registry
+	r.MustRegister("upper", func(s string) (string, error) {
+		if s == "" {
+			return "", errors.New("empty")
+		}
+		return strings.ToUpper(s), nil
+	})
+
+	cuid := uuid.NewRandom()
+	brk := &mockCalleeBroker{
+		cps: []*msg.CallPayload{
+			{ConnUUID: cuid, MsgUUID: uuid.NewRandom(), URI: "upper", Args: json.RawMessage(`"abc"`), TTLAfterRead: time.Second},
+			{ConnUUID: cuid, MsgUUID: uuid.NewRandom(), URI: "upper", Args: json.RawMessage(`""`), TTLAfterRead: time.Second},
+		},
+		err: io.EOF,
+	}
+
+	exp := []*msg.ResPayload{
+		{ConnUUID: cuid, MsgUUID: brk.cps[0].MsgUUID, URI: "upper", Args: json.RawMessage(`"ABC"`)},
+		{ConnUUID: cuid, MsgUUID: brk.cps[1].MsgUUID, URI: "upper", Args: json.RawMessage(`{"error":{"message":"empty"}}`)},
+	}
+
+	cle := &Callee{Broker: brk, LogFunc: juggler.DiscardLog}
+	err := cle.ListenContext(context.Background(), r.Thunks())
+	assert.Equal(t, io.EOF, err, "ListenContext returns expected error")
+	assert.Equal(t, exp, brk.rps, "got expected results")
+}
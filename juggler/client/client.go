@@ -10,11 +10,26 @@
 // RPC call that succeeded (that is, for which the server returned
 // an OK message, not an ERR) either generates a RES or an EXP,
 // but never both or none.
+//
+// A call may stream its results, in which case RES messages with
+// Payload.Partial set to true are received before the final RES.
+// Only the final RES completes the call, so partial results may
+// still be followed by an EXP if the timeout expires first.
+//
+// CallAndWait makes a call and blocks until its result is received,
+// which is convenient when the result is needed synchronously. The
+// message that completes such a call is returned to the caller
+// instead of being sent to the Handler.
+//
+// A Client is bound to a single websocket connection. A
+// ReconnectingClient, obtained via DialReconnect, redials the server
+// when the connection is lost and restores its subscriptions.
 package client
 
 import (
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
 	"net/http"
 	"sync"
 	"time"
@@ -22,11 +37,24 @@ import (
 	"golang.org/x/net/context"
 
 	"github.com/PuerkitoBio/exp/juggler/broker"
+	"github.com/PuerkitoBio/exp/juggler/logger"
 	"github.com/PuerkitoBio/exp/juggler/msg"
+	"github.com/PuerkitoBio/exp/juggler/trace"
 	"github.com/gorilla/websocket"
 	"github.com/pborman/uuid"
 )
 
+// ErrNotPending is returned by Client.Cncl when the call to cancel is
+// not pending.
+var ErrNotPending = errors.New("client: call is not pending")
+
+// errCallExpired and errCallCanceled are recorded in the span of a
+// call that completes without a result.
+var (
+	errCallExpired  = errors.New("call expired")
+	errCallCanceled = errors.New("call canceled")
+)
+
 // Client is a juggler client based on a websocket connection. It can
 // be used to send and receive messages to and from a juggler server.
 type Client struct {
@@ -36,28 +64,52 @@ type Client struct {
 
 	callTimeout time.Duration
 	handler     Handler
-	logFunc     func(string, ...interface{})
+	logger      logger.Logger
+	tracer      trace.Tracer
 
 	wg      sync.WaitGroup // wait for handleMessages goroutine
 	stop    chan struct{}  // stop signal for expiration goroutines
+	wmu     sync.Mutex     // serialize writes to the websocket connection
 	conn    *websocket.Conn
-	mu      sync.Mutex // lock access to results map
-	results map[string]struct{}
+	codec   msg.Codec                 // codec of the negotiated subprotocol
+	inflate bool                      // application-level compression negotiated
+	err     error                     // error that stopped handleMessages
+	mu      sync.Mutex                // lock access to results and waiters maps
+	results map[string]*pendingCall   // pending calls by call UUID
+	waiters map[string]chan<- msg.Msg // CallAndWait calls by call UUID
 }
 
 // NewClient creates a juggler client using the provided websocket
 // connection and response header. Received messages are sent to
-// the handler set by the SetHandler option.
+// the handler set by the SetHandler option. Messages are encoded
+// with the codec of the negotiated subprotocol, or with JSON if the
+// subprotocol has no registered codec. If the response header has
+// the msg.CompressionHeader set to msg.Deflate, the messages received
+// from the server are decompressed.
 func NewClient(conn *websocket.Conn, resHeader http.Header, opts ...Option) *Client {
+	codec := msg.CodecForSubprotocol(conn.Subprotocol())
+	if codec == nil {
+		codec = msg.JSON
+	}
+
 	c := &Client{
 		ResponseHeader: resHeader,
 		conn:           conn,
+		codec:          codec,
+		inflate:        resHeader.Get(msg.CompressionHeader) == msg.Deflate,
 		stop:           make(chan struct{}),
-		results:        make(map[string]struct{}),
+		results:        make(map[string]*pendingCall),
+		waiters:        make(map[string]chan<- msg.Msg),
 	}
 	for _, opt := range opts {
 		opt(c)
 	}
+	if c.logger == nil {
+		c.logger = logger.Func(nil)
+	}
+	if c.tracer == nil {
+		c.tracer = trace.Nop
+	}
 	c.wg.Add(1)
 	go c.handleMessages()
 	return c
@@ -72,32 +124,79 @@ func (c *Client) handleMessages() {
 	for {
 		_, r, err := c.conn.NextReader()
 		if err != nil {
-			logf(c.logFunc, "client: NextReader failed: %v; stopping read loop", err)
+			c.logger.Log(logger.Warn, "client: NextReader failed; stopping read loop", logger.Err(err))
+			c.err = err
 			return
 		}
 
-		m, err := msg.UnmarshalResponse(r)
+		if c.inflate {
+			if r, err = msg.DecompressReader(r); err != nil {
+				c.logger.Log(logger.Error, "client: DecompressReader failed; skipping message", logger.Err(err))
+				continue
+			}
+		}
+
+		m, err := msg.UnmarshalResponseCodec(r, c.codec)
 		if err != nil {
-			logf(c.logFunc, "client: UnmarshalResponse failed: %v; skipping message", err)
+			c.logger.Log(logger.Error, "client: UnmarshalResponse failed; skipping message", logger.Err(err))
 			continue
 		}
 
 		switch m := m.(type) {
 		case *msg.Res:
-			// got the result, do not trigger an expired message
-			if ok := c.deletePending(m.Payload.For.String()); !ok {
+			if m.Payload.Partial {
+				// partial result, the call is still pending
+				if _, ok := c.isPending(m.Payload.For.String()); !ok {
+					continue
+				}
+				break
+			}
+
+			// got the final result, do not trigger an expired message
+			pc := c.deletePending(m.Payload.For.String())
+			if pc == nil {
 				// if an expired message got here first, then drop the
 				// result, client treated this call as expired already.
 				continue
 			}
+			pc.span.End(nil)
+			c.dispatch(m.Payload.For.String(), m)
+			continue
 
 		case *msg.Err:
 			if m.Payload.ForType == msg.CallMsg {
 				// won't get any result for this call (unless already expired)
-				c.deletePending(m.Payload.For.String())
+				if pc := c.deletePending(m.Payload.For.String()); pc != nil {
+					pc.span.End(errors.New(m.Payload.Message))
+				}
+				c.dispatch(m.Payload.For.String(), m)
+				continue
 			}
 		}
 
+		c.handle(m)
+	}
+}
+
+// dispatch sends the message m that completes the call identified by
+// key to the waiting CallAndWait, if any, or to the handler otherwise.
+func (c *Client) dispatch(key string, m msg.Msg) {
+	c.mu.Lock()
+	ch := c.waiters[key]
+	delete(c.waiters, key)
+	c.mu.Unlock()
+
+	if ch != nil {
+		ch <- m
+		return
+	}
+	c.handle(m)
+}
+
+// handle calls the handler with m in a separate goroutine, if a
+// handler is set.
+func (c *Client) handle(m msg.Msg) {
+	if c.handler != nil {
 		go c.handler.Handle(context.Background(), c, m)
 	}
 }
@@ -110,12 +209,24 @@ func (c *Client) handleMessages() {
 // create the client once the connection is established, using NewClient.
 //
 // The Dialer's Subprotocols field should be set to one of (or any/all of)
-// juggler.Subprotocol.
+// juggler.Subprotocols. The messages are encoded with the codec of the
+// negotiated subprotocol, e.g. in MessagePack for "juggler.0+msgpack".
+// If there is no registered codec for that subprotocol, the connection
+// is closed and an error is returned.
+//
+// Websocket permessage-deflate compression is negotiated if the Dialer
+// has EnableCompression set. To request the application-level
+// compression of the messages sent by the server, set the
+// msg.CompressionHeader to msg.Deflate in reqHeader.
 func Dial(d *websocket.Dialer, urlStr string, reqHeader http.Header, opts ...Option) (*Client, error) {
 	conn, res, err := d.Dial(urlStr, reqHeader)
 	if err != nil {
 		return nil, err
 	}
+	if msg.CodecForSubprotocol(conn.Subprotocol()) == nil {
+		conn.Close()
+		return nil, fmt.Errorf("client: no codec for subprotocol %q", conn.Subprotocol())
+	}
 	return NewClient(conn, res.Header, opts...), nil
 }
 
@@ -147,6 +258,12 @@ func (c *Client) UnderlyingConn() *websocket.Conn {
 // It returns the UUID of the call message on success, or an error if
 // the call request could not be sent to the server.
 func (c *Client) Call(uri string, v interface{}, timeout time.Duration) (uuid.UUID, error) {
+	return c.call(uri, v, timeout, nil)
+}
+
+// call sends the call request. If ch is not nil, the message that
+// completes the call is sent on ch instead of the handler.
+func (c *Client) call(uri string, v interface{}, timeout time.Duration, ch chan<- msg.Msg) (uuid.UUID, error) {
 	if timeout == 0 {
 		timeout = c.callTimeout
 	}
@@ -154,22 +271,52 @@ func (c *Client) Call(uri string, v interface{}, timeout time.Duration) (uuid.UU
 	if err != nil {
 		return nil, err
 	}
-	if err := c.conn.WriteJSON(m); err != nil {
+	if err := c.sendCall(m, ch, nil); err != nil {
 		return nil, err
 	}
+	return m.UUID(), nil
+}
 
-	// add the expected result
-	c.addPending(m.UUID().String())
+// sendCall sends the call message m and tracks it as pending until
+// its result is received or its timeout expires. The call is recorded
+// in span, or in a new span if span is nil, whose trace context is
+// set in the metadata of m. The span is ended when the call completes.
+func (c *Client) sendCall(m *msg.Call, ch chan<- msg.Msg, span trace.Span) error {
+	timeout := m.Payload.Timeout
+	if timeout <= 0 {
+		timeout = broker.DefaultCallTimeout
+	}
+
+	if span == nil {
+		span = c.tracer.Start("client.call", trace.FromMetadata(m.Payload.Metadata))
+		span.SetAttr(logger.MsgKey, m.UUID().String())
+		span.SetAttr(logger.URIKey, m.Payload.URI)
+		m.Payload.Metadata = trace.Inject(m.Payload.Metadata, span.Context())
+	}
+
+	// add the expected result before sending the call, so that a
+	// fast result is not dropped
+	key := m.UUID().String()
+	c.addPending(key, &pendingCall{call: m, deadline: time.Now().Add(timeout), wait: ch != nil, span: span})
+	if ch != nil {
+		c.mu.Lock()
+		c.waiters[key] = ch
+		c.mu.Unlock()
+	}
+
+	if err := c.write(m); err != nil {
+		c.deletePending(key)
+		c.deleteWaiter(key)
+		span.End(err)
+		return err
+	}
 
 	go c.handleExpiredCall(m, timeout)
-	return m.UUID(), nil
+	return nil
 }
 
 func (c *Client) handleExpiredCall(m *msg.Call, timeout time.Duration) {
 	// wait for the timeout
-	if timeout <= 0 {
-		timeout = broker.DefaultCallTimeout
-	}
 	select {
 	case <-c.stop:
 		return
@@ -177,28 +324,123 @@ func (c *Client) handleExpiredCall(m *msg.Call, timeout time.Duration) {
 	}
 
 	// check if still waiting for a result
-	if ok := c.deletePending(m.UUID().String()); ok {
+	if pc := c.deletePending(m.UUID().String()); pc != nil {
+		pc.span.End(errCallExpired)
+
 		// if so, send an Exp message
 		exp := newExp(m)
-		go c.handler.Handle(context.Background(), c, exp)
+		c.dispatch(m.UUID().String(), exp)
 	}
 }
 
+// pendingCall is a call for which the result is not received yet.
+type pendingCall struct {
+	call     *msg.Call
+	deadline time.Time
+	wait     bool       // made by CallAndWait
+	span     trace.Span // ended when the call completes
+}
+
 // add a pending call.
-func (c *Client) addPending(key string) {
+func (c *Client) addPending(key string, pc *pendingCall) {
+	c.mu.Lock()
+	c.results[key] = pc
+	c.mu.Unlock()
+}
+
+// isPending returns true if the call is still pending, along with
+// the URI of the call.
+func (c *Client) isPending(key string) (string, bool) {
 	c.mu.Lock()
-	c.results[key] = struct{}{}
+	pc, ok := c.results[key]
 	c.mu.Unlock()
+
+	if !ok {
+		return "", false
+	}
+	return pc.call.Payload.URI, true
 }
 
-// delete the pending call, returning true if it was still pending.
-func (c *Client) deletePending(key string) bool {
+// pendingCalls returns the pending calls that were not made by
+// CallAndWait.
+func (c *Client) pendingCalls() []*pendingCall {
 	c.mu.Lock()
-	_, ok := c.results[key]
+	defer c.mu.Unlock()
+
+	pcs := make([]*pendingCall, 0, len(c.results))
+	for _, pc := range c.results {
+		if !pc.wait {
+			pcs = append(pcs, pc)
+		}
+	}
+	return pcs
+}
+
+// delete the pending call, returning it if it was still pending, or
+// nil otherwise.
+func (c *Client) deletePending(key string) *pendingCall {
+	c.mu.Lock()
+	pc := c.results[key]
 	delete(c.results, key)
 	c.mu.Unlock()
 
-	return ok
+	return pc
+}
+
+// write writes v encoded with the client's codec to the websocket
+// connection.
+func (c *Client) write(v interface{}) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	mt := websocket.TextMessage
+	if c.codec.Binary() {
+		mt = websocket.BinaryMessage
+	}
+	w, err := c.conn.NextWriter(mt)
+	if err != nil {
+		return err
+	}
+	if err := c.codec.Encode(w, v); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// delete the CallAndWait waiter of a call.
+func (c *Client) deleteWaiter(key string) {
+	c.mu.Lock()
+	delete(c.waiters, key)
+	c.mu.Unlock()
+}
+
+// Cncl makes a cancellation request to the server for the call
+// identified by callUUID. If the call is still queued, it is dropped,
+// and if it is being processed, the callee is notified so that it
+// can stop early. The call is no longer pending once Cncl returns
+// successfully, so no RES or EXP message is received for it.
+//
+// It returns the UUID of the cncl message on success, ErrNotPending
+// if the call is not pending (e.g. if its result was already received),
+// or an error if the request could not be sent to the server.
+func (c *Client) Cncl(callUUID uuid.UUID) (uuid.UUID, error) {
+	key := callUUID.String()
+	uri, ok := c.isPending(key)
+	if !ok {
+		return nil, ErrNotPending
+	}
+
+	m := &msg.Cncl{Meta: msg.NewMeta(msg.CnclMsg)}
+	m.Payload.For = callUUID
+	m.Payload.URI = uri
+	if err := c.write(m); err != nil {
+		return nil, err
+	}
+	if pc := c.deletePending(key); pc != nil {
+		pc.span.End(errCallCanceled)
+	}
+	return m.UUID(), nil
 }
 
 // Sub makes a subscription request to the server for the specified
@@ -207,7 +449,7 @@ func (c *Client) deletePending(key string) bool {
 // the request could not be sent to the server.
 func (c *Client) Sub(channel string, pattern bool) (uuid.UUID, error) {
 	m := msg.NewSub(channel, pattern)
-	if err := c.conn.WriteJSON(m); err != nil {
+	if err := c.write(m); err != nil {
 		return nil, err
 	}
 	return m.UUID(), nil
@@ -219,7 +461,7 @@ func (c *Client) Sub(channel string, pattern bool) (uuid.UUID, error) {
 // the request could not be sent to the server.
 func (c *Client) Unsb(channel string, pattern bool) (uuid.UUID, error) {
 	m := msg.NewUnsb(channel, pattern)
-	if err := c.conn.WriteJSON(m); err != nil {
+	if err := c.write(m); err != nil {
 		return nil, err
 	}
 	return m.UUID(), nil
@@ -234,7 +476,7 @@ func (c *Client) Pub(channel string, v interface{}) (uuid.UUID, error) {
 	if err != nil {
 		return nil, err
 	}
-	if err := c.conn.WriteJSON(m); err != nil {
+	if err := c.write(m); err != nil {
 		return nil, err
 	}
 	return m.UUID(), nil
@@ -270,7 +512,8 @@ func SetCallTimeout(timeout time.Duration) Option {
 // SetHandler sets the handler that is called with each message
 // received from the server. Each invocation runs in its own
 // goroutine, so proper synchronization must be used when accessing
-// shared data.
+// shared data. If no handler is set, the received messages are
+// dropped, except those that complete a call made with CallAndWait.
 func SetHandler(h Handler) Option {
 	return func(c *Client) {
 		c.handler = h
@@ -280,10 +523,25 @@ func SetHandler(h Handler) Option {
 // SetLogFunc sets the function used to log errors that occur outside
 // the handler calls, such as when a message fails to be unmarshaled.
 // If nil, it logs using log.Printf. It can be set to juggler.DiscardLog
-// to disable logging.
+// to disable logging. It is the same as SetLogger with a logger.Func.
 func SetLogFunc(fn func(string, ...interface{})) Option {
+	return SetLogger(logger.Func(fn))
+}
+
+// SetLogger sets the structured logger used to log errors that occur
+// outside the handler calls. By default, it logs using log.Printf.
+func SetLogger(l logger.Logger) Option {
 	return func(c *Client) {
-		c.logFunc = fn
+		c.logger = l
+	}
+}
+
+// SetTracer sets the tracer used to record the spans of the calls.
+// The trace context of each call is sent to the server in the call's
+// metadata. By default, no span is recorded.
+func SetTracer(t trace.Tracer) Option {
+	return func(c *Client) {
+		c.tracer = t
 	}
 }
 
@@ -313,11 +571,3 @@ func newExp(m *msg.Call) *Exp {
 	exp.Payload.Args = m.Payload.Args
 	return exp
 }
-
-func logf(fn func(string, ...interface{}), f string, args ...interface{}) {
-	if fn != nil {
-		fn(f, args...)
-	} else {
-		log.Printf(f, args...)
-	}
-}
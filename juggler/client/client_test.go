@@ -123,3 +123,102 @@ func TestClient(t *testing.T) {
 		assert.Equal(t, io.EOF, finalErr, "EOF")
 	}
 }
+
+func TestClientPartialResults(t *testing.T) {
+	done := make(chan bool, 1)
+	srv := wstest.StartServer(t, done, func(c *websocket.Conn) {
+		var call msg.Call
+		if err := c.ReadJSON(&call); !assert.NoError(t, err, "read call") {
+			return
+		}
+		rps := []*msg.ResPayload{
+			{MsgUUID: call.UUID(), URI: call.Payload.URI, Args: json.RawMessage(`1`), Partial: true, Seq: 1},
+			{MsgUUID: call.UUID(), URI: call.Payload.URI, Args: json.RawMessage(`2`), Partial: true, Seq: 2},
+			{MsgUUID: call.UUID(), URI: call.Payload.URI, Args: json.RawMessage(`3`), Seq: 3},
+			// dropped, the call is completed
+			{MsgUUID: call.UUID(), URI: call.Payload.URI, Args: json.RawMessage(`4`), Partial: true, Seq: 4},
+		}
+		for i, rp := range rps {
+			require.NoError(t, c.WriteJSON(msg.NewRes(rp)), "write res %d", i)
+		}
+		// wait for the client to close the connection
+		c.NextReader()
+	})
+	defer srv.Close()
+
+	var (
+		mu   sync.Mutex
+		seqs = make(map[int]bool)
+		wg   sync.WaitGroup
+	)
+	h := HandlerFunc(func(ctx context.Context, cli *Client, m msg.Msg) {
+		defer wg.Done()
+
+		mu.Lock()
+		defer mu.Unlock()
+		if assert.Equal(t, msg.ResMsg, m.Type(), "Expects RES message") {
+			res := m.(*msg.Res)
+			seqs[res.Payload.Seq] = res.Payload.Partial
+		}
+	})
+
+	cli, err := Dial(&websocket.Dialer{}, srv.URL, nil, SetHandler(h),
+		SetLogFunc((&jugglertest.DebugLog{T: t}).Printf))
+	require.NoError(t, err, "Dial")
+
+	wg.Add(3)
+	_, err = cli.Call("a", "call", time.Second)
+	require.NoError(t, err, "Call")
+	wg.Wait()
+
+	// give the client time to process the last partial result
+	time.Sleep(10 * time.Millisecond)
+	cli.Close()
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, map[int]bool{1: true, 2: true, 3: false}, seqs, "got expected results")
+}
+
+func TestClientCncl(t *testing.T) {
+	var buf bytes.Buffer
+	done := make(chan bool, 1)
+	srv := wstest.StartRecordingServer(t, done, &buf)
+	defer srv.Close()
+
+	h := HandlerFunc(func(ctx context.Context, cli *Client, m msg.Msg) {
+		assert.Fail(t, "unexpected message", "%s", m.Type())
+	})
+	cli, err := Dial(&websocket.Dialer{}, srv.URL, nil, SetHandler(h),
+		SetCallTimeout(10*time.Millisecond),
+		SetLogFunc((&jugglertest.DebugLog{T: t}).Printf))
+	require.NoError(t, err, "Dial")
+
+	callUUID, err := cli.Call("a", "call", 0)
+	require.NoError(t, err, "Call")
+	cnclUUID, err := cli.Cncl(callUUID)
+	require.NoError(t, err, "Cncl")
+
+	// the call is no longer pending
+	_, err = cli.Cncl(callUUID)
+	assert.Equal(t, ErrNotPending, err, "Cncl after Cncl")
+
+	// no EXP is raised for the call
+	time.Sleep(20 * time.Millisecond)
+	cli.Close()
+	<-done
+
+	var p json.RawMessage
+	dec := json.NewDecoder(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, dec.Decode(&p), "Decode call")
+	require.NoError(t, dec.Decode(&p), "Decode cncl")
+	m, err := msg.UnmarshalRequest(bytes.NewReader(p))
+	require.NoError(t, err, "UnmarshalRequest")
+	if assert.Equal(t, msg.CnclMsg, m.Type(), "type") {
+		cncl := m.(*msg.Cncl)
+		assert.Equal(t, cnclUUID, cncl.UUID(), "cncl uuid")
+		assert.Equal(t, callUUID, cncl.Payload.For, "for")
+		assert.Equal(t, "a", cncl.Payload.URI, "uri")
+	}
+}
@@ -0,0 +1,382 @@
+package client
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/PuerkitoBio/exp/juggler/logger"
+	"github.com/PuerkitoBio/exp/juggler/msg"
+	"github.com/gorilla/websocket"
+	"github.com/pborman/uuid"
+)
+
+// ErrConnLost is the error of the ERR messages raised by a
+// ReconnectingClient for the pending calls that failed because
+// the connection was lost.
+var ErrConnLost = errors.New("client: connection lost")
+
+// The default backoff delays of a ReconnectingClient.
+const (
+	DefaultMinBackoff = 100 * time.Millisecond
+	DefaultMaxBackoff = 10 * time.Second
+)
+
+// ConnState represents the possible states of the connection of a
+// ReconnectingClient.
+type ConnState int
+
+// The list of possible connection states.
+const (
+	Connected ConnState = iota
+	Disconnected
+	Closed
+)
+
+// PendingCallPolicy defines what happens to the pending calls of a
+// ReconnectingClient when the connection is lost.
+type PendingCallPolicy int
+
+// The list of pending call policies.
+const (
+	// FailPendingCalls raises an ERR message with code 503 for each
+	// pending call when the connection is lost.
+	FailPendingCalls PendingCallPolicy = iota
+
+	// RetryPendingCalls sends the pending calls again, with the same
+	// UUID and the remaining timeout, once the connection is restored.
+	// The calls that expired in the meantime raise an EXP message.
+	// As the original call may have been processed already, the
+	// remote procedures should be idempotent.
+	RetryPendingCalls
+)
+
+// ReconnectConfig configures a ReconnectingClient.
+type ReconnectConfig struct {
+	// MinBackoff is the delay before the first reconnection attempt.
+	// It doubles after each failed attempt, up to MaxBackoff. The
+	// zero values use DefaultMinBackoff and DefaultMaxBackoff.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// MaxAttempts is the maximum number of consecutive reconnection
+	// attempts before the client gives up and gets closed. The
+	// default of 0 means no limit.
+	MaxAttempts int
+
+	// PendingCalls is the policy applied to the pending calls when
+	// the connection is lost.
+	PendingCalls PendingCallPolicy
+
+	// ConnState specifies an optional callback function that is called
+	// when the connection changes state. The error is the cause of the
+	// Disconnected state, or of the Closed state if the client gave up
+	// reconnecting. It is called synchronously by the goroutine that
+	// manages the connection, so it should return quickly.
+	ConnState func(*ReconnectingClient, ConnState, error)
+}
+
+type subscription struct {
+	channel string
+	pattern bool
+}
+
+// ReconnectingClient is a juggler client that automatically redials
+// the server when the websocket connection is lost. It keeps track
+// of the subscriptions made via Sub and Unsb and restores them once
+// reconnected, and it applies the configured PendingCallPolicy to
+// the pending calls.
+//
+// Each connection is handled by its own Client, created with the
+// same options, so the *Client received by the Handler is the one
+// of the connection that received the message.
+type ReconnectingClient struct {
+	dialer *websocket.Dialer
+	urlStr string
+	header http.Header
+	opts   []Option
+	conf   ReconnectConfig
+
+	closeOnce sync.Once
+	kill      chan struct{} // closed by Close
+	done      chan struct{} // closed when the client is closed for good
+	wg        sync.WaitGroup
+
+	mu   sync.Mutex // lock access to the following fields
+	cli  *Client
+	up   chan struct{} // closed when cli is connected
+	subs map[subscription]struct{}
+}
+
+// DialReconnect creates a ReconnectingClient connected to urlStr
+// using the provided *websocket.Dialer and request headers, and the
+// options to apply to the Client of each connection. If conf is nil,
+// the default configuration is used. The initial connection is not
+// retried, it returns an error if it fails.
+func DialReconnect(d *websocket.Dialer, urlStr string, reqHeader http.Header, conf *ReconnectConfig, opts ...Option) (*ReconnectingClient, error) {
+	cli, err := Dial(d, urlStr, reqHeader, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	rc := &ReconnectingClient{
+		dialer: d,
+		urlStr: urlStr,
+		header: reqHeader,
+		opts:   opts,
+		kill:   make(chan struct{}),
+		done:   make(chan struct{}),
+		cli:    cli,
+		up:     make(chan struct{}),
+		subs:   make(map[subscription]struct{}),
+	}
+	if conf != nil {
+		rc.conf = *conf
+	}
+	if rc.conf.MinBackoff <= 0 {
+		rc.conf.MinBackoff = DefaultMinBackoff
+	}
+	if rc.conf.MaxBackoff <= 0 {
+		rc.conf.MaxBackoff = DefaultMaxBackoff
+	}
+
+	close(rc.up)
+	rc.setState(Connected, nil)
+
+	rc.wg.Add(1)
+	go rc.run()
+	return rc, nil
+}
+
+// Close closes the connection and stops reconnecting. No more messages
+// will be received.
+func (rc *ReconnectingClient) Close() error {
+	var err error
+	rc.closeOnce.Do(func() {
+		close(rc.kill)
+		err = rc.Client().Close()
+	})
+	rc.wg.Wait()
+	return err
+}
+
+// CloseNotify returns a channel that is closed when the client is
+// closed for good, either because Close was called or because it
+// gave up reconnecting.
+func (rc *ReconnectingClient) CloseNotify() <-chan struct{} {
+	return rc.done
+}
+
+// Client returns the Client of the current connection. It may be
+// disconnected, in which case its methods fail.
+func (rc *ReconnectingClient) Client() *Client {
+	rc.mu.Lock()
+	cli := rc.cli
+	rc.mu.Unlock()
+	return cli
+}
+
+// Call makes a call request using the current connection. See
+// Client.Call for details.
+func (rc *ReconnectingClient) Call(uri string, v interface{}, timeout time.Duration) (uuid.UUID, error) {
+	return rc.Client().Call(uri, v, timeout)
+}
+
+// CallAndWait makes a call request and waits for its result. See
+// Client.CallAndWait for details. If the connection is down, it waits
+// for the connection to be restored. If the connection is lost before
+// the result is received, it returns ErrClosed under the
+// FailPendingCalls policy, and it makes the call again on the new
+// connection under the RetryPendingCalls policy.
+func (rc *ReconnectingClient) CallAndWait(ctx context.Context, uri string, v interface{}, result interface{}) error {
+	for {
+		cli, err := rc.connected(ctx)
+		if err != nil {
+			return err
+		}
+		err = cli.CallAndWait(ctx, uri, v, result)
+		if err != ErrClosed || rc.conf.PendingCalls != RetryPendingCalls {
+			return err
+		}
+	}
+}
+
+// Cncl makes a cancellation request using the current connection.
+// See Client.Cncl for details.
+func (rc *ReconnectingClient) Cncl(callUUID uuid.UUID) (uuid.UUID, error) {
+	return rc.Client().Cncl(callUUID)
+}
+
+// Sub makes a subscription request using the current connection. See
+// Client.Sub for details. The subscription is recorded even if the
+// request fails, and it is restored when the client reconnects.
+func (rc *ReconnectingClient) Sub(channel string, pattern bool) (uuid.UUID, error) {
+	rc.mu.Lock()
+	rc.subs[subscription{channel, pattern}] = struct{}{}
+	cli := rc.cli
+	rc.mu.Unlock()
+
+	return cli.Sub(channel, pattern)
+}
+
+// Unsb makes an unsubscription request using the current connection.
+// See Client.Unsb for details. The subscription is forgotten even if
+// the request fails, so it is not restored when the client reconnects.
+func (rc *ReconnectingClient) Unsb(channel string, pattern bool) (uuid.UUID, error) {
+	rc.mu.Lock()
+	delete(rc.subs, subscription{channel, pattern})
+	cli := rc.cli
+	rc.mu.Unlock()
+
+	return cli.Unsb(channel, pattern)
+}
+
+// Pub makes a publish request using the current connection. See
+// Client.Pub for details.
+func (rc *ReconnectingClient) Pub(channel string, v interface{}) (uuid.UUID, error) {
+	return rc.Client().Pub(channel, v)
+}
+
+// connected returns the Client of the current connection once it is
+// connected.
+func (rc *ReconnectingClient) connected(ctx context.Context) (*Client, error) {
+	rc.mu.Lock()
+	up := rc.up
+	rc.mu.Unlock()
+
+	// if up is not closed yet, it gets closed when the connection is
+	// restored, and the new client is then the current one.
+	select {
+	case <-up:
+		return rc.Client(), nil
+	case <-rc.done:
+		return nil, ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (rc *ReconnectingClient) setState(cs ConnState, err error) {
+	if fn := rc.conf.ConnState; fn != nil {
+		fn(rc, cs, err)
+	}
+}
+
+func (rc *ReconnectingClient) run() {
+	defer func() {
+		close(rc.done)
+		rc.wg.Done()
+	}()
+
+	cli := rc.Client()
+	for {
+		<-cli.CloseNotify()
+
+		select {
+		case <-rc.kill:
+			rc.setState(Closed, nil)
+			return
+		default:
+		}
+
+		rc.mu.Lock()
+		rc.up = make(chan struct{})
+		rc.mu.Unlock()
+		rc.setState(Disconnected, cli.err)
+
+		newCli, err := rc.redial(cli.logger)
+		if err != nil {
+			if err == ErrClosed {
+				// Close was called while reconnecting
+				rc.setState(Closed, nil)
+				return
+			}
+			for _, pc := range cli.pendingCalls() {
+				pc.span.End(ErrConnLost)
+				cli.handle(msg.NewErr(pc.call, 503, ErrConnLost))
+			}
+			rc.setState(Closed, err)
+			return
+		}
+
+		rc.mu.Lock()
+		select {
+		case <-rc.kill:
+			rc.mu.Unlock()
+			newCli.Close()
+			rc.setState(Closed, nil)
+			return
+		default:
+		}
+		rc.cli = newCli
+		close(rc.up)
+		subs := make([]subscription, 0, len(rc.subs))
+		for sub := range rc.subs {
+			subs = append(subs, sub)
+		}
+		rc.mu.Unlock()
+
+		for _, sub := range subs {
+			if _, err := newCli.Sub(sub.channel, sub.pattern); err != nil {
+				newCli.logger.Log(logger.Error, "client: failed to restore subscription", logger.Channel(sub.channel), logger.F("pattern", sub.pattern), logger.Err(err))
+			}
+		}
+		rc.resumeCalls(cli, newCli)
+
+		rc.setState(Connected, nil)
+		cli = newCli
+	}
+}
+
+// redial dials the server until it succeeds, the maximum number of
+// attempts is reached or the client is closed, in which case it
+// returns ErrClosed.
+func (rc *ReconnectingClient) redial(lg logger.Logger) (*Client, error) {
+	backoff := rc.conf.MinBackoff
+	var err error
+	for i := 1; rc.conf.MaxAttempts <= 0 || i <= rc.conf.MaxAttempts; i++ {
+		select {
+		case <-rc.kill:
+			return nil, ErrClosed
+		case <-time.After(backoff):
+		}
+
+		var cli *Client
+		if cli, err = Dial(rc.dialer, rc.urlStr, rc.header, rc.opts...); err == nil {
+			return cli, nil
+		}
+		lg.Log(logger.Warn, "client: reconnection attempt failed", logger.F("attempt", i), logger.Err(err))
+
+		if backoff *= 2; backoff > rc.conf.MaxBackoff {
+			backoff = rc.conf.MaxBackoff
+		}
+	}
+	return nil, err
+}
+
+// resumeCalls applies the pending call policy to the pending calls of
+// the old client, raising the resulting messages on the new client.
+func (rc *ReconnectingClient) resumeCalls(old, cli *Client) {
+	for _, pc := range old.pendingCalls() {
+		if rc.conf.PendingCalls != RetryPendingCalls {
+			pc.span.End(ErrConnLost)
+			cli.handle(msg.NewErr(pc.call, 503, ErrConnLost))
+			continue
+		}
+
+		remaining := pc.deadline.Sub(time.Now())
+		if remaining <= 0 {
+			pc.span.End(errCallExpired)
+			cli.handle(newExp(pc.call))
+			continue
+		}
+		m := *pc.call
+		m.Payload.Timeout = remaining
+		if err := cli.sendCall(&m, nil, pc.span); err != nil {
+			cli.handle(msg.NewErr(pc.call, 503, err))
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package client
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/PuerkitoBio/exp/juggler/internal/jugglertest"
+	"github.com/PuerkitoBio/exp/juggler/internal/wstest"
+	"github.com/PuerkitoBio/exp/juggler/msg"
+	"github.com/PuerkitoBio/exp/juggler/trace"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stateRecorder records the connection states of a ReconnectingClient.
+type stateRecorder struct {
+	mu     sync.Mutex
+	states []ConnState
+}
+
+func (r *stateRecorder) record(rc *ReconnectingClient, cs ConnState, err error) {
+	r.mu.Lock()
+	r.states = append(r.states, cs)
+	r.mu.Unlock()
+}
+
+func (r *stateRecorder) get() []ConnState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]ConnState(nil), r.states...)
+}
+
+func TestReconnectRetry(t *testing.T) {
+	type received struct {
+		conn int
+		m    msg.Msg
+	}
+
+	var (
+		mu    sync.Mutex
+		conns int
+	)
+	recv := make(chan received, 10)
+	done := make(chan bool, 2)
+	srv := wstest.StartServer(t, done, func(c *websocket.Conn) {
+		mu.Lock()
+		conns++
+		n := conns
+		mu.Unlock()
+
+		for {
+			_, r, err := c.NextReader()
+			if err != nil {
+				return
+			}
+			m, err := msg.UnmarshalRequest(r)
+			if !assert.NoError(t, err, "UnmarshalRequest") {
+				return
+			}
+			recv <- received{n, m}
+
+			call, ok := m.(*msg.Call)
+			if !ok {
+				continue
+			}
+			if n == 1 {
+				// drop the first connection without replying
+				return
+			}
+			rp := &msg.ResPayload{MsgUUID: call.UUID(), URI: call.Payload.URI, Args: call.Payload.Args}
+			require.NoError(t, c.WriteJSON(msg.NewRes(rp)), "write res")
+		}
+	})
+	defer srv.Close()
+
+	results := make(chan *msg.Res, 1)
+	h := HandlerFunc(func(ctx context.Context, cli *Client, m msg.Msg) {
+		if assert.Equal(t, msg.ResMsg, m.Type(), "Expects RES message") {
+			results <- m.(*msg.Res)
+		}
+	})
+
+	var sr stateRecorder
+	rc, err := DialReconnect(&websocket.Dialer{}, srv.URL, nil,
+		&ReconnectConfig{MinBackoff: 10 * time.Millisecond, PendingCalls: RetryPendingCalls, ConnState: sr.record},
+		SetHandler(h), SetCallTimeout(time.Second),
+		SetLogFunc((&jugglertest.DebugLog{T: t}).Printf))
+	require.NoError(t, err, "DialReconnect")
+
+	_, err = rc.Sub("a", false)
+	require.NoError(t, err, "Sub a")
+	_, err = rc.Sub("b", true)
+	require.NoError(t, err, "Sub b")
+	_, err = rc.Unsb("b", true)
+	require.NoError(t, err, "Unsb b")
+	callUUID, err := rc.Call("echo", "x", 0)
+	require.NoError(t, err, "Call")
+
+	select {
+	case res := <-results:
+		assert.Equal(t, callUUID, res.Payload.For, "result for")
+		assert.Equal(t, json.RawMessage(`"x"`), res.Payload.Args, "result args")
+	case <-time.After(time.Second):
+		require.FailNow(t, "no result received")
+	}
+
+	// CallAndWait works on the new connection
+	var s string
+	if assert.NoError(t, rc.CallAndWait(context.Background(), "echo", "y", &s), "CallAndWait") {
+		assert.Equal(t, "y", s, "CallAndWait result")
+	}
+
+	require.NoError(t, rc.Close(), "Close")
+	<-done
+	<-done
+	<-rc.CloseNotify()
+
+	assert.Equal(t, []ConnState{Connected, Disconnected, Connected, Closed}, sr.get(), "states")
+
+	close(recv)
+	var got []string
+	for r := range recv {
+		switch m := r.m.(type) {
+		case *msg.Sub:
+			got = append(got, string(rune('0'+r.conn))+" SUB "+m.Payload.Channel)
+		case *msg.Unsb:
+			got = append(got, string(rune('0'+r.conn))+" UNSB "+m.Payload.Channel)
+		case *msg.Call:
+			if m.UUID().String() == callUUID.String() {
+				got = append(got, string(rune('0'+r.conn))+" CALL "+m.Payload.URI)
+			}
+		}
+	}
+	assert.Equal(t, []string{"1 SUB a", "1 SUB b", "1 UNSB b", "1 CALL echo", "2 SUB a", "2 CALL echo"}, got, "received messages")
+}
+
+func TestReconnectFail(t *testing.T) {
+	done := make(chan bool, 1)
+	called := make(chan bool, 1)
+	srv := wstest.StartServer(t, done, func(c *websocket.Conn) {
+		// drop the connection on the first call
+		c.NextReader()
+		called <- true
+	})
+
+	errs := make(chan *msg.Err, 1)
+	h := HandlerFunc(func(ctx context.Context, cli *Client, m msg.Msg) {
+		if assert.Equal(t, msg.ErrMsg, m.Type(), "Expects ERR message") {
+			errs <- m.(*msg.Err)
+		}
+	})
+
+	var sr stateRecorder
+	var exp trace.MemoryExporter
+	rc, err := DialReconnect(&websocket.Dialer{}, srv.URL, nil,
+		&ReconnectConfig{MinBackoff: 50 * time.Millisecond, MaxAttempts: 2, ConnState: sr.record},
+		SetHandler(h), SetCallTimeout(time.Second), SetTracer(trace.NewTracer(&exp)),
+		SetLogFunc((&jugglertest.DebugLog{T: t}).Printf))
+	require.NoError(t, err, "DialReconnect")
+
+	callUUID, err := rc.Call("a", nil, 0)
+	require.NoError(t, err, "Call")
+
+	// stop the server so that reconnection fails
+	<-called
+	srv.Close()
+	<-done
+
+	select {
+	case e := <-errs:
+		assert.Equal(t, callUUID, e.Payload.For, "err for")
+		assert.Equal(t, 503, e.Payload.Code, "err code")
+		assert.Equal(t, ErrConnLost.Error(), e.Payload.Message, "err message")
+	case <-time.After(time.Second):
+		assert.Fail(t, "no ERR received")
+	}
+
+	<-rc.CloseNotify()
+	assert.Equal(t, []ConnState{Connected, Disconnected, Closed}, sr.get(), "states")
+	assert.Equal(t, ErrClosed, rc.CallAndWait(context.Background(), "a", nil, nil), "CallAndWait after give up")
+	if spans := exp.Spans(); assert.Equal(t, 1, len(spans), "ended spans") {
+		assert.Equal(t, ErrConnLost, spans[0].Err, "call span error")
+	}
+}
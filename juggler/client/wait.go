@@ -0,0 +1,122 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"golang.org/x/net/context"
+
+	"github.com/PuerkitoBio/exp/juggler/msg"
+)
+
+var (
+	// ErrCallExpired is returned by CallAndWait when the call timeout
+	// expires before the result is received.
+	ErrCallExpired = errors.New("client: call expired")
+
+	// ErrClosed is returned by CallAndWait when the connection is
+	// closed before the result is received.
+	ErrClosed = errors.New("client: closed")
+)
+
+// CallError is the error returned by CallAndWait when the server
+// replies to the call request with an ERR message, e.g. because
+// the call could not be registered in the broker.
+type CallError struct {
+	Code    int
+	Message string
+}
+
+// Error returns the error message.
+func (e *CallError) Error() string {
+	return fmt.Sprintf("client: call failed with code %d: %s", e.Code, e.Message)
+}
+
+// ResultError is the error returned by CallAndWait when the callee
+// returned an error as result of the call. Message is the message of
+// the msg.ErrResult payload, and Args is the raw JSON result, which
+// can be used to decode custom error payloads.
+type ResultError struct {
+	Message string
+	Args    json.RawMessage
+}
+
+// Error returns the error message.
+func (e *ResultError) Error() string {
+	return "client: call returned an error: " + e.Message
+}
+
+// CallAndWait makes a call request to the server for the remote
+// procedure identified by uri, like Call, and waits for its result.
+// The v value is marshaled as JSON and sent as the parameters to the
+// remote procedure. The call uses Client.CallTimeout as timeout.
+//
+// If the result is received, it is unmarshaled into result, unless
+// result is nil. If the callee returned an error, a *ResultError is
+// returned instead. If the server replied with an ERR message, a
+// *CallError is returned. If the call timeout expires first,
+// ErrCallExpired is returned, and if the client is closed first,
+// ErrClosed is returned.
+//
+// If ctx is done before the result is received, the call is canceled
+// with a CNCL message and ctx.Err() is returned.
+//
+// The messages that complete the call are not sent to the Handler,
+// but the OK message for the call and its partial results are.
+func (c *Client) CallAndWait(ctx context.Context, uri string, v interface{}, result interface{}) error {
+	ch := make(chan msg.Msg, 1)
+	callUUID, err := c.call(uri, v, 0, ch)
+	if err != nil {
+		return err
+	}
+
+	var m msg.Msg
+	select {
+	case m = <-ch:
+	case <-c.stop:
+		c.deleteWaiter(callUUID.String())
+		return ErrClosed
+	case <-ctx.Done():
+		c.deleteWaiter(callUUID.String())
+		c.Cncl(callUUID)
+		return ctx.Err()
+	}
+
+	switch m := m.(type) {
+	case *msg.Res:
+		if er := decodeErrResult(m.Payload.Args); er != nil {
+			return er
+		}
+		if result == nil {
+			return nil
+		}
+		return json.Unmarshal(m.Payload.Args, result)
+
+	case *msg.Err:
+		return &CallError{Code: m.Payload.Code, Message: m.Payload.Message}
+
+	case *Exp:
+		return ErrCallExpired
+
+	default:
+		return fmt.Errorf("client: unexpected message %s for call %v", m.Type(), callUUID)
+	}
+}
+
+// decodeErrResult returns a *ResultError if the args are those of a
+// msg.ErrResult, nil otherwise.
+func decodeErrResult(args json.RawMessage) *ResultError {
+	var er struct {
+		Error *struct {
+			Message *string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(args, &er); err != nil {
+		return nil
+	}
+	if er.Error == nil || er.Error.Message == nil {
+		return nil
+	}
+	return &ResultError{Message: *er.Error.Message, Args: args}
+}
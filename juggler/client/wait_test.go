@@ -0,0 +1,107 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/PuerkitoBio/exp/juggler/internal/jugglertest"
+	"github.com/PuerkitoBio/exp/juggler/internal/wstest"
+	"github.com/PuerkitoBio/exp/juggler/msg"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCallAndWait(t *testing.T) {
+	done := make(chan bool, 1)
+	cncls := make(chan *msg.Cncl, 1)
+	srv := wstest.StartServer(t, done, func(c *websocket.Conn) {
+		for {
+			_, r, err := c.NextReader()
+			if err != nil {
+				return
+			}
+			m, err := msg.UnmarshalRequest(r)
+			if !assert.NoError(t, err, "UnmarshalRequest") {
+				return
+			}
+
+			switch m := m.(type) {
+			case *msg.Call:
+				rp := &msg.ResPayload{MsgUUID: m.UUID(), URI: m.Payload.URI}
+				switch m.Payload.URI {
+				case "echo":
+					rp.Args = m.Payload.Args
+				case "fail":
+					var er msg.ErrResult
+					er.Error.Message = "failed"
+					b, _ := json.Marshal(er)
+					rp.Args = b
+				case "err":
+					require.NoError(t, c.WriteJSON(msg.NewErr(m, 500, errors.New("broker error"))), "write err")
+					continue
+				default:
+					// no result
+					continue
+				}
+				require.NoError(t, c.WriteJSON(msg.NewOK(m)), "write ok")
+				require.NoError(t, c.WriteJSON(msg.NewRes(rp)), "write res")
+
+			case *msg.Cncl:
+				cncls <- m
+			}
+		}
+	})
+	defer srv.Close()
+
+	cli, err := Dial(&websocket.Dialer{}, srv.URL, nil,
+		SetCallTimeout(50*time.Millisecond),
+		SetLogFunc((&jugglertest.DebugLog{T: t}).Printf))
+	require.NoError(t, err, "Dial")
+
+	ctx := context.Background()
+
+	// successful call
+	var s string
+	if assert.NoError(t, cli.CallAndWait(ctx, "echo", "abc", &s), "echo") {
+		assert.Equal(t, "abc", s, "echo result")
+	}
+	assert.NoError(t, cli.CallAndWait(ctx, "echo", "abc", nil), "echo with nil result")
+
+	// callee error
+	err = cli.CallAndWait(ctx, "fail", nil, &s)
+	if assert.IsType(t, &ResultError{}, err, "fail") {
+		assert.Equal(t, "failed", err.(*ResultError).Message, "fail message")
+	}
+
+	// server error
+	err = cli.CallAndWait(ctx, "err", nil, &s)
+	if assert.IsType(t, &CallError{}, err, "err") {
+		assert.Equal(t, 500, err.(*CallError).Code, "err code")
+		assert.Equal(t, "broker error", err.(*CallError).Message, "err message")
+	}
+
+	// call timeout
+	assert.Equal(t, ErrCallExpired, cli.CallAndWait(ctx, "none", nil, &s), "expired")
+
+	// context canceled
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, cli.CallAndWait(ctx, "none", nil, &s), "canceled")
+	select {
+	case cncl := <-cncls:
+		assert.Equal(t, "none", cncl.Payload.URI, "cncl uri")
+	case <-time.After(100 * time.Millisecond):
+		assert.Fail(t, "no CNCL received")
+	}
+
+	cli.Close()
+	<-done
+
+	// client closed
+	assert.Error(t, cli.CallAndWait(context.Background(), "echo", "abc", &s), "after Close")
+}
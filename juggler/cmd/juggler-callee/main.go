@@ -1,20 +1,23 @@
 // Command juggler-callee implements a testing callee that provides
 // simple URI functions.
 //
-//     - test.echo (string) : returns the received string
-//     - test.reverse (string) : reverses each rune in the received string
-//     - test.delay (string) : sleeps for the duration received as string, converted to number (in ms)
-//
+//   - test.echo (string) : returns the received string
+//   - test.reverse (string) : reverses each rune in the received string
+//   - test.delay (string) : sleeps for the duration received as string, converted to number (in ms)
 package main
 
 import (
-	"encoding/json"
 	"flag"
 	"log"
+	"os"
+	"os/signal"
 	"strconv"
-	"sync"
+	"strings"
+	"syscall"
 	"time"
 
+	"golang.org/x/net/context"
+
 	"github.com/PuerkitoBio/exp/juggler/broker"
 	"github.com/PuerkitoBio/exp/juggler/broker/redisbroker"
 	"github.com/PuerkitoBio/exp/juggler/callee"
@@ -23,20 +26,28 @@ import (
 )
 
 var (
-	redisAddrFlag             = flag.String("redis", ":6379", "Redis `address`.")
+	redisAddrFlag             = flag.String("redis", ":6379", "Redis `address`, or comma-separated list of cluster nodes with -redis-cluster, or of sentinels with -redis-master-name.")
+	redisClusterFlag          = flag.Bool("redis-cluster", false, "Connect to a redis cluster.")
+	redisMasterNameFlag       = flag.String("redis-master-name", "", "Connect to the redis master with this `name`, monitored by sentinels.")
 	redisPoolMaxActiveFlag    = flag.Int("redis-max-active", 100, "Maximum active redis `connections`.")
 	redisPoolMaxIdleFlag      = flag.Int("redis-max-idle", 10, "Maximum idle redis `connections`.")
 	redisPoolIdleTimeoutFlag  = flag.Duration("redis-idle-timeout", time.Minute, "Redis idle connection `timeout`.")
 	brokerResultCapFlag       = flag.Int("broker-result-cap", 100, "Capacity of the `results` queue.")
 	brokerBlockingTimeoutFlag = flag.Duration("broker-blocking-timeout", 0, "Blocking `timeout` when polling for call requests.")
-	workersFlag               = flag.Int("workers", 1, "Number of concurrent `workers` processing call requests.")
+	brokerStreamsFlag         = flag.Bool("broker-streams", false, "Use Redis Streams for the call requests.")
+	brokerRedialFlag          = flag.Bool("broker-redial", false, "Redial the long-lived redis connections when they fail.")
+	brokerRedialMaxDelayFlag  = flag.Duration("broker-redial-max-delay", redisbroker.DefaultRedialMaxDelay, "Maximum `delay` between redial attempts (with -broker-redial).")
+	brokerClaimIdleFlag       = flag.Duration("broker-claim-idle", redisbroker.DefaultClaimIdle, "Idle `time` before an unacknowledged call request is reclaimed (with -broker-streams).")
+	cancelsFlag               = flag.Bool("cancels", false, "Listen for call cancellation requests.")
+	workersFlag               = flag.Int("workers", 1, "Number of concurrent `workers` processing call requests, split between the hash slot groups of URIs with -redis-cluster.")
+	shutdownTimeoutFlag       = flag.Duration("shutdown-timeout", 10*time.Second, "Maximum `duration` to wait for running calls on shutdown.")
 	helpFlag                  = flag.Bool("help", false, "Show help.")
 )
 
-var uris = map[string]callee.Thunk{
-	"test.echo":    echoThunk,
-	"test.reverse": reverseThunk,
-	"test.delay":   delayThunk,
+var uris = map[string]interface{}{
+	"test.echo":    echo,
+	"test.reverse": reverse,
+	"test.delay":   delayString,
 }
 
 func main() {
@@ -54,58 +65,106 @@ func main() {
 
 	log.Printf("listening for call requests on %s with %d workers", *redisAddrFlag, *workersFlag)
 
-	keys := make([]string, 0, len(uris))
-	for k := range uris {
-		keys = append(keys, k)
+	// gracefully stop on SIGINT or SIGTERM
+	go func() {
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+		<-ch
+
+		log.Printf("shutting down, waiting for running calls")
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeoutFlag)
+		defer cancel()
+		if err := c.Shutdown(ctx); err != nil {
+			log.Printf("Shutdown failed: %v", err)
+		}
+	}()
+
+	var reg callee.Registry
+	for k, fn := range uris {
+		reg.MustRegister(k, fn)
+	}
+	m := reg.Thunks()
+	for k, fn := range m {
+		m[k] = logWrapThunk(fn)
 	}
+	if err := listen(c, m); err != nil && err != callee.ErrCalleeClosed {
+		log.Fatalf("Listen failed: %v", err)
+	}
+}
 
-	cc, err := c.Broker.Calls(keys...)
-	if err != nil {
-		log.Fatalf("Calls failed: %v", err)
+// listen listens for call requests for the URIs in m. With a redis
+// cluster, it listens on a separate connection for each group of URIs
+// in the same hash slot, the workers being split between the groups,
+// and returns the first error. The cancellation requests of all URIs
+// are then listened to on a single connection.
+func listen(c *callee.Callee, m map[string]callee.ContextThunk) error {
+	if !*redisClusterFlag {
+		opts := []callee.ListenOption{callee.Workers(*workersFlag)}
+		if *cancelsFlag {
+			opts = append(opts, callee.HandleCancels())
+		}
+		return c.ListenContext(context.Background(), m, opts...)
 	}
-	defer cc.Close()
 
-	wg := sync.WaitGroup{}
-	wg.Add(*workersFlag)
-	for i := 0; i < *workersFlag; i++ {
+	uris := make([]string, 0, len(m))
+	for k := range m {
+		uris = append(uris, k)
+	}
+	groups := callee.SplitByHashSlot(uris)
+
+	if *cancelsFlag {
+		cncl, err := c.Broker.Cancels(uris...)
+		if err != nil {
+			return err
+		}
+		defer cncl.Close()
+
 		go func() {
-			defer wg.Done()
-
-			ch := cc.Calls()
-			for cp := range ch {
-				log.Printf("received request %v %s", cp.MsgUUID, cp.URI)
-				if err := c.InvokeAndStoreResult(cp, uris[cp.URI]); err != nil {
-					if err != callee.ErrCallExpired {
-						log.Printf("InvokeAndStoreResult failed: %v", err)
-						continue
-					}
-					log.Printf("expired request %v %s", cp.MsgUUID, cp.URI)
-					continue
-				}
-				log.Printf("sent result %v %s", cp.MsgUUID, cp.URI)
+			for cp := range cncl.Cancels() {
+				c.Cancel(cp)
 			}
 		}()
 	}
-	wg.Wait()
+
+	errc := make(chan error, len(groups))
+	for i, g := range groups {
+		gm := make(map[string]callee.ContextThunk, len(g))
+		for _, uri := range g {
+			gm[uri] = m[uri]
+		}
+
+		// ListenContext uses at least one worker per group
+		workers := *workersFlag / len(groups)
+		if i < *workersFlag%len(groups) {
+			workers++
+		}
+		go func() {
+			errc <- c.ListenContext(context.Background(), gm, callee.Workers(workers))
+		}()
+	}
+
+	var err error
+	for range groups {
+		if e := <-errc; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
 }
 
-func logWrapThunk(t callee.Thunk) callee.Thunk {
-	return func(cp *msg.CallPayload) (interface{}, error) {
+func logWrapThunk(t callee.ContextThunk) callee.ContextThunk {
+	return func(ctx context.Context, cp *msg.CallPayload) (interface{}, error) {
 		log.Printf("received call for %s from %v", cp.URI, cp.MsgUUID)
-		v, err := t(cp)
+		v, err := t(ctx, cp)
 		log.Printf("sending result for %s from %v", cp.URI, cp.MsgUUID)
 		return v, err
 	}
 }
 
-func delayThunk(cp *msg.CallPayload) (interface{}, error) {
-	var s string
-	if err := json.Unmarshal(cp.Args, &s); err != nil {
-		return nil, err
-	}
+func delayString(s string) (int, error) {
 	i, err := strconv.Atoi(s)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 	return delay(i), nil
 }
@@ -115,14 +174,6 @@ func delay(i int) int {
 	return i
 }
 
-func reverseThunk(cp *msg.CallPayload) (interface{}, error) {
-	var s string
-	if err := json.Unmarshal(cp.Args, &s); err != nil {
-		return nil, err
-	}
-	return reverse(s), nil
-}
-
 func reverse(s string) string {
 	chars := []rune(s)
 	for i, j := 0, len(chars)-1; i < j; i, j = i+1, j-1 {
@@ -131,29 +182,61 @@ func reverse(s string) string {
 	return string(chars)
 }
 
-func echoThunk(cp *msg.CallPayload) (interface{}, error) {
-	var s string
-	if err := json.Unmarshal(cp.Args, &s); err != nil {
-		return nil, err
-	}
-	return echo(s), nil
-}
-
 func echo(s string) string {
 	return s
 }
 
-func newBroker(pool *redis.Pool) broker.CalleeBroker {
-	return &redisbroker.Broker{
+func newBroker(pool redisPool) broker.CalleeBroker {
+	brk := redisbroker.Broker{
 		Pool:            pool,
 		Dial:            pool.Dial,
+		Redial:          pool.Redial,
 		BlockingTimeout: *brokerBlockingTimeoutFlag,
 		ResultCap:       *brokerResultCapFlag,
 	}
+	if *brokerStreamsFlag {
+		return &redisbroker.StreamBroker{Broker: brk, ClaimIdle: *brokerClaimIdleFlag}
+	}
+	return &brk
+}
+
+// redisPool is a redis pool along with the function to dial the
+// non-pooled connections, for a single node, a cluster or a master
+// monitored by sentinels, and the backoff configuration of the redial
+// of those connections.
+type redisPool struct {
+	redisbroker.Pool
+	Dial   func() (redis.Conn, error)
+	Redial *redisbroker.Backoff
 }
 
-func newRedisPool(addr string) *redis.Pool {
-	return &redis.Pool{
+func newRedisPool(addr string) redisPool {
+	var backoff *redisbroker.Backoff
+	if *brokerRedialFlag {
+		backoff = &redisbroker.Backoff{MaxDelay: *brokerRedialMaxDelayFlag, Jitter: true}
+	}
+
+	if *redisClusterFlag {
+		c := &redisbroker.Cluster{
+			StartupNodes: strings.Split(addr, ","),
+			MaxIdle:      *redisPoolMaxIdleFlag,
+			MaxActive:    *redisPoolMaxActiveFlag,
+			IdleTimeout:  *redisPoolIdleTimeoutFlag,
+		}
+		return redisPool{c, c.Dial, backoff}
+	}
+	if *redisMasterNameFlag != "" {
+		s := &redisbroker.Sentinel{
+			Addrs:       strings.Split(addr, ","),
+			MasterName:  *redisMasterNameFlag,
+			MaxIdle:     *redisPoolMaxIdleFlag,
+			MaxActive:   *redisPoolMaxActiveFlag,
+			IdleTimeout: *redisPoolIdleTimeoutFlag,
+			Redial:      backoff,
+		}
+		return redisPool{s, s.Dial, backoff}
+	}
+	p := &redis.Pool{
 		MaxIdle:     *redisPoolMaxIdleFlag,
 		MaxActive:   *redisPoolMaxActiveFlag,
 		IdleTimeout: *redisPoolIdleTimeoutFlag,
@@ -169,4 +252,5 @@ func newRedisPool(addr string) *redis.Pool {
 			return err
 		},
 	}
+	return redisPool{p, p.Dial, backoff}
 }
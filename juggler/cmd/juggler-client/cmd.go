@@ -15,6 +15,7 @@ import (
 	"github.com/PuerkitoBio/exp/juggler/client"
 	"github.com/PuerkitoBio/exp/juggler/msg"
 	"github.com/gorilla/websocket"
+	"github.com/pborman/uuid"
 )
 
 var (
@@ -32,6 +33,7 @@ func init() {
 		"send":       sendCmd,
 		"close":      closeCmd,
 		"call":       callCmd,
+		"cncl":       cnclCmd,
 		"pub":        pubCmd,
 		"sub":        subCmd,
 		"psub":       psubCmd,
@@ -227,6 +229,31 @@ var callCmd = &cmd{
 	},
 }
 
+var cnclCmd = &cmd{
+	Usage:   "usage: cncl CONN_ID CALL_UUID",
+	MinArgs: 2,
+	Help:    "send a CNCL message to the connection identified by CONN_ID\n\tto cancel the pending call identified by CALL_UUID",
+
+	Run: func(cmd *cmd, args ...string) {
+		if c, ix := getConn(args[0]); c != nil {
+			callUUID := uuid.Parse(args[1])
+			if callUUID == nil {
+				printErr("[%d] invalid call UUID: %s", ix+1, args[1])
+				return
+			}
+
+			uuid, err := c.Cncl(callUUID)
+			if err != nil {
+				printErr("[%d] Cncl failed: %v", ix+1, err)
+				return
+			}
+			printf("[%d] >>> CNCL message: %v", ix+1, uuid)
+		} else {
+			printErr("invalid connection ID: %s", args[0])
+		}
+	},
+}
+
 var pubCmd = &cmd{
 	Usage:   "usage: pub CONN_ID CHANNEL [ARGS]",
 	MinArgs: 2,
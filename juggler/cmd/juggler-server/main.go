@@ -15,7 +15,10 @@ import (
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"golang.org/x/net/context"
@@ -25,6 +28,7 @@ import (
 	"github.com/PuerkitoBio/exp/juggler"
 	"github.com/PuerkitoBio/exp/juggler/broker"
 	"github.com/PuerkitoBio/exp/juggler/broker/redisbroker"
+	"github.com/PuerkitoBio/exp/juggler/metrics"
 	"github.com/PuerkitoBio/exp/juggler/msg"
 	"github.com/garyburd/redigo/redis"
 	"github.com/gorilla/websocket"
@@ -38,20 +42,46 @@ var (
 	helpFlag            = flag.Bool("help", false, "Show help.")
 )
 
-// Redis defines the redis-specific configuration options.
+// Redis defines the redis-specific configuration options. If Cluster
+// is true, Addr is a comma-separated list of the startup nodes of a
+// redis cluster. If MasterName is set, Addr is a comma-separated list
+// of the redis sentinels that monitor the master with that name.
+// If Redial is set, the long-lived connections redial when they fail.
+// If MuxConns is > 0, the pub-sub and results connections of the
+// juggler connections are multiplexed over that many redis connections,
+// which is not supported with Cluster.
 type Redis struct {
 	Addr        string        `yaml:"addr"`
+	Cluster     bool          `yaml:"cluster"`
+	MasterName  string        `yaml:"master_name"`
 	MaxActive   int           `yaml:"max_active"`
 	MaxIdle     int           `yaml:"max_idle"`
 	IdleTimeout time.Duration `yaml:"idle_timeout"`
+	Redial      *Redial       `yaml:"redial"`
+	MuxConns    int           `yaml:"mux_conns"`
+	MuxBuffer   int           `yaml:"mux_buffer"`
 	PubSub      *Redis        `yaml:"pubsub"`
 	Caller      *Redis        `yaml:"caller"`
 }
 
+// Redial defines the backoff configuration of the redial of the
+// long-lived redis connections. The zero values use the defaults of
+// redisbroker.Backoff.
+type Redial struct {
+	MinDelay    time.Duration `yaml:"min_delay"`
+	MaxDelay    time.Duration `yaml:"max_delay"`
+	MaxAttempts int           `yaml:"max_attempts"`
+	Jitter      bool          `yaml:"jitter"`
+}
+
 // CallerBroker defines the configuration options for the caller broker.
 type CallerBroker struct {
 	BlockingTimeout time.Duration `yaml:"blocking_timeout"`
 	CallCap         int           `yaml:"call_cap"`
+
+	// Streams uses Redis Streams for the call requests, the callees
+	// must use a redisbroker.StreamBroker too.
+	Streams bool `yaml:"streams"`
 }
 
 // Server defines the juggler server configuration options.
@@ -64,6 +94,8 @@ type Server struct {
 	WriteBufferSize    int           `yaml:"write_buffer_size"`
 	HandshakeTimeout   time.Duration `yaml:"handshake_timeout"`
 	WhitelistedOrigins []string      `yaml:"whitelisted_origins"`
+	EnableCompression  bool          `yaml:"enable_compression"`
+	MetricsPath        string        `yaml:"metrics_path"`
 
 	// websocket/juggler configuration
 	ReadLimit               int64         `yaml:"read_limit"`
@@ -71,7 +103,14 @@ type Server struct {
 	WriteLimit              int64         `yaml:"write_limit"`
 	WriteTimeout            time.Duration `yaml:"write_timeout"`
 	AcquireWriteLockTimeout time.Duration `yaml:"acquire_write_lock_timeout"`
+	PingInterval            time.Duration `yaml:"ping_interval"`
+	PongTimeout             time.Duration `yaml:"pong_timeout"`
+	IdleTimeout             time.Duration `yaml:"idle_timeout"`
+	SendQueueSize           int           `yaml:"send_queue_size"`
+	CompressionThreshold    int           `yaml:"compression_threshold"`
+	CompressionLevel        int           `yaml:"compression_level"`
 	AllowEmptySubprotocol   bool          `yaml:"allow_empty_subprotocol"`
+	ShutdownTimeout         time.Duration `yaml:"shutdown_timeout"`
 
 	// handler options
 	CloseURI string `yaml:"close_uri"`
@@ -106,6 +145,7 @@ func getDefaultConfig() *Config {
 			WriteTimeout:            0,
 			AcquireWriteLockTimeout: 0,
 			AllowEmptySubprotocol:   *allowEmptyProtoFlag,
+			ShutdownTimeout:         0,
 			CloseURI:                "",
 		},
 	}
@@ -159,6 +199,15 @@ func isZeroRedis(rc *Redis) bool {
 // for pubsub and caller, or use Config.Redis.PubSub and Config.Redis.Caller.
 // No other combination is accepted.
 func checkRedisConfig(conf *Redis) error {
+	for _, rc := range []*Redis{conf, conf.PubSub, conf.Caller} {
+		if rc != nil && rc.Cluster && rc.MasterName != "" {
+			return errors.New("redis cluster and master_name are mutually exclusive")
+		}
+		if rc != nil && rc.Cluster && rc.MuxConns > 0 {
+			return errors.New("redis cluster and mux_conns are mutually exclusive")
+		}
+	}
+
 	// if either PubSub or Caller is set, then both must be set
 	if !isZeroRedis(conf.PubSub) || !isZeroRedis(conf.Caller) {
 		if (conf.PubSub == nil || conf.PubSub.Addr == "") || (conf.Caller == nil || conf.Caller.Addr == "") {
@@ -197,7 +246,7 @@ func main() {
 	}
 
 	// create pool, brokers, server, upgrader, HTTP server
-	var poolp, poolc *redis.Pool
+	var poolp, poolc redisPool
 	if conf.Redis.Addr != "" {
 		pool := newRedisPool(conf.Redis)
 		poolp, poolc = pool, pool
@@ -214,6 +263,11 @@ func main() {
 	srv := newServer(conf.Server, psb, cb)
 	srv.Handler = newHandler(conf.Server)
 	srv.Vars = expvar.NewMap("juggler")
+	if p := conf.Server.MetricsPath; p != "" {
+		prom := &metrics.Prometheus{Namespace: "juggler"}
+		srv.Metrics = prom
+		http.Handle(p, prom)
+	}
 
 	upg := newUpgrader(conf.Server) // must be after newServer, for Subprotocols
 
@@ -224,10 +278,35 @@ func main() {
 
 	httpSrv := newHTTPServer(conf.Server)
 
+	// gracefully stop on SIGINT or SIGTERM
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+		<-ch
+
+		log.Printf("shutting down, waiting for pending calls")
+		ctx := context.Background()
+		if to := conf.Server.ShutdownTimeout; to > 0 {
+			var cancel func()
+			ctx, cancel = context.WithTimeout(ctx, to)
+			defer cancel()
+		}
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("Shutdown failed: %v", err)
+		}
+		if err := httpSrv.Shutdown(ctx); err != nil {
+			log.Printf("HTTP server Shutdown failed: %v", err)
+		}
+	}()
+
 	log.Printf("listening for connections on %s", conf.Server.Addr)
-	if err := httpSrv.ListenAndServe(); err != nil {
+	if err := httpSrv.ListenAndServe(); err != http.ErrServerClosed {
 		log.Fatalf("ListenAndServe failed: %v", err)
 	}
+	<-done
 }
 
 func newHandler(conf *Server) juggler.Handler {
@@ -268,20 +347,28 @@ func newHandler(conf *Server) juggler.Handler {
 		))
 }
 
-func newPubSubBroker(pool *redis.Pool) broker.PubSubBroker {
+func newPubSubBroker(pool redisPool) broker.PubSubBroker {
 	return &redisbroker.Broker{
-		Pool: pool,
-		Dial: pool.Dial,
+		Pool:   pool,
+		Dial:   pool.Dial,
+		Redial: pool.Redial,
+		Mux:    pool.newMux(),
 	}
 }
 
-func newCallerBroker(conf *CallerBroker, pool *redis.Pool) broker.CallerBroker {
-	return &redisbroker.Broker{
+func newCallerBroker(conf *CallerBroker, pool redisPool) broker.CallerBroker {
+	brk := redisbroker.Broker{
 		Pool:            pool,
 		Dial:            pool.Dial,
+		Redial:          pool.Redial,
+		Mux:             pool.newMux(),
 		BlockingTimeout: conf.BlockingTimeout,
 		CallCap:         conf.CallCap,
 	}
+	if conf.Streams {
+		return &redisbroker.StreamBroker{Broker: brk}
+	}
+	return &brk
 }
 
 func isIn(list []string, v string) bool {
@@ -295,10 +382,11 @@ func isIn(list []string, v string) bool {
 
 func newUpgrader(conf *Server) *websocket.Upgrader {
 	upg := &websocket.Upgrader{
-		HandshakeTimeout: conf.HandshakeTimeout,
-		ReadBufferSize:   conf.ReadBufferSize,
-		WriteBufferSize:  conf.WriteBufferSize,
-		Subprotocols:     juggler.Subprotocols,
+		HandshakeTimeout:  conf.HandshakeTimeout,
+		ReadBufferSize:    conf.ReadBufferSize,
+		WriteBufferSize:   conf.WriteBufferSize,
+		Subprotocols:      juggler.Subprotocols,
+		EnableCompression: conf.EnableCompression,
 	}
 
 	if len(conf.WhitelistedOrigins) > 0 {
@@ -331,13 +419,60 @@ func newServer(conf *Server, pubSub broker.PubSubBroker, caller broker.CallerBro
 		WriteLimit:              conf.WriteLimit,
 		WriteTimeout:            conf.WriteTimeout,
 		AcquireWriteLockTimeout: conf.AcquireWriteLockTimeout,
+		PingInterval:            conf.PingInterval,
+		PongTimeout:             conf.PongTimeout,
+		IdleTimeout:             conf.IdleTimeout,
+		SendQueueSize:           conf.SendQueueSize,
+		CompressionThreshold:    conf.CompressionThreshold,
+		CompressionLevel:        conf.CompressionLevel,
 		ConnState:               juggler.LogConn,
 		PubSubBroker:            pubSub,
 		CallerBroker:            caller,
 	}
 }
 
-func newRedisPool(conf *Redis) *redis.Pool {
+// redisPool is a redis pool along with the function to dial the
+// non-pooled connections, for a single node, a cluster or a master
+// monitored by sentinels, the backoff configuration of the redial of
+// those connections, and the configuration of their multiplexing.
+type redisPool struct {
+	redisbroker.Pool
+	Dial      func() (redis.Conn, error)
+	Redial    *redisbroker.Backoff
+	MuxConns  int
+	MuxBuffer int
+}
+
+// newMux returns a new Mux for a broker, or nil if the connections
+// are not multiplexed.
+func (p redisPool) newMux() *redisbroker.Mux {
+	if p.MuxConns <= 0 {
+		return nil
+	}
+	return &redisbroker.Mux{Conns: p.MuxConns, Buffer: p.MuxBuffer}
+}
+
+func newRedisPool(conf *Redis) redisPool {
+	var backoff *redisbroker.Backoff
+	if r := conf.Redial; r != nil {
+		backoff = &redisbroker.Backoff{
+			MinDelay:    r.MinDelay,
+			MaxDelay:    r.MaxDelay,
+			MaxAttempts: r.MaxAttempts,
+			Jitter:      r.Jitter,
+		}
+	}
+
+	if conf.Cluster {
+		c := newRedisCluster(conf)
+		return redisPool{c, c.Dial, backoff, 0, 0}
+	}
+	if conf.MasterName != "" {
+		s := newRedisSentinel(conf)
+		s.Redial = backoff
+		return redisPool{s, s.Dial, backoff, conf.MuxConns, conf.MuxBuffer}
+	}
+
 	addr := conf.Addr
 	p := &redis.Pool{
 		MaxIdle:     conf.MaxIdle,
@@ -364,5 +499,39 @@ func newRedisPool(conf *Redis) *redis.Pool {
 		log.Fatalf("redis PING failed: %v", err)
 	}
 
-	return p
+	return redisPool{p, p.Dial, backoff, conf.MuxConns, conf.MuxBuffer}
+}
+
+func newRedisCluster(conf *Redis) *redisbroker.Cluster {
+	c := &redisbroker.Cluster{
+		StartupNodes: strings.Split(conf.Addr, ","),
+		MaxIdle:      conf.MaxIdle,
+		MaxActive:    conf.MaxActive,
+		IdleTimeout:  conf.IdleTimeout,
+	}
+
+	// load the slots so that it fails fast if the cluster is not available
+	if err := c.Refresh(); err != nil {
+		log.Fatalf("redis cluster Refresh failed: %v", err)
+	}
+	return c
+}
+
+func newRedisSentinel(conf *Redis) *redisbroker.Sentinel {
+	s := &redisbroker.Sentinel{
+		Addrs:       strings.Split(conf.Addr, ","),
+		MasterName:  conf.MasterName,
+		MaxIdle:     conf.MaxIdle,
+		MaxActive:   conf.MaxActive,
+		IdleTimeout: conf.IdleTimeout,
+	}
+
+	// test the connection so that it fails fast if the master is not available
+	c := s.Get()
+	defer c.Close()
+
+	if _, err := c.Do("PING"); err != nil {
+		log.Fatalf("redis sentinel master PING failed: %v", err)
+	}
+	return s
 }
@@ -48,6 +48,50 @@ func TestCheckRedisConfig(t *testing.T) {
     caller:
         addr: :1235
         idle_timeout: 1s
+`, true},
+		{`redis:
+    addr: :26379,:26380
+    master_name: mymaster
+`, false},
+		{`redis:
+    pubsub:
+        addr: :1234
+        redial:
+            max_delay: 1s
+    caller:
+        addr: :1235
+        redial:
+            jitter: true
+`, false},
+		{`redis:
+    redial:
+        max_attempts: 3
+    pubsub:
+        addr: :1234
+    caller:
+        addr: :1235
+`, true},
+		{`redis:
+    addr: :6379
+    mux_conns: 4
+`, false},
+		{`redis:
+    addr: :6379
+    cluster: true
+    mux_conns: 4
+`, true},
+		{`redis:
+    addr: :26379
+    cluster: true
+    master_name: mymaster
+`, true},
+		{`redis:
+    pubsub:
+        addr: :1234
+        cluster: true
+        master_name: mymaster
+    caller:
+        addr: :1235
 `, true},
 	}
 	for i, c := range cases {
@@ -0,0 +1,40 @@
+package juggler
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/PuerkitoBio/exp/juggler/msg"
+)
+
+// writeCompressedMsg writes the message m to the connection c, which
+// negotiated the application-level compression. The message is
+// encoded first, so that the server's WriteLimit applies to the
+// uncompressed size and the CompressionThreshold can be checked.
+func writeCompressedMsg(c *Conn, m msg.Msg) error {
+	var buf bytes.Buffer
+	lw := io.Writer(&buf)
+	if l := c.srv.WriteLimit; l > 0 {
+		lw = limitWriter(&buf, l)
+	}
+	if err := c.codec.Encode(lw, m); err != nil {
+		return err
+	}
+
+	w := c.Writer(c.srv.AcquireWriteLockTimeout)
+	defer w.Close()
+
+	n, err := msg.WriteCompressed(w, buf.Bytes(), c.srv.CompressionThreshold, c.srv.CompressionLevel)
+	if err != nil {
+		return err
+	}
+	c.touch()
+
+	mtr := c.srv.metrics()
+	if buf.Len() > c.srv.CompressionThreshold {
+		mtr.AddCounter("CompressedMsgs", 1)
+	}
+	mtr.AddCounter("CompressionInBytes", int64(buf.Len()))
+	mtr.AddCounter("CompressionOutBytes", int64(n))
+	return nil
+}
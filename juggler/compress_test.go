@@ -0,0 +1,77 @@
+package juggler_test
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/PuerkitoBio/exp/juggler"
+	"github.com/PuerkitoBio/exp/juggler/broker/memorybroker"
+	"github.com/PuerkitoBio/exp/juggler/client"
+	"github.com/PuerkitoBio/exp/juggler/internal/jugglertest"
+	"github.com/PuerkitoBio/exp/juggler/msg"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompression(t *testing.T) {
+	dbgl := &jugglertest.DebugLog{T: t}
+	brk := &memorybroker.Broker{LogFunc: dbgl.Printf}
+	server := &juggler.Server{
+		CallerBroker:         brk,
+		PubSubBroker:         brk,
+		LogFunc:              dbgl.Printf,
+		Vars:                 new(expvar.Map).Init(),
+		CompressionThreshold: 500,
+	}
+	upg := &websocket.Upgrader{Subprotocols: juggler.Subprotocols, EnableCompression: true}
+	srv := httptest.NewServer(juggler.Upgrade(upg, server))
+	srv.URL = strings.Replace(srv.URL, "http:", "ws:", 1)
+	defer srv.Close()
+
+	large := strings.Repeat("x", 1000)
+	for _, proto := range []string{"juggler.0", "juggler.0+msgpack"} {
+		evs := make(chan *msg.Evnt, 1)
+		h := client.HandlerFunc(func(ctx context.Context, cli *client.Client, m msg.Msg) {
+			if ev, ok := m.(*msg.Evnt); ok {
+				evs <- ev
+			}
+		})
+
+		d := &websocket.Dialer{Subprotocols: []string{proto}, EnableCompression: true}
+		hdr := http.Header{msg.CompressionHeader: {msg.Deflate}}
+		cli, err := client.Dial(d, srv.URL, hdr, client.SetHandler(h), client.SetLogFunc(dbgl.Printf))
+		require.NoError(t, err, "%s: Dial", proto)
+		assert.Equal(t, msg.Deflate, cli.ResponseHeader.Get(msg.CompressionHeader), "%s: negotiated", proto)
+
+		_, err = cli.Sub("a", false)
+		require.NoError(t, err, "%s: Sub", proto)
+		_, err = cli.Pub("a", large)
+		require.NoError(t, err, "%s: Pub", proto)
+
+		select {
+		case ev := <-evs:
+			assert.Equal(t, `"`+large+`"`, string(ev.Payload.Args), "%s: args", proto)
+		case <-time.After(time.Second):
+			assert.Fail(t, "no event received", proto)
+		}
+		cli.Close()
+	}
+
+	assert.Equal(t, "2", server.Vars.Get("CompressedConns").String(), "CompressedConns")
+	assert.Equal(t, "2", server.Vars.Get("CompressedMsgs").String(), "CompressedMsgs")
+	in, out := server.Vars.Get("CompressionInBytes").(*expvar.Int), server.Vars.Get("CompressionOutBytes").(*expvar.Int)
+	assert.True(t, out.Value() < in.Value(), "compressed bytes %d < %d", out.Value(), in.Value())
+
+	// without the header, no application-level compression
+	cli, err := client.Dial(&websocket.Dialer{}, srv.URL, nil)
+	require.NoError(t, err, "Dial")
+	assert.Equal(t, "", cli.ResponseHeader.Get(msg.CompressionHeader), "not negotiated")
+	cli.Close()
+}
@@ -12,6 +12,7 @@ import (
 
 	"github.com/PuerkitoBio/exp/juggler/broker"
 	"github.com/PuerkitoBio/exp/juggler/msg"
+	"github.com/PuerkitoBio/exp/juggler/trace"
 	"github.com/gorilla/websocket"
 	"github.com/pborman/uuid"
 )
@@ -39,6 +40,11 @@ type Conn struct {
 	// UUID is the unique identifier of the connection.
 	UUID uuid.UUID
 
+	// Identity is the identity returned by the Server's Authenticator
+	// when the connection was established. It is nil if there is no
+	// Authenticator or if it accepted an anonymous connection.
+	Identity *Identity
+
 	// CloseErr is the error, if any, that caused the connection
 	// to close. Must only be accessed after the close notification
 	// has been received (i.e. after a <-conn.CloseNotify()).
@@ -47,6 +53,11 @@ type Conn struct {
 	// the underlying websocket connection.
 	wsConn *websocket.Conn
 
+	// the codec of the negotiated subprotocol, and whether the
+	// application-level compression was negotiated.
+	codec    msg.Codec
+	compress bool
+
 	wmu  chan struct{} // write lock
 	srv  *Server
 	psc  broker.PubSubConn  // single pub-sub-dedicated broker connection
@@ -55,6 +66,23 @@ type Conn struct {
 	// ensure the kill channel can only be closed once
 	closeOnce sync.Once
 	kill      chan struct{}
+
+	// pending calls by call UUID
+	pmu     sync.Mutex
+	pending map[string]pendingCall
+
+	// tags of the connection, protected by the server's lock
+	tags map[string]struct{}
+
+	// time of the last juggler message read or written
+	amu          sync.Mutex
+	lastActivity time.Time
+
+	// send queue of the messages received from the broker, qsignal
+	// receives a value when messages are added.
+	qmu     sync.Mutex
+	queue   []msg.Msg
+	qsignal chan struct{}
 }
 
 func newConn(c *websocket.Conn, srv *Server) *Conn {
@@ -64,11 +92,15 @@ func newConn(c *websocket.Conn, srv *Server) *Conn {
 	wmu <- struct{}{}
 
 	return &Conn{
-		UUID:   uuid.NewRandom(),
-		wsConn: c,
-		wmu:    wmu,
-		srv:    srv,
-		kill:   make(chan struct{}),
+		UUID:         uuid.NewRandom(),
+		wsConn:       c,
+		codec:        msg.CodecForSubprotocol(c.Subprotocol()),
+		wmu:          wmu,
+		srv:          srv,
+		kill:         make(chan struct{}),
+		pending:      make(map[string]pendingCall),
+		lastActivity: time.Now(),
+		qsignal:      make(chan struct{}, 1),
 	}
 }
 
@@ -110,6 +142,7 @@ func (c *Conn) Close(err error) {
 		c.CloseErr = err
 		c.psc.Close()
 		c.resc.Close()
+		c.clearPending(err)
 		close(c.kill)
 	})
 }
@@ -119,6 +152,7 @@ type exclusiveWriter struct {
 	w            io.WriteCloser
 	init         bool
 	writeLock    chan struct{}
+	messageType  int
 	lockTimeout  time.Duration
 	writeTimeout time.Duration
 	wsConn       *websocket.Conn
@@ -139,7 +173,7 @@ func (w *exclusiveWriter) Write(p []byte) (int, error) {
 		case <-w.writeLock:
 			// lock acquired, get next writer from the websocket connection
 			w.init = true
-			wc, err := w.wsConn.NextWriter(websocket.TextMessage)
+			wc, err := w.wsConn.NextWriter(w.messageType)
 			if err != nil {
 				return 0, err
 			}
@@ -180,6 +214,11 @@ func (w *exclusiveWriter) Close() error {
 // the time to wait to acquire the lock on the first call to
 // Write. If the lock cannot be acquired within that time,
 // ErrWriteLockTimeout is returned and no write is performed.
+// The writer sends a websocket.BinaryMessage if the codec of the
+// connection's subprotocol is binary or if the application-level
+// compression was negotiated, a websocket.TextMessage otherwise.
+// With application-level compression, the message must be written
+// with msg.WriteCompressed.
 //
 // It is possible to enter a deadlock state if Writer is called
 // with no timeout, an initial Write is executed, and Writer is
@@ -190,14 +229,30 @@ func (w *exclusiveWriter) Close() error {
 // The returned writer itself is not safe for concurrent use, but
 // as all Conn methods, Writer can be called concurrently.
 func (c *Conn) Writer(timeout time.Duration) io.WriteCloser {
+	mt := c.messageType()
+	if c.compress {
+		mt = websocket.BinaryMessage
+	}
 	return &exclusiveWriter{
 		writeLock:    c.wmu,
+		messageType:  mt,
 		lockTimeout:  timeout,
 		writeTimeout: c.srv.WriteTimeout,
 		wsConn:       c.wsConn,
 	}
 }
 
+// messageType returns the websocket message type of the juggler
+// messages, as defined by the codec of the connection. The messages
+// sent with application-level compression are binary regardless of
+// the codec.
+func (c *Conn) messageType() int {
+	if c.codec.Binary() {
+		return websocket.BinaryMessage
+	}
+	return websocket.TextMessage
+}
+
 // Send sends the msg to the client. It calls the Server's
 // Handler if any, or ProcessMsg if nil.
 func (c *Conn) Send(m msg.Msg) {
@@ -208,18 +263,129 @@ func (c *Conn) Send(m msg.Msg) {
 	}
 }
 
+// errCallExpired, errCallCanceled and errConnClosed are recorded in
+// the span of a pending call that ends without a result.
+var (
+	errCallExpired  = errors.New("call expired")
+	errCallCanceled = errors.New("call canceled")
+	errConnClosed   = errors.New("connection closed")
+)
+
+// pendingCall is the start and expiration time of a pending call,
+// along with its span and the timer that removes it once expired.
+type pendingCall struct {
+	start   time.Time
+	expires time.Time
+	span    trace.Span
+	timer   *time.Timer
+}
+
+// addPending registers the call identified by callUUID as pending
+// for the duration of timeout. The span is ended when the call is
+// no longer pending, and the call is removed once it expires, if its
+// result was not received.
+func (c *Conn) addPending(callUUID uuid.UUID, timeout time.Duration, span trace.Span) {
+	if timeout <= 0 {
+		timeout = broker.DefaultCallTimeout
+	}
+	now := time.Now()
+	k := callUUID.String()
+	pc := pendingCall{start: now, expires: now.Add(timeout), span: span}
+	pc.timer = time.AfterFunc(timeout, func() {
+		c.expirePending(k)
+	})
+
+	c.pmu.Lock()
+	c.pending[k] = pc
+	c.pmu.Unlock()
+}
+
+// expirePending removes the pending call identified by k if it is
+// expired, and ends its span.
+func (c *Conn) expirePending(k string) {
+	c.pmu.Lock()
+	pc, ok := c.pending[k]
+	if !ok || time.Now().Before(pc.expires) {
+		c.pmu.Unlock()
+		return
+	}
+	delete(c.pending, k)
+	c.pmu.Unlock()
+
+	pc.span.End(errCallExpired)
+}
+
+// deletePending removes the pending call identified by callUUID. It
+// returns the pending call and true if it was pending.
+func (c *Conn) deletePending(callUUID uuid.UUID) (pendingCall, bool) {
+	c.pmu.Lock()
+	defer c.pmu.Unlock()
+
+	k := callUUID.String()
+	pc, ok := c.pending[k]
+	if ok {
+		pc.timer.Stop()
+		delete(c.pending, k)
+	}
+	return pc, ok
+}
+
+// clearPending removes all pending calls when the connection is
+// closed, and ends their span with err, or errConnClosed if err is
+// nil.
+func (c *Conn) clearPending(err error) {
+	if err == nil {
+		err = errConnClosed
+	}
+
+	c.pmu.Lock()
+	spans := make([]trace.Span, 0, len(c.pending))
+	for k, pc := range c.pending {
+		pc.timer.Stop()
+		delete(c.pending, k)
+		spans = append(spans, pc.span)
+	}
+	c.pmu.Unlock()
+
+	for _, sp := range spans {
+		sp.End(err)
+	}
+}
+
+// pendingCalls returns the number of pending calls that have not
+// expired yet.
+func (c *Conn) pendingCalls() int {
+	now := time.Now()
+
+	var expired []trace.Span
+	c.pmu.Lock()
+	for k, pc := range c.pending {
+		if now.After(pc.expires) {
+			pc.timer.Stop()
+			delete(c.pending, k)
+			expired = append(expired, pc.span)
+		}
+	}
+	n := len(c.pending)
+	c.pmu.Unlock()
+
+	for _, sp := range expired {
+		sp.End(errCallExpired)
+	}
+	return n
+}
+
 // results is the loop that looks for call results, started in its own
 // goroutine.
 func (c *Conn) results() {
-	if c.srv.Vars != nil {
-		c.srv.Vars.Add("TotalConnGoros", 1)
-		c.srv.Vars.Add("ActiveConnGoros", 1)
-		defer c.srv.Vars.Add("ActiveConnGoros", -1)
-	}
+	mtr := c.srv.metrics()
+	mtr.AddCounter("TotalConnGoros", 1)
+	mtr.AddGauge("ActiveConnGoros", 1)
+	defer mtr.AddGauge("ActiveConnGoros", -1)
 
 	ch := c.resc.Results()
 	for res := range ch {
-		c.Send(msg.NewRes(res))
+		c.enqueue(msg.NewRes(res))
 	}
 
 	// results loop was stopped, the connection should be closed if it
@@ -230,15 +396,19 @@ func (c *Conn) results() {
 // pubSub is the loop that receives events that the connection is subscribed
 // to, started in its own goroutine.
 func (c *Conn) pubSub() {
-	if c.srv.Vars != nil {
-		c.srv.Vars.Add("TotalConnGoros", 1)
-		c.srv.Vars.Add("ActiveConnGoros", 1)
-		defer c.srv.Vars.Add("ActiveConnGoros", -1)
-	}
+	mtr := c.srv.metrics()
+	mtr.AddCounter("TotalConnGoros", 1)
+	mtr.AddGauge("ActiveConnGoros", 1)
+	defer mtr.AddGauge("ActiveConnGoros", -1)
 
 	ch := c.psc.Events()
 	for ev := range ch {
-		c.Send(msg.NewEvnt(ev))
+		if ev.Pattern != "" && isReservedChannel(ev.Channel) {
+			// a client pattern subscription must not receive the
+			// events pushed to specific connections
+			continue
+		}
+		c.enqueue(msg.NewEvnt(ev))
 	}
 
 	// pubsub loop was stopped, the connection should be closed if it
@@ -248,11 +418,10 @@ func (c *Conn) pubSub() {
 
 // receive is the read loop, started in its own goroutine.
 func (c *Conn) receive() {
-	if c.srv.Vars != nil {
-		c.srv.Vars.Add("TotalConnGoros", 1)
-		c.srv.Vars.Add("ActiveConnGoros", 1)
-		defer c.srv.Vars.Add("ActiveConnGoros", -1)
-	}
+	mtr := c.srv.metrics()
+	mtr.AddCounter("TotalConnGoros", 1)
+	mtr.AddGauge("ActiveConnGoros", 1)
+	defer mtr.AddGauge("ActiveConnGoros", -1)
 
 	for {
 		c.wsConn.SetReadDeadline(time.Time{})
@@ -264,7 +433,7 @@ func (c *Conn) receive() {
 			c.Close(err)
 			return
 		}
-		if mt != websocket.TextMessage {
+		if mt != c.messageType() {
 			c.Close(fmt.Errorf("invalid websocket message type: %d", mt))
 			return
 		}
@@ -272,11 +441,12 @@ func (c *Conn) receive() {
 			c.wsConn.SetReadDeadline(time.Now().Add(to))
 		}
 
-		m, err := msg.UnmarshalRequest(r)
+		m, err := msg.UnmarshalRequestCodec(r, c.codec)
 		if err != nil {
 			c.Close(err)
 			return
 		}
+		c.touch()
 
 		if h := c.srv.Handler; h != nil {
 			h.Handle(context.Background(), c, m)
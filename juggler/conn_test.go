@@ -10,7 +10,9 @@ import (
 
 	"github.com/PuerkitoBio/exp/juggler/internal/jugglertest"
 	"github.com/PuerkitoBio/exp/juggler/internal/wstest"
+	"github.com/PuerkitoBio/exp/juggler/trace"
 	"github.com/gorilla/websocket"
+	"github.com/pborman/uuid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -110,3 +112,35 @@ func TestConnClose(t *testing.T) {
 
 	assert.Equal(t, errors.New("a"), conn.CloseErr, "got expected close error")
 }
+
+func TestConnPending(t *testing.T) {
+	srv := &Server{LogFunc: (&jugglertest.DebugLog{T: t}).Printf}
+	conn := newConn(&websocket.Conn{}, srv)
+	conn.psc, conn.resc = fakePubSubConn{}, fakeResultsConn{}
+
+	numPending := func() int {
+		conn.pmu.Lock()
+		defer conn.pmu.Unlock()
+		return len(conn.pending)
+	}
+
+	var exp trace.MemoryExporter
+	tr := trace.NewTracer(&exp)
+	conn.addPending(uuid.NewRandom(), 10*time.Millisecond, tr.Start("expired", trace.SpanContext{}))
+	conn.addPending(uuid.NewRandom(), time.Minute, tr.Start("closed", trace.SpanContext{}))
+	require.Equal(t, 2, numPending(), "pending calls")
+
+	// the expired call is removed without a result
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 1, numPending(), "pending calls after expiration")
+
+	conn.Close(nil)
+	assert.Equal(t, 0, numPending(), "pending calls after Close")
+
+	// the spans of the calls are ended with an error
+	errs := make(map[string]error)
+	for _, sd := range exp.Spans() {
+		errs[sd.Name] = sd.Err
+	}
+	assert.Equal(t, map[string]error{"expired": errCallExpired, "closed": errConnClosed}, errs, "span errors")
+}
@@ -1,15 +1,19 @@
 package juggler
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"runtime"
+	"time"
 
 	"golang.org/x/net/context"
 
+	"github.com/PuerkitoBio/exp/juggler/broker"
+	"github.com/PuerkitoBio/exp/juggler/logger"
+	"github.com/PuerkitoBio/exp/juggler/metrics"
 	"github.com/PuerkitoBio/exp/juggler/msg"
+	"github.com/PuerkitoBio/exp/juggler/trace"
 )
 
 // Handler defines the method required for a server to handle a send or receive
@@ -39,15 +43,13 @@ func Chain(hs ...Handler) Handler {
 }
 
 // PanicRecover returns a Handler that recovers from panics that
-// may happen in h and logs the panic to the server's LogFunc. The
+// may happen in h and logs the panic to the server's logger. The
 // connection is closed on a panic.
 func PanicRecover(h Handler) Handler {
 	return HandlerFunc(func(ctx context.Context, c *Conn, m msg.Msg) {
 		defer func() {
 			if e := recover(); e != nil {
-				if c.srv.Vars != nil {
-					c.srv.Vars.Add("RecoveredPanics", 1)
-				}
+				c.srv.metrics().AddCounter("RecoveredPanics", 1)
 
 				var err error
 				switch e := e.(type) {
@@ -58,10 +60,11 @@ func PanicRecover(h Handler) Handler {
 				}
 				c.Close(err)
 
-				logf(c.srv.LogFunc, "%v: recovered from panic %v; serving message %v %s", c.UUID, e, m.UUID(), m.Type())
+				lg := c.srv.logger()
+				lg.Log(logger.Error, "recovered from panic", append(msgFields(c, m), logger.F("panic", e))...)
 				var b [4096]byte
 				n := runtime.Stack(b[:], false)
-				logf(c.srv.LogFunc, string(b[:n]))
+				lg.Log(logger.Error, "panic stack trace", logger.Conn(c.UUID), logger.F("stack", string(b[:n])))
 			}
 		}()
 		h.Handle(ctx, c, m)
@@ -69,23 +72,23 @@ func PanicRecover(h Handler) Handler {
 }
 
 // LogConn is a function compatible with the Server.ConnState field
-// type that logs connections and disconnections to the server's LogFunc.
+// type that logs connections and disconnections to the server's logger.
 func LogConn(c *Conn, state ConnState) {
 	switch state {
 	case Connected:
-		logf(c.srv.LogFunc, "%v: connected from %v with subprotocol %q", c.UUID, c.RemoteAddr(), c.Subprotocol())
+		c.srv.logger().Log(logger.Info, "connected", logger.Conn(c.UUID), logger.F("remote_addr", c.RemoteAddr()), logger.F("subprotocol", c.Subprotocol()))
 	case Closing:
-		logf(c.srv.LogFunc, "%v: closing from %v with error %v", c.UUID, c.RemoteAddr(), c.CloseErr)
+		c.srv.logger().Log(logger.Info, "closing", logger.Conn(c.UUID), logger.F("remote_addr", c.RemoteAddr()), logger.Err(c.CloseErr))
 	}
 }
 
 // LogMsg is a HandlerFunc that logs messages received or sent on
-// c to the server's LogFunc.
+// c to the server's logger, at the Debug level.
 func LogMsg(ctx context.Context, c *Conn, m msg.Msg) {
 	if m.Type().IsRead() {
-		logf(c.srv.LogFunc, "%v: received message %v %s", c.UUID, m.UUID(), m.Type())
+		c.srv.logger().Log(logger.Debug, "received message", msgFields(c, m)...)
 	} else if m.Type().IsWrite() {
-		logf(c.srv.LogFunc, "%v: sending message %v %s", c.UUID, m.UUID(), m.Type())
+		c.srv.logger().Log(logger.Debug, "sending message", msgFields(c, m)...)
 	}
 }
 
@@ -94,111 +97,227 @@ func LogMsg(ctx context.Context, c *Conn, m msg.Msg) {
 // or pub-sub mechanisms. For server messages, it marshals
 // the message and sends it to the client.
 //
+// Client messages are first checked with the server's Authorizer,
+// if any. If the message is denied, an ERR message is sent to the
+// client and the message is not processed any further. Once the
+// server is shutting down, CALL, PUB and SUB messages are refused
+// with an ERR message with a 503 code. PUB, SUB and UNSB messages on
+// reserved channels (see ReservedChannelPrefix) are refused with an
+// ERR message with a 403 code.
+//
 // When a custom Handler is set on the Server, it should at some
 // point call ProcessMsg so the expected behaviour happens.
 func ProcessMsg(ctx context.Context, c *Conn, m msg.Msg) {
-	addFn := func(string, int64) {}
-	if c.srv.Vars != nil {
-		addFn = c.srv.Vars.Add
-		addFn("Msgs", 1)
-		if m.Type().IsRead() {
-			addFn("ReadMsgs", 1)
+	mtr := c.srv.metrics()
+	mtr.AddCounter("Msgs", 1)
+	if m.Type().IsRead() {
+		mtr.AddCounter("ReadMsgs", 1)
+	}
+	if m.Type().IsWrite() {
+		mtr.AddCounter("WriteMsgs", 1)
+	}
+
+	switch m.(type) {
+	case *msg.Call, *msg.Pub, *msg.Sub:
+		if c.srv.isShuttingDown() {
+			mtr.AddCounter("RefusedMsgs", 1)
+			c.Send(msg.NewErr(m, 503, ErrServerClosed))
+			return
+		}
+	}
+
+	if m.Type().IsRead() {
+		if code, err := authorize(ctx, c, m); err != nil {
+			mtr.AddCounter("UnauthorizedMsgs", 1)
+			c.Send(msg.NewErr(m, code, err))
+			return
 		}
-		if m.Type().IsWrite() {
-			addFn("WriteMsgs", 1)
+		if isReservedChannel(requestChannel(m)) {
+			mtr.AddCounter("ReservedChannelMsgs", 1)
+			c.Send(msg.NewErr(m, 403, ErrReservedChannel))
+			return
 		}
 	}
 
 	switch m := m.(type) {
 	case *msg.Call:
-		addFn("CallMsgs", 1)
+		mtr.AddCounter("CallMsgs", 1)
+
+		tr := c.srv.tracer()
+		span := tr.Start("server.call", trace.FromMetadata(m.Payload.Metadata))
+		span.SetAttr(logger.ConnKey, c.UUID.String())
+		span.SetAttr(logger.MsgKey, m.UUID().String())
+		span.SetAttr(logger.URIKey, m.Payload.URI)
 
+		// the callee's span is a child of the broker's span
+		bspan := tr.Start("broker.call", span.Context())
 		cp := &msg.CallPayload{
 			ConnUUID: c.UUID,
 			MsgUUID:  m.UUID(),
 			URI:      m.Payload.URI,
 			Args:     m.Payload.Args,
+			Metadata: trace.Inject(callMetadata(c, m), bspan.Context()),
 		}
-		if err := c.srv.CallerBroker.Call(cp, m.Payload.Timeout); err != nil {
+		// register the call as pending before sending it to the broker,
+		// as its result may be received before Call returns.
+		c.addPending(m.UUID(), m.Payload.Timeout, span)
+		start := time.Now()
+		err := c.srv.CallerBroker.Call(cp, m.Payload.Timeout)
+		mtr.Observe("BrokerCallDuration", time.Since(start).Seconds())
+		bspan.End(err)
+		if err != nil {
+			c.deletePending(m.UUID())
+			span.End(err)
 			c.Send(msg.NewErr(m, 500, err))
 			return
 		}
 		c.Send(msg.NewOK(m))
 
+	case *msg.Cncl:
+		mtr.AddCounter("CnclMsgs", 1)
+
+		cp := &msg.CnclPayload{
+			ConnUUID: c.UUID,
+			MsgUUID:  m.Payload.For,
+			URI:      m.Payload.URI,
+		}
+		start := time.Now()
+		err := c.srv.CallerBroker.Cancel(cp)
+		mtr.Observe("BrokerCancelDuration", time.Since(start).Seconds())
+		if err != nil {
+			code := 500
+			if err == broker.ErrCallNotOwned {
+				code = 403
+			}
+			c.Send(msg.NewErr(m, code, err))
+			return
+		}
+		if pc, ok := c.deletePending(m.Payload.For); ok {
+			pc.span.End(errCallCanceled)
+		}
+		c.Send(msg.NewOK(m))
+
 	case *msg.Pub:
-		addFn("PubMsgs", 1)
+		mtr.AddCounter("PubMsgs", 1)
 
 		pp := &msg.PubPayload{
 			MsgUUID: m.UUID(),
 			Args:    m.Payload.Args,
 		}
-		if err := c.srv.PubSubBroker.Publish(m.Payload.Channel, pp); err != nil {
+		start := time.Now()
+		err := c.srv.PubSubBroker.Publish(m.Payload.Channel, pp)
+		mtr.Observe("BrokerPublishDuration", time.Since(start).Seconds())
+		if err != nil {
 			c.Send(msg.NewErr(m, 500, err))
 			return
 		}
 		c.Send(msg.NewOK(m))
 
 	case *msg.Sub:
-		addFn("SubMsgs", 1)
+		mtr.AddCounter("SubMsgs", 1)
 
-		if err := c.psc.Subscribe(m.Payload.Channel, m.Payload.Pattern); err != nil {
+		start := time.Now()
+		err := c.psc.Subscribe(m.Payload.Channel, m.Payload.Pattern)
+		mtr.Observe("BrokerSubscribeDuration", time.Since(start).Seconds())
+		if err != nil {
 			c.Send(msg.NewErr(m, 500, err))
 			return
 		}
 		c.Send(msg.NewOK(m))
 
 	case *msg.Unsb:
-		addFn("UnsbMsgs", 1)
+		mtr.AddCounter("UnsbMsgs", 1)
 
-		if err := c.psc.Unsubscribe(m.Payload.Channel, m.Payload.Pattern); err != nil {
+		start := time.Now()
+		err := c.psc.Unsubscribe(m.Payload.Channel, m.Payload.Pattern)
+		mtr.Observe("BrokerUnsubscribeDuration", time.Since(start).Seconds())
+		if err != nil {
 			c.Send(msg.NewErr(m, 500, err))
 			return
 		}
 		c.Send(msg.NewOK(m))
 
 	case *msg.OK:
-		addFn("OKMsgs", 1)
-		doWrite(c, m, addFn)
+		mtr.AddCounter("OKMsgs", 1)
+		doWrite(c, m, mtr)
 	case *msg.Err:
-		addFn("ErrMsgs", 1)
-		doWrite(c, m, addFn)
+		mtr.AddCounter("ErrMsgs", 1)
+		doWrite(c, m, mtr)
 	case *msg.Evnt:
-		addFn("EvntMsgs", 1)
-		doWrite(c, m, addFn)
+		mtr.AddCounter("EvntMsgs", 1)
+		doWrite(c, m, mtr)
 	case *msg.Res:
-		addFn("ResMsgs", 1)
-		doWrite(c, m, addFn)
+		mtr.AddCounter("ResMsgs", 1)
+		doWrite(c, m, mtr)
 
 	default:
-		addFn("UnknownMsgs", 1)
-		logf(c.srv.LogFunc, "unknown message in ProcessMsg: %T", m)
+		mtr.AddCounter("UnknownMsgs", 1)
+		c.srv.logger().Log(logger.Warn, "unknown message in ProcessMsg", logger.Conn(c.UUID), logger.F("go_type", fmt.Sprintf("%T", m)))
 	}
 }
 
-func doWrite(c *Conn, m msg.Msg, addFn func(string, int64)) {
-	if err := writeMsg(c, m); err != nil {
+// requestChannel returns the pub-sub channel of the PUB, SUB and UNSB
+// messages, or an empty string for other messages.
+func requestChannel(m msg.Msg) string {
+	switch m := m.(type) {
+	case *msg.Pub:
+		return m.Payload.Channel
+	case *msg.Sub:
+		return m.Payload.Channel
+	case *msg.Unsb:
+		return m.Payload.Channel
+	}
+	return ""
+}
+
+// msgFields returns the log fields that identify the message m on
+// connection c.
+func msgFields(c *Conn, m msg.Msg) []logger.Field {
+	fields := []logger.Field{logger.Conn(c.UUID), logger.Msg(m.UUID()), logger.Type(m.Type())}
+	switch m := m.(type) {
+	case *msg.Call:
+		fields = append(fields, logger.URI(m.Payload.URI))
+	case *msg.Cncl:
+		fields = append(fields, logger.URI(m.Payload.URI))
+	case *msg.Res:
+		fields = append(fields, logger.URI(m.Payload.URI))
+	case *msg.Evnt:
+		fields = append(fields, logger.Channel(m.Payload.Channel))
+	default:
+		if ch := requestChannel(m); ch != "" {
+			fields = append(fields, logger.Channel(ch))
+		}
+	}
+	return fields
+}
+
+func doWrite(c *Conn, m msg.Msg, mtr metrics.Metrics) {
+	start := time.Now()
+	err := writeMsg(c, m)
+	mtr.Observe("WriteDuration", time.Since(start).Seconds())
+	if err != nil {
 		switch err {
 		case ErrWriteLockTimeout:
-			addFn("WriteLockTimeouts", 1)
+			mtr.AddCounter("WriteLockTimeouts", 1)
 			c.Close(fmt.Errorf("writeMsg failed: %v; closing connection", err))
 
 		case errWriteLimitExceeded:
-			addFn("WriteLimitExceeded", 1)
-			logf(c.srv.LogFunc, "%v: writeMsg %v failed: %v", c.UUID, m.UUID(), err)
+			mtr.AddCounter("WriteLimitExceeded", 1)
+			c.srv.logger().Log(logger.Warn, "writeMsg failed", append(msgFields(c, m), logger.Err(err))...)
 
 			// no good http code for this case
 			if err := writeMsg(c, msg.NewErr(m, 599, err)); err != nil {
 				if err == ErrWriteLockTimeout {
-					addFn("WriteLockTimeouts", 1)
+					mtr.AddCounter("WriteLockTimeouts", 1)
 					c.Close(fmt.Errorf("writeMsg failed: %v; closing connection", err))
 				} else {
-					logf(c.srv.LogFunc, "%v: writeMsg %v for write limit exceeded notification failed: %v", c.UUID, m.UUID(), err)
+					c.srv.logger().Log(logger.Error, "writeMsg for write limit exceeded notification failed", append(msgFields(c, m), logger.Err(err))...)
 				}
 				return
 			}
 
 		default:
-			logf(c.srv.LogFunc, "%v: writeMsg %v failed: %v", c.UUID, m.UUID(), err)
+			c.srv.logger().Log(logger.Error, "writeMsg failed", append(msgFields(c, m), logger.Err(err))...)
 		}
 	}
 }
@@ -228,6 +347,10 @@ func (w *limitedWriter) Write(p []byte) (int, error) {
 }
 
 func writeMsg(c *Conn, m msg.Msg) error {
+	if c.compress {
+		return writeCompressedMsg(c, m)
+	}
+
 	w := c.Writer(c.srv.AcquireWriteLockTimeout)
 	defer w.Close()
 
@@ -235,8 +358,26 @@ func writeMsg(c *Conn, m msg.Msg) error {
 	if l := c.srv.WriteLimit; l > 0 {
 		lw = limitWriter(w, l)
 	}
-	if err := json.NewEncoder(lw).Encode(m); err != nil {
+	if err := c.codec.Encode(lw, m); err != nil {
 		return err
 	}
+	c.touch()
 	return nil
 }
+
+// callMetadata returns the metadata to store in the CallPayload of
+// the call m received on connection c.
+func callMetadata(c *Conn, m *msg.Call) map[string]string {
+	var md map[string]string
+	if n := len(m.Payload.Metadata); n > 0 || c.Identity != nil {
+		md = make(map[string]string, n+1)
+	}
+	for k, v := range m.Payload.Metadata {
+		md[k] = v
+	}
+	delete(md, msg.IdentityKey)
+	if c.Identity != nil {
+		md[msg.IdentityKey] = c.Identity.ID
+	}
+	return md
+}
@@ -1,12 +1,20 @@
 package juggler
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
+	"expvar"
 	"io/ioutil"
+	"net/http/httptest"
 	"testing"
 	"testing/quick"
+	"time"
 
+	"github.com/PuerkitoBio/exp/juggler/broker/memorybroker"
 	"github.com/PuerkitoBio/exp/juggler/internal/jugglertest"
+	"github.com/PuerkitoBio/exp/juggler/internal/wstest"
+	"github.com/PuerkitoBio/exp/juggler/metrics"
 	"github.com/PuerkitoBio/exp/juggler/msg"
 	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
@@ -105,3 +113,161 @@ func TestLimitedWriter(t *testing.T) {
 	}
 	assert.NoError(t, quick.Check(checker, nil))
 }
+
+func TestProcessMsgCallMetadata(t *testing.T) {
+	done := make(chan bool, 1)
+	srv := wstest.StartRecordingServer(t, done, ioutil.Discard)
+	defer srv.Close()
+
+	wsc := wstest.Dial(t, srv.URL)
+	defer wsc.Close()
+
+	dbgl := &jugglertest.DebugLog{T: t}
+	brk := &memorybroker.Broker{LogFunc: dbgl.Printf}
+	server := &Server{CallerBroker: brk, PubSubBroker: brk, LogFunc: dbgl.Printf}
+	jc := newConn(wsc, server)
+	jc.psc, jc.resc = fakePubSubConn{}, fakeResultsConn{}
+
+	cc, err := brk.Calls("a")
+	require.NoError(t, err, "get Calls connection")
+	defer cc.Close()
+
+	cases := []struct {
+		id   *Identity
+		md   map[string]string
+		want map[string]string
+	}{
+		{nil, nil, nil},
+		{nil, map[string]string{"k": "v", msg.IdentityKey: "spoof"}, map[string]string{"k": "v"}},
+		{&Identity{ID: "x"}, nil, map[string]string{msg.IdentityKey: "x"}},
+		{&Identity{ID: "x"}, map[string]string{"k": "v", msg.IdentityKey: "spoof"}, map[string]string{"k": "v", msg.IdentityKey: "x"}},
+	}
+	for i, c := range cases {
+		call, err := msg.NewCall("a", nil, 0)
+		require.NoError(t, err, "NewCall %d", i)
+		call.Payload.Metadata = c.md
+
+		jc.Identity = c.id
+		ProcessMsg(context.Background(), jc, call)
+
+		select {
+		case cp := <-cc.Calls():
+			assert.Equal(t, call.UUID(), cp.MsgUUID, "%d: msg UUID", i)
+			assert.Equal(t, c.want, cp.Metadata, "%d: metadata", i)
+		case <-time.After(100 * time.Millisecond):
+			assert.Fail(t, "no call received", "%d", i)
+		}
+	}
+}
+
+func TestProcessMsgCncl(t *testing.T) {
+	var buf bytes.Buffer
+	done := make(chan bool, 1)
+	srv := wstest.StartRecordingServer(t, done, &buf)
+	defer srv.Close()
+
+	wsc := wstest.Dial(t, srv.URL)
+	defer wsc.Close()
+
+	dbgl := &jugglertest.DebugLog{T: t}
+	brk := &memorybroker.Broker{LogFunc: dbgl.Printf}
+	server := &Server{CallerBroker: brk, PubSubBroker: brk, LogFunc: dbgl.Printf}
+	jc := newConn(wsc, server)
+	jc.psc, jc.resc = fakePubSubConn{}, fakeResultsConn{}
+
+	call, err := msg.NewCall("a", nil, 0)
+	require.NoError(t, err, "NewCall")
+	ProcessMsg(context.Background(), jc, call)
+
+	// cancel from another connection is denied
+	other := newConn(wsc, server)
+	cncl1 := msg.NewCncl(call)
+	ProcessMsg(context.Background(), other, cncl1)
+
+	// cancel from the calling connection succeeds
+	cncl2 := msg.NewCncl(call)
+	ProcessMsg(context.Background(), jc, cncl2)
+
+	wsc.Close()
+	<-done
+
+	cases := []struct {
+		mt   msg.MessageType
+		from msg.Msg
+		code int
+	}{
+		{msg.OKMsg, call, 0},
+		{msg.ErrMsg, cncl1, 403},
+		{msg.OKMsg, cncl2, 0},
+	}
+	var p json.RawMessage
+	dec := json.NewDecoder(bytes.NewReader(buf.Bytes()))
+	for i, c := range cases {
+		require.NoError(t, dec.Decode(&p), "Decode %d", i)
+		m, err := msg.UnmarshalResponse(bytes.NewReader(p))
+		require.NoError(t, err, "UnmarshalResponse %d", i)
+		require.Equal(t, c.mt, m.Type(), "%d: type", i)
+
+		switch m := m.(type) {
+		case *msg.Err:
+			assert.Equal(t, c.from.UUID(), m.Payload.For, "%d: for", i)
+			assert.Equal(t, c.code, m.Payload.Code, "%d: code", i)
+		case *msg.OK:
+			assert.Equal(t, c.from.UUID(), m.Payload.For, "%d: for", i)
+		}
+	}
+
+	// the call is no longer queued
+	cc, err := brk.Calls("a")
+	require.NoError(t, err, "get Calls connection")
+	defer cc.Close()
+	select {
+	case cp := <-cc.Calls():
+		assert.Fail(t, "unexpected call", "%v", cp.MsgUUID)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestProcessMsgMetrics(t *testing.T) {
+	done := make(chan bool, 1)
+	srv := wstest.StartRecordingServer(t, done, ioutil.Discard)
+	defer srv.Close()
+
+	wsc := wstest.Dial(t, srv.URL)
+	defer wsc.Close()
+
+	dbgl := &jugglertest.DebugLog{T: t}
+	brk := &memorybroker.Broker{LogFunc: dbgl.Printf}
+	prom := &metrics.Prometheus{}
+	server := &Server{
+		CallerBroker: brk,
+		PubSubBroker: brk,
+		LogFunc:      dbgl.Printf,
+		Vars:         new(expvar.Map).Init(),
+		Metrics:      prom,
+	}
+	jc := newConn(wsc, server)
+	jc.psc, jc.resc = fakePubSubConn{}, fakeResultsConn{}
+
+	call, err := msg.NewCall("a", nil, 0)
+	require.NoError(t, err, "NewCall")
+	ProcessMsg(context.Background(), jc, call)
+	jc.enqueue(msg.NewRes(&msg.ResPayload{MsgUUID: call.UUID(), URI: "a"}))
+
+	w := httptest.NewRecorder()
+	prom.ServeHTTP(w, nil)
+	out := w.Body.String()
+	for _, want := range []string{
+		"call_msgs_total 1\n",
+		"res_msgs_total 1\n",
+		"broker_call_duration_seconds_count 1\n",
+		"call_duration_seconds_count 1\n",
+		"write_duration_seconds_count 2\n",
+	} {
+		assert.Contains(t, out, want)
+	}
+
+	// the same metrics are collected in Vars
+	assert.Equal(t, "1", server.Vars.Get("CallMsgs").String(), "CallMsgs")
+	assert.NotNil(t, server.Vars.Get("CallDuration"), "CallDuration")
+}
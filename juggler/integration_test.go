@@ -19,6 +19,7 @@ import (
 
 	"github.com/PuerkitoBio/exp/juggler"
 	"github.com/PuerkitoBio/exp/juggler/broker"
+	"github.com/PuerkitoBio/exp/juggler/broker/memorybroker"
 	"github.com/PuerkitoBio/exp/juggler/broker/redisbroker"
 	"github.com/PuerkitoBio/exp/juggler/callee"
 	"github.com/PuerkitoBio/exp/juggler/client"
@@ -159,11 +160,53 @@ func (s *runStats) clone() *runStats {
 	}
 }
 
+// intgBroker is a broker that implements all broker roles.
+type intgBroker interface {
+	broker.CallerBroker
+	broker.CalleeBroker
+	broker.PubSubBroker
+}
+
 func TestIntegration(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping the integration test when the -short flag is set")
 	}
-	runIntegrationTest(t, getIntgConfig())
+
+	conf := getIntgConfig()
+	dbgl := &jugglertest.DebugLog{T: t}
+
+	cmd, port := redistest.StartServer(t, nil)
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	pool.MaxActive = conf.RedisPoolMaxActive
+	pool.MaxIdle = conf.RedisPoolMaxIdle
+	pool.IdleTimeout = conf.RedisPoolIdleTimeout
+	brk := &redisbroker.Broker{
+		Pool:    pool,
+		Dial:    pool.Dial,
+		LogFunc: dbgl.Printf,
+
+		BlockingTimeout: conf.BrokerBlockingTimeout,
+		CallCap:         conf.BrokerCallCap,
+		ResultCap:       conf.BrokerResultCap,
+	}
+	runIntegrationTest(t, conf, brk, dbgl)
+}
+
+func TestIntegrationMemoryBroker(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping the integration test when the -short flag is set")
+	}
+
+	conf := getIntgConfig()
+	dbgl := &jugglertest.DebugLog{T: t}
+	brk := &memorybroker.Broker{
+		LogFunc:   dbgl.Printf,
+		CallCap:   conf.BrokerCallCap,
+		ResultCap: conf.BrokerResultCap,
+	}
+	runIntegrationTest(t, conf, brk, dbgl)
 }
 
 func incStats(stats *runStats, m msg.Msg, fromSrv bool) {
@@ -308,36 +351,13 @@ func newClientMsg(t *testing.T, conf *IntgConfig, rnd *rand.Rand) (m msg.Msg, ex
 	return m, expires
 }
 
-func runIntegrationTest(t *testing.T, conf *IntgConfig) {
-	dbgl := &jugglertest.DebugLog{T: t}
-
+func runIntegrationTest(t *testing.T, conf *IntgConfig, brk intgBroker, dbgl *jugglertest.DebugLog) {
 	// start/create:
-	// 1. redis-server
-	// 2. redis pool and broker
-	// 3. juggler server
-	// 4. m callees
-	// 5. n clients
-
-	// 1. redis-server
-	cmd, port := redistest.StartServer(t, nil)
-	defer cmd.Process.Kill()
-
-	// 2. create the redis pool and broker
-	pool := redistest.NewPool(t, ":"+port)
-	pool.MaxActive = conf.RedisPoolMaxActive
-	pool.MaxIdle = conf.RedisPoolMaxIdle
-	pool.IdleTimeout = conf.RedisPoolIdleTimeout
-	brk := &redisbroker.Broker{
-		Pool:    pool,
-		Dial:    pool.Dial,
-		LogFunc: dbgl.Printf,
-
-		BlockingTimeout: conf.BrokerBlockingTimeout,
-		CallCap:         conf.BrokerCallCap,
-		ResultCap:       conf.BrokerResultCap,
-	}
+	// 1. juggler server
+	// 2. m callees
+	// 3. n clients
 
-	// 3. create the juggler server
+	// 1. create the juggler server
 	rc := prepareExec(t, conf)
 
 	var srvStats runStats
@@ -364,7 +384,7 @@ func runIntegrationTest(t *testing.T, conf *IntgConfig) {
 		return "ok", nil
 	}
 
-	// 4. start m callees
+	// 2. start m callees
 	calleeStarted := make(chan struct{})
 	for i := 0; i < conf.NCallees; i++ {
 		go func(i int) {
@@ -400,7 +420,7 @@ func runIntegrationTest(t *testing.T, conf *IntgConfig) {
 		}(i)
 	}
 
-	// 5. start n clients
+	// 3. start n clients
 	var clientStats runStats
 	clientStarted := make(chan struct{})
 	wg := sync.WaitGroup{}
@@ -0,0 +1,33 @@
+package hashslot
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCRC16(t *testing.T) {
+	assert.Equal(t, uint16(0x31c3), crc16("123456789"), "check value")
+}
+
+func TestSlot(t *testing.T) {
+	cases := []struct {
+		key  string
+		slot int
+	}{
+		{"", 0},
+		{"foo", 12182},
+		{"bar", 5061},
+		{"{user1000}.following", Slot("user1000")},
+		{"{user1000}.followers", Slot("user1000")},
+		{"foo{}{bar}", Slot("foo{}{bar}")},
+		{"foo{{bar}}zap", Slot("{bar")},
+		{"foo{bar}{zap}", Slot("bar")},
+		{"juggler:calls:{a}", Slot("a")},
+		{"juggler:calls:timeout:{a}:123", Slot("a")},
+	}
+	for i, c := range cases {
+		assert.Equal(t, c.slot, Slot(c.key), "%d: %s", i, c.key)
+	}
+	assert.NotEqual(t, Slot("foo{}{bar}"), Slot("bar"), "empty hash tag")
+}
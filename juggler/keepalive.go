@@ -0,0 +1,125 @@
+package juggler
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	// ErrPongTimeout is the CloseErr of a connection closed because no
+	// pong was received in time after a ping.
+	ErrPongTimeout = errors.New("juggler: pong timeout")
+
+	// ErrIdleTimeout is the CloseErr of a connection closed because it
+	// had no juggler traffic for the idle timeout.
+	ErrIdleTimeout = errors.New("juggler: idle timeout")
+)
+
+// touch records juggler traffic on the connection.
+func (c *Conn) touch() {
+	c.amu.Lock()
+	c.lastActivity = time.Now()
+	c.amu.Unlock()
+}
+
+// idleSince returns the time of the last juggler traffic on the
+// connection.
+func (c *Conn) idleSince() time.Time {
+	c.amu.Lock()
+	defer c.amu.Unlock()
+	return c.lastActivity
+}
+
+// ping writes a ping control frame under the write lock.
+func (c *Conn) ping() error {
+	var wait <-chan time.Time
+	if to := c.srv.AcquireWriteLockTimeout; to > 0 {
+		wait = time.After(to)
+	}
+
+	select {
+	case <-wait:
+		return ErrWriteLockTimeout
+	case <-c.wmu:
+	}
+	defer func() { c.wmu <- struct{}{} }()
+
+	var deadline time.Time
+	if to := c.srv.WriteTimeout; to > 0 {
+		deadline = time.Now().Add(to)
+	}
+	return c.wsConn.WriteControl(websocket.PingMessage, nil, deadline)
+}
+
+// keepAlive is the loop that sends pings at the server's PingInterval
+// and closes the connection if a pong is not received before the
+// PongTimeout, started in its own goroutine. The pong channel receives
+// a value when a pong is received.
+func (c *Conn) keepAlive(pong <-chan struct{}) {
+	mtr := c.srv.metrics()
+	mtr.AddCounter("TotalConnGoros", 1)
+	mtr.AddGauge("ActiveConnGoros", 1)
+	defer mtr.AddGauge("ActiveConnGoros", -1)
+
+	timeout := c.srv.PongTimeout
+	if timeout <= 0 {
+		timeout = c.srv.PingInterval
+	}
+
+	for {
+		select {
+		case <-c.kill:
+			return
+		case <-time.After(c.srv.PingInterval):
+		}
+
+		// drop any unsolicited pong
+		select {
+		case <-pong:
+		default:
+		}
+
+		if err := c.ping(); err != nil {
+			c.Close(err)
+			return
+		}
+
+		select {
+		case <-c.kill:
+			return
+		case <-pong:
+		case <-time.After(timeout):
+			mtr.AddCounter("PongTimeouts", 1)
+			c.Close(ErrPongTimeout)
+			return
+		}
+	}
+}
+
+// idle is the loop that closes the connection once it had no juggler
+// traffic for the server's IdleTimeout, started in its own goroutine.
+func (c *Conn) idle() {
+	mtr := c.srv.metrics()
+	mtr.AddCounter("TotalConnGoros", 1)
+	mtr.AddGauge("ActiveConnGoros", 1)
+	defer mtr.AddGauge("ActiveConnGoros", -1)
+
+	timeout := c.srv.IdleTimeout
+	wait := timeout
+	for {
+		select {
+		case <-c.kill:
+			return
+		case <-time.After(wait):
+		}
+
+		wait = c.idleSince().Add(timeout).Sub(time.Now())
+		if wait <= 0 {
+			mtr.AddCounter("IdleTimeouts", 1)
+			c.Close(ErrIdleTimeout)
+			return
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package juggler
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/exp/juggler/broker/memorybroker"
+	"github.com/PuerkitoBio/exp/juggler/internal/jugglertest"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startKeepAliveServer starts a server configured by fn, and returns
+// the channel that receives the CloseErr of the closed connections.
+func startKeepAliveServer(t *testing.T, fn func(*Server)) (*httptest.Server, <-chan error) {
+	dbgl := &jugglertest.DebugLog{T: t}
+	brk := &memorybroker.Broker{LogFunc: dbgl.Printf}
+	errs := make(chan error, 1)
+	server := &Server{
+		CallerBroker: brk,
+		PubSubBroker: brk,
+		LogFunc:      dbgl.Printf,
+		ConnState: func(c *Conn, cs ConnState) {
+			if cs == Closing {
+				errs <- c.CloseErr
+			}
+		},
+	}
+	fn(server)
+
+	upg := &websocket.Upgrader{Subprotocols: Subprotocols}
+	srv := httptest.NewServer(Upgrade(upg, server))
+	srv.URL = strings.Replace(srv.URL, "http:", "ws:", 1)
+	return srv, errs
+}
+
+// dialAndRead dials srv and starts reading from the connection, so
+// that control frames get processed.
+func dialAndRead(t *testing.T, url string, pingHandler func(string) error) *websocket.Conn {
+	d := &websocket.Dialer{Subprotocols: Subprotocols}
+	conn, _, err := d.Dial(url, nil)
+	require.NoError(t, err, "Dial")
+	if pingHandler != nil {
+		conn.SetPingHandler(pingHandler)
+	}
+	go func() {
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+	return conn
+}
+
+func TestKeepAlive(t *testing.T) {
+	srv, errs := startKeepAliveServer(t, func(s *Server) {
+		s.PingInterval = 10 * time.Millisecond
+		s.PongTimeout = 50 * time.Millisecond
+	})
+	defer srv.Close()
+
+	// the default ping handler replies with a pong
+	conn := dialAndRead(t, srv.URL, nil)
+	defer conn.Close()
+
+	select {
+	case err := <-errs:
+		assert.Fail(t, "connection closed", "%v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestPongTimeout(t *testing.T) {
+	srv, errs := startKeepAliveServer(t, func(s *Server) {
+		s.PingInterval = 10 * time.Millisecond
+		s.PongTimeout = 20 * time.Millisecond
+	})
+	defer srv.Close()
+
+	// ignore pings, so no pong is sent
+	conn := dialAndRead(t, srv.URL, func(string) error { return nil })
+	defer conn.Close()
+
+	select {
+	case err := <-errs:
+		assert.Equal(t, ErrPongTimeout, err, "CloseErr")
+	case <-time.After(time.Second):
+		assert.Fail(t, "connection not closed")
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	srv, errs := startKeepAliveServer(t, func(s *Server) {
+		s.PingInterval = 10 * time.Millisecond
+		s.IdleTimeout = 50 * time.Millisecond
+	})
+	defer srv.Close()
+
+	// pongs do not count as juggler traffic
+	conn := dialAndRead(t, srv.URL, nil)
+	defer conn.Close()
+
+	select {
+	case err := <-errs:
+		assert.Equal(t, ErrIdleTimeout, err, "CloseErr")
+	case <-time.After(time.Second):
+		assert.Fail(t, "connection not closed")
+	}
+}
@@ -0,0 +1,166 @@
+// Package logger defines the structured, leveled Logger interface used
+// by the juggler packages to log events. Each event has a level, a
+// message and a list of key-value fields, such as the UUID of the
+// connection or of the message.
+//
+// The Std type adapts a *log.Logger from the standard library, and
+// the Func type adapts a printf-style logging function, such as the
+// LogFunc fields of the juggler types.
+package logger
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/pborman/uuid"
+)
+
+// Level is the severity level of a log event.
+type Level int
+
+// The list of levels, by increasing severity.
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+var lookupLevel = map[Level]string{
+	Debug: "DEBUG",
+	Info:  "INFO",
+	Warn:  "WARN",
+	Error: "ERROR",
+}
+
+// String returns the human-readable representation of the level.
+func (l Level) String() string {
+	if s := lookupLevel[l]; s != "" {
+		return s
+	}
+	return fmt.Sprintf("<unknown: %d>", l)
+}
+
+// The standard keys of the fields.
+const (
+	ConnKey    = "conn"
+	MsgKey     = "msg"
+	TypeKey    = "type"
+	URIKey     = "uri"
+	ChannelKey = "channel"
+	ErrKey     = "err"
+)
+
+// Field is a key-value pair attached to a log event.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// F returns a field with the specified key and value.
+func F(key string, v interface{}) Field {
+	return Field{Key: key, Value: v}
+}
+
+// Conn returns the field for the UUID of a connection.
+func Conn(id uuid.UUID) Field {
+	return Field{Key: ConnKey, Value: id}
+}
+
+// Msg returns the field for the UUID of a message.
+func Msg(id uuid.UUID) Field {
+	return Field{Key: MsgKey, Value: id}
+}
+
+// Type returns the field for the type of a message.
+func Type(mt fmt.Stringer) Field {
+	return Field{Key: TypeKey, Value: mt}
+}
+
+// URI returns the field for the URI of a call.
+func URI(uri string) Field {
+	return Field{Key: URIKey, Value: uri}
+}
+
+// Channel returns the field for a pub-sub channel.
+func Channel(ch string) Field {
+	return Field{Key: ChannelKey, Value: ch}
+}
+
+// Err returns the field for an error.
+func Err(err error) Field {
+	return Field{Key: ErrKey, Value: err}
+}
+
+// Logger defines the method required to log events.
+type Logger interface {
+	// Log logs the event described by msg at the specified level,
+	// with the key-value fields.
+	Log(level Level, msg string, fields ...Field)
+}
+
+// Discard is a Logger that discards all events.
+var Discard Logger = discard{}
+
+type discard struct{}
+
+func (discard) Log(Level, string, ...Field) {}
+
+// Func is a printf-style logging function that implements Logger.
+// The events are formatted with Format. A nil Func logs using
+// log.Printf.
+type Func func(string, ...interface{})
+
+// Log implements Logger for the Func by calling the function with
+// the formatted event.
+func (fn Func) Log(level Level, msg string, fields ...Field) {
+	s := Format(level, msg, fields...)
+	if fn == nil {
+		log.Printf("%s", s)
+		return
+	}
+	fn("%s", s)
+}
+
+// Std is a Logger that logs the events at or above its MinLevel
+// using a *log.Logger. The events are formatted with Format.
+type Std struct {
+	// Logger is the logger to use. If nil, the standard logger of
+	// the log package is used.
+	Logger *log.Logger
+
+	// MinLevel is the minimum level of the events to log.
+	MinLevel Level
+}
+
+// Log implements Logger for the Std.
+func (s *Std) Log(level Level, msg string, fields ...Field) {
+	if level < s.MinLevel {
+		return
+	}
+	if s.Logger == nil {
+		log.Print(Format(level, msg, fields...))
+		return
+	}
+	s.Logger.Print(Format(level, msg, fields...))
+}
+
+// Format formats the event as the level, the message and the fields
+// as key=value pairs, separated by spaces. Values that contain spaces
+// or quotes are quoted.
+func Format(level Level, msg string, fields ...Field) string {
+	var buf bytes.Buffer
+	buf.WriteString(level.String())
+	buf.WriteByte(' ')
+	buf.WriteString(msg)
+	for _, f := range fields {
+		v := fmt.Sprint(f.Value)
+		if v == "" || strings.ContainsAny(v, " \t\n\"=") {
+			v = fmt.Sprintf("%q", v)
+		}
+		fmt.Fprintf(&buf, " %s=%s", f.Key, v)
+	}
+	return buf.String()
+}
@@ -0,0 +1,55 @@
+package logger
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"testing"
+
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormat(t *testing.T) {
+	t.Parallel()
+
+	id := uuid.Parse("7d0f0a2e-43a5-4b5c-9d0e-7c4b1c1d2e3f")
+	cases := []struct {
+		level  Level
+		msg    string
+		fields []Field
+		want   string
+	}{
+		{Info, "connected", nil, "INFO connected"},
+		{Debug, "a", []Field{Conn(id)}, "DEBUG a conn=7d0f0a2e-43a5-4b5c-9d0e-7c4b1c1d2e3f"},
+		{Warn, "b", []Field{URI("x"), Channel("")}, `WARN b uri=x channel=""`},
+		{Error, "c", []Field{Err(errors.New("some error")), F("n", 3)}, `ERROR c err="some error" n=3`},
+		{Level(9), "d", nil, "<unknown: 9> d"},
+	}
+	for i, c := range cases {
+		assert.Equal(t, c.want, Format(c.level, c.msg, c.fields...), "%d", i)
+	}
+}
+
+func TestFunc(t *testing.T) {
+	t.Parallel()
+
+	var got string
+	fn := Func(func(f string, args ...interface{}) {
+		got = fmt.Sprintf(f, args...)
+	})
+	fn.Log(Warn, "100% done", F("k", "v"))
+	assert.Equal(t, "WARN 100% done k=v", got)
+}
+
+func TestStd(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	l := &Std{Logger: log.New(&buf, "", 0), MinLevel: Info}
+	l.Log(Debug, "a")
+	l.Log(Info, "b")
+	l.Log(Error, "c", F("k", 1))
+	assert.Equal(t, "INFO b\nERROR c k=1\n", buf.String())
+}
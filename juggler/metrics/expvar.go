@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// Expvar is a Metrics implementation that collects the metrics in an
+// *expvar.Map. Counters and gauges are stored as *expvar.Int values,
+// and histograms as values that marshal to a JSON object with the
+// count, the sum and the cumulative count of each bucket.
+type Expvar struct {
+	// Map is the map that holds the metrics. It must be set before
+	// the Expvar can be used.
+	Map *expvar.Map
+
+	// Buckets is the list of upper bounds of the histogram buckets.
+	// The default of nil uses DefaultBuckets.
+	Buckets []float64
+
+	mu sync.Mutex // lock creation of histograms
+}
+
+// NewExpvar returns an Expvar that collects the metrics in m.
+func NewExpvar(m *expvar.Map) *Expvar {
+	return &Expvar{Map: m}
+}
+
+// AddCounter adds delta to the expvar.Int identified by name.
+func (e *Expvar) AddCounter(name string, delta int64) {
+	e.Map.Add(name, delta)
+}
+
+// AddGauge adds delta to the expvar.Int identified by name.
+func (e *Expvar) AddGauge(name string, delta int64) {
+	e.Map.Add(name, delta)
+}
+
+// Observe adds v to the histogram identified by name.
+func (e *Expvar) Observe(name string, v float64) {
+	h, ok := e.Map.Get(name).(*expvarHistogram)
+	if !ok {
+		e.mu.Lock()
+		if h, ok = e.Map.Get(name).(*expvarHistogram); !ok {
+			h = &expvarHistogram{newHistogram(e.Buckets)}
+			e.Map.Set(name, h)
+		}
+		e.mu.Unlock()
+	}
+	h.observe(v)
+}
+
+// expvarHistogram is a histogram that implements expvar.Var.
+type expvarHistogram struct {
+	*histogram
+}
+
+// String returns the JSON representation of the histogram.
+func (h *expvarHistogram) String() string {
+	cum, count, sum := h.snapshot()
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `{"count": %d, "sum": %s, "buckets": {`, count, strconv.FormatFloat(sum, 'g', -1, 64))
+	for i, c := range cum {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		le := "+Inf"
+		if i < len(h.buckets) {
+			le = strconv.FormatFloat(h.buckets[i], 'g', -1, 64)
+		}
+		fmt.Fprintf(&buf, "%q: %d", le, c)
+	}
+	buf.WriteString("}}")
+	return buf.String()
+}
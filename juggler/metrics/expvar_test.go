@@ -0,0 +1,38 @@
+package metrics
+
+import (
+	"encoding/json"
+	"expvar"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpvar(t *testing.T) {
+	t.Parallel()
+
+	e := &Expvar{Map: new(expvar.Map).Init(), Buckets: []float64{0.1, 1}}
+	e.AddCounter("Msgs", 2)
+	e.AddGauge("ActiveConns", 3)
+	e.AddGauge("ActiveConns", -1)
+	for _, v := range []float64{0.05, 0.1, 0.5, 2} {
+		e.Observe("CallDuration", v)
+	}
+
+	var got struct {
+		Msgs         int
+		ActiveConns  int
+		CallDuration struct {
+			Count   int
+			Sum     float64
+			Buckets map[string]int
+		}
+	}
+	require.NoError(t, json.Unmarshal([]byte(e.Map.String()), &got), "Unmarshal")
+	assert.Equal(t, 2, got.Msgs, "Msgs")
+	assert.Equal(t, 2, got.ActiveConns, "ActiveConns")
+	assert.Equal(t, 4, got.CallDuration.Count, "count")
+	assert.Equal(t, 2.65, got.CallDuration.Sum, "sum")
+	assert.Equal(t, map[string]int{"0.1": 2, "1": 3, "+Inf": 4}, got.CallDuration.Buckets, "buckets")
+}
@@ -0,0 +1,118 @@
+// Package metrics defines the Metrics interface used by the juggler
+// server to collect counters, gauges and histograms. The Expvar type
+// implements it using an *expvar.Map, and the Prometheus type
+// implements it in memory and serves the metrics in the Prometheus
+// text exposition format.
+//
+// Metric names are in CamelCase (e.g. "ActiveConns"), and it is up
+// to the implementation to translate them to its own conventions.
+// Histograms observe durations, in seconds.
+package metrics
+
+import (
+	"sort"
+	"sync"
+)
+
+// Metrics defines the methods required to collect metrics.
+type Metrics interface {
+	// AddCounter adds delta to the counter identified by name. A
+	// counter only increases.
+	AddCounter(name string, delta int64)
+
+	// AddGauge adds delta to the gauge identified by name. A gauge
+	// may increase and decrease.
+	AddGauge(name string, delta int64)
+
+	// Observe adds the value v to the histogram identified by name.
+	Observe(name string, v float64)
+}
+
+// DefaultBuckets is the default list of upper bounds of the histogram
+// buckets, in seconds.
+var DefaultBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Discard is a Metrics implementation that discards all metrics.
+var Discard Metrics = discard{}
+
+type discard struct{}
+
+func (discard) AddCounter(string, int64) {}
+func (discard) AddGauge(string, int64)   {}
+func (discard) Observe(string, float64)  {}
+
+// Multi returns a Metrics implementation that collects the metrics
+// in all ms. If ms is empty, it returns Discard.
+func Multi(ms ...Metrics) Metrics {
+	switch len(ms) {
+	case 0:
+		return Discard
+	case 1:
+		return ms[0]
+	}
+	return multi(ms)
+}
+
+type multi []Metrics
+
+func (ms multi) AddCounter(name string, delta int64) {
+	for _, m := range ms {
+		m.AddCounter(name, delta)
+	}
+}
+
+func (ms multi) AddGauge(name string, delta int64) {
+	for _, m := range ms {
+		m.AddGauge(name, delta)
+	}
+}
+
+func (ms multi) Observe(name string, v float64) {
+	for _, m := range ms {
+		m.Observe(name, v)
+	}
+}
+
+// histogram counts the observed values in buckets. It is safe for
+// concurrent use.
+type histogram struct {
+	mu      sync.Mutex
+	buckets []float64 // sorted upper bounds, +Inf is implicit
+	counts  []uint64  // per bucket, the last one is for +Inf
+	count   uint64
+	sum     float64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	b := append([]float64(nil), buckets...)
+	sort.Float64s(b)
+	return &histogram{buckets: b, counts: make([]uint64, len(b)+1)}
+}
+
+func (h *histogram) observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+
+	h.mu.Lock()
+	h.counts[i]++
+	h.count++
+	h.sum += v
+	h.mu.Unlock()
+}
+
+// snapshot returns the cumulative count of each bucket, the last one
+// being the +Inf bucket, along with the count and sum of the values.
+func (h *histogram) snapshot() ([]uint64, uint64, float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	cum := make([]uint64, len(h.counts))
+	var n uint64
+	for i, c := range h.counts {
+		n += c
+		cum[i] = n
+	}
+	return cum, h.count, h.sum
+}
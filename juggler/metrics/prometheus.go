@@ -0,0 +1,158 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"unicode"
+)
+
+// Prometheus is a Metrics implementation that collects the metrics in
+// memory. It implements http.Handler to serve them in the Prometheus
+// text exposition format. The zero value is ready to use.
+//
+// The CamelCase metric names are translated to snake_case and
+// prefixed with the Namespace, counters get the "_total" suffix and
+// histograms the "_seconds" suffix, so that the "CallMsgs" counter is
+// exposed as "juggler_call_msgs_total" with the "juggler" namespace.
+type Prometheus struct {
+	// Namespace is the prefix of the metric names. If empty, the
+	// names are not prefixed.
+	Namespace string
+
+	// Buckets is the list of upper bounds of the histogram buckets.
+	// The default of nil uses DefaultBuckets.
+	Buckets []float64
+
+	mu       sync.Mutex
+	counters map[string]int64
+	gauges   map[string]int64
+	hists    map[string]*histogram
+}
+
+// AddCounter adds delta to the counter identified by name.
+func (p *Prometheus) AddCounter(name string, delta int64) {
+	p.mu.Lock()
+	if p.counters == nil {
+		p.counters = make(map[string]int64)
+	}
+	p.counters[name] += delta
+	p.mu.Unlock()
+}
+
+// AddGauge adds delta to the gauge identified by name.
+func (p *Prometheus) AddGauge(name string, delta int64) {
+	p.mu.Lock()
+	if p.gauges == nil {
+		p.gauges = make(map[string]int64)
+	}
+	p.gauges[name] += delta
+	p.mu.Unlock()
+}
+
+// Observe adds v to the histogram identified by name.
+func (p *Prometheus) Observe(name string, v float64) {
+	p.mu.Lock()
+	if p.hists == nil {
+		p.hists = make(map[string]*histogram)
+	}
+	h := p.hists[name]
+	if h == nil {
+		h = newHistogram(p.Buckets)
+		p.hists[name] = h
+	}
+	p.mu.Unlock()
+
+	h.observe(v)
+}
+
+// ServeHTTP implements http.Handler for the Prometheus type. It writes
+// the metrics in the text exposition format, sorted by name.
+func (p *Prometheus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	p.mu.Lock()
+	counters := sortedKeys(p.counters)
+	gauges := sortedKeys(p.gauges)
+	hists := make([]string, 0, len(p.hists))
+	for k := range p.hists {
+		hists = append(hists, k)
+	}
+	sort.Strings(hists)
+
+	bw := bufio.NewWriter(w)
+	for _, k := range counters {
+		name := p.metricName(k, "_total")
+		fmt.Fprintf(bw, "# TYPE %s counter\n%s %d\n", name, name, p.counters[k])
+	}
+	for _, k := range gauges {
+		name := p.metricName(k, "")
+		fmt.Fprintf(bw, "# TYPE %s gauge\n%s %d\n", name, name, p.gauges[k])
+	}
+	hs := make([]*histogram, len(hists))
+	for i, k := range hists {
+		hs[i] = p.hists[k]
+	}
+	p.mu.Unlock()
+
+	for i, k := range hists {
+		h := hs[i]
+		cum, count, sum := h.snapshot()
+
+		name := p.metricName(k, "_seconds")
+		fmt.Fprintf(bw, "# TYPE %s histogram\n", name)
+		for j, c := range cum {
+			le := "+Inf"
+			if j < len(h.buckets) {
+				le = strconv.FormatFloat(h.buckets[j], 'g', -1, 64)
+			}
+			fmt.Fprintf(bw, "%s_bucket{le=%q} %d\n", name, le, c)
+		}
+		fmt.Fprintf(bw, "%s_sum %s\n%s_count %d\n", name, strconv.FormatFloat(sum, 'g', -1, 64), name, count)
+	}
+	bw.Flush()
+}
+
+// metricName returns the Prometheus name of the metric identified by
+// name, with the suffix appended.
+func (p *Prometheus) metricName(name, suffix string) string {
+	s := snakeCase(name) + suffix
+	if p.Namespace != "" {
+		s = p.Namespace + "_" + s
+	}
+	return s
+}
+
+func sortedKeys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// snakeCase translates the CamelCase s to snake_case. A sequence of
+// uppercase letters is treated as a single word, so that "OKMsgs"
+// becomes "ok_msgs".
+func snakeCase(s string) string {
+	rs := []rune(s)
+	out := make([]rune, 0, len(rs)+4)
+	for i, r := range rs {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				prev := rs[i-1]
+				nextLower := i+1 < len(rs) && unicode.IsLower(rs[i+1])
+				if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+					out = append(out, '_')
+				}
+			}
+			r = unicode.ToLower(r)
+		}
+		out = append(out, r)
+	}
+	return string(out)
+}
@@ -0,0 +1,74 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnakeCase(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]string{
+		"":                "",
+		"Msgs":            "msgs",
+		"ActiveConnGoros": "active_conn_goros",
+		"OKMsgs":          "ok_msgs",
+		"ErrMsgs":         "err_msgs",
+		"Http2Conns":      "http2_conns",
+	}
+	for in, want := range cases {
+		assert.Equal(t, want, snakeCase(in), in)
+	}
+}
+
+func TestPrometheus(t *testing.T) {
+	t.Parallel()
+
+	p := &Prometheus{Namespace: "juggler", Buckets: []float64{1, 0.1}}
+	p.AddCounter("Msgs", 2)
+	p.AddCounter("CallMsgs", 1)
+	p.AddGauge("ActiveConns", 3)
+	p.Observe("CallDuration", 0.05)
+	p.Observe("CallDuration", 0.5)
+	p.Observe("CallDuration", 2)
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, nil)
+
+	want := `# TYPE juggler_call_msgs_total counter
+juggler_call_msgs_total 1
+# TYPE juggler_msgs_total counter
+juggler_msgs_total 2
+# TYPE juggler_active_conns gauge
+juggler_active_conns 3
+# TYPE juggler_call_duration_seconds histogram
+juggler_call_duration_seconds_bucket{le="0.1"} 1
+juggler_call_duration_seconds_bucket{le="1"} 2
+juggler_call_duration_seconds_bucket{le="+Inf"} 3
+juggler_call_duration_seconds_sum 2.55
+juggler_call_duration_seconds_count 3
+`
+	assert.Equal(t, want, w.Body.String(), "output")
+	assert.Equal(t, "text/plain; version=0.0.4", w.Header().Get("Content-Type"), "content type")
+}
+
+func TestMulti(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, Discard, Multi(), "no metrics")
+
+	p1, p2 := &Prometheus{}, &Prometheus{}
+	assert.Equal(t, p1, Multi(p1), "single metrics")
+
+	m := Multi(p1, p2)
+	m.AddCounter("Msgs", 1)
+	m.AddGauge("ActiveConns", 1)
+	m.Observe("CallDuration", 1)
+	for i, p := range []*Prometheus{p1, p2} {
+		assert.Equal(t, int64(1), p.counters["Msgs"], "%d: counter", i)
+		assert.Equal(t, int64(1), p.gauges["ActiveConns"], "%d: gauge", i)
+		assert.Equal(t, 1, len(p.hists), "%d: histograms", i)
+	}
+}
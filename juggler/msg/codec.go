@@ -0,0 +1,169 @@
+package msg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+
+	"github.com/ugorji/go/codec"
+)
+
+// Codec defines the methods required to encode and decode messages
+// to and from their wire format. The encoded and decoded values may
+// have json.RawMessage fields, which hold JSON-encoded values (such
+// as the Args of a Call) that the codec must translate to and from
+// its own format.
+type Codec interface {
+	// Name returns the name of the codec, which is the suffix of the
+	// subprotocols that use it (e.g. "msgpack" for "juggler.0+msgpack").
+	Name() string
+
+	// Binary returns true if the encoded messages must be sent as
+	// websocket.BinaryMessage, false if they must be sent as
+	// websocket.TextMessage.
+	Binary() bool
+
+	// Encode writes the encoding of v to w.
+	Encode(w io.Writer, v interface{}) error
+
+	// Decode reads the next encoded value from r and stores it in v.
+	Decode(r io.Reader, v interface{}) error
+}
+
+// The list of predefined codecs.
+var (
+	// JSON is the codec of the juggler.0 subprotocol. Messages are
+	// sent as websocket.TextMessage.
+	JSON Codec = jsonCodec{}
+
+	// MsgPack is the MessagePack codec of the juggler.0+msgpack
+	// subprotocol. Messages are sent as websocket.BinaryMessage.
+	MsgPack Codec = newMsgPackCodec()
+
+	// CBOR is the CBOR codec of the juggler.0+cbor subprotocol.
+	// Messages are sent as websocket.BinaryMessage.
+	CBOR Codec = newCBORCodec()
+)
+
+var codecs = map[string]Codec{
+	MsgPack.Name(): MsgPack,
+	CBOR.Name():    CBOR,
+}
+
+// RegisterCodec registers the codec c so that it is used for the
+// subprotocols with the "+" + c.Name() suffix. It panics if a codec
+// by that name has already been registered. As with RegisterCustomMsg,
+// it should be called in the init function of the package that needs
+// the codec.
+func RegisterCodec(c Codec) {
+	if _, ok := codecs[c.Name()]; ok || c.Name() == JSON.Name() {
+		panic("RegisterCodec called twice for " + c.Name())
+	}
+	codecs[c.Name()] = c
+}
+
+// CodecForSubprotocol returns the codec used by the subprotocol. A
+// subprotocol with no "+" suffix, such as "juggler.0" or the empty
+// subprotocol, uses the JSON codec. It returns nil if the suffix
+// names a codec that is not registered.
+func CodecForSubprotocol(proto string) Codec {
+	ix := strings.LastIndex(proto, "+")
+	if ix < 0 {
+		return JSON
+	}
+	return codecs[proto[ix+1:]]
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return "json" }
+func (jsonCodec) Binary() bool { return false }
+
+func (jsonCodec) Encode(w io.Writer, v interface{}) error {
+	return json.NewEncoder(w).Encode(v)
+}
+
+func (jsonCodec) Decode(r io.Reader, v interface{}) error {
+	return json.NewDecoder(r).Decode(v)
+}
+
+// binaryCodec is a codec that transcodes from and to JSON, so that
+// the messages' fields and raw JSON arguments get encoded as native
+// values of the binary format.
+type binaryCodec struct {
+	name string
+	h    codec.Handle
+}
+
+// decode schema-less maps as map[string]interface{}, which can be
+// marshaled to JSON.
+var mapStringIntfType = reflect.TypeOf(map[string]interface{}(nil))
+
+func newMsgPackCodec() Codec {
+	var h codec.MsgpackHandle
+	h.WriteExt = true // use the str8 and bin types of the current spec
+	h.RawToString = true
+	h.MapType = mapStringIntfType
+	return &binaryCodec{name: "msgpack", h: &h}
+}
+
+func newCBORCodec() Codec {
+	var h codec.CborHandle
+	h.MapType = mapStringIntfType
+	return &binaryCodec{name: "cbor", h: &h}
+}
+
+func (c *binaryCodec) Name() string { return c.name }
+func (c *binaryCodec) Binary() bool { return true }
+
+func (c *binaryCodec) Encode(w io.Writer, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	var val interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&val); err != nil {
+		return err
+	}
+	return codec.NewEncoder(w, c.h).Encode(fromJSON(val))
+}
+
+func (c *binaryCodec) Decode(r io.Reader, v interface{}) error {
+	var val interface{}
+	if err := codec.NewDecoder(r, c.h).Decode(&val); err != nil {
+		return err
+	}
+	b, err := json.Marshal(val)
+	if err != nil {
+		return fmt.Errorf("invalid %s value: %v", c.name, err)
+	}
+	return json.Unmarshal(b, v)
+}
+
+// fromJSON converts the numbers of the JSON-decoded value v to
+// integers when possible, floats otherwise.
+func fromJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case []interface{}:
+		for i, vv := range v {
+			v[i] = fromJSON(vv)
+		}
+	case map[string]interface{}:
+		for k, vv := range v {
+			v[k] = fromJSON(vv)
+		}
+	}
+	return v
+}
@@ -0,0 +1,90 @@
+package msg
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/ugorji/go/codec"
+)
+
+func TestCodecForSubprotocol(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		proto string
+		want  Codec
+	}{
+		{"", JSON},
+		{"juggler.0", JSON},
+		{"juggler.0+msgpack", MsgPack},
+		{"juggler.0+cbor", CBOR},
+		{"juggler.0+unknown", nil},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.want, CodecForSubprotocol(c.proto), c.proto)
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	t.Parallel()
+
+	call, err := NewCall("a", map[string]interface{}{"x": 3, "y": []interface{}{1.5, "z", nil}}, time.Second)
+	require.NoError(t, err, "NewCall")
+	pub, err := NewPub("d", "ok")
+	require.NoError(t, err, "NewPub")
+	rp := &ResPayload{
+		MsgUUID: uuid.NewRandom(),
+		URI:     "g",
+		Args:    json.RawMessage(`{"a":{"b":-1}}`),
+		Partial: true,
+		Seq:     2,
+	}
+
+	reqs := []Msg{call, NewSub("b", false), NewUnsb("c", true), pub, NewCncl(call)}
+	resps := []Msg{NewErr(call, 500, io.EOF), NewOK(pub), NewRes(rp)}
+
+	for _, c := range []Codec{JSON, MsgPack, CBOR} {
+		for i, m := range append(reqs, resps...) {
+			var buf bytes.Buffer
+			require.NoError(t, c.Encode(&buf, m), "%s: Encode %d", c.Name(), i)
+
+			unmarshal := UnmarshalRequestCodec
+			if i >= len(reqs) {
+				unmarshal = UnmarshalResponseCodec
+			}
+			mm, err := unmarshal(bytes.NewReader(buf.Bytes()), c)
+			require.NoError(t, err, "%s: Unmarshal %d", c.Name(), i)
+
+			if m.Type() == ErrMsg {
+				m.(*Err).Payload.Err = nil
+			}
+			assert.True(t, reflect.DeepEqual(m, mm), "%s: DeepEqual %d", c.Name(), i)
+		}
+	}
+}
+
+func TestMsgPackNativeArgs(t *testing.T) {
+	t.Parallel()
+
+	call, err := NewCall("a", map[string]interface{}{"x": 3}, time.Second)
+	require.NoError(t, err, "NewCall")
+
+	var buf bytes.Buffer
+	require.NoError(t, MsgPack.Encode(&buf, call), "Encode")
+
+	// the arguments are encoded as a msgpack map, not as raw JSON
+	var v map[string]interface{}
+	var h codec.MsgpackHandle
+	h.RawToString = true
+	require.NoError(t, codec.NewDecoderBytes(buf.Bytes(), &h).Decode(&v), "Decode")
+	pld := v["payload"].(map[interface{}]interface{})
+	args := pld["args"].(map[interface{}]interface{})
+	assert.EqualValues(t, 3, args["x"], "args")
+}
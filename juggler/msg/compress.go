@@ -0,0 +1,103 @@
+package msg
+
+import (
+	"bufio"
+	"compress/flate"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// CompressionHeader is the HTTP header used to negotiate the
+// application-level compression of the messages sent by the server
+// during the websocket handshake. The client sets it to Deflate in
+// its request to indicate that it supports it, and the server sets it
+// to Deflate in its response if it compresses the messages.
+const CompressionHeader = "Juggler-Compression"
+
+// Deflate is the value of the CompressionHeader for the deflate
+// compression.
+const Deflate = "deflate"
+
+// The compression flags. With application-level compression, each
+// message sent by the server is a websocket.BinaryMessage that starts
+// with a compression flag, followed by the encoded message, compressed
+// if the flag is DeflateFlag.
+const (
+	NoCompressionFlag byte = iota
+	DeflateFlag
+)
+
+// AcceptsDeflate returns true if the value of a CompressionHeader
+// includes Deflate. The value is a comma-separated list of compression
+// methods.
+func AcceptsDeflate(hdr string) bool {
+	for _, v := range strings.Split(hdr, ",") {
+		if strings.EqualFold(strings.TrimSpace(v), Deflate) {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteCompressed writes the encoded message b to w, preceded by its
+// compression flag. If b is larger than threshold, it is compressed
+// with deflate at the specified level (see compress/flate), the level
+// 0 meaning flate.DefaultCompression. It returns the number of bytes
+// written to w.
+func WriteCompressed(w io.Writer, b []byte, threshold, level int) (int, error) {
+	cw := &countWriter{w: w}
+	if len(b) <= threshold {
+		if _, err := cw.Write([]byte{NoCompressionFlag}); err != nil {
+			return cw.n, err
+		}
+		_, err := cw.Write(b)
+		return cw.n, err
+	}
+
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+	if _, err := cw.Write([]byte{DeflateFlag}); err != nil {
+		return cw.n, err
+	}
+	fw, err := flate.NewWriter(cw, level)
+	if err != nil {
+		return cw.n, err
+	}
+	if _, err := fw.Write(b); err != nil {
+		return cw.n, err
+	}
+	err = fw.Close()
+	return cw.n, err
+}
+
+// DecompressReader returns a reader of the encoded message read from
+// r, which must have been written by WriteCompressed.
+func DecompressReader(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	flag, err := br.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch flag {
+	case NoCompressionFlag:
+		return br, nil
+	case DeflateFlag:
+		return flate.NewReader(br), nil
+	default:
+		return nil, fmt.Errorf("invalid compression flag: %d", flag)
+	}
+}
+
+type countWriter struct {
+	w io.Writer
+	n int
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += n
+	return n, err
+}
@@ -0,0 +1,64 @@
+package msg
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAcceptsDeflate(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		in   string
+		want bool
+	}{
+		{"", false},
+		{"gzip", false},
+		{"deflate", true},
+		{"Deflate", true},
+		{"gzip, deflate", true},
+		{"deflated", false},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.want, AcceptsDeflate(c.in), c.in)
+	}
+}
+
+func TestWriteCompressed(t *testing.T) {
+	t.Parallel()
+
+	small := []byte(`{"a":1}`)
+	large := []byte(`{"a":"` + strings.Repeat("x", 1000) + `"}`)
+
+	cases := []struct {
+		in   []byte
+		flag byte
+	}{
+		{small, NoCompressionFlag},
+		{large, DeflateFlag},
+	}
+	for i, c := range cases {
+		var buf bytes.Buffer
+		n, err := WriteCompressed(&buf, c.in, 100, 0)
+		require.NoError(t, err, "%d: WriteCompressed", i)
+		assert.Equal(t, buf.Len(), n, "%d: bytes written", i)
+		assert.Equal(t, c.flag, buf.Bytes()[0], "%d: flag", i)
+		if c.flag == DeflateFlag {
+			assert.True(t, n < len(c.in), "%d: compressed", i)
+		}
+
+		r, err := DecompressReader(&buf)
+		require.NoError(t, err, "%d: DecompressReader", i)
+		b, err := ioutil.ReadAll(r)
+		require.NoError(t, err, "%d: ReadAll", i)
+		assert.Equal(t, c.in, b, "%d: decompressed", i)
+	}
+
+	_, err := DecompressReader(bytes.NewReader([]byte{99}))
+	assert.Error(t, err, "invalid flag")
+}
@@ -7,21 +7,26 @@
 //     - SUB  : to subscribe to a pub/sub channel
 //     - UNSB : to unsubscribe from a pub/sub channel
 //     - PUB  : to publish to a pub/sub channel
+//     - CNCL : to cancel a pending CALL
 //
 // And the following messages for the server:
 //
-//     - ERR  : failed CALL, SUB, UNSB or PUB
-//     - OK   : successful CALL (but no result yet), SUB, UNSB or PUB
+//     - ERR  : failed CALL, SUB, UNSB, PUB or CNCL
+//     - OK   : successful CALL (but no result yet), SUB, UNSB, PUB or CNCL
 //     - RES  : the result of a CALL message
 //     - EVNT : an event triggered on a channel that the client is subscribed to
 //
 // Closing the communication is done via the standard websocket close
 // process.
 //
-// All messages must be of type websocket.TextMessage. Failing to properly
-// speak the protocol terminates the connection without notice from the
-// peer. That includes sending binary messages and sending unknown (or
-// invalid for the peer) message types.
+// With the juggler.0 subprotocol, all messages are encoded in JSON and
+// must be of type websocket.TextMessage. Subprotocols with a codec
+// suffix, such as juggler.0+msgpack, encode the same messages with
+// that binary Codec, and all messages must be of type
+// websocket.BinaryMessage. Failing to properly speak the protocol
+// terminates the connection without notice from the peer. That
+// includes sending messages of the wrong websocket type and sending
+// unknown (or invalid for the peer) message types.
 //
 package msg
 
@@ -53,6 +58,11 @@ const (
 	EvntMsg
 	endWrite
 
+	// CnclMsg is a read message that was added after the initial
+	// protocol messages, so that the values of the existing message
+	// types do not change.
+	CnclMsg
+
 	// customMsg allows for definition of custom message types,
 	// starting at ID 256 (first 255 are reserved).
 	customMsg MessageType = 256
@@ -69,6 +79,7 @@ var lookupMessageType = map[MessageType]string{
 	OKMsg:   "OK",
 	ResMsg:  "RES",
 	EvntMsg: "EVNT",
+	CnclMsg: "CNCL",
 }
 
 // RegisterCustomMsg registers a new custom message having the
@@ -112,7 +123,7 @@ func (mt MessageType) String() string {
 // point of view of the server (that is, if this is a message
 // that was sent by a client).
 func (mt MessageType) IsRead() bool {
-	return startRead < mt && mt < endRead
+	return (startRead < mt && mt < endRead) || mt == CnclMsg
 }
 
 // IsWrite returns true if the message type is a "write" from the
@@ -170,6 +181,12 @@ type Call struct {
 		URI     string          `json:"uri"`
 		Timeout time.Duration   `json:"timeout"`
 		Args    json.RawMessage `json:"args"`
+
+		// Metadata holds optional key-value pairs that are forwarded
+		// to the callee in the CallPayload, e.g. to propagate tracing
+		// context. Handlers in the server's chain may add to it before
+		// the call is processed.
+		Metadata map[string]string `json:"metadata,omitempty"`
 	} `json:"payload"`
 }
 
@@ -260,6 +277,28 @@ func NewPub(channel string, args interface{}) (*Pub, error) {
 	return p, nil
 }
 
+// Cncl is a cancellation message. It cancels the call request made
+// by the Call message identified by For, if it is still pending. If
+// the call is still queued, it is dropped, and if it is being processed
+// by a callee, the callee is notified so that it can stop early.
+type Cncl struct {
+	Meta    `json:"meta"`
+	Payload struct {
+		For uuid.UUID `json:"for"` // no ForType, because always CALL
+		URI string    `json:"uri"` // URI of the CALL
+	} `json:"payload"`
+}
+
+// NewCncl creates a Cncl message to cancel the provided call.
+func NewCncl(m *Call) *Cncl {
+	cn := &Cncl{
+		Meta: NewMeta(CnclMsg),
+	}
+	cn.Payload.For = m.UUID()
+	cn.Payload.URI = m.Payload.URI
+	return cn
+}
+
 // Err is an error message. It indicates the source message that
 // failed to be delivered in the For (and ForType) fields. An Err
 // is sent only when something failed to execute properly - notably,
@@ -270,7 +309,7 @@ type Err struct {
 	Payload struct {
 		For     uuid.UUID   `json:"for"`
 		ForType MessageType `json:"for_type"`
-		URI     string      `json:"uri,omitempty"`     // when in response to a CALL
+		URI     string      `json:"uri,omitempty"`     // when in response to a CALL or CNCL
 		Channel string      `json:"channel,omitempty"` // when in response to a PUB, SUB or UNSB
 		Code    int         `json:"code"`
 		Message string      `json:"message"` // defaults to Err.Error()
@@ -299,6 +338,8 @@ func NewErr(from Msg, code int, e error) *Err {
 		err.Payload.Channel = from.Payload.Channel
 	case *Unsb:
 		err.Payload.Channel = from.Payload.Channel
+	case *Cncl:
+		err.Payload.URI = from.Payload.URI
 
 		// other cases can happen e.g. if the message is too large
 		// instead of sending the "from" info from the never-sent
@@ -334,7 +375,7 @@ type OK struct {
 	Payload struct {
 		For     uuid.UUID   `json:"for"`
 		ForType MessageType `json:"for_type"`
-		URI     string      `json:"uri,omitempty"`     // when in response to a CALL
+		URI     string      `json:"uri,omitempty"`     // when in response to a CALL or CNCL
 		Channel string      `json:"channel,omitempty"` // when in response to a PUB, SUB or UNSB
 	} `json:"payload"`
 }
@@ -357,18 +398,31 @@ func NewOK(from Msg) *OK {
 		ok.Payload.Channel = from.Payload.Channel
 	case *Unsb:
 		ok.Payload.Channel = from.Payload.Channel
+	case *Cncl:
+		ok.Payload.URI = from.Payload.URI
 	}
 	return ok
 }
 
 // Res is a result message. It returns the result of the invocation
-// of a Call message.
+// of a Call message. A Call may stream its results, in which case
+// one or more partial Res messages are sent before the final one.
 type Res struct {
 	Meta    `json:"meta"`
 	Payload struct {
 		For  uuid.UUID       `json:"for"`           // no ForType, because always CALL
 		URI  string          `json:"uri,omitempty"` // URI of the CALL
 		Args json.RawMessage `json:"args"`
+
+		// Partial is true if more results will follow for the same
+		// CALL. Seq is the sequence number of the result, starting
+		// at 1, if the CALL streams its results.
+		Partial bool `json:"partial,omitempty"`
+		Seq     int  `json:"seq,omitempty"`
+
+		// Metadata holds optional key-value pairs set by the callee,
+		// e.g. to propagate tracing context.
+		Metadata map[string]string `json:"metadata,omitempty"`
 	} `json:"payload"`
 }
 
@@ -394,6 +448,9 @@ func NewRes(pld *ResPayload) *Res {
 	res.Payload.For = pld.MsgUUID
 	res.Payload.URI = pld.URI
 	res.Payload.Args = pld.Args
+	res.Payload.Partial = pld.Partial
+	res.Payload.Seq = pld.Seq
+	res.Payload.Metadata = pld.Metadata
 	return res
 }
 
@@ -426,20 +483,32 @@ func NewEvnt(pld *EvntPayload) *Evnt {
 // correct concrete message type. It returns an error if the message
 // type is invalid for a request (client -> server).
 func UnmarshalRequest(r io.Reader) (Msg, error) {
-	return unmarshalIf(r, CallMsg, SubMsg, UnsbMsg, PubMsg)
+	return UnmarshalRequestCodec(r, JSON)
+}
+
+// UnmarshalRequestCodec is like UnmarshalRequest, but the message is
+// decoded using the codec c.
+func UnmarshalRequestCodec(r io.Reader, c Codec) (Msg, error) {
+	return unmarshalIf(r, c, CallMsg, SubMsg, UnsbMsg, PubMsg, CnclMsg)
 }
 
 // UnmarshalResponse unmarshals a JSON-encoded message from r into the
 // correct concrete message type. It returns an error if the message
 // type is invalid for a response (client <- server).
 func UnmarshalResponse(r io.Reader) (Msg, error) {
-	return unmarshalIf(r, ErrMsg, OKMsg, EvntMsg, ResMsg)
+	return UnmarshalResponseCodec(r, JSON)
+}
+
+// UnmarshalResponseCodec is like UnmarshalResponse, but the message is
+// decoded using the codec c.
+func UnmarshalResponseCodec(r io.Reader, c Codec) (Msg, error) {
+	return unmarshalIf(r, c, ErrMsg, OKMsg, EvntMsg, ResMsg)
 }
 
 // Unmarshal unmarshals a JSON-encoded message from r into the correct
 // concrete message type.
 func Unmarshal(r io.Reader) (Msg, error) {
-	return unmarshalIf(r)
+	return unmarshalIf(r, JSON)
 }
 
 func isIn(list []MessageType, v MessageType) bool {
@@ -451,10 +520,12 @@ func isIn(list []MessageType, v MessageType) bool {
 	return false
 }
 
-func unmarshalIf(r io.Reader, allowed ...MessageType) (Msg, error) {
+func unmarshalIf(r io.Reader, c Codec, allowed ...MessageType) (Msg, error) {
+	// the codec decodes the partial message, the payload is then
+	// unmarshaled from raw JSON.
 	var pm partialMsg
-	if err := json.NewDecoder(r).Decode(&pm); err != nil {
-		return nil, fmt.Errorf("invalid JSON message: %v", err)
+	if err := c.Decode(r, &pm); err != nil {
+		return nil, fmt.Errorf("invalid %s message: %v", c.Name(), err)
 	}
 
 	if len(allowed) > 0 && !isIn(allowed, pm.Meta.T) {
@@ -503,6 +574,13 @@ func unmarshalIf(r io.Reader, allowed ...MessageType) (Msg, error) {
 		}
 		m = &pub
 
+	case CnclMsg:
+		var cn Cncl
+		if err := genericUnmarshal(&cn, &cn.Meta); err != nil {
+			return nil, err
+		}
+		m = &cn
+
 	case ErrMsg:
 		var e Err
 		if err := genericUnmarshal(&e, &e.Meta); err != nil {
@@ -38,6 +38,7 @@ func TestMarshalUnmarshal(t *testing.T) {
 		NewSub("b", false),
 		NewUnsb("c", true),
 		pub,
+		NewCncl(call),
 		NewErr(call, 500, io.EOF),
 		NewOK(pub),
 		NewRes(rp),
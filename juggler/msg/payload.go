@@ -7,6 +7,12 @@ import (
 	"github.com/pborman/uuid"
 )
 
+// IdentityKey is the CallPayload metadata key that holds the ID of
+// the authenticated identity that made the call. It is reserved for
+// the server: a value set by the client for this key is overwritten,
+// or removed if the connection is anonymous.
+const IdentityKey = "juggler.identity"
+
 // CallPayload is the payload stored in the connector for a Call
 // request.
 type CallPayload struct {
@@ -15,6 +21,13 @@ type CallPayload struct {
 	URI      string          `json:"uri"`
 	Args     json.RawMessage `json:"args,omitempty"`
 
+	// Metadata holds the key-value pairs associated with the call. It
+	// is filled from the Call message's metadata, and the server sets
+	// the IdentityKey to the ID of the calling connection's identity,
+	// if it is authenticated. The "traceparent" key holds the tracing
+	// context of the call, if any (see the trace package).
+	Metadata map[string]string `json:"metadata,omitempty"`
+
 	// TTLAfterRead is the time-to-live remaining for the call request
 	// once it has been extracted from the connector and just before it
 	// is sent for processing to the callee.
@@ -27,6 +40,15 @@ type CallPayload struct {
 	ReadTimestamp time.Time `json:"-"`
 }
 
+// CnclPayload is the payload of a cancellation request for a call.
+// ConnUUID is the UUID of the connection that requested the cancellation,
+// which must be the same as the one that made the call.
+type CnclPayload struct {
+	ConnUUID uuid.UUID `json:"conn_uuid"`
+	MsgUUID  uuid.UUID `json:"msg_uuid"` // UUID of the CALL message
+	URI      string    `json:"uri"`
+}
+
 // ResPayload is the payload stored in the connector for a result
 // of a call request.
 type ResPayload struct {
@@ -34,6 +56,19 @@ type ResPayload struct {
 	MsgUUID  uuid.UUID       `json:"msg_uuid"`
 	URI      string          `json:"uri"`
 	Args     json.RawMessage `json:"args,omitempty"`
+
+	// Partial is true if the result is an intermediate result of a
+	// call that streams its results. It is followed by other results
+	// for the same call, the last one having Partial set to false.
+	Partial bool `json:"partial,omitempty"`
+
+	// Seq is the 1-based sequence number of the result for a call that
+	// streams its results, or 0 for a call that has a single result.
+	Seq int `json:"seq,omitempty"`
+
+	// Metadata holds the key-value pairs associated with the result,
+	// e.g. to propagate the tracing context back to the caller.
+	Metadata map[string]string `json:"metadata,omitempty"`
 }
 
 // PubPayload is the payload to publish an event.
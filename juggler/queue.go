@@ -0,0 +1,150 @@
+package juggler
+
+import (
+	"errors"
+	"time"
+
+	"github.com/PuerkitoBio/exp/juggler/msg"
+)
+
+// ErrSendQueueFull is the CloseErr of a connection closed because its
+// send queue overflowed with the CloseConn policy.
+var ErrSendQueueFull = errors.New("juggler: send queue full")
+
+// OverflowPolicy defines what happens when a message is added to a
+// connection's send queue that is full.
+type OverflowPolicy int
+
+// The list of overflow policies.
+const (
+	// DropOldestEvnt drops the oldest EVNT message in the queue to make
+	// room for the new message. If the queue has no EVNT message, the
+	// new message is dropped, as with DropNewest.
+	DropOldestEvnt OverflowPolicy = iota
+
+	// DropNewest drops the new message.
+	DropNewest
+
+	// CloseConn closes the connection with ErrSendQueueFull.
+	CloseConn
+)
+
+// enqueue adds the message m received from the broker to the send
+// queue of the connection, applying the server's SendQueuePolicy if
+// it is full. If the server has no SendQueueSize, m is sent
+// immediately.
+func (c *Conn) enqueue(m msg.Msg) {
+	size := c.srv.SendQueueSize
+	if size <= 0 {
+		c.Send(m)
+		c.sent(m, nil)
+		return
+	}
+
+	mtr := c.srv.metrics()
+
+	var dropped msg.Msg
+	c.qmu.Lock()
+	select {
+	case <-c.kill:
+		// the send queue loop is stopped, nothing would send m
+		c.qmu.Unlock()
+		mtr.AddCounter("DroppedMsgs", 1)
+		c.sent(m, errConnClosed)
+		return
+	default:
+	}
+	if len(c.queue) >= size {
+		mtr.AddCounter("SendQueueOverflows", 1)
+
+		switch c.srv.SendQueuePolicy {
+		case CloseConn:
+			c.qmu.Unlock()
+			c.Close(ErrSendQueueFull)
+			c.sent(m, ErrSendQueueFull)
+			return
+
+		case DropOldestEvnt:
+			dropped = m
+			for i, qm := range c.queue {
+				if _, ok := qm.(*msg.Evnt); ok {
+					dropped = qm
+					c.queue = append(c.queue[:i], c.queue[i+1:]...)
+					mtr.AddGauge("SendQueueDepth", -1)
+					break
+				}
+			}
+
+		default:
+			dropped = m
+		}
+	}
+	if dropped != m {
+		c.queue = append(c.queue, m)
+		mtr.AddGauge("SendQueueDepth", 1)
+	}
+	c.qmu.Unlock()
+
+	if dropped != nil {
+		mtr.AddCounter("DroppedMsgs", 1)
+		c.sent(dropped, ErrSendQueueFull)
+	}
+
+	select {
+	case c.qsignal <- struct{}{}:
+	default:
+	}
+}
+
+// sent is called once the message m received from the broker is sent
+// to the client, with a nil err, or dropped because of err. The final
+// RES of a call records the call round-trip time and ends its span.
+func (c *Conn) sent(m msg.Msg, err error) {
+	if res, ok := m.(*msg.Res); ok && !res.Payload.Partial {
+		if pc, ok := c.deletePending(res.Payload.For); ok {
+			if err == nil {
+				c.srv.metrics().Observe("CallDuration", time.Since(pc.start).Seconds())
+			}
+			pc.span.End(err)
+		}
+	}
+}
+
+// sendQueue is the loop that sends the messages of the send queue,
+// started in its own goroutine if the server has a SendQueueSize.
+func (c *Conn) sendQueue() {
+	mtr := c.srv.metrics()
+	mtr.AddCounter("TotalConnGoros", 1)
+	mtr.AddGauge("ActiveConnGoros", 1)
+	defer mtr.AddGauge("ActiveConnGoros", -1)
+
+	for {
+		select {
+		case <-c.kill:
+			// discard the messages still in the queue
+			c.qmu.Lock()
+			mtr.AddGauge("SendQueueDepth", -int64(len(c.queue)))
+			c.queue = nil
+			c.qmu.Unlock()
+			return
+
+		case <-c.qsignal:
+		}
+
+		for {
+			c.qmu.Lock()
+			if len(c.queue) == 0 {
+				c.qmu.Unlock()
+				break
+			}
+			m := c.queue[0]
+			c.queue[0] = nil
+			c.queue = c.queue[1:]
+			c.qmu.Unlock()
+
+			mtr.AddGauge("SendQueueDepth", -1)
+			c.Send(m)
+			c.sent(m, nil)
+		}
+	}
+}
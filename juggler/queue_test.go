@@ -0,0 +1,156 @@
+package juggler
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/exp/juggler/internal/jugglertest"
+	"github.com/PuerkitoBio/exp/juggler/internal/wstest"
+	"github.com/PuerkitoBio/exp/juggler/msg"
+	"github.com/PuerkitoBio/exp/juggler/trace"
+	"github.com/gorilla/websocket"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestEvnt(channel string) *msg.Evnt {
+	return msg.NewEvnt(&msg.EvntPayload{MsgUUID: uuid.NewRandom(), Channel: channel})
+}
+
+func newTestRes() *msg.Res {
+	return msg.NewRes(&msg.ResPayload{MsgUUID: uuid.NewRandom(), URI: "a"})
+}
+
+func TestEnqueueOverflow(t *testing.T) {
+	t.Parallel()
+
+	e1, e2, e3 := newTestEvnt("1"), newTestEvnt("2"), newTestEvnt("3")
+	r1, r2 := newTestRes(), newTestRes()
+
+	cases := []struct {
+		policy OverflowPolicy
+		in     []msg.Msg
+		out    []msg.Msg
+		drops  int
+		closed bool
+	}{
+		{DropOldestEvnt, []msg.Msg{e1, r1, e2}, []msg.Msg{r1, e2}, 1, false},
+		{DropOldestEvnt, []msg.Msg{e1, r1, r2, e2}, []msg.Msg{r1, r2}, 2, false},
+		{DropNewest, []msg.Msg{e1, e2, e3}, []msg.Msg{e1, e2}, 1, false},
+		{DropNewest, []msg.Msg{r1, e1, r2}, []msg.Msg{r1, e1}, 1, false},
+		{CloseConn, []msg.Msg{e1, e2, e3}, []msg.Msg{e1, e2}, 0, true},
+	}
+	for i, c := range cases {
+		dbgl := &jugglertest.DebugLog{T: t}
+		srv := &Server{
+			LogFunc:         dbgl.Printf,
+			Vars:            new(expvar.Map).Init(),
+			SendQueueSize:   2,
+			SendQueuePolicy: c.policy,
+		}
+		conn := newConn(&websocket.Conn{}, srv)
+		conn.psc, conn.resc = fakePubSubConn{}, fakeResultsConn{}
+
+		for _, m := range c.in {
+			if res, ok := m.(*msg.Res); ok {
+				conn.addPending(res.Payload.For, time.Second, trace.Nop.Start("test", trace.SpanContext{}))
+			}
+			conn.enqueue(m)
+		}
+
+		assert.Equal(t, c.out, conn.queue, "%d: queue", i)
+		assert.Equal(t, c.closed, conn.CloseErr == ErrSendQueueFull, "%d: closed", i)
+		if c.drops > 0 {
+			assert.Equal(t, c.drops, int(srv.Vars.Get("DroppedMsgs").(*expvar.Int).Value()), "%d: dropped", i)
+		}
+		assert.Equal(t, len(c.out), int(srv.Vars.Get("SendQueueDepth").(*expvar.Int).Value()), "%d: depth", i)
+
+		// dropped results are no longer pending
+		var pending int
+		for _, m := range c.out {
+			if _, ok := m.(*msg.Res); ok {
+				pending++
+			}
+		}
+		assert.Equal(t, pending, conn.pendingCalls(), "%d: pending calls", i)
+	}
+}
+
+func TestSendQueue(t *testing.T) {
+	var buf bytes.Buffer
+	done := make(chan bool, 1)
+	srv := wstest.StartRecordingServer(t, done, &buf)
+	defer srv.Close()
+
+	wsc := wstest.Dial(t, srv.URL)
+	defer wsc.Close()
+
+	dbgl := &jugglertest.DebugLog{T: t}
+	server := &Server{LogFunc: dbgl.Printf, Vars: new(expvar.Map).Init(), SendQueueSize: 10}
+	jc := newConn(wsc, server)
+	jc.psc, jc.resc = fakePubSubConn{}, fakeResultsConn{}
+	go jc.sendQueue()
+
+	evs := []*msg.Evnt{newTestEvnt("1"), newTestEvnt("2"), newTestEvnt("3")}
+	for _, ev := range evs {
+		jc.enqueue(ev)
+	}
+
+	// wait for the queue to be sent
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) && server.Vars.Get("SendQueueDepth").String() != "0" {
+		time.Sleep(time.Millisecond)
+	}
+	jc.Close(nil)
+	wsc.Close()
+	<-done
+
+	var p json.RawMessage
+	dec := json.NewDecoder(bytes.NewReader(buf.Bytes()))
+	for i, ev := range evs {
+		require.NoError(t, dec.Decode(&p), "Decode %d", i)
+		m, err := msg.UnmarshalResponse(bytes.NewReader(p))
+		require.NoError(t, err, "UnmarshalResponse %d", i)
+		assert.Equal(t, ev.UUID(), m.UUID(), "%d: uuid", i)
+	}
+}
+
+func TestEnqueueDropped(t *testing.T) {
+	t.Parallel()
+
+	var exp trace.MemoryExporter
+	tr := trace.NewTracer(&exp)
+
+	dbgl := &jugglertest.DebugLog{T: t}
+	srv := &Server{
+		LogFunc:         dbgl.Printf,
+		Vars:            new(expvar.Map).Init(),
+		SendQueueSize:   1,
+		SendQueuePolicy: DropNewest,
+	}
+	conn := newConn(&websocket.Conn{}, srv)
+	conn.psc, conn.resc = fakePubSubConn{}, fakeResultsConn{}
+
+	// the span of a dropped result ends with an error
+	r1, r2 := newTestRes(), newTestRes()
+	r1.Payload.For, r2.Payload.For = uuid.NewRandom(), uuid.NewRandom()
+	conn.addPending(r1.Payload.For, time.Second, tr.Start("r1", trace.SpanContext{}))
+	conn.addPending(r2.Payload.For, time.Second, tr.Start("r2", trace.SpanContext{}))
+	conn.enqueue(r1)
+	conn.enqueue(r2)
+	if spans := exp.Spans(); assert.Equal(t, 1, len(spans), "ended spans") {
+		assert.Equal(t, "r2", spans[0].Name, "span name")
+		assert.Equal(t, ErrSendQueueFull, spans[0].Err, "span error")
+	}
+
+	// the messages received once the connection is closed are dropped
+	conn.Close(nil)
+	conn.enqueue(newTestEvnt("1"))
+	assert.Equal(t, []msg.Msg{r1}, conn.queue, "queue")
+	assert.Equal(t, 1, int(srv.Vars.Get("SendQueueDepth").(*expvar.Int).Value()), "depth")
+	assert.Equal(t, 2, int(srv.Vars.Get("DroppedMsgs").(*expvar.Int).Value()), "dropped")
+}
@@ -0,0 +1,182 @@
+package juggler
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/PuerkitoBio/exp/juggler/msg"
+)
+
+// ErrRateLimited is the error sent to the clients for requests refused
+// because a rate limit was exceeded.
+var ErrRateLimited = errors.New("juggler: rate limit exceeded")
+
+// pruneInterval is the minimum interval between two removals of the
+// idle token buckets.
+const pruneInterval = time.Minute
+
+// Rate defines the rate of a token bucket: Limit tokens are added to
+// the bucket every second, up to Burst tokens (at least 1). Each
+// message consumes one token. The zero value means no limit.
+type Rate struct {
+	Limit float64
+	Burst int
+}
+
+// RateLimitConfig defines the rate limits applied by the RateLimit
+// handler.
+type RateLimitConfig struct {
+	// PerConn is the rate allowed for each connection.
+	PerConn Rate
+
+	// PerIP is the rate allowed for all connections from the same
+	// remote IP address. The remote address of the websocket
+	// connection is used, so if the server is behind a proxy, the
+	// proxy's address is used.
+	PerIP Rate
+
+	// PerURI is the rate allowed for each call URI and each pub-sub
+	// channel, for all connections. The URIs map can be used to
+	// override it for specific call URIs or channels.
+	PerURI Rate
+	URIs   map[string]Rate
+}
+
+// RateLimit returns a Handler that applies the rate limits defined
+// by conf to the CALL and PUB messages, and calls h if the message
+// is allowed. Token buckets are kept per connection, per remote IP
+// address and per call URI or channel, and a message must be allowed
+// by all buckets. If it isn't, h is not called and an ERR message
+// with a 429 code is sent to the client instead. Other messages are
+// always passed to h.
+func RateLimit(conf *RateLimitConfig, h Handler) Handler {
+	l := newLimiter()
+
+	return HandlerFunc(func(ctx context.Context, c *Conn, m msg.Msg) {
+		var key string
+		switch m := m.(type) {
+		case *msg.Call:
+			key = m.Payload.URI
+		case *msg.Pub:
+			key = m.Payload.Channel
+		default:
+			h.Handle(ctx, c, m)
+			return
+		}
+
+		r, ok := conf.URIs[key]
+		if !ok {
+			r = conf.PerURI
+		}
+		limits := []limit{
+			{"conn:" + c.UUID.String(), conf.PerConn},
+			{m.Type().String() + ":" + key, r},
+		}
+		if conf.PerIP.Limit > 0 {
+			limits = append(limits, limit{"ip:" + remoteIP(c), conf.PerIP})
+		}
+
+		if !l.allow(time.Now(), limits...) {
+			c.srv.metrics().AddCounter("RateLimitedMsgs", 1)
+			c.Send(msg.NewErr(m, 429, ErrRateLimited))
+			return
+		}
+		h.Handle(ctx, c, m)
+	})
+}
+
+// remoteIP returns the IP address of the remote end of c.
+func remoteIP(c *Conn) string {
+	addr := c.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// bucket is a token bucket.
+type bucket struct {
+	rate   Rate
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens accumulated between the last refill and t.
+func (b *bucket) refill(t time.Time) {
+	b.tokens += t.Sub(b.last).Seconds() * b.rate.Limit
+	if max := float64(b.rate.Burst); b.tokens > max {
+		b.tokens = max
+	}
+	b.last = t
+}
+
+// limit identifies a token bucket and its rate.
+type limit struct {
+	key  string
+	rate Rate
+}
+
+// limiter holds the token buckets.
+type limiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastPrune time.Time
+}
+
+func newLimiter() *limiter {
+	return &limiter{buckets: make(map[string]*bucket)}
+}
+
+// allow returns true if all buckets identified by limits have a token
+// available at time t, in which case a token is consumed from each of
+// them. Otherwise, no token is consumed.
+func (l *limiter) allow(t time.Time, limits ...limit) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if t.Sub(l.lastPrune) > pruneInterval {
+		l.prune(t)
+	}
+
+	bs := make([]*bucket, 0, len(limits))
+	for _, lim := range limits {
+		r := lim.rate
+		if r.Limit <= 0 {
+			continue
+		}
+		if r.Burst < 1 {
+			r.Burst = 1
+		}
+
+		b := l.buckets[lim.key]
+		if b == nil {
+			b = &bucket{rate: r, tokens: float64(r.Burst), last: t}
+			l.buckets[lim.key] = b
+		}
+		b.refill(t)
+		if b.tokens < 1 {
+			return false
+		}
+		bs = append(bs, b)
+	}
+
+	for _, b := range bs {
+		b.tokens--
+	}
+	return true
+}
+
+// prune removes the buckets that would be full at time t, as they
+// are equivalent to new buckets. The lock must be held.
+func (l *limiter) prune(t time.Time) {
+	l.lastPrune = t
+	for k, b := range l.buckets {
+		if b.refill(t); b.tokens >= float64(b.rate.Burst) {
+			delete(l.buckets, k)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package juggler
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/PuerkitoBio/exp/juggler/internal/jugglertest"
+	"github.com/PuerkitoBio/exp/juggler/internal/wstest"
+	"github.com/PuerkitoBio/exp/juggler/msg"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimiter(t *testing.T) {
+	t.Parallel()
+
+	l := newLimiter()
+	a := limit{"a", Rate{Limit: 2, Burst: 3}}
+	b := limit{"b", Rate{Limit: 1, Burst: 1}}
+	start := time.Now()
+
+	// the burst is available immediately
+	for i := 0; i < 3; i++ {
+		assert.True(t, l.allow(start, a), "burst %d", i)
+	}
+	assert.False(t, l.allow(start, a), "after burst")
+
+	// other keys have their own bucket
+	assert.True(t, l.allow(start, b), "other key")
+
+	// tokens are added at the rate limit
+	assert.True(t, l.allow(start.Add(500*time.Millisecond), a), "after 500ms")
+
+	// no token is consumed if a bucket is empty
+	assert.True(t, l.allow(start.Add(time.Second), b), "b after 1s")
+	assert.False(t, l.allow(start.Add(time.Second), a, b), "a and b")
+	assert.True(t, l.allow(start.Add(time.Second), a), "a only")
+
+	// zero rate means no limit
+	for i := 0; i < 10; i++ {
+		assert.True(t, l.allow(start, limit{"c", Rate{}}), "no limit %d", i)
+	}
+
+	// idle buckets are pruned
+	l.allow(start.Add(2*pruneInterval), a)
+	assert.Equal(t, 1, len(l.buckets), "buckets after prune")
+}
+
+func TestRateLimit(t *testing.T) {
+	var buf bytes.Buffer
+	done := make(chan bool, 1)
+	srv := wstest.StartRecordingServer(t, done, &buf)
+	defer srv.Close()
+
+	wsc := wstest.Dial(t, srv.URL)
+	defer wsc.Close()
+
+	dbgl := &jugglertest.DebugLog{T: t}
+	server := &Server{LogFunc: dbgl.Printf, Vars: new(expvar.Map).Init()}
+	jc := newConn(wsc, server)
+	jc.psc, jc.resc = fakePubSubConn{}, fakeResultsConn{}
+
+	var handled []msg.Msg
+	h := RateLimit(&RateLimitConfig{
+		PerConn: Rate{Limit: 1, Burst: 3},
+		URIs:    map[string]Rate{"b": {Limit: 1, Burst: 1}},
+	}, HandlerFunc(func(ctx context.Context, c *Conn, m msg.Msg) {
+		handled = append(handled, m)
+	}))
+
+	newCall := func(uri string) msg.Msg {
+		m, err := msg.NewCall(uri, nil, 0)
+		require.NoError(t, err, "NewCall")
+		return m
+	}
+	msgs := []msg.Msg{
+		newCall("a"),
+		newCall("b"),
+		newCall("b"),            // over the URI limit
+		msg.NewSub("c", false),  // not limited
+		newCall("a"),            // last token of the connection
+		newCall("a"),            // over the connection limit
+		msg.NewUnsb("c", false), // not limited
+	}
+	for _, m := range msgs {
+		h.Handle(context.Background(), jc, m)
+	}
+
+	wsc.Close()
+	<-done
+
+	assert.Equal(t, []msg.Msg{msgs[0], msgs[1], msgs[3], msgs[4], msgs[6]}, handled, "handled messages")
+	assert.Equal(t, "2", server.Vars.Get("RateLimitedMsgs").String(), "RateLimitedMsgs")
+
+	var p json.RawMessage
+	dec := json.NewDecoder(bytes.NewReader(buf.Bytes()))
+	for i, from := range []msg.Msg{msgs[2], msgs[5]} {
+		require.NoError(t, dec.Decode(&p), "Decode %d", i)
+		m, err := msg.UnmarshalResponse(bytes.NewReader(p))
+		require.NoError(t, err, "UnmarshalResponse %d", i)
+		if assert.Equal(t, msg.ErrMsg, m.Type(), "%d: type", i) {
+			e := m.(*msg.Err)
+			assert.Equal(t, from.UUID(), e.Payload.For, "%d: for", i)
+			assert.Equal(t, 429, e.Payload.Code, "%d: code", i)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package juggler
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/PuerkitoBio/exp/juggler/msg"
+	"github.com/pborman/uuid"
+)
+
+// ReservedChannelPrefix is the prefix of the pub-sub channels reserved
+// by the server to push events to specific connections. Clients cannot
+// publish, subscribe or unsubscribe to channels with that prefix, and
+// events received on such channels via a client's pattern subscription
+// are dropped.
+const ReservedChannelPrefix = "juggler:"
+
+var (
+	// ErrConnNotFound is returned when a connection is not registered
+	// on the server.
+	ErrConnNotFound = errors.New("juggler: connection not found")
+
+	// ErrReservedChannel is the error sent to the clients for requests
+	// that use a reserved channel.
+	ErrReservedChannel = errors.New("juggler: reserved channel")
+)
+
+// ConnChannel returns the reserved pub-sub channel of the connection
+// identified by connUUID. Each connection is subscribed to its channel,
+// so that events published to it are received by that connection,
+// regardless of the server node that holds it.
+func ConnChannel(connUUID uuid.UUID) string {
+	return ReservedChannelPrefix + "conn:" + connUUID.String()
+}
+
+// TagChannel returns the reserved pub-sub channel of the connections
+// tagged with tag. Each connection is subscribed to the channels of
+// its tags.
+func TagChannel(tag string) string {
+	return ReservedChannelPrefix + "tag:" + tag
+}
+
+func isReservedChannel(channel string) bool {
+	return strings.HasPrefix(channel, ReservedChannelPrefix)
+}
+
+// Conn returns the active connection identified by connUUID, or nil
+// if there is no such connection on this server.
+func (srv *Server) Conn(connUUID uuid.UUID) *Conn {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.conns[connUUID.String()]
+}
+
+// Conns returns the active connections of this server.
+func (srv *Server) Conns() []*Conn {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	conns := make([]*Conn, 0, len(srv.conns))
+	for _, c := range srv.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// ConnsByTag returns the active connections of this server that are
+// tagged with tag.
+func (srv *Server) ConnsByTag(tag string) []*Conn {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	conns := make([]*Conn, 0, len(srv.tags[tag]))
+	for c := range srv.tags[tag] {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// ConnCount returns the number of active connections of this server.
+func (srv *Server) ConnCount() int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return len(srv.conns)
+}
+
+// TagCount returns the number of active connections of this server
+// that are tagged with tag.
+func (srv *Server) TagCount(tag string) int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return len(srv.tags[tag])
+}
+
+// SendTo sends m to the active connection identified by connUUID, via
+// Conn.Send. This can be used to send custom messages to a connection,
+// which are then processed by the server's Handler. It returns
+// ErrConnNotFound if there is no such connection on this server, use
+// PushToConn to reach connections held by other server nodes.
+func (srv *Server) SendTo(connUUID uuid.UUID, m msg.Msg) error {
+	c := srv.Conn(connUUID)
+	if c == nil {
+		return ErrConnNotFound
+	}
+	c.Send(m)
+	return nil
+}
+
+// PushToConn publishes an event on the reserved channel of the
+// connection identified by connUUID. The v value is marshaled as JSON
+// and sent as event payload. The connection receives it as an EVNT
+// message, even if it is held by another server node that uses the
+// same pub-sub broker.
+func (srv *Server) PushToConn(connUUID uuid.UUID, v interface{}) error {
+	return srv.push(ConnChannel(connUUID), v)
+}
+
+// PushToTag publishes an event on the reserved channel of the
+// connections tagged with tag. The v value is marshaled as JSON
+// and sent as event payload. The connections receive it as an EVNT
+// message, even if they are held by other server nodes that use the
+// same pub-sub broker.
+func (srv *Server) PushToTag(tag string, v interface{}) error {
+	return srv.push(TagChannel(tag), v)
+}
+
+func (srv *Server) push(channel string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	pp := &msg.PubPayload{
+		MsgUUID: uuid.NewRandom(),
+		Args:    b,
+	}
+	return srv.PubSubBroker.Publish(channel, pp)
+}
+
+// addConn registers the active connection c. It returns false if the
+// server is shutting down, in which case c is not registered.
+func (srv *Server) addConn(c *Conn) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.shuttingDown {
+		return false
+	}
+	if srv.conns == nil {
+		srv.conns = make(map[string]*Conn)
+	}
+	srv.conns[c.UUID.String()] = c
+	return true
+}
+
+// removeConn unregisters the connection c and its tags.
+func (srv *Server) removeConn(c *Conn) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	delete(srv.conns, c.UUID.String())
+	for tag := range c.tags {
+		srv.untag(c, tag)
+	}
+}
+
+// untag removes the tag from c. The server's lock must be held.
+func (srv *Server) untag(c *Conn, tag string) {
+	delete(c.tags, tag)
+	if m := srv.tags[tag]; m != nil {
+		delete(m, c)
+		if len(m) == 0 {
+			delete(srv.tags, tag)
+		}
+	}
+}
+
+// Tag adds the tag to the connection, e.g. to identify all connections
+// of a given user. The connection is subscribed to the reserved channel
+// of the tag, so that it receives the events published with
+// Server.PushToTag.
+func (c *Conn) Tag(tag string) error {
+	if err := c.psc.Subscribe(TagChannel(tag), false); err != nil {
+		return err
+	}
+
+	srv := c.srv
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if c.tags == nil {
+		c.tags = make(map[string]struct{})
+	}
+	c.tags[tag] = struct{}{}
+	if srv.tags == nil {
+		srv.tags = make(map[string]map[*Conn]struct{})
+	}
+	if srv.tags[tag] == nil {
+		srv.tags[tag] = make(map[*Conn]struct{})
+	}
+	srv.tags[tag][c] = struct{}{}
+	return nil
+}
+
+// Untag removes the tag from the connection, and unsubscribes it from
+// the reserved channel of the tag.
+func (c *Conn) Untag(tag string) error {
+	srv := c.srv
+	srv.mu.Lock()
+	srv.untag(c, tag)
+	srv.mu.Unlock()
+
+	return c.psc.Unsubscribe(TagChannel(tag), false)
+}
+
+// Tags returns the sorted tags of the connection.
+func (c *Conn) Tags() []string {
+	srv := c.srv
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	tags := make([]string, 0, len(c.tags))
+	for tag := range c.tags {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
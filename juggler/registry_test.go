@@ -0,0 +1,122 @@
+package juggler
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/exp/juggler/broker/memorybroker"
+	"github.com/PuerkitoBio/exp/juggler/internal/jugglertest"
+	"github.com/PuerkitoBio/exp/juggler/msg"
+	"github.com/gorilla/websocket"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// dialRegistered dials srv and returns the websocket connection along
+// with the corresponding server connection.
+func dialRegistered(t *testing.T, server *Server, srv *httptest.Server) (*websocket.Conn, *Conn) {
+	before := server.Conns()
+
+	d := &websocket.Dialer{Subprotocols: Subprotocols}
+	wsc, _, err := d.Dial(srv.URL, nil)
+	require.NoError(t, err, "Dial")
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+	conns:
+		for _, c := range server.Conns() {
+			for _, b := range before {
+				if b == c {
+					continue conns
+				}
+			}
+			return wsc, c
+		}
+		time.Sleep(time.Millisecond)
+	}
+	require.FailNow(t, "connection not registered")
+	return nil, nil
+}
+
+func readEvnt(t *testing.T, wsc *websocket.Conn) *msg.Evnt {
+	wsc.SetReadDeadline(time.Now().Add(time.Second))
+	m := readResponse(t, wsc)
+	require.Equal(t, msg.EvntMsg, m.Type(), "EVNT")
+	return m.(*msg.Evnt)
+}
+
+func TestRegistry(t *testing.T) {
+	dbgl := &jugglertest.DebugLog{T: t}
+	brk := &memorybroker.Broker{LogFunc: dbgl.Printf}
+	server := &Server{CallerBroker: brk, PubSubBroker: brk, LogFunc: dbgl.Printf}
+	upg := &websocket.Upgrader{Subprotocols: Subprotocols}
+	srv := httptest.NewServer(Upgrade(upg, server))
+	srv.URL = strings.Replace(srv.URL, "http:", "ws:", 1)
+	defer srv.Close()
+
+	wsc1, c1 := dialRegistered(t, server, srv)
+	defer wsc1.Close()
+	wsc2, c2 := dialRegistered(t, server, srv)
+	defer wsc2.Close()
+
+	// lookup and counts
+	assert.Equal(t, 2, server.ConnCount(), "ConnCount")
+	assert.Equal(t, c1, server.Conn(c1.UUID), "Conn 1")
+	assert.Equal(t, c2, server.Conn(c2.UUID), "Conn 2")
+	assert.Nil(t, server.Conn(uuid.NewRandom()), "Conn unknown")
+	assert.Equal(t, ErrConnNotFound, server.SendTo(uuid.NewRandom(), msg.NewSub("a", false)), "SendTo unknown")
+
+	// tags
+	require.NoError(t, c1.Tag("user:1"), "Tag c1")
+	require.NoError(t, c1.Tag("admin"), "Tag c1")
+	require.NoError(t, c2.Tag("user:1"), "Tag c2")
+	assert.Equal(t, []string{"admin", "user:1"}, c1.Tags(), "c1 tags")
+	assert.Equal(t, 2, server.TagCount("user:1"), "TagCount user:1")
+	assert.Equal(t, []*Conn{c1}, server.ConnsByTag("admin"), "ConnsByTag admin")
+	require.NoError(t, c1.Untag("admin"), "Untag c1")
+	assert.Equal(t, 0, server.TagCount("admin"), "TagCount admin")
+
+	// client cannot use reserved channels, but can subscribe to all
+	// channels with a pattern
+	sub := msg.NewSub(ConnChannel(c1.UUID), false)
+	require.NoError(t, wsc2.WriteJSON(sub), "write sub")
+	if m := readResponse(t, wsc2); assert.Equal(t, msg.ErrMsg, m.Type(), "reserved SUB") {
+		assert.Equal(t, 403, m.(*msg.Err).Payload.Code, "code")
+	}
+	require.NoError(t, wsc2.WriteJSON(msg.NewSub("*", true)), "write pattern sub")
+	require.Equal(t, msg.OKMsg, readResponse(t, wsc2).Type(), "pattern SUB")
+
+	// push to a connection
+	require.NoError(t, server.PushToConn(c1.UUID, "hello"), "PushToConn")
+	ev := readEvnt(t, wsc1)
+	assert.Equal(t, ConnChannel(c1.UUID), ev.Payload.Channel, "channel")
+	assert.Equal(t, json.RawMessage(`"hello"`), ev.Payload.Args, "args")
+
+	// push to a tag
+	require.NoError(t, server.PushToTag("user:1", 42), "PushToTag")
+	for i, wsc := range []*websocket.Conn{wsc1, wsc2} {
+		ev := readEvnt(t, wsc)
+		assert.Equal(t, TagChannel("user:1"), ev.Payload.Channel, "%d: channel", i)
+		assert.Equal(t, json.RawMessage(`42`), ev.Payload.Args, "%d: args", i)
+	}
+
+	// the pattern subscription received none of the pushed events
+	pub, err := msg.NewPub("public", 1)
+	require.NoError(t, err, "NewPub")
+	require.NoError(t, wsc1.WriteJSON(pub), "write pub")
+	ev = readEvnt(t, wsc2)
+	assert.Equal(t, "public", ev.Payload.Channel, "pattern event channel")
+
+	// closed connections are unregistered
+	c2.Close(nil)
+	deadline := time.Now().Add(time.Second)
+	for server.ConnCount() > 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, 1, server.ConnCount(), "ConnCount after close")
+	assert.Equal(t, []*Conn{c1}, server.ConnsByTag("user:1"), "ConnsByTag after close")
+}
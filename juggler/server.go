@@ -2,11 +2,15 @@ package juggler
 
 import (
 	"expvar"
-	"log"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/PuerkitoBio/exp/juggler/broker"
+	"github.com/PuerkitoBio/exp/juggler/logger"
+	"github.com/PuerkitoBio/exp/juggler/metrics"
+	"github.com/PuerkitoBio/exp/juggler/msg"
+	"github.com/PuerkitoBio/exp/juggler/trace"
 	"github.com/gorilla/websocket"
 )
 
@@ -16,9 +20,15 @@ func DiscardLog(f string, args ...interface{}) {}
 
 // Subprotocols is the list of juggler protocol versions supported by this
 // package. It should be set as-is on the websocket.Upgrader Subprotocols
-// field.
+// field. The juggler.0 subprotocol encodes messages in JSON, the ones
+// with a codec suffix encode them with the corresponding msg.Codec
+// (see msg.CodecForSubprotocol). As the upgrader selects the first
+// subprotocol of this list that the client supports, JSON is
+// preferred if the client supports it.
 var Subprotocols = []string{
 	"juggler.0",
+	"juggler.0+msgpack",
+	"juggler.0+cbor",
 }
 
 func isIn(list []string, v string) bool {
@@ -65,6 +75,47 @@ type Server struct {
 	// 0 means no timeout.
 	AcquireWriteLockTimeout time.Duration
 
+	// PingInterval is the interval at which websocket ping control
+	// frames are sent to each connection, to detect dead peers. The
+	// default of 0 means no ping.
+	PingInterval time.Duration
+
+	// PongTimeout is the time to wait for the pong after a ping. If
+	// it is not received before the timeout, the connection is closed
+	// with ErrPongTimeout. The default of 0 uses the PingInterval.
+	PongTimeout time.Duration
+
+	// IdleTimeout is the maximum duration without juggler messages
+	// read from or written to a connection (ping and pong frames do
+	// not count). Once reached, the connection is closed with
+	// ErrIdleTimeout. The default of 0 means no timeout.
+	IdleTimeout time.Duration
+
+	// SendQueueSize is the maximum number of messages received from
+	// the broker (RES and EVNT) that can be queued for each connection
+	// before being sent. With a send queue, a slow client does not block
+	// the goroutines that receive the messages from the broker. The
+	// default of 0 means no queue, the messages are sent synchronously.
+	SendQueueSize int
+
+	// SendQueuePolicy is the policy applied when a message is added
+	// to a full send queue. The default is DropOldestEvnt.
+	SendQueuePolicy OverflowPolicy
+
+	// CompressionThreshold enables the application-level compression
+	// of the messages sent to the clients that request it during the
+	// handshake (see msg.CompressionHeader). Messages larger than this
+	// size in bytes, once encoded, are compressed with deflate. The
+	// default of 0 disables application-level compression. Websocket
+	// permessage-deflate compression is independent of this field, it
+	// is negotiated if the websocket.Upgrader has EnableCompression set.
+	CompressionThreshold int
+
+	// CompressionLevel is the deflate compression level used for both
+	// the application-level and the permessage-deflate compression
+	// (see compress/flate). The default of 0 uses the default level.
+	CompressionLevel int
+
 	// ConnState specifies an optional callback function that is called
 	// when a connection changes state. If non-nil, it is called for
 	// Connected and Closing states.
@@ -77,10 +128,15 @@ type Server struct {
 	// manually process the messages.
 	Handler Handler
 
-	// LogFunc is the function called to log events. By default,
-	// it logs using log.Printf. Logging can be disabled by setting
-	// LogFunc to DiscardLog.
-	LogFunc func(string, ...interface{}) // TODO : normalize calls so that order of args is somewhat predictable
+	// Logger is the structured logger used to log events. If nil,
+	// the events are logged with LogFunc.
+	Logger logger.Logger
+
+	// LogFunc is the function called to log events if Logger is nil,
+	// with the events formatted by logger.Format. By default, it logs
+	// using log.Printf. Logging can be disabled by setting LogFunc to
+	// DiscardLog.
+	LogFunc func(string, ...interface{})
 
 	// PubSubBroker is the broker to use for pub-sub messages. It must be
 	// set before the Server can be used.
@@ -90,37 +146,125 @@ type Server struct {
 	// set before the server can be used.
 	CallerBroker broker.CallerBroker
 
+	// Authenticator is called by Upgrade with the HTTP request that
+	// initiates the websocket connection, before the upgrade. If it
+	// returns an error, the upgrade is refused with a 401 status code,
+	// otherwise the returned identity is set on the Conn. If nil, all
+	// connections are accepted with a nil identity.
+	Authenticator Authenticator
+
+	// Authorizer is called by ProcessMsg for CALL, CNCL, PUB, SUB and
+	// UNSB messages before they are forwarded to the broker. If it
+	// returns an error, an ERR message with a 401 or 403 code is sent
+	// to the client instead. If nil, all messages are allowed.
+	Authorizer Authorizer
+
 	// Vars can be set to an *expvar.Map to collect metrics about the
 	// server. It should be set before starting to listen for
-	// connections.
+	// connections. It is equivalent to adding a metrics.Expvar for
+	// that map to Metrics.
 	Vars *expvar.Map
+
+	// Metrics can be set to collect metrics about the server, in
+	// addition to Vars. See the metrics package for the available
+	// implementations. It should be set before starting to listen for
+	// connections.
+	Metrics metrics.Metrics
+
+	// Tracer can be set to record the spans of the calls processed by
+	// the server. The trace context received in the metadata of a
+	// call is propagated to the callee in the CallPayload metadata.
+	// If nil, no span is recorded, but the trace context is still
+	// propagated.
+	Tracer trace.Tracer
+
+	mu           sync.Mutex                    // lock access to the following fields
+	conns        map[string]*Conn              // active connections by UUID
+	tags         map[string]map[*Conn]struct{} // tagged connections by tag
+	shuttingDown bool
+
+	metricsOnce sync.Once
+	mtr         metrics.Metrics // combines Vars and Metrics
+}
+
+// metrics returns the Metrics that collects the server's metrics in
+// Vars and Metrics.
+func (srv *Server) metrics() metrics.Metrics {
+	srv.metricsOnce.Do(func() {
+		var ms []metrics.Metrics
+		if srv.Vars != nil {
+			ms = append(ms, metrics.NewExpvar(srv.Vars))
+		}
+		if srv.Metrics != nil {
+			ms = append(ms, srv.Metrics)
+		}
+		srv.mtr = metrics.Multi(ms...)
+	})
+	return srv.mtr
 }
 
 // ServeConn serves the websocket connection as a juggler connection. It
 // blocks until the juggler connection is closed, leaving the websocket
-// connection open.
+// connection open. The Authenticator is not called, so the Conn has a
+// nil identity. It returns immediately if the server is shutting down.
 func (srv *Server) ServeConn(conn *websocket.Conn) {
-	if srv.Vars != nil {
-		srv.Vars.Add("ActiveConns", 1)
-		srv.Vars.Add("TotalConns", 1)
-		defer srv.Vars.Add("ActiveConns", -1)
+	srv.serveConn(conn, nil, false)
+}
+
+// serveConn serves the websocket connection conn for the identity id.
+// If compress is true, the client negotiated application-level
+// compression.
+func (srv *Server) serveConn(conn *websocket.Conn, id *Identity, compress bool) {
+	if srv.isShuttingDown() {
+		srv.logger().Log(logger.Warn, "server is shutting down; dropping connection")
+		return
 	}
 
+	mtr := srv.metrics()
+	mtr.AddGauge("ActiveConns", 1)
+	mtr.AddCounter("TotalConns", 1)
+	defer mtr.AddGauge("ActiveConns", -1)
+
 	conn.SetReadLimit(srv.ReadLimit)
+	if l := srv.CompressionLevel; l != 0 {
+		if err := conn.SetCompressionLevel(l); err != nil {
+			srv.logger().Log(logger.Error, "failed to set compression level; dropping connection", logger.Err(err))
+			return
+		}
+	}
 	c := newConn(conn, srv)
+	c.Identity = id
+	if compress {
+		c.compress = true
+		mtr.AddCounter("CompressedConns", 1)
+	}
 	resConn, err := srv.CallerBroker.Results(c.UUID)
 	if err != nil {
-		logf(srv.LogFunc, "failed to create results connection: %v; dropping connection", err)
+		srv.logger().Log(logger.Error, "failed to create results connection; dropping connection", logger.Conn(c.UUID), logger.Err(err))
 		return
 	}
 	pubSubConn, err := srv.PubSubBroker.PubSub()
 	if err != nil {
-		logf(srv.LogFunc, "failed to create pubsub connection: %v; dropping connection", err)
+		srv.logger().Log(logger.Error, "failed to create pubsub connection; dropping connection", logger.Conn(c.UUID), logger.Err(err))
 		return
 	}
 	c.psc = pubSubConn
 	c.resc = resConn
 
+	// subscribe to the connection's reserved channel, and register
+	// the connection
+	if err := c.psc.Subscribe(ConnChannel(c.UUID), false); err != nil {
+		srv.logger().Log(logger.Error, "failed to subscribe to connection channel; dropping connection", logger.Conn(c.UUID), logger.Channel(ConnChannel(c.UUID)), logger.Err(err))
+		c.Close(err)
+		return
+	}
+	if !srv.addConn(c) {
+		srv.logger().Log(logger.Warn, "server is shutting down; dropping connection", logger.Conn(c.UUID))
+		c.Close(ErrServerClosed)
+		return
+	}
+	defer srv.removeConn(c)
+
 	if cs := srv.ConnState; cs != nil {
 		defer func() {
 			cs(c, Closing)
@@ -132,6 +276,25 @@ func (srv *Server) ServeConn(conn *websocket.Conn) {
 		cs(c, Connected)
 	}
 
+	// the pong handler must be set before the read loop starts
+	if srv.PingInterval > 0 {
+		pong := make(chan struct{}, 1)
+		conn.SetPongHandler(func(string) error {
+			select {
+			case pong <- struct{}{}:
+			default:
+			}
+			return nil
+		})
+		go c.keepAlive(pong)
+	}
+	if srv.IdleTimeout > 0 {
+		go c.idle()
+	}
+	if srv.SendQueueSize > 0 {
+		go c.sendQueue()
+	}
+
 	// receive, results loop, pub/sub loop
 	go c.pubSub()
 	go c.results()
@@ -146,32 +309,78 @@ func (srv *Server) ServeConn(conn *websocket.Conn) {
 // must be upgraded to a supported juggler subprotocol otherwise
 // the connection is dropped.
 //
+// If the server has an Authenticator, it is called before the upgrade
+// and the request fails with a 401 status code if authentication fails.
+// If the server is shutting down, the request fails with a 503 status
+// code. If the server has a CompressionThreshold and the request's
+// msg.CompressionHeader accepts msg.Deflate, the application-level
+// compression is negotiated by setting that header on the response.
+//
 // Once connected, the websocket connection is served via srv.ServeConn.
 // The websocket connection is closed when the juggler connection is closed.
 func Upgrade(upgrader *websocket.Upgrader, srv *Server) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if srv.isShuttingDown() {
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+
+		// authenticate the request before the upgrade
+		var id *Identity
+		if a := srv.Authenticator; a != nil {
+			var err error
+			if id, err = a.Authenticate(r); err != nil {
+				srv.metrics().AddCounter("FailedAuthentications", 1)
+				srv.logger().Log(logger.Warn, "juggler: authentication failed", logger.F("remote_addr", r.RemoteAddr), logger.Err(err))
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+		}
+
+		// negotiate the application-level compression
+		var hdr http.Header
+		compress := srv.CompressionThreshold > 0 && msg.AcceptsDeflate(r.Header.Get(msg.CompressionHeader))
+		if compress {
+			hdr = http.Header{msg.CompressionHeader: {msg.Deflate}}
+		}
+
 		// upgrade the HTTP connection to the websocket protocol
-		wsConn, err := upgrader.Upgrade(w, r, nil)
+		wsConn, err := upgrader.Upgrade(w, r, hdr)
 		if err != nil {
 			return
 		}
 		defer wsConn.Close()
 
-		// the agreed-upon subprotocol must be one of the supported ones.
+		// the agreed-upon subprotocol must be one of the supported ones,
+		// with a registered codec.
 		if !isIn(Subprotocols, wsConn.Subprotocol()) {
-			logf(srv.LogFunc, "juggler: no supported subprotocol, closing connection")
+			srv.logger().Log(logger.Warn, "juggler: no supported subprotocol, closing connection", logger.F("remote_addr", r.RemoteAddr))
+			return
+		}
+		if msg.CodecForSubprotocol(wsConn.Subprotocol()) == nil {
+			srv.logger().Log(logger.Warn, "juggler: no codec for subprotocol, closing connection", logger.F("remote_addr", r.RemoteAddr), logger.F("subprotocol", wsConn.Subprotocol()))
 			return
 		}
 
 		// this call blocks until the juggler connection is closed
-		srv.ServeConn(wsConn)
+		srv.serveConn(wsConn, id, compress)
 	})
 }
 
-func logf(fn func(string, ...interface{}), f string, args ...interface{}) {
-	if fn != nil {
-		fn(f, args...)
-	} else {
-		log.Printf(f, args...)
+// tracer returns the Tracer of the server, which is trace.Nop if
+// Tracer is nil.
+func (srv *Server) tracer() trace.Tracer {
+	if srv.Tracer != nil {
+		return srv.Tracer
+	}
+	return trace.Nop
+}
+
+// logger returns the Logger of the server, which adapts LogFunc if
+// Logger is nil.
+func (srv *Server) logger() logger.Logger {
+	if srv.Logger != nil {
+		return srv.Logger
 	}
+	return logger.Func(srv.LogFunc)
 }
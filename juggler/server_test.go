@@ -11,6 +11,7 @@ import (
 	"golang.org/x/net/context"
 
 	"github.com/PuerkitoBio/exp/juggler"
+	"github.com/PuerkitoBio/exp/juggler/broker/memorybroker"
 	"github.com/PuerkitoBio/exp/juggler/broker/redisbroker"
 	"github.com/PuerkitoBio/exp/juggler/client"
 	"github.com/PuerkitoBio/exp/juggler/internal/jugglertest"
@@ -114,3 +115,41 @@ func TestUpgrade(t *testing.T) {
 	}
 	cli.Close()
 }
+
+func TestUpgradeCodec(t *testing.T) {
+	dbgl := &jugglertest.DebugLog{T: t}
+	brk := &memorybroker.Broker{LogFunc: dbgl.Printf}
+	server := &juggler.Server{CallerBroker: brk, PubSubBroker: brk, LogFunc: dbgl.Printf}
+	upg := &websocket.Upgrader{Subprotocols: juggler.Subprotocols}
+	srv := httptest.NewServer(juggler.Upgrade(upg, server))
+	srv.URL = strings.Replace(srv.URL, "http:", "ws:", 1)
+	defer srv.Close()
+
+	for _, proto := range []string{"juggler.0+msgpack", "juggler.0+cbor"} {
+		evs := make(chan *msg.Evnt, 1)
+		h := client.HandlerFunc(func(ctx context.Context, cli *client.Client, m msg.Msg) {
+			if ev, ok := m.(*msg.Evnt); ok {
+				evs <- ev
+			}
+		})
+
+		d := &websocket.Dialer{Subprotocols: []string{proto}}
+		cli, err := client.Dial(d, srv.URL, nil, client.SetHandler(h), client.SetLogFunc(dbgl.Printf))
+		require.NoError(t, err, "%s: Dial", proto)
+		assert.Equal(t, proto, cli.UnderlyingConn().Subprotocol(), "%s: subprotocol", proto)
+
+		_, err = cli.Sub("a", false)
+		require.NoError(t, err, "%s: Sub", proto)
+		_, err = cli.Pub("a", map[string]interface{}{"x": 1, "y": "z"})
+		require.NoError(t, err, "%s: Pub", proto)
+
+		select {
+		case ev := <-evs:
+			assert.Equal(t, "a", ev.Payload.Channel, "%s: channel", proto)
+			assert.Equal(t, `{"x":1,"y":"z"}`, string(ev.Payload.Args), "%s: args", proto)
+		case <-time.After(time.Second):
+			assert.Fail(t, "no event received", proto)
+		}
+		cli.Close()
+	}
+}
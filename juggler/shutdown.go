@@ -0,0 +1,84 @@
+package juggler
+
+import (
+	"errors"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/PuerkitoBio/exp/juggler/logger"
+	"github.com/gorilla/websocket"
+)
+
+// ErrServerClosed is the error sent to the clients for requests
+// refused because the server is shutting down, and the CloseErr of
+// the connections closed by Server.Shutdown.
+var ErrServerClosed = errors.New("juggler: server closed")
+
+// shutdownPollInterval is the interval at which Shutdown checks for
+// pending calls.
+var shutdownPollInterval = 100 * time.Millisecond
+
+// closeFrameTimeout is the time allowed to send the websocket close
+// message to a connection on shutdown.
+const closeFrameTimeout = time.Second
+
+// Shutdown gracefully shuts down the server. It first stops accepting
+// new connections (Upgrade returns a 503 status code), and refuses the
+// new CALL, PUB and SUB requests of the active connections with an ERR
+// message with a 503 code. It then waits for the results of the pending
+// calls of all active connections, until ctx is done. Finally, it sends
+// a websocket close message with the "going away" status code to all
+// active connections and closes them, which closes their broker
+// connections.
+//
+// It returns ctx.Err() if ctx is done before all pending calls
+// received their result, nil otherwise. The connections are closed in
+// both cases.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.mu.Lock()
+	srv.shuttingDown = true
+	srv.mu.Unlock()
+
+	var err error
+wait:
+	for srv.pendingCalls() > 0 {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			break wait
+		case <-time.After(shutdownPollInterval):
+		}
+	}
+
+	for _, c := range srv.Conns() {
+		if e := c.wsConn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"),
+			time.Now().Add(closeFrameTimeout)); e != nil {
+
+			srv.logger().Log(logger.Warn, "failed to send close message", logger.Conn(c.UUID), logger.Err(e))
+		}
+		c.Close(ErrServerClosed)
+	}
+	return err
+}
+
+// isShuttingDown returns true if Shutdown was called.
+func (srv *Server) isShuttingDown() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.shuttingDown
+}
+
+// pendingCalls returns the number of pending calls of all active
+// connections.
+func (srv *Server) pendingCalls() int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	var n int
+	for _, c := range srv.conns {
+		n += c.pendingCalls()
+	}
+	return n
+}
@@ -0,0 +1,133 @@
+package juggler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/PuerkitoBio/exp/juggler/broker/memorybroker"
+	"github.com/PuerkitoBio/exp/juggler/internal/jugglertest"
+	"github.com/PuerkitoBio/exp/juggler/msg"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startShutdownServer(t *testing.T) (*Server, *memorybroker.Broker, *httptest.Server) {
+	dbgl := &jugglertest.DebugLog{T: t}
+	brk := &memorybroker.Broker{LogFunc: dbgl.Printf}
+	server := &Server{CallerBroker: brk, PubSubBroker: brk, LogFunc: dbgl.Printf}
+	upg := &websocket.Upgrader{Subprotocols: Subprotocols}
+	srv := httptest.NewServer(Upgrade(upg, server))
+	srv.URL = strings.Replace(srv.URL, "http:", "ws:", 1)
+	return server, brk, srv
+}
+
+// readResponse reads the next response from conn.
+func readResponse(t *testing.T, conn *websocket.Conn) msg.Msg {
+	_, r, err := conn.NextReader()
+	require.NoError(t, err, "NextReader")
+	m, err := msg.UnmarshalResponse(r)
+	require.NoError(t, err, "UnmarshalResponse")
+	return m
+}
+
+func TestShutdown(t *testing.T) {
+	server, brk, srv := startShutdownServer(t)
+	defer srv.Close()
+
+	d := &websocket.Dialer{Subprotocols: Subprotocols}
+	conn, _, err := d.Dial(srv.URL, nil)
+	require.NoError(t, err, "Dial")
+	defer conn.Close()
+
+	call, err := msg.NewCall("a", "x", time.Second)
+	require.NoError(t, err, "NewCall")
+	require.NoError(t, conn.WriteJSON(call), "write call")
+	require.Equal(t, msg.OKMsg, readResponse(t, conn).Type(), "call OK")
+
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		done <- server.Shutdown(ctx)
+	}()
+
+	// wait for the server to be shutting down
+	for !server.isShuttingDown() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// new connections are refused
+	_, res, err := d.Dial(srv.URL, nil)
+	if assert.Error(t, err, "Dial after Shutdown") {
+		assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode, "status code")
+	}
+
+	// new calls are refused
+	call2, err := msg.NewCall("a", "y", time.Second)
+	require.NoError(t, err, "NewCall")
+	require.NoError(t, conn.WriteJSON(call2), "write call 2")
+	if m := readResponse(t, conn); assert.Equal(t, msg.ErrMsg, m.Type(), "call 2 ERR") {
+		assert.Equal(t, 503, m.(*msg.Err).Payload.Code, "code")
+	}
+
+	// the pending call still gets its result
+	select {
+	case err := <-done:
+		require.Fail(t, "Shutdown returned before the pending call completed", "%v", err)
+	default:
+	}
+	cc, err := brk.Calls("a")
+	require.NoError(t, err, "Calls")
+	defer cc.Close()
+	cp := <-cc.Calls()
+	require.NoError(t, brk.Result(&msg.ResPayload{
+		ConnUUID: cp.ConnUUID,
+		MsgUUID:  cp.MsgUUID,
+		URI:      cp.URI,
+		Args:     json.RawMessage(`"ok"`),
+	}, time.Second), "Result")
+
+	if m := readResponse(t, conn); assert.Equal(t, msg.ResMsg, m.Type(), "RES") {
+		assert.Equal(t, call.UUID(), m.(*msg.Res).Payload.For, "for")
+	}
+
+	// the connection is then closed with going away
+	select {
+	case err := <-done:
+		assert.NoError(t, err, "Shutdown")
+	case <-time.After(time.Second):
+		require.Fail(t, "Shutdown did not return")
+	}
+	_, _, err = conn.NextReader()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), "close error: %v", err)
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	server, _, srv := startShutdownServer(t)
+	defer srv.Close()
+
+	d := &websocket.Dialer{Subprotocols: Subprotocols}
+	conn, _, err := d.Dial(srv.URL, nil)
+	require.NoError(t, err, "Dial")
+	defer conn.Close()
+
+	call, err := msg.NewCall("a", "x", time.Second)
+	require.NoError(t, err, "NewCall")
+	require.NoError(t, conn.WriteJSON(call), "write call")
+	require.Equal(t, msg.OKMsg, readResponse(t, conn).Type(), "call OK")
+
+	// the call is never processed
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, server.Shutdown(ctx), "Shutdown")
+
+	_, _, err = conn.NextReader()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), "close error: %v", err)
+}
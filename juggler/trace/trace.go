@@ -0,0 +1,282 @@
+// Package trace defines the Tracer interface used by the juggler
+// packages to record the spans of a call as it travels from the
+// client to the server, the broker and the callee, and back.
+//
+// The trace context is propagated in the metadata of the messages
+// and payloads, under the TraceparentKey, using the format of the
+// W3C Trace Context traceparent header:
+//
+//	00-<32 hex trace ID>-<16 hex parent span ID>-<2 hex flags>
+//
+// NewTracer returns a Tracer that sends the finished spans to an
+// Exporter, such as the MemoryExporter that keeps them in memory
+// for tests.
+package trace
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// TraceparentKey is the metadata key that holds the trace context,
+// in the traceparent format.
+const TraceparentKey = "traceparent"
+
+// SampledFlag is the trace flag that indicates that the trace is
+// sampled.
+const SampledFlag byte = 0x01
+
+// ErrInvalidTraceparent is returned by Parse when the value is not
+// a valid traceparent.
+var ErrInvalidTraceparent = errors.New("trace: invalid traceparent")
+
+// TraceID is the identifier of a trace.
+type TraceID [16]byte
+
+// SpanID is the identifier of a span.
+type SpanID [8]byte
+
+// SpanContext is the trace context of a span that is propagated
+// across the hops of a call.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Flags   byte
+}
+
+// IsValid returns true if the span context has a non-zero trace ID
+// and span ID.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// String returns the span context in the traceparent format.
+func (sc SpanContext) String() string {
+	return fmt.Sprintf("00-%x-%x-%02x", sc.TraceID[:], sc.SpanID[:], sc.Flags)
+}
+
+// Parse parses the traceparent s. Only version 00 is supported.
+func Parse(s string) (SpanContext, error) {
+	var sc SpanContext
+
+	// 2 + 1 + 32 + 1 + 16 + 1 + 2
+	if len(s) != 55 || s[2] != '-' || s[35] != '-' || s[52] != '-' || s[:2] != "00" {
+		return sc, ErrInvalidTraceparent
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(s[3:35])); err != nil {
+		return sc, ErrInvalidTraceparent
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(s[36:52])); err != nil {
+		return sc, ErrInvalidTraceparent
+	}
+	var flags [1]byte
+	if _, err := hex.Decode(flags[:], []byte(s[53:])); err != nil {
+		return sc, ErrInvalidTraceparent
+	}
+	sc.Flags = flags[0]
+	if !sc.IsValid() {
+		return sc, ErrInvalidTraceparent
+	}
+	return sc, nil
+}
+
+// FromMetadata returns the span context stored in the metadata md
+// under the TraceparentKey. It returns the zero SpanContext if there
+// is none or if it is invalid.
+func FromMetadata(md map[string]string) SpanContext {
+	sc, err := Parse(md[TraceparentKey])
+	if err != nil {
+		return SpanContext{}
+	}
+	return sc
+}
+
+// Inject stores the span context sc in the metadata md under the
+// TraceparentKey, and returns the metadata, which is allocated if md
+// is nil. If sc is not valid, md is returned unchanged.
+func Inject(md map[string]string, sc SpanContext) map[string]string {
+	if !sc.IsValid() {
+		return md
+	}
+	if md == nil {
+		md = make(map[string]string, 1)
+	}
+	md[TraceparentKey] = sc.String()
+	return md
+}
+
+// Tracer defines the method required to start spans.
+type Tracer interface {
+	// Start starts a span identified by name. If parent is valid,
+	// the span is a child of parent, otherwise it starts a new trace.
+	Start(name string, parent SpanContext) Span
+}
+
+// Span is an operation in a trace, started by a Tracer.
+type Span interface {
+	// Context returns the span context to propagate to the children
+	// of the span.
+	Context() SpanContext
+
+	// SetAttr sets the attribute key to the value v.
+	SetAttr(key string, v interface{})
+
+	// End finishes the span, recording err if it is not nil. Calls
+	// after the first one have no effect.
+	End(err error)
+}
+
+// Nop is a Tracer that records nothing. Its spans return the parent
+// span context, so that the trace context is still propagated.
+var Nop Tracer = nop{}
+
+type nop struct{}
+
+func (nop) Start(name string, parent SpanContext) Span { return nopSpan(parent) }
+
+type nopSpan SpanContext
+
+func (s nopSpan) Context() SpanContext      { return SpanContext(s) }
+func (nopSpan) SetAttr(string, interface{}) {}
+func (nopSpan) End(error)                   {}
+
+// SpanData holds the recorded data of a finished span.
+type SpanData struct {
+	Name    string
+	Context SpanContext
+	Parent  SpanContext // zero if the span is the root of its trace
+	Start   time.Time
+	End     time.Time
+	Attrs   map[string]interface{}
+	Err     error
+}
+
+// Exporter defines the method required to export the finished spans.
+type Exporter interface {
+	// Export is called with the data of each span when it ends. It
+	// may be called concurrently.
+	Export(*SpanData)
+}
+
+// NewTracer returns a Tracer that records the spans and exports them
+// to e when they end. New traces are sampled.
+func NewTracer(e Exporter) Tracer {
+	return &tracer{e: e}
+}
+
+type tracer struct {
+	e Exporter
+}
+
+func (t *tracer) Start(name string, parent SpanContext) Span {
+	sd := &SpanData{
+		Name:   name,
+		Parent: parent,
+		Start:  time.Now(),
+	}
+	if parent.IsValid() {
+		sd.Context.TraceID = parent.TraceID
+		sd.Context.Flags = parent.Flags
+	} else {
+		sd.Parent = SpanContext{}
+		sd.Context.TraceID = newTraceID()
+		sd.Context.Flags = SampledFlag
+	}
+	sd.Context.SpanID = newSpanID()
+	return &span{e: t.e, data: sd}
+}
+
+type span struct {
+	e Exporter
+
+	mu    sync.Mutex
+	data  *SpanData
+	ended bool
+}
+
+func (s *span) Context() SpanContext {
+	return s.data.Context
+}
+
+func (s *span) SetAttr(key string, v interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ended {
+		return
+	}
+	if s.data.Attrs == nil {
+		s.data.Attrs = make(map[string]interface{})
+	}
+	s.data.Attrs[key] = v
+}
+
+func (s *span) End(err error) {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	s.data.Err = err
+	s.mu.Unlock()
+
+	s.e.Export(s.data)
+}
+
+// MemoryExporter is an Exporter that keeps the finished spans in
+// memory. It is meant to be used in tests. The zero value is ready
+// to use.
+type MemoryExporter struct {
+	mu    sync.Mutex
+	spans []*SpanData
+}
+
+// Export adds sd to the list of spans.
+func (e *MemoryExporter) Export(sd *SpanData) {
+	e.mu.Lock()
+	e.spans = append(e.spans, sd)
+	e.mu.Unlock()
+}
+
+// Spans returns the spans exported so far, in the order in which
+// they ended.
+func (e *MemoryExporter) Spans() []*SpanData {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]*SpanData(nil), e.spans...)
+}
+
+// Reset removes all spans.
+func (e *MemoryExporter) Reset() {
+	e.mu.Lock()
+	e.spans = nil
+	e.mu.Unlock()
+}
+
+func newTraceID() TraceID {
+	var id TraceID
+	for id == (TraceID{}) {
+		randRead(id[:])
+	}
+	return id
+}
+
+func newSpanID() SpanID {
+	var id SpanID
+	for id == (SpanID{}) {
+		randRead(id[:])
+	}
+	return id
+}
+
+func randRead(b []byte) {
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,83 @@
+package trace
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		in  string
+		err bool
+	}{
+		{"", true},
+		{"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", false},
+		{"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00", false},
+		{"01-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", true},
+		{"00-00000000000000000000000000000000-b7ad6b7169203331-01", true},
+		{"00-0af7651916cd43dd8448eb211c80319c-0000000000000000-01", true},
+		{"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-0", true},
+		{"00_0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", true},
+		{"00-0af7651916cd43dd8448eb211c80319z-b7ad6b7169203331-01", true},
+	}
+	for i, c := range cases {
+		sc, err := Parse(c.in)
+		if c.err {
+			assert.Equal(t, ErrInvalidTraceparent, err, "%d: %s", i, c.in)
+			continue
+		}
+		if assert.NoError(t, err, "%d: %s", i, c.in) {
+			assert.Equal(t, c.in, sc.String(), "%d: String", i)
+			assert.True(t, sc.IsValid(), "%d: IsValid", i)
+		}
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	assert.Nil(t, Inject(nil, SpanContext{}), "invalid context")
+	assert.False(t, FromMetadata(nil).IsValid(), "nil metadata")
+	assert.False(t, FromMetadata(map[string]string{TraceparentKey: "x"}).IsValid(), "invalid traceparent")
+
+	sc := SpanContext{TraceID: newTraceID(), SpanID: newSpanID(), Flags: SampledFlag}
+	md := Inject(nil, sc)
+	assert.Equal(t, map[string]string{TraceparentKey: sc.String()}, md, "injected")
+	assert.Equal(t, sc, FromMetadata(md), "extracted")
+}
+
+func TestTracer(t *testing.T) {
+	var exp MemoryExporter
+	tr := NewTracer(&exp)
+
+	root := tr.Start("root", SpanContext{})
+	child := tr.Start("child", root.Context())
+	child.SetAttr("k", "v")
+	e := errors.New("fail")
+	child.End(e)
+	child.End(nil)
+	root.End(nil)
+
+	spans := exp.Spans()
+	require.Equal(t, 2, len(spans), "number of spans")
+	assert.Equal(t, "child", spans[0].Name, "child name")
+	assert.Equal(t, root.Context(), spans[0].Parent, "child parent")
+	assert.Equal(t, root.Context().TraceID, spans[0].Context.TraceID, "child trace ID")
+	assert.NotEqual(t, root.Context().SpanID, spans[0].Context.SpanID, "child span ID")
+	assert.Equal(t, e, spans[0].Err, "child error")
+	assert.Equal(t, map[string]interface{}{"k": "v"}, spans[0].Attrs, "child attrs")
+	assert.False(t, spans[0].End.Before(spans[0].Start), "child end")
+
+	assert.Equal(t, "root", spans[1].Name, "root name")
+	assert.False(t, spans[1].Parent.IsValid(), "root parent")
+	assert.Equal(t, SampledFlag, spans[1].Context.Flags, "root flags")
+
+	exp.Reset()
+	assert.Equal(t, 0, len(exp.Spans()), "reset")
+
+	// the Nop tracer propagates the parent context
+	sp := Nop.Start("nop", root.Context())
+	assert.Equal(t, root.Context(), sp.Context(), "nop context")
+	sp.End(nil)
+}
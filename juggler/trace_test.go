@@ -0,0 +1,102 @@
+package juggler_test
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/PuerkitoBio/exp/juggler"
+	"github.com/PuerkitoBio/exp/juggler/broker/memorybroker"
+	"github.com/PuerkitoBio/exp/juggler/callee"
+	"github.com/PuerkitoBio/exp/juggler/client"
+	"github.com/PuerkitoBio/exp/juggler/internal/jugglertest"
+	"github.com/PuerkitoBio/exp/juggler/msg"
+	"github.com/PuerkitoBio/exp/juggler/trace"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrace(t *testing.T) {
+	var exp trace.MemoryExporter
+	tr := trace.NewTracer(&exp)
+
+	dbgl := &jugglertest.DebugLog{T: t}
+	brk := &memorybroker.Broker{LogFunc: dbgl.Printf}
+	server := &juggler.Server{
+		CallerBroker: brk,
+		PubSubBroker: brk,
+		LogFunc:      dbgl.Printf,
+		Tracer:       tr,
+	}
+	upg := &websocket.Upgrader{Subprotocols: juggler.Subprotocols}
+	srv := httptest.NewServer(juggler.Upgrade(upg, server))
+	srv.URL = strings.Replace(srv.URL, "http:", "ws:", 1)
+	defer srv.Close()
+
+	cle := &callee.Callee{Broker: brk, LogFunc: dbgl.Printf, Tracer: tr}
+	done := make(chan error, 1)
+	go func() {
+		done <- cle.Listen(map[string]callee.Thunk{
+			"echo": func(cp *msg.CallPayload) (interface{}, error) {
+				return cp.Args, nil
+			},
+		})
+	}()
+
+	results := make(chan *msg.Res, 1)
+	h := client.HandlerFunc(func(ctx context.Context, cli *client.Client, m msg.Msg) {
+		if res, ok := m.(*msg.Res); ok {
+			results <- res
+		}
+	})
+	cli, err := client.Dial(&websocket.Dialer{Subprotocols: juggler.Subprotocols}, srv.URL, nil,
+		client.SetHandler(h), client.SetLogFunc(dbgl.Printf), client.SetTracer(tr))
+	require.NoError(t, err, "Dial")
+	defer cli.Close()
+
+	_, err = cli.Call("echo", "x", time.Second)
+	require.NoError(t, err, "Call")
+
+	var res *msg.Res
+	select {
+	case res = <-results:
+	case <-time.After(time.Second):
+		require.FailNow(t, "no result received")
+	}
+
+	// the server span ends once the result is sent to the client
+	deadline := time.Now().Add(time.Second)
+	for len(exp.Spans()) < 4 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	spans := make(map[string]*trace.SpanData)
+	for _, sd := range exp.Spans() {
+		spans[sd.Name] = sd
+	}
+	require.Equal(t, 4, len(spans), "number of spans")
+
+	cs, ss, bs, ces := spans["client.call"], spans["server.call"], spans["broker.call"], spans["callee.call"]
+	require.NotNil(t, cs, "client span")
+	require.NotNil(t, ss, "server span")
+	require.NotNil(t, bs, "broker span")
+	require.NotNil(t, ces, "callee span")
+
+	assert.False(t, cs.Parent.IsValid(), "client span is the root")
+	assert.Equal(t, cs.Context, ss.Parent, "server span parent")
+	assert.Equal(t, ss.Context, bs.Parent, "broker span parent")
+	assert.Equal(t, bs.Context, ces.Parent, "callee span parent")
+	for _, sd := range spans {
+		assert.Equal(t, cs.Context.TraceID, sd.Context.TraceID, "%s: trace ID", sd.Name)
+		assert.Nil(t, sd.Err, "%s: error", sd.Name)
+	}
+	assert.Equal(t, "echo", ss.Attrs["uri"], "server span URI")
+	assert.Equal(t, ces.Context, trace.FromMetadata(res.Payload.Metadata), "result trace context")
+
+	cle.Shutdown(context.Background())
+	<-done
+}